@@ -14,6 +14,7 @@ import (
 	"github.com/oatsaysai/billing-in-discord/internal/config"
 	"github.com/oatsaysai/billing-in-discord/internal/db"
 	"github.com/oatsaysai/billing-in-discord/internal/discord"
+	"github.com/oatsaysai/billing-in-discord/pkg/blobstore"
 	"github.com/oatsaysai/billing-in-discord/pkg/firebase"
 	"github.com/oatsaysai/billing-in-discord/pkg/ocr"
 	"github.com/spf13/viper"
@@ -62,6 +63,16 @@ func main() {
 	// Set the OCR client in the discord package
 	discord.SetOCRClient(ocrClient)
 
+	// Initialize the archive of receipt and slip images
+	archiveStore, err := blobstore.New(viper.GetString("Archive.Backend"), viper.GetString("Archive.LocalPath"))
+	if err != nil {
+		log.Fatalf("Failed to initialize image archive: %v", err)
+	}
+	log.Printf("Image archive initialized with backend: %s", viper.GetString("Archive.Backend"))
+
+	// Set the archive in the discord package
+	discord.SetBlobStore(archiveStore)
+
 	// Start HTTP server for webhook callbacks
 	go setupHTTPServer()
 
@@ -93,10 +104,57 @@ func main() {
 	go func() {
 		for range ticker.C {
 			discord.CleanupExpiredSites()
+			discord.CleanupExpiredInteractionStates()
+			discord.CleanupProcessedEvents()
+			discord.CleanupExpiredOCRResults()
 		}
 	}()
 	defer ticker.Stop()
 
+	// Setup periodic reconciliation of debt balances against unpaid transactions
+	if interval := viper.GetInt("Reconciliation.IntervalMinutes"); interval > 0 {
+		reconcileTicker := time.NewTicker(time.Duration(interval) * time.Minute)
+		go func() {
+			for range reconcileTicker.C {
+				discord.RunDebtReconciliation(viper.GetBool("Reconciliation.AutoFix"), viper.GetString("Reconciliation.ReportChannelID"))
+			}
+		}()
+		defer reconcileTicker.Stop()
+	}
+
+	// Setup periodic late fee charging on overdue transactions
+	if interval := viper.GetInt("LateFee.IntervalMinutes"); interval > 0 {
+		lateFeeTicker := time.NewTicker(time.Duration(interval) * time.Minute)
+		go func() {
+			for range lateFeeTicker.C {
+				discord.RunLateFees()
+			}
+		}()
+		defer lateFeeTicker.Stop()
+	}
+
+	// Setup periodic reminders for installments coming due
+	if interval := viper.GetInt("Installment.ReminderIntervalMinutes"); interval > 0 {
+		installmentTicker := time.NewTicker(time.Duration(interval) * time.Minute)
+		go func() {
+			for range installmentTicker.C {
+				discord.RunInstallmentReminders()
+			}
+		}()
+		defer installmentTicker.Stop()
+	}
+
+	// Setup periodic auto-accept of bill debts whose participants didn't respond in time
+	if interval := viper.GetInt("BillConsent.IntervalMinutes"); interval > 0 {
+		consentTicker := time.NewTicker(time.Duration(interval) * time.Minute)
+		go func() {
+			for range consentTicker.C {
+				discord.RunBillConsentAutoAccept()
+			}
+		}()
+		defer consentTicker.Stop()
+	}
+
 	// Keep the application running until context is cancelled
 	<-ctx.Done()
 	log.Println("Billing in Discord bot shutting down...")
@@ -109,6 +167,10 @@ func setupHTTPServer() {
 	// Register route for webhook callback
 	mux.HandleFunc("/api/bill-webhook", discord.HandleBillWebhookCallback)
 
+	// Routes for participants claiming items together on the bill allocation web page
+	mux.HandleFunc("/api/bill-claims", discord.HandleBillClaimsState)
+	mux.HandleFunc("/api/bill-claims/claim", discord.HandleBillClaimsClaim)
+
 	// Add middleware for CORS
 	handler := corsMiddleware(mux)
 
@@ -44,8 +44,9 @@ type PostgreSQLConfig struct {
 
 // OCRConfig holds OCR service configuration
 type OCRConfig struct {
-	ApiUrl string
-	ApiKey string
+	ApiUrl        string
+	ApiKey        string
+	CacheTTLHours int
 }
 
 // ServerConfig holds HTTP server configuration
@@ -115,6 +116,31 @@ func Initialize() {
 	viper.SetDefault("Firebase.SiteNamePrefix", "psweb")
 	viper.SetDefault("Firebase.WebhookURL", "/api/bill-webhook")
 
+	viper.SetDefault("SlipVerifier.DateToleranceMinutes", 10)
+
+	viper.SetDefault("OCR.CacheTTLHours", 720)
+
+	viper.SetDefault("Archive.Backend", "local")
+	viper.SetDefault("Archive.LocalPath", "archive")
+
+	viper.SetDefault("Payment.AllocationStrategy", "fifo")
+	viper.SetDefault("Payment.AutoNetting", true)
+	viper.SetDefault("Payment.DefaultDueDays", 7)
+
+	viper.SetDefault("LateFee.IntervalMinutes", 60)
+
+	viper.SetDefault("Installment.ReminderIntervalMinutes", 60)
+	viper.SetDefault("Installment.ReminderHoursBefore", 24)
+
+	viper.SetDefault("BillConsent.Enabled", false)
+	viper.SetDefault("BillConsent.TimeoutHours", 48)
+	viper.SetDefault("BillConsent.IntervalMinutes", 15)
+
+	viper.SetDefault("Reconciliation.IntervalMinutes", 60)
+	viper.SetDefault("Reconciliation.AutoFix", false)
+	viper.SetDefault("Reconciliation.ReportChannelID", "")
+	viper.SetDefault("Reconciliation.OwnerDiscordIDs", []string{})
+
 	viper.SetDefault("Server.Port", "8080")
 
 	// Load configuration
@@ -0,0 +1,240 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Kinds of archived images
+const (
+	ArchiveReceipt = "receipt" // A bill receipt, linked to the bill created from its message
+	ArchiveSlip    = "slip"    // A payment slip, linked to the transactions it paid
+)
+
+// ArchivedImage is a receipt or slip image kept in the blob store as evidence
+type ArchivedImage struct {
+	ID              int       `json:"id"`
+	Kind            string    `json:"kind"`
+	ImageHash       string    `json:"image_hash"`
+	BlobKey         string    `json:"blob_key"`
+	Filename        string    `json:"filename"`
+	ContentType     string    `json:"content_type"`
+	SourceMessageID string    `json:"source_message_id"`
+	ChannelID       string    `json:"channel_id"`
+	GuildID         string    `json:"guild_id"`
+	UploadedBy      string    `json:"uploaded_by"` // Discord ID of the uploader
+	SourceURL       string    `json:"source_url"`  // Discord attachment URL the image was downloaded from
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// MigrateArchiveTables creates the archive of receipt and slip images and its links to transactions
+func MigrateArchiveTables() error {
+	_, err := Pool.Exec(context.Background(), `
+	CREATE TABLE IF NOT EXISTS archived_images (
+		id SERIAL PRIMARY KEY,
+		kind TEXT NOT NULL,
+		image_hash TEXT NOT NULL,
+		blob_key TEXT NOT NULL,
+		filename TEXT NOT NULL DEFAULT '',
+		content_type TEXT NOT NULL DEFAULT '',
+		source_message_id TEXT NOT NULL,
+		channel_id TEXT NOT NULL,
+		guild_id TEXT NOT NULL DEFAULT '',
+		uploaded_by TEXT NOT NULL,
+		source_url TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (kind, source_message_id, image_hash)
+	);
+	-- Receipts are found through bills.message_id, slips queued for review by their URL
+	CREATE INDEX IF NOT EXISTS idx_archived_images_source_message_id ON archived_images(source_message_id);
+	CREATE INDEX IF NOT EXISTS idx_archived_images_source_url ON archived_images(source_url);
+
+	CREATE TABLE IF NOT EXISTS archived_image_transactions (
+		image_id INTEGER NOT NULL REFERENCES archived_images(id) ON DELETE CASCADE,
+		transaction_id INTEGER NOT NULL REFERENCES transactions(id) ON DELETE CASCADE,
+		PRIMARY KEY (image_id, transaction_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_archived_image_transactions_transaction_id ON archived_image_transactions(transaction_id);
+
+	-- Slip reviews keep their archived slip, Discord attachment URLs expire
+	ALTER TABLE slip_reviews
+	ADD COLUMN IF NOT EXISTS slip_image_id INTEGER REFERENCES archived_images(id) ON DELETE SET NULL;
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating archive tables: %w", err)
+	}
+
+	log.Println("Archive tables migrated successfully")
+	return nil
+}
+
+// ArchiveImage records an image stored in the blob store and returns its ID.
+// Archiving the same image of the same message again returns the existing record.
+func ArchiveImage(image *ArchivedImage) (int, error) {
+	var imageID int
+	err := Pool.QueryRow(context.Background(), `
+		INSERT INTO archived_images (kind, image_hash, blob_key, filename, content_type, source_message_id, channel_id, guild_id, uploaded_by, source_url)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (kind, source_message_id, image_hash) DO UPDATE SET blob_key = EXCLUDED.blob_key
+		RETURNING id
+	`, image.Kind, image.ImageHash, image.BlobKey, image.Filename, image.ContentType,
+		image.SourceMessageID, image.ChannelID, image.GuildID, image.UploadedBy, image.SourceURL).Scan(&imageID)
+	if err != nil {
+		return 0, fmt.Errorf("error archiving %s image %s: %w", image.Kind, image.ImageHash, err)
+	}
+	return imageID, nil
+}
+
+// LinkArchivedImageTransactions links an archived slip to the transactions it paid
+func LinkArchivedImageTransactions(imageID int, txIDs []int) error {
+	for _, txID := range txIDs {
+		_, err := Pool.Exec(context.Background(), `
+			INSERT INTO archived_image_transactions (image_id, transaction_id) VALUES ($1, $2)
+			ON CONFLICT (image_id, transaction_id) DO NOTHING
+		`, imageID, txID)
+		if err != nil {
+			return fmt.Errorf("error linking archived image %d to TxID %d: %w", imageID, txID, err)
+		}
+	}
+	return nil
+}
+
+// GetArchivedImageIDByURL returns the ID of the image archived from a Discord attachment URL, or 0 if none was
+func GetArchivedImageIDByURL(kind, sourceURL string) (int, error) {
+	var imageID int
+	err := Pool.QueryRow(context.Background(), `
+		SELECT id FROM archived_images WHERE kind = $1 AND source_url = $2 ORDER BY id DESC LIMIT 1
+	`, kind, sourceURL).Scan(&imageID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error querying archived %s image: %w", kind, err)
+	}
+	return imageID, nil
+}
+
+// scanArchivedImages reads the rows of an archived images query
+func scanArchivedImages(rows pgx.Rows) ([]ArchivedImage, error) {
+	defer rows.Close()
+
+	var images []ArchivedImage
+	for rows.Next() {
+		var image ArchivedImage
+		err := rows.Scan(&image.ID, &image.Kind, &image.ImageHash, &image.BlobKey, &image.Filename, &image.ContentType,
+			&image.SourceMessageID, &image.ChannelID, &image.GuildID, &image.UploadedBy, &image.SourceURL, &image.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning archived image: %w", err)
+		}
+		images = append(images, image)
+	}
+	return images, rows.Err()
+}
+
+// GetArchivedImage returns an archived image by ID, or nil if there is no such image
+func GetArchivedImage(imageID int) (*ArchivedImage, error) {
+	rows, err := Pool.Query(context.Background(), `
+		SELECT id, kind, image_hash, blob_key, filename, content_type,
+		       source_message_id, channel_id, guild_id, uploaded_by, source_url, created_at
+		FROM archived_images
+		WHERE id = $1
+	`, imageID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying archived image %d: %w", imageID, err)
+	}
+	images, err := scanArchivedImages(rows)
+	if err != nil || len(images) == 0 {
+		return nil, err
+	}
+	return &images[0], nil
+}
+
+// GetMessageArchivedImages returns the images of a kind archived from a Discord message
+func GetMessageArchivedImages(kind, messageID string) ([]ArchivedImage, error) {
+	rows, err := Pool.Query(context.Background(), `
+		SELECT id, kind, image_hash, blob_key, filename, content_type,
+		       source_message_id, channel_id, guild_id, uploaded_by, source_url, created_at
+		FROM archived_images
+		WHERE kind = $1 AND source_message_id = $2
+		ORDER BY id
+	`, kind, messageID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying archived %s images of message %s: %w", kind, messageID, err)
+	}
+	return scanArchivedImages(rows)
+}
+
+// GetBillReceiptImages returns the archived receipts of the message a bill was created from.
+// Receipts are archived under the !bill message that carried them, and every way of splitting an
+// OCR'd receipt (preview, claim board or web page) creates its bill with that message as the source.
+func GetBillReceiptImages(billID int) ([]ArchivedImage, error) {
+	rows, err := Pool.Query(context.Background(), `
+		SELECT a.id, a.kind, a.image_hash, a.blob_key, a.filename, a.content_type,
+		       a.source_message_id, a.channel_id, a.guild_id, a.uploaded_by, a.source_url, a.created_at
+		FROM archived_images a
+		JOIN bills b ON b.message_id = a.source_message_id
+		WHERE b.id = $1 AND a.kind = $2
+		ORDER BY a.id
+	`, billID, ArchiveReceipt)
+	if err != nil {
+		return nil, fmt.Errorf("error querying receipts of bill %d: %w", billID, err)
+	}
+	return scanArchivedImages(rows)
+}
+
+// GetTransactionSlipImages returns the archived slips linked to a transaction, oldest first
+func GetTransactionSlipImages(txID int) ([]ArchivedImage, error) {
+	rows, err := Pool.Query(context.Background(), `
+		SELECT a.id, a.kind, a.image_hash, a.blob_key, a.filename, a.content_type,
+		       a.source_message_id, a.channel_id, a.guild_id, a.uploaded_by, a.source_url, a.created_at
+		FROM archived_images a
+		JOIN archived_image_transactions l ON l.image_id = a.id
+		WHERE l.transaction_id = $1 AND a.kind = $2
+		ORDER BY a.created_at
+	`, txID, ArchiveSlip)
+	if err != nil {
+		return nil, fmt.Errorf("error querying slips of TxID %d: %w", txID, err)
+	}
+	return scanArchivedImages(rows)
+}
+
+// GetBill returns a bill by ID whatever its status, or nil if there is no such bill
+func GetBill(billID int) (*Bill, error) {
+	bill := &Bill{}
+	err := Pool.QueryRow(context.Background(), `
+		SELECT b.id, b.message_id, b.channel_id, b.guild_id, b.creditor_id, u.discord_id, b.status
+		FROM bills b
+		JOIN users u ON b.creditor_id = u.id
+		WHERE b.id = $1
+	`, billID).Scan(&bill.ID, &bill.MessageID, &bill.ChannelID, &bill.GuildID, &bill.CreditorID, &bill.CreditorDiscordID, &bill.Status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error querying bill %d: %w", billID, err)
+	}
+	return bill, nil
+}
+
+// IsBillParticipant reports whether the Discord user is the creditor or a debtor of a bill
+func IsBillParticipant(billID int, discordID string) (bool, error) {
+	var participant bool
+	err := Pool.QueryRow(context.Background(), `
+		SELECT EXISTS (
+			SELECT 1 FROM bills b JOIN users u ON u.id = b.creditor_id
+			WHERE b.id = $1 AND u.discord_id = $2
+			UNION ALL
+			SELECT 1 FROM transactions t JOIN users u ON u.id = t.payer_id
+			WHERE t.bill_id = $1 AND u.discord_id = $2
+		)
+	`, billID, discordID).Scan(&participant)
+	if err != nil {
+		return false, fmt.Errorf("error checking participants of bill %d: %w", billID, err)
+	}
+	return participant, nil
+}
@@ -0,0 +1,411 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Bill statuses
+const (
+	BillOpen    = "open"
+	BillDeleted = "deleted" // The source message was deleted and the bill's unpaid transactions voided
+)
+
+// Bill links the transactions of a text bill to the Discord message that created it
+type Bill struct {
+	ID                int    `json:"id"`
+	MessageID         string `json:"message_id"`
+	ChannelID         string `json:"channel_id"`
+	GuildID           string `json:"guild_id"`
+	CreditorID        int    `json:"creditor_id"`
+	CreditorDiscordID string `json:"creditor_discord_id"`
+	Status            string `json:"status"`
+}
+
+// BillSource identifies the Discord message a bill was created from
+type BillSource struct {
+	MessageID string `json:"message_id"`
+	ChannelID string `json:"channel_id"`
+	GuildID   string `json:"guild_id,omitempty"`
+}
+
+// BillEntry is one participant's share of one bill item
+type BillEntry struct {
+	DebtorID    int        `json:"debtor_id"`
+	Amount      float64    `json:"amount"`
+	Description string     `json:"description"`
+	Pending     bool       `json:"pending"`            // Waits for the debtor's consent, user_debts is left untouched
+	DueDate     *time.Time `json:"due_date,omitempty"` // Defaults to the due date of the bill's other transactions
+}
+
+// BillTransaction is a transaction of a bill as seen when the bill changes
+type BillTransaction struct {
+	TxID            int     `json:"tx_id"`
+	DebtorID        int     `json:"debtor_id"`
+	DebtorDiscordID string  `json:"debtor_discord_id"`
+	Amount          float64 `json:"amount"`
+	NewAmount       float64 `json:"new_amount,omitempty"` // Set for updated transactions and edits blocked by a payment
+	Description     string  `json:"description"`
+	NewDescription  string  `json:"new_description,omitempty"` // Set for updated transactions whose description was edited
+	Status          string  `json:"status"`
+	Paid            bool    `json:"paid"` // Fully or partially paid, so the bill edit can't touch it
+}
+
+// BillSyncResult describes how an edited bill changed its transactions
+type BillSyncResult struct {
+	Added     []BillTransaction `json:"added"`
+	Updated   []BillTransaction `json:"updated"`
+	Voided    []BillTransaction `json:"voided"`
+	Protected []BillTransaction `json:"protected"` // Paid transactions the edit wanted to change or remove
+}
+
+// Changed reports whether the edit changed anything
+func (r *BillSyncResult) Changed() bool {
+	return len(r.Added)+len(r.Updated)+len(r.Voided)+len(r.Protected) > 0
+}
+
+// MigrateBillTables creates the bills table and links transactions to their bill
+func MigrateBillTables() error {
+	_, err := Pool.Exec(context.Background(), `
+	CREATE TABLE IF NOT EXISTS bills (
+		id SERIAL PRIMARY KEY,
+		message_id TEXT NOT NULL UNIQUE,
+		channel_id TEXT NOT NULL,
+		guild_id TEXT NOT NULL DEFAULT '',
+		creditor_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		status TEXT NOT NULL DEFAULT 'open',
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+	);
+
+	ALTER TABLE transactions
+	ADD COLUMN IF NOT EXISTS bill_id INTEGER REFERENCES bills(id) ON DELETE SET NULL;
+	CREATE INDEX IF NOT EXISTS idx_transactions_bill_id ON transactions(bill_id);
+
+	DROP TRIGGER IF EXISTS update_bills_modtime ON bills;
+	CREATE TRIGGER update_bills_modtime
+	BEFORE UPDATE ON bills
+	FOR EACH ROW
+	EXECUTE FUNCTION update_modified_column();
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating bill tables: %w", err)
+	}
+
+	log.Println("Bill tables migrated successfully")
+	return nil
+}
+
+// CreateBill records every entry of a bill owed to creditorID in a single DB transaction,
+// linked to the message it came from. Either all transactions and user_debts updates are
+// written or none are. Returns the created TxIDs in the same order as entries, or
+// ErrDuplicateSource if the message already created a bill.
+func CreateBill(source BillSource, creditorID int, entries []BillEntry) ([]int, error) {
+	if source.MessageID == "" {
+		return nil, fmt.Errorf("bill has no source message")
+	}
+
+	tx, err := Pool.Begin(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("ไม่สามารถเริ่ม Transaction ได้: %w", err)
+	}
+	defer tx.Rollback(context.Background()) // Rollback if commit isn't called
+
+	var billID int
+	err = tx.QueryRow(context.Background(), `
+		INSERT INTO bills (message_id, channel_id, guild_id, creditor_id)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`, source.MessageID, source.ChannelID, source.GuildID, creditorID).Scan(&billID)
+	if isUniqueViolation(err) {
+		return nil, ErrDuplicateSource
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error creating bill: %w", err)
+	}
+
+	txIDs := make([]int, len(entries))
+	for idx, entry := range entries {
+		if txIDs[idx], err = insertBillEntry(tx, billID, creditorID, entry); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = tx.Commit(context.Background()); err != nil {
+		return nil, fmt.Errorf("ไม่สามารถ Commit Transaction ได้: %w", err)
+	}
+	return txIDs, nil
+}
+
+// insertBillEntry creates the transaction of one bill entry within tx and, unless it is pending,
+// adds it to user_debts. Entries added to an existing bill take over its open trip, and its due date
+// unless they have their own.
+func insertBillEntry(tx pgx.Tx, billID, creditorID int, entry BillEntry) (int, error) {
+	status := TxStatusActive
+	if entry.Pending {
+		status = TxStatusPending
+	}
+
+	var txID int
+	err := tx.QueryRow(context.Background(), `
+		INSERT INTO transactions (payer_id, payee_id, amount, description, status, bill_id, source_message_id, due_date, trip_id)
+		VALUES ($1, $2, $3, $4, $5, $6,
+			(SELECT message_id FROM bills WHERE id = $6),
+			COALESCE($8, (SELECT MAX(due_date) FROM transactions WHERE bill_id = $6)),
+			(SELECT MAX(t.trip_id) FROM transactions t JOIN trips tr ON tr.id = t.trip_id
+			 WHERE t.bill_id = $6 AND tr.status = $7))
+		RETURNING id
+	`, entry.DebtorID, creditorID, entry.Amount, entry.Description, status, billID, TripOpen, entry.DueDate).Scan(&txID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create transaction: %w", err)
+	}
+	if entry.Pending {
+		return txID, nil
+	}
+
+	_, err = tx.Exec(context.Background(), `
+		INSERT INTO user_debts (debtor_id, creditor_id, amount, created_at, updated_at)
+		VALUES ($1, $2, $3, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+		ON CONFLICT (debtor_id, creditor_id)
+		DO UPDATE SET amount = user_debts.amount + EXCLUDED.amount, updated_at = CURRENT_TIMESTAMP
+	`, entry.DebtorID, creditorID, entry.Amount)
+	if err != nil {
+		return 0, fmt.Errorf("failed to update user_debts: %w", err)
+	}
+	return txID, nil
+}
+
+// GetBillByMessageID returns the open bill created from a message, or nil if the message created none
+func GetBillByMessageID(messageID string) (*Bill, error) {
+	bill := &Bill{}
+	err := Pool.QueryRow(context.Background(), `
+		SELECT b.id, b.message_id, b.channel_id, b.guild_id, b.creditor_id, u.discord_id, b.status
+		FROM bills b
+		JOIN users u ON b.creditor_id = u.id
+		WHERE b.message_id = $1 AND b.status = $2
+	`, messageID, BillOpen).Scan(&bill.ID, &bill.MessageID, &bill.ChannelID, &bill.GuildID, &bill.CreditorID, &bill.CreditorDiscordID, &bill.Status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error querying bill for message %s: %w", messageID, err)
+	}
+	return bill, nil
+}
+
+// lockBillTransactions loads the bill's transactions that still count (active or pending) for update.
+// Transactions converted into an installment plan are included as paid, since the bill can no longer change them.
+func lockBillTransactions(tx pgx.Tx, billID int) ([]BillTransaction, error) {
+	rows, err := tx.Query(context.Background(), `
+		SELECT t.id, t.payer_id, u.discord_id, t.amount, COALESCE(t.description, ''), t.status,
+		       t.already_paid OR t.paid_amount > 0 OR t.status = $4
+		FROM transactions t
+		JOIN users u ON t.payer_id = u.id
+		WHERE t.bill_id = $1 AND t.status IN ($2, $3, $4)
+		ORDER BY t.id
+		FOR UPDATE OF t
+	`, billID, TxStatusActive, TxStatusPending, TxStatusConverted)
+	if err != nil {
+		return nil, fmt.Errorf("error loading bill transactions: %w", err)
+	}
+	defer rows.Close()
+
+	var transactions []BillTransaction
+	for rows.Next() {
+		var t BillTransaction
+		if err := rows.Scan(&t.TxID, &t.DebtorID, &t.DebtorDiscordID, &t.Amount, &t.Description, &t.Status, &t.Paid); err != nil {
+			return nil, fmt.Errorf("error scanning bill transaction: %w", err)
+		}
+		transactions = append(transactions, t)
+	}
+	return transactions, rows.Err()
+}
+
+// voidBillTransaction voids an unpaid bill transaction within tx, removing it from user_debts if it was active
+func voidBillTransaction(tx pgx.Tx, creditorID int, t BillTransaction) error {
+	_, err := tx.Exec(context.Background(),
+		`UPDATE transactions SET status = $2 WHERE id = $1`, t.TxID, TxStatusVoided)
+	if err != nil {
+		return fmt.Errorf("error voiding transaction %d: %w", t.TxID, err)
+	}
+	if t.Status != TxStatusActive {
+		return nil
+	}
+	_, err = tx.Exec(context.Background(),
+		`UPDATE user_debts SET amount = GREATEST(amount - $1, 0), updated_at = CURRENT_TIMESTAMP
+         WHERE debtor_id = $2 AND creditor_id = $3`,
+		t.Amount, t.DebtorID, creditorID)
+	if err != nil {
+		return fmt.Errorf("failed to update user_debts: %w", err)
+	}
+	return nil
+}
+
+// matchBillEntries pairs the entries of an edited bill with stored transactions of the same debtor.
+// It matches by description first, then by amount for renamed items, and finally by position among the
+// debtor's remaining transactions, so an edit that changes both never leaves a paid transaction aside
+// and adds a new debt next to it. Returns the index of the stored transaction of each entry, -1 if none.
+func matchBillEntries(stored []BillTransaction, entries []BillEntry) []int {
+	matches := make([]int, len(entries))
+	for idx := range matches {
+		matches[idx] = -1
+	}
+	used := make([]bool, len(stored))
+	match := func(same func(entry BillEntry, t BillTransaction) bool) {
+		for entryIdx, entry := range entries {
+			if matches[entryIdx] >= 0 {
+				continue
+			}
+			for storedIdx, t := range stored {
+				if !used[storedIdx] && t.DebtorID == entry.DebtorID && same(entry, t) {
+					matches[entryIdx] = storedIdx
+					used[storedIdx] = true
+					break
+				}
+			}
+		}
+	}
+	match(func(entry BillEntry, t BillTransaction) bool { return entry.Description == t.Description })
+	match(func(entry BillEntry, t BillTransaction) bool { return math.Abs(entry.Amount-t.Amount) < 0.005 })
+	match(func(BillEntry, BillTransaction) bool { return true })
+	return matches
+}
+
+// SyncBill applies an edited bill to its transactions in a single DB transaction. Stored transactions
+// are matched with entries of the same debtor (see matchBillEntries): unpaid ones get the new amount and
+// description or are voided when their entry is gone, entries without a match are added, and paid ones are left untouched.
+func SyncBill(bill *Bill, entries []BillEntry) (*BillSyncResult, error) {
+	tx, err := Pool.Begin(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("ไม่สามารถเริ่ม Transaction ได้: %w", err)
+	}
+	defer tx.Rollback(context.Background()) // Rollback if commit isn't called
+
+	stored, err := lockBillTransactions(tx, bill.ID)
+	if err != nil {
+		return nil, err
+	}
+	matches := matchBillEntries(stored, entries)
+	matched := make([]bool, len(stored))
+
+	result := &BillSyncResult{}
+	for entryIdx, entry := range entries {
+		if matches[entryIdx] < 0 {
+			txID, err := insertBillEntry(tx, bill.ID, bill.CreditorID, entry)
+			if err != nil {
+				return nil, err
+			}
+			status := TxStatusActive
+			if entry.Pending {
+				status = TxStatusPending
+			}
+			result.Added = append(result.Added, BillTransaction{TxID: txID, DebtorID: entry.DebtorID, Amount: entry.Amount, Description: entry.Description, Status: status})
+			continue
+		}
+
+		t := stored[matches[entryIdx]]
+		matched[matches[entryIdx]] = true
+		amountChanged := math.Abs(t.Amount-entry.Amount) >= 0.005
+		if !amountChanged && (t.Paid || t.Description == entry.Description) {
+			continue
+		}
+		t.NewAmount = entry.Amount
+		if t.Paid {
+			result.Protected = append(result.Protected, t)
+			continue
+		}
+		if t.Description != entry.Description {
+			t.NewDescription = entry.Description
+		}
+
+		_, err = tx.Exec(context.Background(),
+			`UPDATE transactions SET amount = $2, description = $3 WHERE id = $1`, t.TxID, entry.Amount, entry.Description)
+		if err != nil {
+			return nil, fmt.Errorf("error updating transaction %d: %w", t.TxID, err)
+		}
+		if t.Status == TxStatusActive && amountChanged {
+			_, err = tx.Exec(context.Background(),
+				`UPDATE user_debts SET amount = GREATEST(amount + $1, 0), updated_at = CURRENT_TIMESTAMP
+                 WHERE debtor_id = $2 AND creditor_id = $3`,
+				entry.Amount-t.Amount, t.DebtorID, bill.CreditorID)
+			if err != nil {
+				return nil, fmt.Errorf("failed to update user_debts: %w", err)
+			}
+		}
+		result.Updated = append(result.Updated, t)
+	}
+
+	// Whatever is left no longer appears in the bill
+	for storedIdx, t := range stored {
+		if matched[storedIdx] {
+			continue
+		}
+		if t.Paid {
+			result.Protected = append(result.Protected, t)
+			continue
+		}
+		if err := voidBillTransaction(tx, bill.CreditorID, t); err != nil {
+			return nil, err
+		}
+		result.Voided = append(result.Voided, t)
+	}
+
+	if err = tx.Commit(context.Background()); err != nil {
+		return nil, fmt.Errorf("ไม่สามารถ Commit Transaction ได้: %w", err)
+	}
+	return result, nil
+}
+
+// SetBillDueDate moves the due date of a bill's unpaid transactions. Returns how many were updated.
+func SetBillDueDate(billID int, dueDate time.Time) (int64, error) {
+	result, err := Pool.Exec(context.Background(), `
+		UPDATE transactions SET due_date = $2
+		WHERE bill_id = $1 AND status IN ($3, $4) AND already_paid = false
+	`, billID, dueDate, TxStatusActive, TxStatusPending)
+	if err != nil {
+		return 0, fmt.Errorf("error setting due date of bill %d: %w", billID, err)
+	}
+	return result.RowsAffected(), nil
+}
+
+// VoidBill voids the unpaid transactions of a bill whose message was deleted.
+// Returns the voided transactions and the paid ones that were kept.
+func VoidBill(bill *Bill) (voided, kept []BillTransaction, err error) {
+	tx, err := Pool.Begin(context.Background())
+	if err != nil {
+		return nil, nil, fmt.Errorf("ไม่สามารถเริ่ม Transaction ได้: %w", err)
+	}
+	defer tx.Rollback(context.Background()) // Rollback if commit isn't called
+
+	stored, err := lockBillTransactions(tx, bill.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, t := range stored {
+		if t.Paid {
+			kept = append(kept, t)
+			continue
+		}
+		if err := voidBillTransaction(tx, bill.CreditorID, t); err != nil {
+			return nil, nil, err
+		}
+		voided = append(voided, t)
+	}
+
+	_, err = tx.Exec(context.Background(),
+		`UPDATE bills SET status = $2 WHERE id = $1`, bill.ID, BillDeleted)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error marking bill %d deleted: %w", bill.ID, err)
+	}
+
+	if err = tx.Commit(context.Background()); err != nil {
+		return nil, nil, fmt.Errorf("ไม่สามารถ Commit Transaction ได้: %w", err)
+	}
+	return voided, kept, nil
+}
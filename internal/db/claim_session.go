@@ -0,0 +1,318 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Claim session statuses
+const (
+	ClaimSessionOpen      = "open"
+	ClaimSessionFinalized = "finalized"
+	ClaimSessionCancelled = "cancelled"
+)
+
+// ErrClaimSessionClosed is returned when a claim session was already finalized or cancelled
+var ErrClaimSessionClosed = errors.New("รายการแบ่งบิลนี้ปิดไปแล้ว")
+
+// ClaimItem is one item of a receipt being claimed
+type ClaimItem struct {
+	Name     string  `json:"name"`
+	Price    float64 `json:"price"` // Total price of the line, not per unit
+	Quantity int     `json:"quantity"`
+}
+
+// ItemClaim is a participant's claim on a receipt item. Units is how many of the item they had,
+// zero means they share whatever units nobody claimed individually.
+type ItemClaim struct {
+	ItemIndex int    `json:"item_index"`
+	DiscordID string `json:"discord_id"`
+	Units     int    `json:"units"`
+}
+
+// ClaimParticipant is someone allowed to claim items on the bill allocation web page
+type ClaimParticipant struct {
+	DiscordID string `json:"id"`
+	Name      string `json:"name"`
+}
+
+// ClaimSession is an OCR'd receipt whose items the participants claim themselves,
+// either on a claim board in Discord or together on the bill allocation web page
+type ClaimSession struct {
+	ID              int         `json:"id"`
+	ChannelID       string      `json:"channel_id"`
+	GuildID         string      `json:"guild_id"`
+	MessageID       string      `json:"message_id"`        // The claim board message
+	SourceMessageID string      `json:"source_message_id"` // The receipt message the bill is created from
+	OwnerDiscordID  string      `json:"owner_discord_id"`
+	MerchantName    string      `json:"merchant_name"`
+	BillDatetime    string      `json:"bill_datetime"`
+	Items           []ClaimItem `json:"items"`
+	ExtraCharges    float64     `json:"extra_charges"` // VAT and service charge, shared in proportion to each claim
+	Status          string      `json:"status"`
+	Claims          []ItemClaim `json:"claims"`
+
+	// Only set for sessions of the bill allocation web page
+	WebToken        string             `json:"-"` // Shared with every participant in the page link
+	OwnerKey        string             `json:"-"` // Only the owner's link has it, it allows locking and submitting
+	ParticipantKeys map[string]string  `json:"-"` // Participant Discord ID -> key only their own link has, it identifies them
+	Participants    []ClaimParticipant `json:"participants"`
+}
+
+// MigrateClaimSessionTables creates the tables for claiming receipt items in Discord
+func MigrateClaimSessionTables() error {
+	_, err := Pool.Exec(context.Background(), `
+	CREATE TABLE IF NOT EXISTS claim_sessions (
+		id SERIAL PRIMARY KEY,
+		channel_id TEXT NOT NULL,
+		guild_id TEXT NOT NULL DEFAULT '',
+		message_id TEXT NOT NULL DEFAULT '',
+		owner_discord_id TEXT NOT NULL,
+		merchant_name TEXT NOT NULL DEFAULT '',
+		bill_datetime TEXT NOT NULL DEFAULT '',
+		items JSONB NOT NULL,
+		extra_charges NUMERIC(10, 2) NOT NULL DEFAULT 0,
+		status TEXT NOT NULL DEFAULT 'open',
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS claim_session_claims (
+		session_id INTEGER NOT NULL REFERENCES claim_sessions(id) ON DELETE CASCADE,
+		item_index INTEGER NOT NULL,
+		discord_id TEXT NOT NULL,
+		units INTEGER NOT NULL CHECK (units >= 0),
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (session_id, item_index, discord_id)
+	);
+
+	ALTER TABLE claim_sessions
+	ADD COLUMN IF NOT EXISTS web_token TEXT,
+	ADD COLUMN IF NOT EXISTS owner_key TEXT NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS participants JSONB NOT NULL DEFAULT '[]',
+	ADD COLUMN IF NOT EXISTS source_message_id TEXT NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS participant_keys JSONB NOT NULL DEFAULT '{}';
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_claim_sessions_web_token ON claim_sessions(web_token) WHERE web_token IS NOT NULL;
+
+	DROP TRIGGER IF EXISTS update_claim_sessions_modtime ON claim_sessions;
+	CREATE TRIGGER update_claim_sessions_modtime
+	BEFORE UPDATE ON claim_sessions
+	FOR EACH ROW
+	EXECUTE FUNCTION update_modified_column();
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating claim session tables: %w", err)
+	}
+
+	log.Println("Claim session tables migrated successfully")
+	return nil
+}
+
+// CreateClaimSession stores a new open claim session and returns its ID
+func CreateClaimSession(session *ClaimSession) (int, error) {
+	itemsJSON, err := json.Marshal(session.Items)
+	if err != nil {
+		return 0, fmt.Errorf("error encoding claim items: %w", err)
+	}
+	participantsJSON, err := json.Marshal(session.Participants)
+	if err != nil {
+		return 0, fmt.Errorf("error encoding claim participants: %w", err)
+	}
+	participantKeys := session.ParticipantKeys
+	if participantKeys == nil {
+		participantKeys = map[string]string{}
+	}
+	participantKeysJSON, err := json.Marshal(participantKeys)
+	if err != nil {
+		return 0, fmt.Errorf("error encoding claim participant keys: %w", err)
+	}
+
+	var sessionID int
+	err = Pool.QueryRow(context.Background(), `
+		INSERT INTO claim_sessions (channel_id, guild_id, owner_discord_id, merchant_name, bill_datetime, items, extra_charges,
+			web_token, owner_key, participants, source_message_id, participant_keys)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), $9, $10, $11, $12)
+		RETURNING id
+	`, session.ChannelID, session.GuildID, session.OwnerDiscordID, session.MerchantName, session.BillDatetime, itemsJSON, session.ExtraCharges,
+		session.WebToken, session.OwnerKey, participantsJSON, session.SourceMessageID, participantKeysJSON).Scan(&sessionID)
+	if err != nil {
+		return 0, fmt.Errorf("error creating claim session: %w", err)
+	}
+	return sessionID, nil
+}
+
+// SetClaimSessionMessage records the message showing the session's claim board
+func SetClaimSessionMessage(sessionID int, messageID string) error {
+	_, err := Pool.Exec(context.Background(),
+		`UPDATE claim_sessions SET message_id = $2 WHERE id = $1`, sessionID, messageID)
+	if err != nil {
+		return fmt.Errorf("error saving claim board message: %w", err)
+	}
+	return nil
+}
+
+// GetClaimSession returns a claim session with its claims
+func GetClaimSession(sessionID int) (*ClaimSession, error) {
+	return getClaimSession(Pool, sessionID, false)
+}
+
+// GetClaimSessionByWebToken returns the claim session of a bill allocation web page, or nil if the token is unknown
+func GetClaimSessionByWebToken(token string) (*ClaimSession, error) {
+	var sessionID int
+	err := Pool.QueryRow(context.Background(),
+		`SELECT id FROM claim_sessions WHERE web_token = $1`, token).Scan(&sessionID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error querying claim session by web token: %w", err)
+	}
+	return getClaimSession(Pool, sessionID, false)
+}
+
+// getClaimSession loads a claim session with its claims, optionally locking the session row
+func getClaimSession(q rowQuerier, sessionID int, lock bool) (*ClaimSession, error) {
+	query := `
+		SELECT id, channel_id, guild_id, message_id, owner_discord_id, merchant_name, bill_datetime, items, extra_charges, status,
+			COALESCE(web_token, ''), owner_key, participants, source_message_id, participant_keys
+		FROM claim_sessions WHERE id = $1`
+	if lock {
+		query += " FOR UPDATE"
+	}
+
+	session := &ClaimSession{}
+	var itemsJSON, participantsJSON, participantKeysJSON []byte
+	err := q.QueryRow(context.Background(), query, sessionID).Scan(&session.ID, &session.ChannelID, &session.GuildID, &session.MessageID,
+		&session.OwnerDiscordID, &session.MerchantName, &session.BillDatetime, &itemsJSON, &session.ExtraCharges, &session.Status,
+		&session.WebToken, &session.OwnerKey, &participantsJSON, &session.SourceMessageID, &participantKeysJSON)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("ไม่พบรายการแบ่งบิล #%d", sessionID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error querying claim session %d: %w", sessionID, err)
+	}
+	if err := json.Unmarshal(itemsJSON, &session.Items); err != nil {
+		return nil, fmt.Errorf("error decoding claim items of session %d: %w", sessionID, err)
+	}
+	if err := json.Unmarshal(participantsJSON, &session.Participants); err != nil {
+		return nil, fmt.Errorf("error decoding participants of session %d: %w", sessionID, err)
+	}
+	if err := json.Unmarshal(participantKeysJSON, &session.ParticipantKeys); err != nil {
+		return nil, fmt.Errorf("error decoding participant keys of session %d: %w", sessionID, err)
+	}
+
+	rows, err := q.Query(context.Background(), `
+		SELECT item_index, discord_id, units FROM claim_session_claims
+		WHERE session_id = $1 ORDER BY item_index, created_at`, sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying claims of session %d: %w", sessionID, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var claim ItemClaim
+		if err := rows.Scan(&claim.ItemIndex, &claim.DiscordID, &claim.Units); err != nil {
+			return nil, fmt.Errorf("error scanning claim: %w", err)
+		}
+		session.Claims = append(session.Claims, claim)
+	}
+	return session, rows.Err()
+}
+
+// SetItemClaim records how many units of an item a participant had, replacing their previous claim.
+// Units of zero shares the item's unclaimed units. Claims can't exceed the item's quantity.
+func SetItemClaim(sessionID, itemIndex int, discordID string, units int) error {
+	tx, err := Pool.Begin(context.Background())
+	if err != nil {
+		return fmt.Errorf("ไม่สามารถเริ่ม Transaction ได้: %w", err)
+	}
+	defer tx.Rollback(context.Background()) // Rollback if commit isn't called
+
+	// Lock the session so concurrent claims on the same item can't oversell it
+	session, err := getClaimSession(tx, sessionID, true)
+	if err != nil {
+		return err
+	}
+	if session.Status != ClaimSessionOpen {
+		return fmt.Errorf("รายการแบ่งบิลนี้ปิดไปแล้ว")
+	}
+	if itemIndex < 0 || itemIndex >= len(session.Items) {
+		return fmt.Errorf("ไม่พบรายการที่เลือก")
+	}
+
+	item := session.Items[itemIndex]
+	claimedByOthers := 0
+	for _, claim := range session.Claims {
+		if claim.ItemIndex == itemIndex && claim.DiscordID != discordID {
+			claimedByOthers += claim.Units
+		}
+	}
+	if units > 0 && claimedByOthers+units > item.Quantity {
+		return fmt.Errorf("%s เหลือให้รับอีกเพียง %d ชิ้น", item.Name, item.Quantity-claimedByOthers)
+	}
+
+	_, err = tx.Exec(context.Background(), `
+		INSERT INTO claim_session_claims (session_id, item_index, discord_id, units)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (session_id, item_index, discord_id) DO UPDATE SET units = EXCLUDED.units
+	`, sessionID, itemIndex, discordID, units)
+	if err != nil {
+		return fmt.Errorf("error saving claim: %w", err)
+	}
+
+	if err = tx.Commit(context.Background()); err != nil {
+		return fmt.Errorf("ไม่สามารถ Commit Transaction ได้: %w", err)
+	}
+	return nil
+}
+
+// RemoveItemClaims removes a participant's claims in an open session, on one item or on all items if itemIndex is negative
+func RemoveItemClaims(sessionID, itemIndex int, discordID string) error {
+	_, err := Pool.Exec(context.Background(), `
+		DELETE FROM claim_session_claims c
+		USING claim_sessions s
+		WHERE c.session_id = s.id AND s.id = $1 AND s.status = $4
+		  AND c.discord_id = $2 AND ($3 < 0 OR c.item_index = $3)
+	`, sessionID, discordID, itemIndex, ClaimSessionOpen)
+	if err != nil {
+		return fmt.Errorf("error removing claims: %w", err)
+	}
+	return nil
+}
+
+// CloseClaimSession finalizes or cancels an open claim session
+func CloseClaimSession(sessionID int, status string) error {
+	result, err := Pool.Exec(context.Background(),
+		`UPDATE claim_sessions SET status = $2 WHERE id = $1 AND status = $3`, sessionID, status, ClaimSessionOpen)
+	if err != nil {
+		return fmt.Errorf("error closing claim session %d: %w", sessionID, err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrClaimSessionClosed
+	}
+	return nil
+}
+
+// ReopenClaimSession reopens a finalized claim session whose bill could not be created, so it can be submitted again
+func ReopenClaimSession(sessionID int) error {
+	_, err := Pool.Exec(context.Background(),
+		`UPDATE claim_sessions SET status = $2 WHERE id = $1 AND status = $3`, sessionID, ClaimSessionOpen, ClaimSessionFinalized)
+	if err != nil {
+		return fmt.Errorf("error reopening claim session %d: %w", sessionID, err)
+	}
+	return nil
+}
+
+// CancelClaimSessionByWebToken cancels the open claim session of an expired bill allocation web page
+func CancelClaimSessionByWebToken(token string) error {
+	_, err := Pool.Exec(context.Background(),
+		`UPDATE claim_sessions SET status = $2 WHERE web_token = $1 AND status = $3`, token, ClaimSessionCancelled, ClaimSessionOpen)
+	if err != nil {
+		return fmt.Errorf("error cancelling claim session of web token: %w", err)
+	}
+	return nil
+}
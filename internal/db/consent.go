@@ -0,0 +1,201 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// BillConsentPolicy is a guild's opt-in rule that bill debts wait for the participants to accept them
+type BillConsentPolicy struct {
+	GuildID      string `json:"guild_id"`
+	Enabled      bool   `json:"enabled"`
+	TimeoutHours int    `json:"timeout_hours"` // Pending debts are accepted automatically after this long
+}
+
+// AutoAcceptedDebt is a pending bill transaction accepted because its participant didn't respond in time
+type AutoAcceptedDebt struct {
+	TxID              int     `json:"tx_id"`
+	ChannelID         string  `json:"channel_id"`
+	GuildID           string  `json:"guild_id"`
+	DebtorDiscordID   string  `json:"debtor_discord_id"`
+	CreditorDiscordID string  `json:"creditor_discord_id"`
+	CreditorID        int     `json:"creditor_id"`
+	Amount            float64 `json:"amount"`
+	Description       string  `json:"description"`
+}
+
+// MigrateBillConsentTables creates the consent policy table and the table tracking pending bill debts
+func MigrateBillConsentTables() error {
+	_, err := Pool.Exec(context.Background(), `
+	CREATE TABLE IF NOT EXISTS guild_bill_consent_policies (
+		guild_id TEXT PRIMARY KEY,
+		enabled BOOLEAN NOT NULL DEFAULT FALSE,
+		timeout_hours INTEGER NOT NULL CHECK (timeout_hours > 0),
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS bill_consents (
+		tx_id INTEGER PRIMARY KEY REFERENCES transactions(id) ON DELETE CASCADE,
+		channel_id TEXT NOT NULL,
+		guild_id TEXT NOT NULL DEFAULT '',
+		deadline TIMESTAMPTZ NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_bill_consents_deadline ON bill_consents(deadline);
+
+	DROP TRIGGER IF EXISTS update_guild_bill_consent_policies_modtime ON guild_bill_consent_policies;
+	CREATE TRIGGER update_guild_bill_consent_policies_modtime
+	BEFORE UPDATE ON guild_bill_consent_policies
+	FOR EACH ROW
+	EXECUTE FUNCTION update_modified_column();
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating bill consent tables: %w", err)
+	}
+
+	log.Println("Bill consent tables migrated successfully")
+	return nil
+}
+
+// GetBillConsentPolicy returns the guild's consent policy, ok is false if the guild never set one
+func GetBillConsentPolicy(guildID string) (policy *BillConsentPolicy, ok bool, err error) {
+	policy = &BillConsentPolicy{GuildID: guildID}
+	err = Pool.QueryRow(context.Background(),
+		`SELECT enabled, timeout_hours FROM guild_bill_consent_policies WHERE guild_id = $1`, guildID).
+		Scan(&policy.Enabled, &policy.TimeoutHours)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("error querying bill consent policy: %w", err)
+	}
+	return policy, true, nil
+}
+
+// SetBillConsentPolicy creates or updates the guild's consent policy
+func SetBillConsentPolicy(guildID string, enabled bool, timeoutHours int) error {
+	_, err := Pool.Exec(context.Background(), `
+		INSERT INTO guild_bill_consent_policies (guild_id, enabled, timeout_hours)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (guild_id)
+		DO UPDATE SET enabled = EXCLUDED.enabled, timeout_hours = EXCLUDED.timeout_hours
+	`, guildID, enabled, timeoutHours)
+	if err != nil {
+		return fmt.Errorf("error saving bill consent policy: %w", err)
+	}
+	return nil
+}
+
+// AddBillConsents schedules pending bill transactions to be accepted automatically at the deadline
+func AddBillConsents(txIDs []int, channelID, guildID string, deadline time.Time) error {
+	_, err := Pool.Exec(context.Background(), `
+		INSERT INTO bill_consents (tx_id, channel_id, guild_id, deadline)
+		SELECT UNNEST($1::int[]), $2, $3, $4
+		ON CONFLICT (tx_id) DO NOTHING
+	`, txIDs, channelID, guildID, deadline)
+	if err != nil {
+		return fmt.Errorf("error saving bill consents: %w", err)
+	}
+	return nil
+}
+
+// WithdrawBillConsents stops pending bill transactions from being accepted automatically, e.g. because
+// their participant disputed them. Returns the transactions that were still pending.
+func WithdrawBillConsents(txIDs []int) ([]int, error) {
+	rows, err := Pool.Query(context.Background(), `
+		DELETE FROM bill_consents
+		WHERE tx_id = ANY($1)
+		  AND EXISTS (SELECT 1 FROM transactions t WHERE t.id = bill_consents.tx_id AND t.status = $2)
+		RETURNING tx_id`, txIDs, TxStatusPending)
+	if err != nil {
+		return nil, fmt.Errorf("error withdrawing bill consents: %w", err)
+	}
+	defer rows.Close()
+
+	var withdrawn []int
+	for rows.Next() {
+		var txID int
+		if err := rows.Scan(&txID); err != nil {
+			return nil, fmt.Errorf("error scanning withdrawn bill consent: %w", err)
+		}
+		withdrawn = append(withdrawn, txID)
+	}
+	return withdrawn, rows.Err()
+}
+
+// ClaimExpiredBillConsents accepts every pending bill transaction whose deadline has passed and
+// forgets consents whose transactions were already accepted or disputed. Returns the accepted debts.
+func ClaimExpiredBillConsents() ([]AutoAcceptedDebt, error) {
+	tx, err := Pool.Begin(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("ไม่สามารถเริ่ม Transaction ได้: %w", err)
+	}
+	defer tx.Rollback(context.Background()) // Rollback if commit isn't called
+
+	rows, err := tx.Query(context.Background(), `
+		DELETE FROM bill_consents
+		WHERE deadline < CURRENT_TIMESTAMP
+		   OR EXISTS (SELECT 1 FROM transactions t WHERE t.id = bill_consents.tx_id AND t.status <> $1)
+		RETURNING tx_id, channel_id, guild_id`, TxStatusPending)
+	if err != nil {
+		return nil, fmt.Errorf("error claiming expired bill consents: %w", err)
+	}
+	type consentLocation struct{ channelID, guildID string }
+	locations := make(map[int]consentLocation)
+	var txIDs []int
+	for rows.Next() {
+		var txID int
+		var location consentLocation
+		if err := rows.Scan(&txID, &location.channelID, &location.guildID); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error scanning bill consent: %w", err)
+		}
+		locations[txID] = location
+		txIDs = append(txIDs, txID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(txIDs) == 0 {
+		return nil, nil
+	}
+
+	activated, err := activatePendingTransactions(tx, txIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	var accepted []AutoAcceptedDebt
+	for _, debt := range activated {
+		accepted = append(accepted, AutoAcceptedDebt{
+			TxID:       debt.TxID,
+			ChannelID:  locations[debt.TxID].channelID,
+			GuildID:    locations[debt.TxID].guildID,
+			CreditorID: debt.CreditorID,
+			Amount:     debt.Amount,
+		})
+	}
+	for idx := range accepted {
+		debt := &accepted[idx]
+		err = tx.QueryRow(context.Background(), `
+			SELECT payer.discord_id, payee.discord_id, COALESCE(t.description, '')
+			FROM transactions t
+			JOIN users payer ON t.payer_id = payer.id
+			JOIN users payee ON t.payee_id = payee.id
+			WHERE t.id = $1`, debt.TxID).Scan(&debt.DebtorDiscordID, &debt.CreditorDiscordID, &debt.Description)
+		if err != nil {
+			return nil, fmt.Errorf("error loading auto-accepted transaction %d: %w", debt.TxID, err)
+		}
+	}
+
+	if err = tx.Commit(context.Background()); err != nil {
+		return nil, fmt.Errorf("ไม่สามารถ Commit Transaction ได้: %w", err)
+	}
+	return accepted, nil
+}
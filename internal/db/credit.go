@@ -0,0 +1,183 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// UserCredit is an overpayment one user made to another, kept to pay the counterparty's future bills
+type UserCredit struct {
+	HolderID            int       `json:"holder_id"`       // User who overpaid
+	CounterpartyID      int       `json:"counterparty_id"` // User who received the overpayment
+	OtherPartyDiscordID string    `json:"other_party_discord_id"`
+	Amount              float64   `json:"amount"`
+	UpdatedAt           time.Time `json:"updated_at"`
+}
+
+// MigrateCreditTables creates the user_credits table if it doesn't exist
+func MigrateCreditTables() error {
+	_, err := Pool.Exec(context.Background(), `
+	CREATE TABLE IF NOT EXISTS user_credits (
+		id SERIAL PRIMARY KEY,
+		holder_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		counterparty_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		amount NUMERIC(10, 2) NOT NULL DEFAULT 0 CHECK (amount >= 0),
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (holder_id, counterparty_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_user_credits_counterparty_id ON user_credits(counterparty_id);
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating user_credits table: %w", err)
+	}
+
+	// Apply trigger to user_credits
+	creditsTrigger := `
+	DROP TRIGGER IF EXISTS update_user_credits_modtime ON user_credits;
+	CREATE TRIGGER update_user_credits_modtime
+	BEFORE UPDATE ON user_credits
+	FOR EACH ROW
+	EXECUTE FUNCTION update_modified_column();`
+	_, err = Pool.Exec(context.Background(), creditsTrigger)
+	if err != nil {
+		return fmt.Errorf("error applying trigger to user_credits: %w", err)
+	}
+
+	log.Println("Credit tables migrated successfully")
+	return nil
+}
+
+// addUserCredit adds amount to the holder's credit toward the counterparty inside tx
+func addUserCredit(tx pgx.Tx, holderDbID, counterpartyDbID int, amount float64) error {
+	_, err := tx.Exec(context.Background(), `
+		INSERT INTO user_credits (holder_id, counterparty_id, amount)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (holder_id, counterparty_id)
+		DO UPDATE SET amount = user_credits.amount + EXCLUDED.amount
+	`, holderDbID, counterpartyDbID, amount)
+	if err != nil {
+		return fmt.Errorf("เกิดข้อผิดพลาดขณะบันทึกเครดิต: %w", err)
+	}
+	return nil
+}
+
+// GetUserCredit returns the holder's credit toward the counterparty, 0 if there is none
+func GetUserCredit(holderDbID, counterpartyDbID int) (float64, error) {
+	var amount float64
+	err := Pool.QueryRow(context.Background(), `
+		SELECT amount FROM user_credits WHERE holder_id = $1 AND counterparty_id = $2
+	`, holderDbID, counterpartyDbID).Scan(&amount)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error querying user credit: %w", err)
+	}
+	return amount, nil
+}
+
+// GetUserCredits lists the user's non-zero credits.
+// With asHolder the user is the one who overpaid, otherwise the one who received the overpayment.
+func GetUserCredits(userDbID int, asHolder bool) ([]UserCredit, error) {
+	query := `
+		SELECT uc.holder_id, uc.counterparty_id, u_other.discord_id, uc.amount, uc.updated_at
+		FROM user_credits uc
+		JOIN users u_other ON uc.counterparty_id = u_other.id
+		WHERE uc.holder_id = $1 AND uc.amount > 0.009
+		ORDER BY uc.amount DESC`
+	if !asHolder {
+		query = `
+		SELECT uc.holder_id, uc.counterparty_id, u_other.discord_id, uc.amount, uc.updated_at
+		FROM user_credits uc
+		JOIN users u_other ON uc.holder_id = u_other.id
+		WHERE uc.counterparty_id = $1 AND uc.amount > 0.009
+		ORDER BY uc.amount DESC`
+	}
+
+	rows, err := Pool.Query(context.Background(), query, userDbID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying user credits: %w", err)
+	}
+	defer rows.Close()
+
+	var credits []UserCredit
+	for rows.Next() {
+		var credit UserCredit
+		if err := rows.Scan(&credit.HolderID, &credit.CounterpartyID, &credit.OtherPartyDiscordID, &credit.Amount, &credit.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning user credit: %w", err)
+		}
+		credits = append(credits, credit)
+	}
+	return credits, rows.Err()
+}
+
+// ApplyUserCredit uses the holder's credit toward the counterparty to pay the given unpaid transactions.
+// The credit and user_debts are both reduced by the amount used. Transactions settled from credit
+// are not ranked, since they were paid before the bill existed.
+// Returns nil if the holder has no credit toward the counterparty.
+func ApplyUserCredit(holderDbID, counterpartyDbID int, txIDs []int) (*PaymentAllocation, error) {
+	if len(txIDs) == 0 {
+		return nil, nil
+	}
+
+	tx, err := Pool.Begin(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("ไม่สามารถเริ่ม Transaction ได้: %w", err)
+	}
+	defer tx.Rollback(context.Background()) // Rollback if commit isn't called
+
+	var credit float64
+	err = tx.QueryRow(context.Background(), `
+		SELECT amount FROM user_credits WHERE holder_id = $1 AND counterparty_id = $2 FOR UPDATE
+	`, holderDbID, counterpartyDbID).Scan(&credit)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && credit <= 0.009) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error querying user credit: %w", err)
+	}
+
+	allocation, err := allocateToTransactions(tx, holderDbID, counterpartyDbID, txIDs, credit, "created_at ASC, id ASC", false)
+	if err != nil {
+		return nil, err
+	}
+	used := math.Round((credit-allocation.Unallocated)*100) / 100
+	if used <= 0.009 {
+		return nil, nil
+	}
+
+	_, err = tx.Exec(context.Background(), `
+		UPDATE user_credits SET amount = GREATEST(amount - $1, 0)
+		WHERE holder_id = $2 AND counterparty_id = $3
+	`, used, holderDbID, counterpartyDbID)
+	if err != nil {
+		return nil, fmt.Errorf("เกิดข้อผิดพลาดขณะใช้เครดิต: %w", err)
+	}
+
+	_, err = tx.Exec(context.Background(),
+		`UPDATE user_debts SET amount = GREATEST(amount - $1, 0), updated_at = CURRENT_TIMESTAMP
+         WHERE debtor_id = $2 AND creditor_id = $3`,
+		used, holderDbID, counterpartyDbID)
+	if err != nil {
+		return nil, fmt.Errorf("เกิดข้อผิดพลาดขณะอัปเดตหนี้สินรวม: %w", err)
+	}
+
+	if err = tx.Commit(context.Background()); err != nil {
+		return nil, fmt.Errorf("ไม่สามารถ Commit Transaction ได้: %w", err)
+	}
+
+	// Amount reports what was taken from the credit, not the whole credit balance
+	allocation.Amount = used
+	allocation.Unallocated = 0
+
+	log.Printf("Credit applied: Holder %d, Counterparty %d, Used %.2f, Settled %v",
+		holderDbID, counterpartyDbID, used, allocation.SettledTxIDs())
+	return allocation, nil
+}
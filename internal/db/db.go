@@ -106,6 +106,28 @@ func Migrate() {
 		log.Fatalf("Failed to add paid_at column to transactions table: %v", err)
 	}
 
+	// Add paid_amount column to track partial payments allocated to a transaction
+	addPaidAmount := `
+		ALTER TABLE transactions
+		ADD COLUMN IF NOT EXISTS paid_amount NUMERIC(10, 2) NOT NULL DEFAULT 0;
+	`
+	_, err = Pool.Exec(context.Background(), addPaidAmount)
+	if err != nil {
+		log.Fatalf("Failed to add paid_amount column to transactions table: %v", err)
+	}
+
+	// Add due_date column, and late_fee_for_tx_id linking late fees to the overdue transaction they were charged for
+	addDueDate := `
+		ALTER TABLE transactions
+		ADD COLUMN IF NOT EXISTS due_date TIMESTAMPTZ,
+		ADD COLUMN IF NOT EXISTS late_fee_for_tx_id INTEGER REFERENCES transactions(id) ON DELETE CASCADE;
+		CREATE INDEX IF NOT EXISTS idx_transactions_late_fee_for_tx_id ON transactions(late_fee_for_tx_id);
+	`
+	_, err = Pool.Exec(context.Background(), addDueDate)
+	if err != nil {
+		log.Fatalf("Failed to add due date columns to transactions table: %v", err)
+	}
+
 	// Schema for user_debts table
 	userDebtsSchema := `
     CREATE TABLE IF NOT EXISTS user_debts (
@@ -151,6 +173,16 @@ func Migrate() {
 		log.Fatalf("Failed to migrate user_promptpay table: %v", err)
 	}
 
+	// Add account_name column used to match the receiver name on payment slips
+	addAccountName := `
+		ALTER TABLE user_promptpay
+		ADD COLUMN IF NOT EXISTS account_name TEXT;
+	`
+	_, err = Pool.Exec(context.Background(), addAccountName)
+	if err != nil {
+		log.Fatalf("Failed to add account_name column to user_promptpay table: %v", err)
+	}
+
 	// Apply trigger to user_promptpay
 	userPromptPayTrigger := `
 	DROP TRIGGER IF EXISTS update_user_promptpay_modtime ON user_promptpay;
@@ -287,6 +319,108 @@ func Migrate() {
 		log.Println("Created index on site_token column")
 	}
 
+	// Migrate slip review tables
+	err = MigrateSlipReviewTables()
+	if err != nil {
+		log.Fatalf("Failed to migrate slip review tables: %v", err)
+	}
+
+	// Migrate dispute tables
+	err = MigrateDisputeTables()
+	if err != nil {
+		log.Fatalf("Failed to migrate dispute tables: %v", err)
+	}
+
+	// Migrate interaction state tables
+	err = MigrateInteractionStateTables()
+	if err != nil {
+		log.Fatalf("Failed to migrate interaction state tables: %v", err)
+	}
+
+	// Migrate reconciliation tables
+	err = MigrateReconciliationTables()
+	if err != nil {
+		log.Fatalf("Failed to migrate reconciliation tables: %v", err)
+	}
+
+	// Migrate credit tables
+	err = MigrateCreditTables()
+	if err != nil {
+		log.Fatalf("Failed to migrate credit tables: %v", err)
+	}
+
+	// Migrate netting tables
+	err = MigrateNettingTables()
+	if err != nil {
+		log.Fatalf("Failed to migrate netting tables: %v", err)
+	}
+
+	// Migrate due date tables
+	err = MigrateDueDateTables()
+	if err != nil {
+		log.Fatalf("Failed to migrate due date tables: %v", err)
+	}
+
+	// Migrate installment tables
+	err = MigrateInstallmentTables()
+	if err != nil {
+		log.Fatalf("Failed to migrate installment tables: %v", err)
+	}
+
+	// Migrate trip tables
+	err = MigrateTripTables()
+	if err != nil {
+		log.Fatalf("Failed to migrate trip tables: %v", err)
+	}
+
+	// Migrate payer bill tables
+	err = MigratePayerBillTables()
+	if err != nil {
+		log.Fatalf("Failed to migrate payer bill tables: %v", err)
+	}
+
+	// Migrate transaction status tables
+	err = MigrateTransactionStatusTables()
+	if err != nil {
+		log.Fatalf("Failed to migrate transaction status tables: %v", err)
+	}
+
+	// Migrate bill consent tables
+	err = MigrateBillConsentTables()
+	if err != nil {
+		log.Fatalf("Failed to migrate bill consent tables: %v", err)
+	}
+
+	// Migrate bill tables
+	err = MigrateBillTables()
+	if err != nil {
+		log.Fatalf("Failed to migrate bill tables: %v", err)
+	}
+
+	// Migrate idempotency tables
+	err = MigrateIdempotencyTables()
+	if err != nil {
+		log.Fatalf("Failed to migrate idempotency tables: %v", err)
+	}
+
+	// Migrate claim session tables
+	err = MigrateClaimSessionTables()
+	if err != nil {
+		log.Fatalf("Failed to migrate claim session tables: %v", err)
+	}
+
+	// Migrate OCR cache tables
+	err = MigrateOCRCacheTables()
+	if err != nil {
+		log.Fatalf("Failed to migrate OCR cache tables: %v", err)
+	}
+
+	// Migrate receipt and slip archive tables
+	err = MigrateArchiveTables()
+	if err != nil {
+		log.Fatalf("Failed to migrate archive tables: %v", err)
+	}
+
 	log.Println("Database migration completed successfully")
 }
 
@@ -345,6 +479,8 @@ type DebtDetail struct {
 	OtherPartyDiscordID string
 	OtherPartyName      string
 	Details             string
+	HasOpenDispute      bool    // True while an unresolved dispute exists between the two parties
+	OverdueAmount       float64 // Outstanding amount of transactions past their due date
 }
 
 // GetUserDebtsWithDetails gets all outstanding debts with transaction details for a user
@@ -355,10 +491,11 @@ func GetUserDebtsWithDetails(userID int, isDebtor bool) ([]DebtDetail, error) {
 		SELECT
 			t.payer_id,
 			t.payee_id,
-			t.description || ' (TxID:' || t.id::text || ')' as detail_text,
+			t.description || ' (TxID:' || t.id::text ||
+				CASE WHEN ` + overdueTxCondition + ` THEN ', เกินกำหนดชำระ' ELSE '' END || ')' as detail_text,
 			ROW_NUMBER() OVER (PARTITION BY t.payer_id, t.payee_id ORDER BY t.created_at DESC, t.id DESC) as rn
 		FROM transactions t
-		WHERE t.already_paid = false
+		WHERE t.already_paid = false AND t.status = 'active'
 	)
 	SELECT
 		rtd.payer_id,
@@ -373,7 +510,16 @@ func GetUserDebtsWithDetails(userID int, isDebtor bool) ([]DebtDetail, error) {
 	if isDebtor {
 		query = fmt.Sprintf(`
 			SELECT ud.amount, u_other.discord_id AS other_party_discord_id,
-				   COALESCE(tx_details.details, 'หนี้สินรวม ไม่พบรายการธุรกรรมที่ยังไม่ได้ชำระที่เกี่ยวข้อง') as details
+				   COALESCE(tx_details.details, 'หนี้สินรวม ไม่พบรายการธุรกรรมที่ยังไม่ได้ชำระที่เกี่ยวข้อง') as details,
+				   EXISTS (
+					   SELECT 1 FROM disputes d
+					   WHERE d.debtor_id = ud.debtor_id AND d.creditor_id = ud.creditor_id
+					   AND d.status IN ('open', 'evidence_requested')
+				   ) as has_open_dispute,
+				   COALESCE((
+					   SELECT SUM(t.amount - t.paid_amount) FROM transactions t
+					   WHERE t.payer_id = ud.debtor_id AND t.payee_id = ud.creditor_id AND `+overdueTxCondition+`
+				   ), 0) as overdue_amount
 			FROM user_debts ud
 			JOIN users u_other ON ud.creditor_id = u_other.id
 			LEFT JOIN (
@@ -384,7 +530,16 @@ func GetUserDebtsWithDetails(userID int, isDebtor bool) ([]DebtDetail, error) {
 	} else {
 		query = fmt.Sprintf(`
 			SELECT ud.amount, u_other.discord_id AS other_party_discord_id,
-				   COALESCE(tx_details.details, 'หนี้สินรวม ไม่พบรายการธุรกรรมที่ยังไม่ได้ชำระที่เกี่ยวข้อง') as details
+				   COALESCE(tx_details.details, 'หนี้สินรวม ไม่พบรายการธุรกรรมที่ยังไม่ได้ชำระที่เกี่ยวข้อง') as details,
+				   EXISTS (
+					   SELECT 1 FROM disputes d
+					   WHERE d.debtor_id = ud.debtor_id AND d.creditor_id = ud.creditor_id
+					   AND d.status IN ('open', 'evidence_requested')
+				   ) as has_open_dispute,
+				   COALESCE((
+					   SELECT SUM(t.amount - t.paid_amount) FROM transactions t
+					   WHERE t.payer_id = ud.debtor_id AND t.payee_id = ud.creditor_id AND `+overdueTxCondition+`
+				   ), 0) as overdue_amount
 			FROM user_debts ud
 			JOIN users u_other ON ud.debtor_id = u_other.id
 			LEFT JOIN (
@@ -403,7 +558,7 @@ func GetUserDebtsWithDetails(userID int, isDebtor bool) ([]DebtDetail, error) {
 	var results []DebtDetail
 	for rows.Next() {
 		var debt DebtDetail
-		if err := rows.Scan(&debt.Amount, &debt.OtherPartyDiscordID, &debt.Details); err != nil {
+		if err := rows.Scan(&debt.Amount, &debt.OtherPartyDiscordID, &debt.Details, &debt.HasOpenDispute, &debt.OverdueAmount); err != nil {
 			return nil, fmt.Errorf("error scanning debt/due with details row: %w", err)
 		}
 
@@ -445,22 +600,24 @@ func GetDiscordIDFromDbID(dbUserID int) (string, error) {
 // GetTransactionInfo gets information about a transaction
 func GetTransactionInfo(txID int) (map[string]interface{}, error) {
 	query := `
-		SELECT t.id, t.payer_id, t.payee_id, t.amount, t.description, 
-		       t.already_paid, t.created_at, t.paid_at
+		SELECT t.id, t.payer_id, t.payee_id, t.amount, t.paid_amount, t.description, 
+		       t.already_paid, t.created_at, t.paid_at, t.due_date, t.status
 		FROM transactions t
 		WHERE t.id = $1
 	`
 
 	var id, payerID, payeeID int
-	var amount float64
+	var amount, paidAmount float64
 	var description string
 	var alreadyPaid bool
 	var createdAt time.Time
 	var paidAt *time.Time // Using pointer for nullable column
+	var dueDate *time.Time
+	var status string
 
 	err := Pool.QueryRow(context.Background(), query, txID).Scan(
-		&id, &payerID, &payeeID, &amount, &description,
-		&alreadyPaid, &createdAt, &paidAt,
+		&id, &payerID, &payeeID, &amount, &paidAmount, &description,
+		&alreadyPaid, &createdAt, &paidAt, &dueDate, &status,
 	)
 
 	if err != nil {
@@ -472,14 +629,19 @@ func GetTransactionInfo(txID int) (map[string]interface{}, error) {
 		"payer_id":     payerID,
 		"payee_id":     payeeID,
 		"amount":       amount,
+		"paid_amount":  paidAmount, // Covered by partial payments while the transaction is still unpaid
 		"description":  description,
 		"already_paid": alreadyPaid,
 		"created_at":   createdAt,
+		"status":       status, // Only active transactions count as debts
 	}
 
 	if paidAt != nil {
 		result["paid_at"] = *paidAt
 	}
+	if dueDate != nil {
+		result["due_date"] = *dueDate
+	}
 
 	return result, nil
 }
@@ -0,0 +1,308 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Dispute statuses
+const (
+	DisputeOpen              = "open"
+	DisputeEvidenceRequested = "evidence_requested"
+	DisputeResolvedPaid      = "resolved_paid"
+	DisputeResolvedUnpaid    = "resolved_unpaid"
+)
+
+// openDisputeForTxCondition matches an unresolved dispute covering transaction t, either by TxID
+// or, for disputes without TxIDs, by the debtor/creditor pair
+const openDisputeForTxCondition = `
+	EXISTS (
+		SELECT 1 FROM disputes d
+		WHERE d.status IN ('open', 'evidence_requested')
+		AND (t.id = ANY(d.tx_ids) OR (cardinality(d.tx_ids) = 0 AND d.debtor_id = t.payer_id AND d.creditor_id = t.payee_id))
+	)`
+
+// Dispute represents a disagreement about whether a payment was made
+type Dispute struct {
+	ID                int        `json:"id"`
+	DebtorID          int        `json:"debtor_id"`
+	CreditorID        int        `json:"creditor_id"`
+	DebtorDiscordID   string     `json:"debtor_discord_id"`
+	CreditorDiscordID string     `json:"creditor_discord_id"`
+	ArbiterDiscordID  string     `json:"arbiter_discord_id"` // Empty if no arbiter is assigned
+	OpenedByDiscordID string     `json:"opened_by_discord_id"`
+	Amount            float64    `json:"amount"`
+	TxIDs             []int      `json:"tx_ids"`
+	Status            string     `json:"status"`
+	GuildID           string     `json:"guild_id"`
+	ChannelID         string     `json:"channel_id"`
+	ResolutionNote    string     `json:"resolution_note"`
+	CreatedAt         time.Time  `json:"created_at"`
+	ResolvedAt        *time.Time `json:"resolved_at"`
+}
+
+// DisputeNote represents a note or piece of evidence added to a dispute
+type DisputeNote struct {
+	ID              int       `json:"id"`
+	DisputeID       int       `json:"dispute_id"`
+	AuthorDiscordID string    `json:"author_discord_id"`
+	Note            string    `json:"note"`
+	AttachmentURLs  []string  `json:"attachment_urls"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// IsResolved reports whether the dispute has reached a final status
+func (d *Dispute) IsResolved() bool {
+	return d.Status == DisputeResolvedPaid || d.Status == DisputeResolvedUnpaid
+}
+
+// MigrateDisputeTables creates the disputes and dispute_notes tables if they don't exist
+func MigrateDisputeTables() error {
+	_, err := Pool.Exec(context.Background(), `
+	CREATE TABLE IF NOT EXISTS disputes (
+		id SERIAL PRIMARY KEY,
+		debtor_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		creditor_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		opened_by INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		arbiter_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+		amount NUMERIC(10, 2) NOT NULL DEFAULT 0,
+		tx_ids INTEGER[] NOT NULL DEFAULT '{}',
+		status TEXT NOT NULL DEFAULT 'open', -- 'open', 'evidence_requested', 'resolved_paid', 'resolved_unpaid'
+		guild_id TEXT,
+		channel_id TEXT,
+		resolution_note TEXT,
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		resolved_at TIMESTAMPTZ
+	);
+	CREATE INDEX IF NOT EXISTS idx_disputes_debtor_creditor_status ON disputes(debtor_id, creditor_id, status);
+	CREATE INDEX IF NOT EXISTS idx_disputes_tx_ids ON disputes USING GIN (tx_ids);
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating disputes table: %w", err)
+	}
+
+	_, err = Pool.Exec(context.Background(), `
+	CREATE TABLE IF NOT EXISTS dispute_notes (
+		id SERIAL PRIMARY KEY,
+		dispute_id INTEGER NOT NULL REFERENCES disputes(id) ON DELETE CASCADE,
+		author_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		note TEXT NOT NULL DEFAULT '',
+		attachment_urls TEXT[] NOT NULL DEFAULT '{}',
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_dispute_notes_dispute_id ON dispute_notes(dispute_id);
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating dispute_notes table: %w", err)
+	}
+
+	// Apply trigger to disputes
+	disputesTrigger := `
+	DROP TRIGGER IF EXISTS update_disputes_modtime ON disputes;
+	CREATE TRIGGER update_disputes_modtime
+	BEFORE UPDATE ON disputes
+	FOR EACH ROW
+	EXECUTE FUNCTION update_modified_column();`
+	_, err = Pool.Exec(context.Background(), disputesTrigger)
+	if err != nil {
+		return fmt.Errorf("error applying trigger to disputes: %w", err)
+	}
+
+	log.Println("Dispute tables migrated successfully")
+	return nil
+}
+
+// CreateDispute opens a new dispute between a debtor and a creditor and returns its ID
+func CreateDispute(debtorDbID, creditorDbID, openedByDbID int, amount float64, txIDs []int, guildID, channelID string) (int, error) {
+	if txIDs == nil {
+		txIDs = []int{}
+	}
+
+	var disputeID int
+	err := Pool.QueryRow(context.Background(), `
+		INSERT INTO disputes (debtor_id, creditor_id, opened_by, amount, tx_ids, guild_id, channel_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`, debtorDbID, creditorDbID, openedByDbID, amount, txIDs, guildID, channelID).Scan(&disputeID)
+	if err != nil {
+		return 0, fmt.Errorf("error creating dispute: %w", err)
+	}
+	return disputeID, nil
+}
+
+// disputeSelect is the shared SELECT used to load disputes with Discord IDs
+const disputeSelect = `
+	SELECT ds.id, ds.debtor_id, ds.creditor_id, d.discord_id, c.discord_id,
+		COALESCE(a.discord_id, ''), o.discord_id, ds.amount, ds.tx_ids, ds.status,
+		COALESCE(ds.guild_id, ''), COALESCE(ds.channel_id, ''), COALESCE(ds.resolution_note, ''),
+		ds.created_at, ds.resolved_at
+	FROM disputes ds
+	JOIN users d ON ds.debtor_id = d.id
+	JOIN users c ON ds.creditor_id = c.id
+	JOIN users o ON ds.opened_by = o.id
+	LEFT JOIN users a ON ds.arbiter_id = a.id
+`
+
+// scanDispute scans a row produced by disputeSelect
+func scanDispute(row interface{ Scan(dest ...any) error }) (*Dispute, error) {
+	var dispute Dispute
+	err := row.Scan(
+		&dispute.ID, &dispute.DebtorID, &dispute.CreditorID, &dispute.DebtorDiscordID, &dispute.CreditorDiscordID,
+		&dispute.ArbiterDiscordID, &dispute.OpenedByDiscordID, &dispute.Amount, &dispute.TxIDs, &dispute.Status,
+		&dispute.GuildID, &dispute.ChannelID, &dispute.ResolutionNote,
+		&dispute.CreatedAt, &dispute.ResolvedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &dispute, nil
+}
+
+// GetDispute retrieves a dispute by ID
+func GetDispute(disputeID int) (*Dispute, error) {
+	dispute, err := scanDispute(Pool.QueryRow(context.Background(), disputeSelect+` WHERE ds.id = $1`, disputeID))
+	if err != nil {
+		return nil, fmt.Errorf("ไม่พบข้อพิพาท ID %d: %w", disputeID, err)
+	}
+	return dispute, nil
+}
+
+// GetUserDisputes retrieves disputes where the user is a party or the arbiter
+func GetUserDisputes(userDbID int, includeResolved bool) ([]Dispute, error) {
+	query := disputeSelect + ` WHERE (ds.debtor_id = $1 OR ds.creditor_id = $1 OR ds.arbiter_id = $1)`
+	if !includeResolved {
+		query += ` AND ds.status IN ('open', 'evidence_requested')`
+	}
+	query += ` ORDER BY ds.created_at DESC LIMIT 25`
+
+	rows, err := Pool.Query(context.Background(), query, userDbID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying disputes: %w", err)
+	}
+	defer rows.Close()
+
+	var disputes []Dispute
+	for rows.Next() {
+		dispute, err := scanDispute(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning dispute: %w", err)
+		}
+		disputes = append(disputes, *dispute)
+	}
+	return disputes, rows.Err()
+}
+
+// AddDisputeNote adds a note with optional attachment URLs to a dispute
+func AddDisputeNote(disputeID, authorDbID int, note string, attachmentURLs []string) error {
+	if attachmentURLs == nil {
+		attachmentURLs = []string{}
+	}
+
+	_, err := Pool.Exec(context.Background(), `
+		INSERT INTO dispute_notes (dispute_id, author_id, note, attachment_urls)
+		VALUES ($1, $2, $3, $4)
+	`, disputeID, authorDbID, note, attachmentURLs)
+	if err != nil {
+		return fmt.Errorf("error adding note to dispute %d: %w", disputeID, err)
+	}
+	return nil
+}
+
+// GetDisputeNotes retrieves all notes of a dispute in chronological order
+func GetDisputeNotes(disputeID int) ([]DisputeNote, error) {
+	rows, err := Pool.Query(context.Background(), `
+		SELECT n.id, n.dispute_id, u.discord_id, n.note, n.attachment_urls, n.created_at
+		FROM dispute_notes n
+		JOIN users u ON n.author_id = u.id
+		WHERE n.dispute_id = $1
+		ORDER BY n.created_at ASC, n.id ASC
+	`, disputeID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying dispute notes: %w", err)
+	}
+	defer rows.Close()
+
+	var notes []DisputeNote
+	for rows.Next() {
+		var note DisputeNote
+		if err := rows.Scan(&note.ID, &note.DisputeID, &note.AuthorDiscordID, &note.Note, &note.AttachmentURLs, &note.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning dispute note: %w", err)
+		}
+		notes = append(notes, note)
+	}
+	return notes, rows.Err()
+}
+
+// SetDisputeStatus moves an unresolved dispute to another unresolved status (e.g. evidence_requested)
+func SetDisputeStatus(disputeID int, status string) error {
+	result, err := Pool.Exec(context.Background(), `
+		UPDATE disputes SET status = $2
+		WHERE id = $1 AND status IN ('open', 'evidence_requested')
+	`, disputeID, status)
+	if err != nil {
+		return fmt.Errorf("error updating dispute %d status: %w", disputeID, err)
+	}
+	if result.RowsAffected() == 0 {
+		return fmt.Errorf("ข้อพิพาท ID %d ได้รับการตัดสินไปแล้ว", disputeID)
+	}
+	return nil
+}
+
+// SetDisputeArbiter assigns an arbiter to an unresolved dispute
+func SetDisputeArbiter(disputeID, arbiterDbID int) error {
+	result, err := Pool.Exec(context.Background(), `
+		UPDATE disputes SET arbiter_id = $2
+		WHERE id = $1 AND status IN ('open', 'evidence_requested')
+	`, disputeID, arbiterDbID)
+	if err != nil {
+		return fmt.Errorf("error assigning arbiter to dispute %d: %w", disputeID, err)
+	}
+	if result.RowsAffected() == 0 {
+		return fmt.Errorf("ข้อพิพาท ID %d ได้รับการตัดสินไปแล้ว", disputeID)
+	}
+	return nil
+}
+
+// ResolveDispute moves an unresolved dispute to resolved_paid or resolved_unpaid.
+// It fails if the dispute was already resolved so the outcome is never applied twice.
+func ResolveDispute(disputeID int, status, resolutionNote string) error {
+	if status != DisputeResolvedPaid && status != DisputeResolvedUnpaid {
+		return fmt.Errorf("invalid dispute resolution status: %s", status)
+	}
+
+	var note sql.NullString
+	if resolutionNote != "" {
+		note = sql.NullString{String: resolutionNote, Valid: true}
+	}
+
+	result, err := Pool.Exec(context.Background(), `
+		UPDATE disputes SET status = $2, resolution_note = $3, resolved_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND status IN ('open', 'evidence_requested')
+	`, disputeID, status, note)
+	if err != nil {
+		return fmt.Errorf("error resolving dispute %d: %w", disputeID, err)
+	}
+	if result.RowsAffected() == 0 {
+		return fmt.Errorf("ข้อพิพาท ID %d ได้รับการตัดสินไปแล้ว", disputeID)
+	}
+	return nil
+}
+
+// HasOpenDispute checks whether a debtor/creditor pair has an unresolved dispute
+func HasOpenDispute(debtorDbID, creditorDbID int) (bool, error) {
+	var exists bool
+	err := Pool.QueryRow(context.Background(), `
+		SELECT EXISTS (
+			SELECT 1 FROM disputes
+			WHERE debtor_id = $1 AND creditor_id = $2 AND status IN ('open', 'evidence_requested')
+		)
+	`, debtorDbID, creditorDbID).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("error checking open disputes: %w", err)
+	}
+	return exists, nil
+}
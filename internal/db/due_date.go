@@ -0,0 +1,316 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// overdueTxCondition matches an unpaid transaction t whose due date has passed
+const overdueTxCondition = `(t.already_paid = false AND t.status = 'active' AND t.due_date IS NOT NULL AND t.due_date < CURRENT_TIMESTAMP)`
+
+// Late fee rule types
+const (
+	LateFeeFlat    = "flat"    // A fixed amount per charge
+	LateFeePercent = "percent" // A percentage of the overdue transaction's amount per charge
+)
+
+// LateFeeRule is a creditor's opt-in rule for charging debtors who pay after the due date
+type LateFeeRule struct {
+	CreditorID   int     `json:"creditor_id"`
+	FeeType      string  `json:"fee_type"`      // LateFeeFlat or LateFeePercent
+	Amount       float64 `json:"amount"`        // Baht for flat fees, percent for percentage fees
+	IntervalDays int     `json:"interval_days"` // A new charge is added every IntervalDays while still overdue
+	MaxCharges   int     `json:"max_charges"`   // Most charges added for one transaction
+	Enabled      bool    `json:"enabled"`
+}
+
+// FeeFor returns the fee charged once for an overdue transaction of the given amount
+func (r LateFeeRule) FeeFor(txAmount float64) float64 {
+	if r.FeeType == LateFeePercent {
+		return math.Round(txAmount*r.Amount) / 100
+	}
+	return r.Amount
+}
+
+// LateFeeCharge is a late fee transaction added for an overdue transaction
+type LateFeeCharge struct {
+	TxID              int     `json:"tx_id"`     // Overdue transaction
+	FeeTxID           int     `json:"fee_tx_id"` // Transaction created for the fee
+	DebtorDiscordID   string  `json:"debtor_discord_id"`
+	CreditorDiscordID string  `json:"creditor_discord_id"`
+	Amount            float64 `json:"amount"`
+	ChargeNumber      int     `json:"charge_number"` // 1 for the first fee on the transaction
+}
+
+// MigrateDueDateTables creates the guild_settings and late_fee_rules tables if they don't exist
+func MigrateDueDateTables() error {
+	_, err := Pool.Exec(context.Background(), `
+	CREATE TABLE IF NOT EXISTS guild_settings (
+		guild_id TEXT PRIMARY KEY,
+		default_due_days INTEGER NOT NULL CHECK (default_due_days >= 0),
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+	);
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating guild_settings table: %w", err)
+	}
+
+	_, err = Pool.Exec(context.Background(), `
+	CREATE TABLE IF NOT EXISTS late_fee_rules (
+		creditor_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+		fee_type TEXT NOT NULL CHECK (fee_type IN ('flat', 'percent')),
+		amount NUMERIC(10, 2) NOT NULL CHECK (amount > 0),
+		interval_days INTEGER NOT NULL DEFAULT 7 CHECK (interval_days > 0),
+		max_charges INTEGER NOT NULL DEFAULT 1 CHECK (max_charges > 0),
+		enabled BOOLEAN NOT NULL DEFAULT TRUE,
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+	);
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating late_fee_rules table: %w", err)
+	}
+
+	// Apply triggers to guild_settings and late_fee_rules
+	for _, table := range []string{"guild_settings", "late_fee_rules"} {
+		_, err = Pool.Exec(context.Background(), fmt.Sprintf(`
+		DROP TRIGGER IF EXISTS update_%[1]s_modtime ON %[1]s;
+		CREATE TRIGGER update_%[1]s_modtime
+		BEFORE UPDATE ON %[1]s
+		FOR EACH ROW
+		EXECUTE FUNCTION update_modified_column();`, table))
+		if err != nil {
+			return fmt.Errorf("error applying trigger to %s: %w", table, err)
+		}
+	}
+
+	log.Println("Due date tables migrated successfully")
+	return nil
+}
+
+// GetGuildDefaultDueDays returns the guild's default number of days until a bill is due.
+// ok is false if the guild hasn't set one.
+func GetGuildDefaultDueDays(guildID string) (days int, ok bool, err error) {
+	err = Pool.QueryRow(context.Background(),
+		`SELECT default_due_days FROM guild_settings WHERE guild_id = $1`, guildID).Scan(&days)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("error querying guild settings: %w", err)
+	}
+	return days, true, nil
+}
+
+// SetGuildDefaultDueDays sets the guild's default number of days until a bill is due, 0 for no due date
+func SetGuildDefaultDueDays(guildID string, days int) error {
+	_, err := Pool.Exec(context.Background(), `
+		INSERT INTO guild_settings (guild_id, default_due_days)
+		VALUES ($1, $2)
+		ON CONFLICT (guild_id)
+		DO UPDATE SET default_due_days = EXCLUDED.default_due_days
+	`, guildID, days)
+	if err != nil {
+		return fmt.Errorf("error saving guild settings: %w", err)
+	}
+	return nil
+}
+
+// SetTransactionsDueDate sets the due date of the given transactions
+func SetTransactionsDueDate(txIDs []int, dueDate time.Time) error {
+	_, err := Pool.Exec(context.Background(),
+		`UPDATE transactions SET due_date = $2 WHERE id = ANY($1)`, txIDs, dueDate)
+	if err != nil {
+		return fmt.Errorf("error setting due date: %w", err)
+	}
+	return nil
+}
+
+// GetTransactionsDueDate returns the latest due date of the given transactions, zero if none has one
+func GetTransactionsDueDate(txIDs []int) (time.Time, error) {
+	var dueDate *time.Time
+	err := Pool.QueryRow(context.Background(),
+		`SELECT MAX(due_date) FROM transactions WHERE id = ANY($1)`, txIDs).Scan(&dueDate)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error querying due date: %w", err)
+	}
+	if dueDate == nil {
+		return time.Time{}, nil
+	}
+	return *dueDate, nil
+}
+
+// GetLateFeeRule returns the creditor's late fee rule, or nil if they never set one
+func GetLateFeeRule(creditorDbID int) (*LateFeeRule, error) {
+	rule := LateFeeRule{CreditorID: creditorDbID}
+	err := Pool.QueryRow(context.Background(), `
+		SELECT fee_type, amount, interval_days, max_charges, enabled
+		FROM late_fee_rules WHERE creditor_id = $1
+	`, creditorDbID).Scan(&rule.FeeType, &rule.Amount, &rule.IntervalDays, &rule.MaxCharges, &rule.Enabled)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error querying late fee rule: %w", err)
+	}
+	return &rule, nil
+}
+
+// SetLateFeeRule creates or replaces the creditor's late fee rule and enables it
+func SetLateFeeRule(rule LateFeeRule) error {
+	_, err := Pool.Exec(context.Background(), `
+		INSERT INTO late_fee_rules (creditor_id, fee_type, amount, interval_days, max_charges, enabled)
+		VALUES ($1, $2, $3, $4, $5, TRUE)
+		ON CONFLICT (creditor_id)
+		DO UPDATE SET fee_type = EXCLUDED.fee_type, amount = EXCLUDED.amount,
+			interval_days = EXCLUDED.interval_days, max_charges = EXCLUDED.max_charges, enabled = TRUE
+	`, rule.CreditorID, rule.FeeType, rule.Amount, rule.IntervalDays, rule.MaxCharges)
+	if err != nil {
+		return fmt.Errorf("error saving late fee rule: %w", err)
+	}
+	return nil
+}
+
+// DisableLateFeeRule stops charging late fees for the creditor; fees already charged are kept
+func DisableLateFeeRule(creditorDbID int) error {
+	_, err := Pool.Exec(context.Background(),
+		`UPDATE late_fee_rules SET enabled = FALSE WHERE creditor_id = $1`, creditorDbID)
+	if err != nil {
+		return fmt.Errorf("error disabling late fee rule: %w", err)
+	}
+	return nil
+}
+
+// lateFeeChargeableCondition matches an overdue transaction t that may be charged: not a late fee itself,
+// not disputed and without a slip waiting for review, since the debtor may already have paid it
+const lateFeeChargeableCondition = overdueTxCondition + ` AND t.late_fee_for_tx_id IS NULL
+	AND NOT ` + openDisputeForTxCondition + `
+	AND NOT ` + pendingSlipReviewForTxCondition
+
+// ChargeLateFees adds the late fee transactions due on every overdue transaction whose creditor has
+// an enabled rule. A transaction gets its first charge once overdue and another every IntervalDays,
+// up to MaxCharges. Late fees are never charged on late fees, disputed transactions or transactions
+// whose slip is waiting for review.
+func ChargeLateFees() ([]LateFeeCharge, error) {
+	rows, err := Pool.Query(context.Background(), `
+		SELECT t.id
+		FROM transactions t
+		JOIN late_fee_rules r ON r.creditor_id = t.payee_id AND r.enabled
+		WHERE `+lateFeeChargeableCondition+`
+		ORDER BY t.due_date, t.id`)
+	if err != nil {
+		return nil, fmt.Errorf("error querying overdue transactions: %w", err)
+	}
+	var txIDs []int
+	for rows.Next() {
+		var txID int
+		if err := rows.Scan(&txID); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error scanning overdue transaction: %w", err)
+		}
+		txIDs = append(txIDs, txID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating overdue transactions: %w", err)
+	}
+
+	var charges []LateFeeCharge
+	for _, txID := range txIDs {
+		txCharges, err := chargeLateFeesForTx(txID)
+		if err != nil {
+			log.Printf("Failed to charge late fees for transaction %d: %v", txID, err)
+			continue
+		}
+		charges = append(charges, txCharges...)
+	}
+	return charges, nil
+}
+
+// chargeLateFeesForTx adds the missing late fee charges for one overdue transaction.
+// The transaction row is locked so overlapping runs can't charge the same fee twice.
+func chargeLateFeesForTx(txID int) ([]LateFeeCharge, error) {
+	tx, err := Pool.Begin(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("ไม่สามารถเริ่ม Transaction ได้: %w", err)
+	}
+	defer tx.Rollback(context.Background()) // Rollback if commit isn't called
+
+	var payerID, payeeID int
+	var outstanding float64
+	var dueDate time.Time
+	var debtorDiscordID, creditorDiscordID string
+	var rule LateFeeRule
+	err = tx.QueryRow(context.Background(), `
+		SELECT t.payer_id, t.payee_id, t.amount - t.paid_amount, t.due_date, payer.discord_id, payee.discord_id,
+			r.fee_type, r.amount, r.interval_days, r.max_charges
+		FROM transactions t
+		JOIN late_fee_rules r ON r.creditor_id = t.payee_id AND r.enabled
+		JOIN users payer ON t.payer_id = payer.id
+		JOIN users payee ON t.payee_id = payee.id
+		WHERE t.id = $1 AND `+lateFeeChargeableCondition+`
+		FOR UPDATE OF t`, txID).Scan(&payerID, &payeeID, &outstanding, &dueDate, &debtorDiscordID, &creditorDiscordID,
+		&rule.FeeType, &rule.Amount, &rule.IntervalDays, &rule.MaxCharges)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil // Paid, disputed or rule disabled since the candidates were listed
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error loading overdue transaction: %w", err)
+	}
+
+	var charged int
+	err = tx.QueryRow(context.Background(),
+		`SELECT COUNT(*) FROM transactions WHERE late_fee_for_tx_id = $1`, txID).Scan(&charged)
+	if err != nil {
+		return nil, fmt.Errorf("error counting late fees: %w", err)
+	}
+
+	daysOverdue := int(time.Since(dueDate).Hours() / 24)
+	due := daysOverdue/rule.IntervalDays + 1
+	if due > rule.MaxCharges {
+		due = rule.MaxCharges
+	}
+	// Percentage fees apply to what is still owed, not to the part already paid
+	fee := rule.FeeFor(outstanding)
+	if charged >= due || fee < 0.01 {
+		return nil, nil
+	}
+
+	var charges []LateFeeCharge
+	for n := charged + 1; n <= due; n++ {
+		charge := LateFeeCharge{TxID: txID, DebtorDiscordID: debtorDiscordID, CreditorDiscordID: creditorDiscordID, Amount: fee, ChargeNumber: n}
+		err = tx.QueryRow(context.Background(), `
+			INSERT INTO transactions (payer_id, payee_id, amount, description, late_fee_for_tx_id)
+			VALUES ($1, $2, $3, $4, $5)
+			RETURNING id
+		`, payerID, payeeID, fee, fmt.Sprintf("ค่าปรับชำระล่าช้า ครั้งที่ %d ของ TxID %d", n, txID), txID).Scan(&charge.FeeTxID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create late fee transaction: %w", err)
+		}
+		charges = append(charges, charge)
+	}
+
+	_, err = tx.Exec(context.Background(), `
+		INSERT INTO user_debts (debtor_id, creditor_id, amount, created_at, updated_at)
+		VALUES ($1, $2, $3, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+		ON CONFLICT (debtor_id, creditor_id)
+		DO UPDATE SET amount = user_debts.amount + EXCLUDED.amount, updated_at = CURRENT_TIMESTAMP
+	`, payerID, payeeID, fee*float64(len(charges)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to update user_debts: %w", err)
+	}
+
+	if err = tx.Commit(context.Background()); err != nil {
+		return nil, fmt.Errorf("ไม่สามารถ Commit Transaction ได้: %w", err)
+	}
+
+	log.Printf("Charged %d late fee(s) of %.2f on transaction %d (debtor %d, creditor %d)", len(charges), fee, txID, payerID, payeeID)
+	return charges, nil
+}
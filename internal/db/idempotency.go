@@ -0,0 +1,94 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Kinds of processed events. Each kind has its own ID space.
+const (
+	EventMessage     = "message"     // A Discord message that ran a command or slip verification
+	EventInteraction = "interaction" // A Discord button, select menu or modal interaction
+)
+
+// ErrDuplicateSource is returned when a bill or transaction was already created from the same source message
+var ErrDuplicateSource = errors.New("already created from this source message")
+
+// MigrateIdempotencyTables creates the processed events table and records the source message of transactions
+func MigrateIdempotencyTables() error {
+	_, err := Pool.Exec(context.Background(), `
+	CREATE TABLE IF NOT EXISTS processed_events (
+		kind TEXT NOT NULL,
+		event_id TEXT NOT NULL,
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (kind, event_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_processed_events_created_at ON processed_events(created_at);
+
+	ALTER TABLE transactions
+	ADD COLUMN IF NOT EXISTS source_message_id TEXT;
+	-- Bills own many transactions per message, their uniqueness is on bills.message_id
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_transactions_source_message_id ON transactions(source_message_id)
+		WHERE source_message_id IS NOT NULL AND bill_id IS NULL;
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating idempotency tables: %w", err)
+	}
+
+	log.Println("Idempotency tables migrated successfully")
+	return nil
+}
+
+// ClaimEvent records that an event is being processed. It returns false if the event was
+// claimed before, e.g. a message replayed after a gateway reconnect or seen by a second bot instance.
+func ClaimEvent(kind, eventID string) (bool, error) {
+	result, err := Pool.Exec(context.Background(), `
+		INSERT INTO processed_events (kind, event_id) VALUES ($1, $2)
+		ON CONFLICT (kind, event_id) DO NOTHING
+	`, kind, eventID)
+	if err != nil {
+		return false, fmt.Errorf("error claiming %s event %s: %w", kind, eventID, err)
+	}
+	return result.RowsAffected() == 1, nil
+}
+
+// DeleteProcessedEventsOlderThan forgets processed events that are too old to be replayed
+func DeleteProcessedEventsOlderThan(age time.Duration) (int64, error) {
+	result, err := Pool.Exec(context.Background(),
+		`DELETE FROM processed_events WHERE created_at < $1`, time.Now().Add(-age))
+	if err != nil {
+		return 0, fmt.Errorf("error deleting old processed events: %w", err)
+	}
+	return result.RowsAffected(), nil
+}
+
+// isUniqueViolation reports whether err is a unique constraint violation
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+// CreateSourcedTransaction creates a transaction recorded from a Discord message, pending if it waits for the payer to accept it.
+// Returns ErrDuplicateSource if that message already created a transaction.
+func CreateSourcedTransaction(payerID, payeeID int, amount float64, description, sourceMessageID string, pending bool) (int, error) {
+	status := TxStatusActive
+	if pending {
+		status = TxStatusPending
+	}
+	var txID int
+	err := Pool.QueryRow(context.Background(),
+		`INSERT INTO transactions (payer_id, payee_id, amount, description, source_message_id, status) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		payerID, payeeID, amount, description, sourceMessageID, status).Scan(&txID)
+	if isUniqueViolation(err) {
+		return 0, ErrDuplicateSource
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to create transaction: %w", err)
+	}
+	return txID, nil
+}
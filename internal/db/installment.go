@@ -0,0 +1,424 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Installment plan statuses
+const (
+	InstallmentPlanActive  = "active"   // Installments are reminded as they come due
+	InstallmentPlanPaidOff = "paid_off" // The debtor chose to pay everything left at once
+)
+
+// InstallmentPlan splits one debtor's share of a purchase into dated installments,
+// each its own transaction
+type InstallmentPlan struct {
+	ID                int        `json:"id"`
+	CreditorID        int        `json:"creditor_id"`
+	DebtorID          int        `json:"debtor_id"`
+	CreditorDiscordID string     `json:"creditor_discord_id"`
+	DebtorDiscordID   string     `json:"debtor_discord_id"`
+	Description       string     `json:"description"`
+	TotalAmount       float64    `json:"total_amount"`
+	InstallmentCount  int        `json:"installment_count"`
+	IntervalDays      int        `json:"interval_days"` // 0 for monthly installments
+	Status            string     `json:"status"`
+	ChannelID         string     `json:"channel_id"` // Channel reminders are posted to
+	CreatedAt         time.Time  `json:"created_at"`
+	PaidCount         int        `json:"paid_count"`    // Installments fully paid
+	PaidAmount        float64    `json:"paid_amount"`   // Paid so far, including partial payments
+	NextDueDate       *time.Time `json:"next_due_date"` // Due date of the first unpaid installment, nil when complete
+}
+
+// Completed reports whether every installment has been paid
+func (p *InstallmentPlan) Completed() bool {
+	return p.PaidCount >= p.InstallmentCount
+}
+
+// Installment is one dated installment of a plan
+type Installment struct {
+	TxID       int       `json:"tx_id"`
+	Number     int       `json:"number"`
+	Amount     float64   `json:"amount"`
+	PaidAmount float64   `json:"paid_amount"`
+	DueDate    time.Time `json:"due_date"`
+	Paid       bool      `json:"paid"`
+}
+
+// Outstanding returns what is left to pay on the installment
+func (i Installment) Outstanding() float64 {
+	if i.Paid {
+		return 0
+	}
+	return i.Amount - i.PaidAmount
+}
+
+// InstallmentReminder is an installment that has come due and whose debtor should be reminded
+type InstallmentReminder struct {
+	Installment
+	PlanID            int    `json:"plan_id"`
+	InstallmentCount  int    `json:"installment_count"`
+	Description       string `json:"description"`
+	CreditorID        int    `json:"creditor_id"`
+	CreditorDiscordID string `json:"creditor_discord_id"`
+	DebtorDiscordID   string `json:"debtor_discord_id"`
+	ChannelID         string `json:"channel_id"`
+}
+
+// MigrateInstallmentTables creates the installment_plans table and links transactions to it
+func MigrateInstallmentTables() error {
+	_, err := Pool.Exec(context.Background(), `
+	CREATE TABLE IF NOT EXISTS installment_plans (
+		id SERIAL PRIMARY KEY,
+		creditor_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		debtor_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		description TEXT NOT NULL,
+		total_amount NUMERIC(10, 2) NOT NULL,
+		installment_count INTEGER NOT NULL CHECK (installment_count > 0),
+		interval_days INTEGER NOT NULL DEFAULT 0,
+		status TEXT NOT NULL DEFAULT 'active',
+		channel_id TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_installment_plans_debtor_id ON installment_plans(debtor_id);
+	CREATE INDEX IF NOT EXISTS idx_installment_plans_creditor_id ON installment_plans(creditor_id);
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating installment_plans table: %w", err)
+	}
+
+	_, err = Pool.Exec(context.Background(), `
+	ALTER TABLE transactions
+	ADD COLUMN IF NOT EXISTS installment_plan_id INTEGER REFERENCES installment_plans(id) ON DELETE SET NULL,
+	ADD COLUMN IF NOT EXISTS installment_number INTEGER,
+	ADD COLUMN IF NOT EXISTS installment_reminded_at TIMESTAMPTZ;
+	CREATE INDEX IF NOT EXISTS idx_transactions_installment_plan_id ON transactions(installment_plan_id);
+	`)
+	if err != nil {
+		return fmt.Errorf("error adding installment columns to transactions: %w", err)
+	}
+
+	// Apply trigger to installment_plans
+	plansTrigger := `
+	DROP TRIGGER IF EXISTS update_installment_plans_modtime ON installment_plans;
+	CREATE TRIGGER update_installment_plans_modtime
+	BEFORE UPDATE ON installment_plans
+	FOR EACH ROW
+	EXECUTE FUNCTION update_modified_column();`
+	_, err = Pool.Exec(context.Background(), plansTrigger)
+	if err != nil {
+		return fmt.Errorf("error applying trigger to installment_plans: %w", err)
+	}
+
+	log.Println("Installment tables migrated successfully")
+	return nil
+}
+
+// InstallmentDueDate returns the due date of installment number n (1-based) of a plan starting at start
+func InstallmentDueDate(start time.Time, intervalDays, n int) time.Time {
+	if intervalDays <= 0 {
+		return start.AddDate(0, n-1, 0)
+	}
+	return start.AddDate(0, 0, intervalDays*(n-1))
+}
+
+// ConvertToInstallmentPlan splits what is left of an unpaid transaction owed to the creditor into count
+// installments, the first due at start. Each installment is created as a transaction with its own due date and
+// replaces the original transaction, which keeps only its paid part (or is marked converted if nothing was paid),
+// so user_debts doesn't change. The last installment absorbs rounding so the installments add up to the debt.
+func ConvertToInstallmentPlan(txID, creditorDbID, count, intervalDays int, start time.Time, channelID string) (*InstallmentPlan, []Installment, error) {
+	tx, err := Pool.Begin(context.Background())
+	if err != nil {
+		return nil, nil, fmt.Errorf("ไม่สามารถเริ่ม Transaction ได้: %w", err)
+	}
+	defer tx.Rollback(context.Background()) // Rollback if commit isn't called
+
+	var debtorDbID int
+	var amount, paidAmount float64
+	var description, status string
+	var alreadyPaid, inPlan, held, inOpenTrip bool
+	err = tx.QueryRow(context.Background(), `
+		SELECT t.payer_id, t.amount, t.paid_amount, COALESCE(t.description, ''), t.status, t.already_paid,
+			t.installment_plan_id IS NOT NULL,
+			`+openDisputeForTxCondition+` OR `+pendingSlipReviewForTxCondition+`,
+			EXISTS (SELECT 1 FROM trips tr WHERE tr.id = t.trip_id AND tr.status = $3)
+		FROM transactions t
+		WHERE t.id = $1 AND t.payee_id = $2
+		FOR UPDATE OF t`, txID, creditorDbID, TripOpen).Scan(&debtorDbID, &amount, &paidAmount, &description, &status,
+		&alreadyPaid, &inPlan, &held, &inOpenTrip)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil, fmt.Errorf("ไม่พบรายการ TxID %d ที่คุณเป็นเจ้าหนี้", txID)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("error loading transaction %d: %w", txID, err)
+	}
+	switch {
+	case status != TxStatusActive || alreadyPaid:
+		return nil, nil, fmt.Errorf("TxID %d ไม่ได้ค้างชำระอยู่", txID)
+	case inPlan:
+		return nil, nil, fmt.Errorf("TxID %d เป็นงวดของแผนผ่อนอยู่แล้ว", txID)
+	case held:
+		return nil, nil, fmt.Errorf("TxID %d มีข้อพิพาทหรือสลิปที่รอตรวจสอบอยู่", txID)
+	case inOpenTrip:
+		return nil, nil, fmt.Errorf("TxID %d อยู่ในทริปที่ยังไม่ปิด ซึ่งจะสรุปยอดเมื่อปิดทริป", txID)
+	}
+	outstanding := math.Round((amount-paidAmount)*100) / 100
+	if outstanding/float64(count) < 0.01 {
+		return nil, nil, fmt.Errorf("จำนวนเงินต่องวดน้อยเกินไป")
+	}
+
+	// The original transaction keeps its paid part, the installments take over the rest
+	if paidAmount > 0 {
+		_, err = tx.Exec(context.Background(),
+			`UPDATE transactions SET amount = paid_amount, already_paid = TRUE, paid_at = CURRENT_TIMESTAMP WHERE id = $1`, txID)
+	} else {
+		_, err = tx.Exec(context.Background(),
+			`UPDATE transactions SET status = $2 WHERE id = $1`, txID, TxStatusConverted)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("error converting transaction %d: %w", txID, err)
+	}
+
+	if description == "" {
+		description = fmt.Sprintf("TxID %d", txID)
+	}
+	plan := &InstallmentPlan{
+		CreditorID:       creditorDbID,
+		DebtorID:         debtorDbID,
+		Description:      description,
+		TotalAmount:      outstanding,
+		InstallmentCount: count,
+		IntervalDays:     intervalDays,
+		Status:           InstallmentPlanActive,
+		ChannelID:        channelID,
+	}
+	err = tx.QueryRow(context.Background(), `
+		INSERT INTO installment_plans (creditor_id, debtor_id, description, total_amount, installment_count, interval_days, channel_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at
+	`, creditorDbID, debtorDbID, description, outstanding, count, intervalDays, channelID).Scan(&plan.ID, &plan.CreatedAt)
+	if err != nil {
+		return nil, nil, fmt.Errorf("เกิดข้อผิดพลาดขณะสร้างแผนผ่อนชำระ: %w", err)
+	}
+
+	perInstallment := math.Floor(outstanding/float64(count)*100) / 100
+	installments := make([]Installment, 0, count)
+	for n := 1; n <= count; n++ {
+		installment := Installment{Number: n, Amount: perInstallment, DueDate: InstallmentDueDate(start, intervalDays, n)}
+		if n == count {
+			installment.Amount = math.Round((outstanding-perInstallment*float64(count-1))*100) / 100
+		}
+		// The first installment's QR is sent with the plan, so it needs no reminder
+		err = tx.QueryRow(context.Background(), `
+			INSERT INTO transactions (payer_id, payee_id, amount, description, due_date, installment_plan_id, installment_number,
+				installment_reminded_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, CASE WHEN $7 = 1 THEN CURRENT_TIMESTAMP END)
+			RETURNING id
+		`, debtorDbID, creditorDbID, installment.Amount,
+			fmt.Sprintf("%s (งวดที่ %d/%d แผนผ่อน #%d)", description, n, count, plan.ID),
+			installment.DueDate, plan.ID, n).Scan(&installment.TxID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("เกิดข้อผิดพลาดขณะสร้างงวดที่ %d: %w", n, err)
+		}
+		installments = append(installments, installment)
+	}
+
+	if err = tx.Commit(context.Background()); err != nil {
+		return nil, nil, fmt.Errorf("ไม่สามารถ Commit Transaction ได้: %w", err)
+	}
+
+	next := installments[0].DueDate
+	plan.NextDueDate = &next
+	log.Printf("Installment plan #%d created from TxID %d: Debtor %d, Creditor %d, %.2f in %d installments", plan.ID, txID, debtorDbID, creditorDbID, outstanding, count)
+	return plan, installments, nil
+}
+
+// installmentPlanSelect selects a plan p with its progress computed from its transactions
+const installmentPlanSelect = `
+	SELECT p.id, p.creditor_id, p.debtor_id, c.discord_id, d.discord_id, p.description, p.total_amount,
+		p.installment_count, p.interval_days, p.status, p.channel_id, p.created_at,
+		COUNT(t.id) FILTER (WHERE t.already_paid),
+		COALESCE(SUM(CASE WHEN t.already_paid THEN t.amount ELSE t.paid_amount END), 0),
+		MIN(t.due_date) FILTER (WHERE NOT t.already_paid)
+	FROM installment_plans p
+	JOIN users c ON p.creditor_id = c.id
+	JOIN users d ON p.debtor_id = d.id
+	LEFT JOIN transactions t ON t.installment_plan_id = p.id`
+
+// scanInstallmentPlan reads a row produced by installmentPlanSelect
+func scanInstallmentPlan(row pgx.Row) (*InstallmentPlan, error) {
+	var plan InstallmentPlan
+	err := row.Scan(&plan.ID, &plan.CreditorID, &plan.DebtorID, &plan.CreditorDiscordID, &plan.DebtorDiscordID,
+		&plan.Description, &plan.TotalAmount, &plan.InstallmentCount, &plan.IntervalDays, &plan.Status,
+		&plan.ChannelID, &plan.CreatedAt, &plan.PaidCount, &plan.PaidAmount, &plan.NextDueDate)
+	if err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
+
+// GetInstallmentPlan returns a plan with its progress
+func GetInstallmentPlan(planID int) (*InstallmentPlan, error) {
+	plan, err := scanInstallmentPlan(Pool.QueryRow(context.Background(),
+		installmentPlanSelect+` WHERE p.id = $1 GROUP BY p.id, c.discord_id, d.discord_id`, planID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("ไม่พบแผนผ่อนชำระ #%d", planID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error querying installment plan: %w", err)
+	}
+	return plan, nil
+}
+
+// GetUserInstallmentPlans returns the unfinished plans where the user is the debtor or the creditor
+func GetUserInstallmentPlans(userDbID int) ([]InstallmentPlan, error) {
+	rows, err := Pool.Query(context.Background(), installmentPlanSelect+`
+		WHERE p.debtor_id = $1 OR p.creditor_id = $1
+		GROUP BY p.id, c.discord_id, d.discord_id
+		HAVING COUNT(t.id) FILTER (WHERE NOT t.already_paid) > 0
+		ORDER BY p.created_at DESC`, userDbID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying installment plans: %w", err)
+	}
+	defer rows.Close()
+
+	var plans []InstallmentPlan
+	for rows.Next() {
+		plan, err := scanInstallmentPlan(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning installment plan: %w", err)
+		}
+		plans = append(plans, *plan)
+	}
+	return plans, rows.Err()
+}
+
+// GetInstallments returns a plan's installments in order
+func GetInstallments(planID int) ([]Installment, error) {
+	rows, err := Pool.Query(context.Background(), `
+		SELECT id, installment_number, amount, paid_amount, due_date, already_paid
+		FROM transactions
+		WHERE installment_plan_id = $1
+		ORDER BY installment_number`, planID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying installments: %w", err)
+	}
+	defer rows.Close()
+
+	var installments []Installment
+	for rows.Next() {
+		var installment Installment
+		if err := rows.Scan(&installment.TxID, &installment.Number, &installment.Amount, &installment.PaidAmount,
+			&installment.DueDate, &installment.Paid); err != nil {
+			return nil, fmt.Errorf("error scanning installment: %w", err)
+		}
+		installments = append(installments, installment)
+	}
+	return installments, rows.Err()
+}
+
+// PayOffInstallmentPlan cancels the rest of a plan's schedule: every unpaid installment becomes due
+// at dueDate and no further reminders are sent. Returns the installments left to pay.
+func PayOffInstallmentPlan(planID int, dueDate time.Time) ([]Installment, error) {
+	tx, err := Pool.Begin(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("ไม่สามารถเริ่ม Transaction ได้: %w", err)
+	}
+	defer tx.Rollback(context.Background()) // Rollback if commit isn't called
+
+	tag, err := tx.Exec(context.Background(),
+		`UPDATE installment_plans SET status = $2 WHERE id = $1 AND status = $3`,
+		planID, InstallmentPlanPaidOff, InstallmentPlanActive)
+	if err != nil {
+		return nil, fmt.Errorf("error updating installment plan: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, fmt.Errorf("แผนผ่อนชำระ #%d ไม่ได้อยู่ในสถานะผ่อนชำระ", planID)
+	}
+
+	rows, err := tx.Query(context.Background(), `
+		UPDATE transactions
+		SET due_date = LEAST(due_date, $2), installment_reminded_at = COALESCE(installment_reminded_at, CURRENT_TIMESTAMP)
+		WHERE installment_plan_id = $1 AND already_paid = false
+		RETURNING id, installment_number, amount, paid_amount, due_date, already_paid`, planID, dueDate)
+	if err != nil {
+		return nil, fmt.Errorf("error rescheduling installments: %w", err)
+	}
+	var remaining []Installment
+	for rows.Next() {
+		var installment Installment
+		if err := rows.Scan(&installment.TxID, &installment.Number, &installment.Amount, &installment.PaidAmount,
+			&installment.DueDate, &installment.Paid); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error scanning installment: %w", err)
+		}
+		remaining = append(remaining, installment)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error rescheduling installments: %w", err)
+	}
+
+	if err = tx.Commit(context.Background()); err != nil {
+		return nil, fmt.Errorf("ไม่สามารถ Commit Transaction ได้: %w", err)
+	}
+
+	log.Printf("Installment plan #%d paid off early, %d installments left", planID, len(remaining))
+	return remaining, nil
+}
+
+// ReleaseInstallmentReminder clears the reminder mark of an installment whose reminder could not be sent,
+// so the next run claims it again
+func ReleaseInstallmentReminder(txID int) error {
+	_, err := Pool.Exec(context.Background(),
+		`UPDATE transactions SET installment_reminded_at = NULL WHERE id = $1`, txID)
+	if err != nil {
+		return fmt.Errorf("error releasing installment reminder of TxID %d: %w", txID, err)
+	}
+	return nil
+}
+
+// ClaimDueInstallmentReminders returns the unpaid installments of active plans that are due within lead
+// and haven't been reminded yet, marking them reminded so each one is only claimed once
+func ClaimDueInstallmentReminders(lead time.Duration) ([]InstallmentReminder, error) {
+	rows, err := Pool.Query(context.Background(), `
+		WITH due AS (
+			UPDATE transactions t
+			SET installment_reminded_at = CURRENT_TIMESTAMP
+			FROM installment_plans p
+			WHERE t.installment_plan_id = p.id AND p.status = $1
+			AND t.already_paid = false AND t.installment_reminded_at IS NULL
+			AND t.due_date <= CURRENT_TIMESTAMP + $2::interval
+			RETURNING t.id, t.installment_number, t.amount, t.paid_amount, t.due_date,
+				p.id AS plan_id, p.installment_count, p.description, p.creditor_id, p.debtor_id, p.channel_id
+		)
+		SELECT due.id, due.installment_number, due.amount, due.paid_amount, due.due_date,
+			due.plan_id, due.installment_count, due.description, due.creditor_id, c.discord_id, d.discord_id, due.channel_id
+		FROM due
+		JOIN users c ON due.creditor_id = c.id
+		JOIN users d ON due.debtor_id = d.id
+		ORDER BY due.due_date, due.id`, InstallmentPlanActive, fmt.Sprintf("%d seconds", int(lead.Seconds())))
+	if err != nil {
+		return nil, fmt.Errorf("error claiming installment reminders: %w", err)
+	}
+	defer rows.Close()
+
+	var reminders []InstallmentReminder
+	for rows.Next() {
+		var r InstallmentReminder
+		if err := rows.Scan(&r.TxID, &r.Number, &r.Amount, &r.PaidAmount, &r.DueDate,
+			&r.PlanID, &r.InstallmentCount, &r.Description, &r.CreditorID, &r.CreditorDiscordID, &r.DebtorDiscordID, &r.ChannelID); err != nil {
+			return nil, fmt.Errorf("error scanning installment reminder: %w", err)
+		}
+		reminders = append(reminders, r)
+	}
+	return reminders, rows.Err()
+}
@@ -0,0 +1,174 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// InteractionStateIDLength is the length of the opaque ID appended to component custom IDs
+const InteractionStateIDLength = 16
+
+// InteractionState holds the server-side data behind a Discord component (button, select menu or modal).
+// Component custom IDs only carry "<prefix><state ID>", so they stay short and can't be forged.
+type InteractionState struct {
+	ID             string     `json:"id"`
+	Prefixes       []string   `json:"prefixes"`         // Component prefixes allowed to use this state
+	OwnerDiscordID string     `json:"owner_discord_id"` // User the component was created for
+	AllowedActors  []string   `json:"allowed_actors"`   // Users allowed to use the component, empty means anyone
+	Payload        []byte     `json:"payload"`
+	SingleUse      bool       `json:"single_use"`
+	ExpiresAt      time.Time  `json:"expires_at"`
+	ConsumedAt     *time.Time `json:"consumed_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// MigrateInteractionStateTables creates the interaction_states table if it doesn't exist
+func MigrateInteractionStateTables() error {
+	_, err := Pool.Exec(context.Background(), `
+	CREATE TABLE IF NOT EXISTS interaction_states (
+		id VARCHAR(32) PRIMARY KEY,
+		prefixes TEXT[] NOT NULL,
+		owner_discord_id VARCHAR(50) NOT NULL DEFAULT '',
+		allowed_actors TEXT[] NOT NULL DEFAULT '{}',
+		payload JSONB NOT NULL DEFAULT '{}',
+		single_use BOOLEAN NOT NULL DEFAULT FALSE,
+		expires_at TIMESTAMPTZ NOT NULL,
+		consumed_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_interaction_states_expires_at ON interaction_states(expires_at);
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating interaction_states table: %w", err)
+	}
+
+	log.Println("Interaction state tables migrated successfully")
+	return nil
+}
+
+// newInteractionStateID generates a random opaque state ID
+func newInteractionStateID() (string, error) {
+	buf := make([]byte, InteractionStateIDLength/2)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// CreateInteractionState stores the state behind one or more components and returns its ID
+func CreateInteractionState(prefixes []string, ownerDiscordID string, allowedActors []string, payload interface{}, singleUse bool, ttl time.Duration) (string, error) {
+	stateID, err := newInteractionStateID()
+	if err != nil {
+		return "", fmt.Errorf("error generating interaction state ID: %w", err)
+	}
+
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("error encoding interaction state payload: %w", err)
+	}
+	if allowedActors == nil {
+		allowedActors = []string{}
+	}
+
+	_, err = Pool.Exec(context.Background(), `
+		INSERT INTO interaction_states (id, prefixes, owner_discord_id, allowed_actors, payload, single_use, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, stateID, prefixes, ownerDiscordID, allowedActors, payloadJSON, singleUse, time.Now().Add(ttl))
+	if err != nil {
+		return "", fmt.Errorf("error creating interaction state: %w", err)
+	}
+	return stateID, nil
+}
+
+// GetInteractionState retrieves an interaction state by ID
+func GetInteractionState(stateID string) (*InteractionState, error) {
+	var state InteractionState
+	err := Pool.QueryRow(context.Background(), `
+		SELECT id, prefixes, owner_discord_id, allowed_actors, payload::text, single_use, expires_at, consumed_at, created_at
+		FROM interaction_states
+		WHERE id = $1
+	`, stateID).Scan(
+		&state.ID, &state.Prefixes, &state.OwnerDiscordID, &state.AllowedActors, &state.Payload,
+		&state.SingleUse, &state.ExpiresAt, &state.ConsumedAt, &state.CreatedAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error getting interaction state %s: %w", stateID, err)
+	}
+	return &state, nil
+}
+
+// ConsumeInteractionState marks a single-use state as used.
+// It fails if the state was already consumed, so concurrent clicks are only processed once.
+func ConsumeInteractionState(stateID string) error {
+	result, err := Pool.Exec(context.Background(), `
+		UPDATE interaction_states SET consumed_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND consumed_at IS NULL
+	`, stateID)
+	if err != nil {
+		return fmt.Errorf("error consuming interaction state %s: %w", stateID, err)
+	}
+	if result.RowsAffected() == 0 {
+		return fmt.Errorf("interaction state %s was already used", stateID)
+	}
+	return nil
+}
+
+// ReleaseInteractionState clears the consumption of a single-use state,
+// so its component can be used again after the action it started failed
+func ReleaseInteractionState(stateID string) error {
+	_, err := Pool.Exec(context.Background(), `
+		UPDATE interaction_states SET consumed_at = NULL
+		WHERE id = $1
+	`, stateID)
+	if err != nil {
+		return fmt.Errorf("error releasing interaction state %s: %w", stateID, err)
+	}
+	return nil
+}
+
+// DeleteExpiredInteractionStates removes interaction states that expired more than a day ago
+func DeleteExpiredInteractionStates() (int64, error) {
+	result, err := Pool.Exec(context.Background(), `
+		DELETE FROM interaction_states WHERE expires_at < NOW() - INTERVAL '1 day'
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting expired interaction states: %w", err)
+	}
+	return result.RowsAffected(), nil
+}
+
+// HasPrefix reports whether the state may be used by components with the given prefix
+func (st *InteractionState) HasPrefix(prefix string) bool {
+	for _, p := range st.Prefixes {
+		if p == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// CanAct reports whether the user may use components backed by this state
+func (st *InteractionState) CanAct(userDiscordID string) bool {
+	if len(st.AllowedActors) == 0 {
+		return true
+	}
+	for _, actor := range st.AllowedActors {
+		if actor == userDiscordID {
+			return true
+		}
+	}
+	return false
+}
+
+// DecodePayload unmarshals the state payload into v
+func (st *InteractionState) DecodePayload(v interface{}) error {
+	if err := json.Unmarshal(st.Payload, v); err != nil {
+		return fmt.Errorf("error decoding interaction state %s payload: %w", st.ID, err)
+	}
+	return nil
+}
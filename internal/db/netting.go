@@ -0,0 +1,149 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+// DebtNetting is a ledger entry offsetting two users' debts to each other
+type DebtNetting struct {
+	ID          int                `json:"id"`
+	UserAID     int                `json:"user_a_id"`
+	UserBID     int                `json:"user_b_id"`
+	Amount      float64            `json:"amount"`        // Amount cancelled in each direction
+	UserATxIDs  []int              `json:"user_a_tx_ids"` // Transactions paid by A to B that the netting covered
+	UserBTxIDs  []int              `json:"user_b_tx_ids"` // Transactions paid by B to A that the netting covered
+	UserADebt   *PaymentAllocation `json:"-"`             // How the netting was applied to A's transactions
+	UserBDebt   *PaymentAllocation `json:"-"`             // How the netting was applied to B's transactions
+	TriggeredBy string             `json:"triggered_by"`  // Discord ID of the user who asked, or "automatic"
+	CreatedAt   time.Time          `json:"created_at"`
+}
+
+// MigrateNettingTables creates the debt_nettings table if it doesn't exist
+func MigrateNettingTables() error {
+	_, err := Pool.Exec(context.Background(), `
+	CREATE TABLE IF NOT EXISTS debt_nettings (
+		id SERIAL PRIMARY KEY,
+		user_a_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		user_b_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		amount NUMERIC(10, 2) NOT NULL,
+		user_a_tx_ids INTEGER[] NOT NULL DEFAULT '{}',
+		user_b_tx_ids INTEGER[] NOT NULL DEFAULT '{}',
+		triggered_by TEXT NOT NULL,
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_debt_nettings_users ON debt_nettings(user_a_id, user_b_id);
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating debt_nettings table: %w", err)
+	}
+
+	log.Println("Netting tables migrated successfully")
+	return nil
+}
+
+// NetMutualDebts offsets what two users owe each other. The smaller of the two outstanding
+// balances is applied to the unpaid transactions in both directions, oldest first, so only
+// the difference stays payable. Disputed transactions and transactions with a slip under review
+// are left out. Returns nil if they don't both owe each other.
+func NetMutualDebts(userADbID, userBDbID int, triggeredBy string) (*DebtNetting, error) {
+	if userADbID == userBDbID {
+		return nil, fmt.Errorf("ไม่สามารถหักกลบหนี้กับตัวเองได้")
+	}
+
+	tx, err := Pool.Begin(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("ไม่สามารถเริ่ม Transaction ได้: %w", err)
+	}
+	defer tx.Rollback(context.Background()) // Rollback if commit isn't called
+
+	// Lock both directions in a fixed order so concurrent nettings of the same pair can't deadlock.
+	// Disputed transactions and transactions with a slip under review may already be paid, so they aren't netted.
+	rows, err := tx.Query(context.Background(), `
+		SELECT t.id, t.payer_id, t.amount - t.paid_amount
+		FROM transactions t
+		WHERE ((t.payer_id = $1 AND t.payee_id = $2) OR (t.payer_id = $2 AND t.payee_id = $1)) AND t.already_paid = false AND t.status = 'active'
+		AND NOT `+openDisputeForTxCondition+`
+		AND NOT `+pendingSlipReviewForTxCondition+`
+		ORDER BY t.id
+		FOR UPDATE OF t`, userADbID, userBDbID)
+	if err != nil {
+		return nil, fmt.Errorf("เกิดข้อผิดพลาดขณะดึงรายการที่ค้างชำระ: %w", err)
+	}
+	var owedByA, owedByB float64
+	var txIDsByA, txIDsByB []int
+	for rows.Next() {
+		var txID, payerID int
+		var outstanding float64
+		if err := rows.Scan(&txID, &payerID, &outstanding); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("เกิดข้อผิดพลาดขณะอ่านรายการที่ค้างชำระ: %w", err)
+		}
+		if payerID == userADbID {
+			owedByA += outstanding
+			txIDsByA = append(txIDsByA, txID)
+		} else {
+			owedByB += outstanding
+			txIDsByB = append(txIDsByB, txID)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("เกิดข้อผิดพลาดขณะอ่านรายการที่ค้างชำระ: %w", err)
+	}
+
+	amount := math.Round(math.Min(owedByA, owedByB)*100) / 100
+	if amount <= 0.009 {
+		return nil, nil
+	}
+
+	order := allocationOrder[AllocationFIFO]
+	netting := &DebtNetting{UserAID: userADbID, UserBID: userBDbID, Amount: amount, TriggeredBy: triggeredBy}
+	netting.UserADebt, err = allocateToTransactions(tx, userADbID, userBDbID, txIDsByA, amount, order, false)
+	if err != nil {
+		return nil, err
+	}
+	netting.UserBDebt, err = allocateToTransactions(tx, userBDbID, userADbID, txIDsByB, amount, order, false)
+	if err != nil {
+		return nil, err
+	}
+	netting.UserATxIDs = allocatedTxIDs(netting.UserADebt)
+	netting.UserBTxIDs = allocatedTxIDs(netting.UserBDebt)
+
+	_, err = tx.Exec(context.Background(), `
+		UPDATE user_debts SET amount = GREATEST(amount - $1, 0), updated_at = CURRENT_TIMESTAMP
+		WHERE (debtor_id = $2 AND creditor_id = $3) OR (debtor_id = $3 AND creditor_id = $2)
+	`, amount, userADbID, userBDbID)
+	if err != nil {
+		return nil, fmt.Errorf("เกิดข้อผิดพลาดขณะอัปเดตหนี้สินรวม: %w", err)
+	}
+
+	err = tx.QueryRow(context.Background(), `
+		INSERT INTO debt_nettings (user_a_id, user_b_id, amount, user_a_tx_ids, user_b_tx_ids, triggered_by)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at
+	`, userADbID, userBDbID, amount, netting.UserATxIDs, netting.UserBTxIDs, triggeredBy).Scan(&netting.ID, &netting.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("เกิดข้อผิดพลาดขณะบันทึกการหักกลบหนี้: %w", err)
+	}
+
+	if err = tx.Commit(context.Background()); err != nil {
+		return nil, fmt.Errorf("ไม่สามารถ Commit Transaction ได้: %w", err)
+	}
+
+	log.Printf("Debts netted (#%d): User %d <-> User %d, Amount %.2f, TxIDs %v / %v (triggered by %s)",
+		netting.ID, userADbID, userBDbID, amount, netting.UserATxIDs, netting.UserBTxIDs, triggeredBy)
+	return netting, nil
+}
+
+// allocatedTxIDs returns every transaction an allocation touched, settled or partly paid
+func allocatedTxIDs(allocation *PaymentAllocation) []int {
+	ids := make([]int, 0, len(allocation.Allocations))
+	for _, alloc := range allocation.Allocations {
+		ids = append(ids, alloc.TxID)
+	}
+	return ids
+}
@@ -0,0 +1,122 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// BilledReceiptImage is a receipt image that a bill of a guild was created from
+type BilledReceiptImage struct {
+	ImageHash string
+	MessageID string
+	ChannelID string
+	BilledAt  time.Time
+}
+
+// MigrateOCRCacheTables creates the OCR result cache and the record of receipt images that were billed
+func MigrateOCRCacheTables() error {
+	_, err := Pool.Exec(context.Background(), `
+	CREATE TABLE IF NOT EXISTS ocr_results (
+		image_hash TEXT PRIMARY KEY,
+		result JSONB NOT NULL,
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMPTZ NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_ocr_results_expires_at ON ocr_results(expires_at);
+
+	CREATE TABLE IF NOT EXISTS billed_receipt_images (
+		guild_id TEXT NOT NULL DEFAULT '',
+		image_hash TEXT NOT NULL,
+		message_id TEXT NOT NULL,
+		channel_id TEXT NOT NULL,
+		billed_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (guild_id, image_hash, message_id)
+	);
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating OCR cache tables: %w", err)
+	}
+
+	log.Println("OCR cache tables migrated successfully")
+	return nil
+}
+
+// GetCachedOCRResult returns the cached OCR result of an image as JSON, or nil if it isn't cached or has expired
+func GetCachedOCRResult(imageHash string) ([]byte, error) {
+	var result []byte
+	err := Pool.QueryRow(context.Background(), `
+		SELECT result FROM ocr_results WHERE image_hash = $1 AND expires_at > CURRENT_TIMESTAMP
+	`, imageHash).Scan(&result)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error loading cached OCR result of %s: %w", imageHash, err)
+	}
+	return result, nil
+}
+
+// StoreOCRResult caches the OCR result of an image for ttl, replacing an expired entry
+func StoreOCRResult(imageHash string, result []byte, ttl time.Duration) error {
+	_, err := Pool.Exec(context.Background(), `
+		INSERT INTO ocr_results (image_hash, result, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (image_hash) DO UPDATE
+		SET result = EXCLUDED.result, created_at = CURRENT_TIMESTAMP, expires_at = EXCLUDED.expires_at
+	`, imageHash, result, time.Now().Add(ttl))
+	if err != nil {
+		return fmt.Errorf("error caching OCR result of %s: %w", imageHash, err)
+	}
+	return nil
+}
+
+// DeleteExpiredOCRResults removes cached OCR results past their TTL
+func DeleteExpiredOCRResults() (int64, error) {
+	result, err := Pool.Exec(context.Background(),
+		`DELETE FROM ocr_results WHERE expires_at <= CURRENT_TIMESTAMP`)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting expired OCR results: %w", err)
+	}
+	return result.RowsAffected(), nil
+}
+
+// RecordBilledReceiptImages records that a bill of the guild was created from the receipt images of a message
+func RecordBilledReceiptImages(guildID, channelID, messageID string, imageHashes []string) error {
+	for _, imageHash := range imageHashes {
+		_, err := Pool.Exec(context.Background(), `
+			INSERT INTO billed_receipt_images (guild_id, image_hash, message_id, channel_id) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (guild_id, image_hash, message_id) DO NOTHING
+		`, guildID, imageHash, messageID, channelID)
+		if err != nil {
+			return fmt.Errorf("error recording billed receipt image %s: %w", imageHash, err)
+		}
+	}
+	return nil
+}
+
+// GetBilledReceiptImages returns the bills of the guild that were created from any of the images, oldest first
+func GetBilledReceiptImages(guildID string, imageHashes []string) ([]BilledReceiptImage, error) {
+	rows, err := Pool.Query(context.Background(), `
+		SELECT image_hash, message_id, channel_id, billed_at FROM billed_receipt_images
+		WHERE guild_id = $1 AND image_hash = ANY($2)
+		ORDER BY billed_at
+	`, guildID, imageHashes)
+	if err != nil {
+		return nil, fmt.Errorf("error querying billed receipt images: %w", err)
+	}
+	defer rows.Close()
+
+	var images []BilledReceiptImage
+	for rows.Next() {
+		var image BilledReceiptImage
+		if err := rows.Scan(&image.ImageHash, &image.MessageID, &image.ChannelID, &image.BilledAt); err != nil {
+			return nil, fmt.Errorf("error scanning billed receipt image: %w", err)
+		}
+		images = append(images, image)
+	}
+	return images, rows.Err()
+}
@@ -0,0 +1,436 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Payer bill statuses
+const (
+	PayerBillPending  = "pending"  // Waiting for the payers to confirm
+	PayerBillBooked   = "booked"   // Every payer confirmed, the debts were created
+	PayerBillRejected = "rejected" // A payer said they didn't pay
+	PayerBillDeleted  = "deleted"  // The source message was deleted and the bill's unpaid transactions voided
+)
+
+// PayerBill is a bill recorded by someone other than the person (or people) who paid for it.
+// Its debts are only booked once every payer confirms they really fronted their share.
+type PayerBill struct {
+	ID                  int         `json:"id"`
+	MessageID           string      `json:"message_id"` // The !bill message that recorded the bill
+	ChannelID           string      `json:"channel_id"`
+	GuildID             string      `json:"guild_id"`
+	RecordedBy          int         `json:"recorded_by"`
+	RecordedByDiscordID string      `json:"recorded_by_discord_id"`
+	TotalAmount         float64     `json:"total_amount"`
+	DueDate             *time.Time  `json:"due_date,omitempty"` // Applied to the transactions once booked
+	Status              string      `json:"status"`
+	CreatedAt           time.Time   `json:"created_at"`
+	Payers              []BillPayer `json:"payers"`
+	Debts               []BillDebt  `json:"debts"`
+}
+
+// BillPayer is one person who fronted money for a payer bill
+type BillPayer struct {
+	UserID      int        `json:"user_id"`
+	DiscordID   string     `json:"discord_id"`
+	Contributed float64    `json:"contributed"`
+	ConfirmedAt *time.Time `json:"confirmed_at,omitempty"`
+}
+
+// BillDebt is one debt a payer bill creates when it is booked
+type BillDebt struct {
+	ID                int     `json:"id"`
+	DebtorID          int     `json:"debtor_id"`
+	CreditorID        int     `json:"creditor_id"`
+	DebtorDiscordID   string  `json:"debtor_discord_id"`
+	CreditorDiscordID string  `json:"creditor_discord_id"`
+	Amount            float64 `json:"amount"`
+	Description       string  `json:"description"`
+	TxID              int     `json:"tx_id,omitempty"`   // Set once booked
+	Pending           bool    `json:"pending,omitempty"` // Booked as pending, waiting for the debtor to accept it
+}
+
+// AllConfirmed reports whether every payer has confirmed the bill
+func (b *PayerBill) AllConfirmed() bool {
+	for _, payer := range b.Payers {
+		if payer.ConfirmedAt == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// MigratePayerBillTables creates the tables holding bills that wait for their payers' confirmation
+func MigratePayerBillTables() error {
+	_, err := Pool.Exec(context.Background(), `
+	CREATE TABLE IF NOT EXISTS payer_bills (
+		id SERIAL PRIMARY KEY,
+		channel_id TEXT NOT NULL,
+		guild_id TEXT NOT NULL DEFAULT '',
+		recorded_by INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		total_amount NUMERIC(10, 2) NOT NULL,
+		due_date TIMESTAMPTZ,
+		status TEXT NOT NULL DEFAULT 'pending',
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		resolved_at TIMESTAMPTZ
+	);
+
+	CREATE TABLE IF NOT EXISTS payer_bill_payers (
+		bill_id INTEGER NOT NULL REFERENCES payer_bills(id) ON DELETE CASCADE,
+		payer_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		contributed NUMERIC(10, 2) NOT NULL CHECK (contributed > 0),
+		confirmed_at TIMESTAMPTZ,
+		PRIMARY KEY (bill_id, payer_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS payer_bill_debts (
+		id SERIAL PRIMARY KEY,
+		bill_id INTEGER NOT NULL REFERENCES payer_bills(id) ON DELETE CASCADE,
+		debtor_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		creditor_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		amount NUMERIC(10, 2) NOT NULL,
+		description TEXT,
+		tx_id INTEGER REFERENCES transactions(id) ON DELETE SET NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_payer_bill_debts_bill_id ON payer_bill_debts(bill_id);
+
+	ALTER TABLE payer_bills ADD COLUMN IF NOT EXISTS message_id TEXT NOT NULL DEFAULT '';
+	CREATE INDEX IF NOT EXISTS idx_payer_bills_message_id ON payer_bills(message_id);
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating payer bill tables: %w", err)
+	}
+
+	log.Println("Payer bill tables migrated successfully")
+	return nil
+}
+
+// CreatePayerBill stores a bill waiting for its payers' confirmation and returns its ID.
+// A payer who recorded the bill themselves is confirmed right away.
+func CreatePayerBill(bill *PayerBill) (int, error) {
+	tx, err := Pool.Begin(context.Background())
+	if err != nil {
+		return 0, fmt.Errorf("ไม่สามารถเริ่ม Transaction ได้: %w", err)
+	}
+	defer tx.Rollback(context.Background()) // Rollback if commit isn't called
+
+	var billID int
+	err = tx.QueryRow(context.Background(), `
+		INSERT INTO payer_bills (message_id, channel_id, guild_id, recorded_by, total_amount, due_date)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id
+	`, bill.MessageID, bill.ChannelID, bill.GuildID, bill.RecordedBy, bill.TotalAmount, bill.DueDate).Scan(&billID)
+	if err != nil {
+		return 0, fmt.Errorf("error creating payer bill: %w", err)
+	}
+
+	for _, payer := range bill.Payers {
+		_, err = tx.Exec(context.Background(), `
+			INSERT INTO payer_bill_payers (bill_id, payer_id, contributed, confirmed_at)
+			VALUES ($1, $2, $3, CASE WHEN $2 = $4 THEN CURRENT_TIMESTAMP END)
+		`, billID, payer.UserID, payer.Contributed, bill.RecordedBy)
+		if err != nil {
+			return 0, fmt.Errorf("error adding payer to bill: %w", err)
+		}
+	}
+
+	for _, debt := range bill.Debts {
+		_, err = tx.Exec(context.Background(), `
+			INSERT INTO payer_bill_debts (bill_id, debtor_id, creditor_id, amount, description)
+			VALUES ($1, $2, $3, $4, $5)
+		`, billID, debt.DebtorID, debt.CreditorID, debt.Amount, debt.Description)
+		if err != nil {
+			return 0, fmt.Errorf("error adding debt to bill: %w", err)
+		}
+	}
+
+	if err = tx.Commit(context.Background()); err != nil {
+		return 0, fmt.Errorf("ไม่สามารถ Commit Transaction ได้: %w", err)
+	}
+	return billID, nil
+}
+
+// GetPayerBill retrieves a payer bill with its payers and debts
+func GetPayerBill(billID int) (*PayerBill, error) {
+	return getPayerBill(Pool, billID, false)
+}
+
+// GetPayerBillByMessageID returns the pending or booked payer bill recorded by a message, or nil if there is none
+func GetPayerBillByMessageID(messageID string) (*PayerBill, error) {
+	var billID int
+	err := Pool.QueryRow(context.Background(), `
+		SELECT id FROM payer_bills
+		WHERE message_id = $1 AND message_id <> '' AND status IN ($2, $3)
+		ORDER BY id DESC
+		LIMIT 1
+	`, messageID, PayerBillPending, PayerBillBooked).Scan(&billID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error querying payer bill for message %s: %w", messageID, err)
+	}
+	return GetPayerBill(billID)
+}
+
+// rowQuerier is implemented by both the pool and a DB transaction
+type rowQuerier interface {
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+}
+
+// getPayerBill loads a payer bill, optionally locking its row
+func getPayerBill(q rowQuerier, billID int, lock bool) (*PayerBill, error) {
+	query := `
+		SELECT b.id, b.message_id, b.channel_id, b.guild_id, b.recorded_by, u.discord_id, b.total_amount, b.due_date, b.status, b.created_at
+		FROM payer_bills b
+		JOIN users u ON b.recorded_by = u.id
+		WHERE b.id = $1`
+	if lock {
+		query += ` FOR UPDATE OF b`
+	}
+
+	var bill PayerBill
+	err := q.QueryRow(context.Background(), query, billID).Scan(&bill.ID, &bill.MessageID, &bill.ChannelID, &bill.GuildID, &bill.RecordedBy,
+		&bill.RecordedByDiscordID, &bill.TotalAmount, &bill.DueDate, &bill.Status, &bill.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("ไม่พบบิล #%d", billID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error querying payer bill %d: %w", billID, err)
+	}
+
+	rows, err := q.Query(context.Background(), `
+		SELECT p.payer_id, u.discord_id, p.contributed, p.confirmed_at
+		FROM payer_bill_payers p
+		JOIN users u ON p.payer_id = u.id
+		WHERE p.bill_id = $1
+		ORDER BY p.contributed DESC, p.payer_id`, billID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying payers of bill %d: %w", billID, err)
+	}
+	for rows.Next() {
+		var payer BillPayer
+		if err := rows.Scan(&payer.UserID, &payer.DiscordID, &payer.Contributed, &payer.ConfirmedAt); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error scanning bill payer: %w", err)
+		}
+		bill.Payers = append(bill.Payers, payer)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = q.Query(context.Background(), `
+		SELECT d.id, d.debtor_id, d.creditor_id, debtor.discord_id, creditor.discord_id, d.amount, COALESCE(d.description, ''), COALESCE(d.tx_id, 0)
+		FROM payer_bill_debts d
+		JOIN users debtor ON d.debtor_id = debtor.id
+		JOIN users creditor ON d.creditor_id = creditor.id
+		WHERE d.bill_id = $1
+		ORDER BY d.id`, billID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying debts of bill %d: %w", billID, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var debt BillDebt
+		if err := rows.Scan(&debt.ID, &debt.DebtorID, &debt.CreditorID, &debt.DebtorDiscordID, &debt.CreditorDiscordID,
+			&debt.Amount, &debt.Description, &debt.TxID); err != nil {
+			return nil, fmt.Errorf("error scanning bill debt: %w", err)
+		}
+		bill.Debts = append(bill.Debts, debt)
+	}
+	return &bill, rows.Err()
+}
+
+// ConfirmPayerBill records a payer's confirmation. When it is the last one missing, the bill's
+// transactions and user_debts are created in the same DB transaction and the bill becomes booked.
+// With consent the debts are booked as pending transactions for their debtors to accept.
+// Returns the updated bill.
+func ConfirmPayerBill(billID, payerDbID int, consent bool) (*PayerBill, error) {
+	tx, err := Pool.Begin(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("ไม่สามารถเริ่ม Transaction ได้: %w", err)
+	}
+	defer tx.Rollback(context.Background()) // Rollback if commit isn't called
+
+	bill, err := getPayerBill(tx, billID, true)
+	if err != nil {
+		return nil, err
+	}
+	if bill.Status != PayerBillPending {
+		return nil, fmt.Errorf("บิล #%d ถูกดำเนินการไปแล้ว (สถานะ: %s)", billID, bill.Status)
+	}
+
+	result, err := tx.Exec(context.Background(), `
+		UPDATE payer_bill_payers SET confirmed_at = COALESCE(confirmed_at, CURRENT_TIMESTAMP)
+		WHERE bill_id = $1 AND payer_id = $2`, billID, payerDbID)
+	if err != nil {
+		return nil, fmt.Errorf("error confirming payer bill: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return nil, fmt.Errorf("คุณไม่ได้เป็นผู้จ่ายของบิล #%d", billID)
+	}
+
+	now := time.Now()
+	for idx := range bill.Payers {
+		if bill.Payers[idx].UserID == payerDbID && bill.Payers[idx].ConfirmedAt == nil {
+			bill.Payers[idx].ConfirmedAt = &now
+		}
+	}
+
+	if bill.AllConfirmed() {
+		if err := bookPayerBill(tx, bill, consent); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = tx.Commit(context.Background()); err != nil {
+		return nil, fmt.Errorf("ไม่สามารถ Commit Transaction ได้: %w", err)
+	}
+	return bill, nil
+}
+
+// bookPayerBill creates the transactions and user_debts of a fully confirmed bill.
+// With consent the transactions are pending and user_debts is updated once each debtor accepts.
+func bookPayerBill(tx pgx.Tx, bill *PayerBill, consent bool) error {
+	for idx := range bill.Debts {
+		debt := &bill.Debts[idx]
+		debt.Pending = consent && debt.DebtorID != debt.CreditorID
+		status := TxStatusActive
+		if debt.Pending {
+			status = TxStatusPending
+		}
+		err := tx.QueryRow(context.Background(), `
+			INSERT INTO transactions (payer_id, payee_id, amount, description, status)
+			VALUES ($1, $2, $3, $4, $5)
+			RETURNING id
+		`, debt.DebtorID, debt.CreditorID, debt.Amount, debt.Description, status).Scan(&debt.TxID)
+		if err != nil {
+			return fmt.Errorf("failed to create transaction: %w", err)
+		}
+
+		_, err = tx.Exec(context.Background(),
+			`UPDATE payer_bill_debts SET tx_id = $2 WHERE id = $1`, debt.ID, debt.TxID)
+		if err != nil {
+			return fmt.Errorf("failed to link bill debt to transaction: %w", err)
+		}
+		if debt.Pending {
+			continue
+		}
+
+		_, err = tx.Exec(context.Background(), `
+			INSERT INTO user_debts (debtor_id, creditor_id, amount, created_at, updated_at)
+			VALUES ($1, $2, $3, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+			ON CONFLICT (debtor_id, creditor_id)
+			DO UPDATE SET amount = user_debts.amount + EXCLUDED.amount, updated_at = CURRENT_TIMESTAMP
+		`, debt.DebtorID, debt.CreditorID, debt.Amount)
+		if err != nil {
+			return fmt.Errorf("failed to update user_debts: %w", err)
+		}
+	}
+
+	_, err := tx.Exec(context.Background(),
+		`UPDATE payer_bills SET status = $2, resolved_at = CURRENT_TIMESTAMP WHERE id = $1`, bill.ID, PayerBillBooked)
+	if err != nil {
+		return fmt.Errorf("error booking payer bill: %w", err)
+	}
+	bill.Status = PayerBillBooked
+	return nil
+}
+
+// RejectPayerBill cancels a pending payer bill because one of its payers disputes having paid
+func RejectPayerBill(billID, payerDbID int) error {
+	result, err := Pool.Exec(context.Background(), `
+		UPDATE payer_bills SET status = $3, resolved_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND status = $4
+		  AND EXISTS (SELECT 1 FROM payer_bill_payers WHERE bill_id = $1 AND payer_id = $2)
+	`, billID, payerDbID, PayerBillRejected, PayerBillPending)
+	if err != nil {
+		return fmt.Errorf("error rejecting payer bill %d: %w", billID, err)
+	}
+	if result.RowsAffected() == 0 {
+		return fmt.Errorf("ไม่สามารถปฏิเสธบิล #%d ได้ บิลอาจถูกดำเนินการไปแล้ว หรือคุณไม่ได้เป็นผู้จ่ายของบิลนี้", billID)
+	}
+	return nil
+}
+
+// DeletePayerBill cancels a payer bill whose message was deleted. A pending bill is simply cancelled,
+// a booked one gets its unpaid transactions voided like a deleted text bill.
+// Returns the voided transactions and the paid ones that were kept.
+func DeletePayerBill(billID int) (voided, kept []BillTransaction, err error) {
+	tx, err := Pool.Begin(context.Background())
+	if err != nil {
+		return nil, nil, fmt.Errorf("ไม่สามารถเริ่ม Transaction ได้: %w", err)
+	}
+	defer tx.Rollback(context.Background()) // Rollback if commit isn't called
+
+	bill, err := getPayerBill(tx, billID, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	if bill.Status != PayerBillPending && bill.Status != PayerBillBooked {
+		return nil, nil, fmt.Errorf("บิล #%d ถูกดำเนินการไปแล้ว (สถานะ: %s)", billID, bill.Status)
+	}
+
+	if bill.Status == PayerBillBooked {
+		rows, err := tx.Query(context.Background(), `
+			SELECT t.id, t.payer_id, u.discord_id, t.payee_id, t.amount, COALESCE(t.description, ''), t.status,
+			       t.already_paid OR t.paid_amount > 0 OR t.status = $4
+			FROM payer_bill_debts d
+			JOIN transactions t ON d.tx_id = t.id
+			JOIN users u ON t.payer_id = u.id
+			WHERE d.bill_id = $1 AND t.status IN ($2, $3, $4)
+			ORDER BY t.id
+			FOR UPDATE OF t
+		`, billID, TxStatusActive, TxStatusPending, TxStatusConverted)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error loading payer bill transactions: %w", err)
+		}
+		creditorIDs := make(map[int]int)
+		var stored []BillTransaction
+		for rows.Next() {
+			var t BillTransaction
+			var creditorID int
+			if err := rows.Scan(&t.TxID, &t.DebtorID, &t.DebtorDiscordID, &creditorID, &t.Amount, &t.Description, &t.Status, &t.Paid); err != nil {
+				rows.Close()
+				return nil, nil, fmt.Errorf("error scanning payer bill transaction: %w", err)
+			}
+			creditorIDs[t.TxID] = creditorID
+			stored = append(stored, t)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, nil, err
+		}
+
+		for _, t := range stored {
+			if t.Paid {
+				kept = append(kept, t)
+				continue
+			}
+			if err := voidBillTransaction(tx, creditorIDs[t.TxID], t); err != nil {
+				return nil, nil, err
+			}
+			voided = append(voided, t)
+		}
+	}
+
+	_, err = tx.Exec(context.Background(),
+		`UPDATE payer_bills SET status = $2, resolved_at = CURRENT_TIMESTAMP WHERE id = $1`, billID, PayerBillDeleted)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error marking payer bill %d deleted: %w", billID, err)
+	}
+
+	if err = tx.Commit(context.Background()); err != nil {
+		return nil, nil, fmt.Errorf("ไม่สามารถ Commit Transaction ได้: %w", err)
+	}
+	return voided, kept, nil
+}
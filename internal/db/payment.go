@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"math"
 	"regexp"
 	"strconv"
 	"strings"
@@ -60,6 +61,74 @@ func GetUserPromptPayID(userDBID int) (string, error) {
 	return promptPayID, nil
 }
 
+// SetUserAccountName sets the bank account name shown on slips sent to a user's PromptPay ID
+func SetUserAccountName(userDBID int, accountName string) error {
+	query := `UPDATE user_promptpay SET account_name = $2, updated_at = CURRENT_TIMESTAMP WHERE user_id = $1`
+	result, err := Pool.Exec(context.Background(), query, userDBID, accountName)
+	if err != nil {
+		log.Printf("Error setting account name for user %d: %v", userDBID, err)
+		return fmt.Errorf("ไม่สามารถบันทึกชื่อบัญชีของคุณได้: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return fmt.Errorf("ยังไม่พบ PromptPay ID สำหรับคุณ กรุณาตั้งค่าด้วยคำสั่ง !setpromptpay")
+	}
+	return nil
+}
+
+// GetUserPromptPayAccount gets a user's PromptPay ID together with the registered account name (may be empty)
+func GetUserPromptPayAccount(userDBID int) (promptPayID string, accountName string, err error) {
+	var name sql.NullString
+	query := `SELECT promptpay_id, account_name FROM user_promptpay WHERE user_id = $1`
+	err = Pool.QueryRow(context.Background(), query, userDBID).Scan(&promptPayID, &name)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return "", "", fmt.Errorf("ยังไม่พบ PromptPay ID สำหรับผู้ใช้นี้")
+		}
+		return "", "", fmt.Errorf("ไม่สามารถดึงข้อมูล PromptPay ID ได้: %w", err)
+	}
+	return promptPayID, name.String, nil
+}
+
+// GetEarliestTransactionTime gets the creation time of the oldest transaction among the given TxIDs
+func GetEarliestTransactionTime(txIDs []int) (time.Time, error) {
+	var earliest *time.Time
+	query := `SELECT MIN(created_at) FROM transactions WHERE id = ANY($1)`
+	err := Pool.QueryRow(context.Background(), query, txIDs).Scan(&earliest)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error getting earliest transaction time: %w", err)
+	}
+	if earliest == nil {
+		return time.Time{}, fmt.Errorf("ไม่พบรายการ TxIDs %v", txIDs)
+	}
+	return *earliest, nil
+}
+
+// GetTransactionsTotalAmount sums the outstanding (not yet paid) amounts of the given transactions
+func GetTransactionsTotalAmount(txIDs []int) (float64, error) {
+	var total float64
+	err := Pool.QueryRow(context.Background(),
+		`SELECT COALESCE(SUM(amount - paid_amount), 0) FROM transactions WHERE id = ANY($1)`, txIDs,
+	).Scan(&total)
+	if err != nil {
+		return 0, fmt.Errorf("error summing transaction amounts: %w", err)
+	}
+	return total, nil
+}
+
+// GetOldestUnpaidTransactionTime gets the creation time of the oldest unpaid transaction between two users
+func GetOldestUnpaidTransactionTime(debtorDbID, creditorDbID int) (time.Time, error) {
+	var oldest *time.Time
+	query := `SELECT MIN(created_at) FROM transactions WHERE payer_id = $1 AND payee_id = $2 AND already_paid = false AND status = 'active'`
+	err := Pool.QueryRow(context.Background(), query, debtorDbID, creditorDbID).Scan(&oldest)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error getting oldest unpaid transaction time: %w", err)
+	}
+	if oldest == nil {
+		return time.Time{}, fmt.Errorf("ไม่พบรายการที่ยังไม่ได้ชำระ")
+	}
+	return *oldest, nil
+}
+
 // FindIntendedPayee attempts to determine the intended payee for a payment
 // based on the debtor and amount. It returns the payee's Discord ID if found,
 // or an error if the payee cannot be determined or if multiple possibilities exist.
@@ -98,7 +167,7 @@ func FindIntendedPayee(debtorDiscordID string, amount float64) (string, error) {
 		JOIN users u ON t.payee_id = u.id
 		WHERE t.payer_id = $1
 		  AND ABS(t.amount - $2::numeric) < 0.01 -- Transaction amount matches closely
-		  AND t.already_paid = false
+		  AND t.already_paid = false AND t.status = 'active'
 		GROUP BY u.discord_id -- Group by payee in case of multiple tx to same payee
 		LIMIT 2; -- Fetch up to 2 to detect ambiguity
 	`
@@ -134,57 +203,198 @@ func FindIntendedPayee(debtorDiscordID string, amount float64) (string, error) {
 	return "", fmt.Errorf("ไม่สามารถระบุผู้รับเงินที่แน่นอนสำหรับยอดนี้ได้ โปรดให้ผู้รับเงินยืนยันด้วย `!paid <TxID>` หรือตอบกลับ QR ที่มี TxID")
 }
 
-// ReduceDebtFromPayment reduces debt for a payment between users
-func ReduceDebtFromPayment(debtorDiscordID, payeeDiscordID string, amount float64) error {
+// Payment allocation strategies for payments that don't name their transactions
+const (
+	AllocationFIFO     = "fifo"     // Oldest transactions first
+	AllocationLIFO     = "lifo"     // Newest transactions first
+	AllocationSmallest = "smallest" // Smallest outstanding amounts first, settles as many transactions as possible
+)
+
+// allocationOrder maps an allocation strategy to the ORDER BY used to pick transactions
+var allocationOrder = map[string]string{
+	AllocationFIFO:     "created_at ASC, id ASC",
+	AllocationLIFO:     "created_at DESC, id DESC",
+	AllocationSmallest: "amount - paid_amount ASC, created_at ASC, id ASC",
+}
+
+// TxAllocation is the part of a payment applied to one transaction
+type TxAllocation struct {
+	TxID      int     `json:"tx_id"`
+	Applied   float64 `json:"applied"`   // Amount of this payment applied to the transaction
+	Remaining float64 `json:"remaining"` // Amount still outstanding afterwards, 0 if settled
+}
+
+// PaymentAllocation describes how a lump-sum payment was spread over outstanding transactions
+type PaymentAllocation struct {
+	Amount      float64        `json:"amount"`
+	Allocations []TxAllocation `json:"allocations"`
+	Unallocated float64        `json:"unallocated"` // Overpayment left after every outstanding transaction was covered
+	Credited    float64        `json:"credited"`    // Part of the overpayment stored as credit toward the payee
+}
+
+// SettledTxIDs returns the transactions fully paid by this payment
+func (a *PaymentAllocation) SettledTxIDs() []int {
+	var ids []int
+	for _, alloc := range a.Allocations {
+		if alloc.Remaining <= 0.009 {
+			ids = append(ids, alloc.TxID)
+		}
+	}
+	return ids
+}
+
+// PartialAllocations returns the transactions only partly paid by this payment
+func (a *PaymentAllocation) PartialAllocations() []TxAllocation {
+	var partial []TxAllocation
+	for _, alloc := range a.Allocations {
+		if alloc.Remaining > 0.009 {
+			partial = append(partial, alloc)
+		}
+	}
+	return partial
+}
+
+// AllocatePayment applies a payment that doesn't name its transactions to the debtor's outstanding
+// transactions toward the payee, in the order given by strategy (FIFO if unknown).
+// Covered transactions are marked paid and ranked, the last one may be left partially paid.
+// user_debts is reduced by the allocated part and any overpayment is kept as credit toward the payee.
+func AllocatePayment(debtorDiscordID, payeeDiscordID string, amount float64, strategy string) (*PaymentAllocation, error) {
+	return allocatePayment(debtorDiscordID, payeeDiscordID, nil, amount, strategy)
+}
+
+// AllocatePaymentToTransactions applies a payment made for the given transactions like AllocatePayment,
+// but only to those transactions. Whatever they don't take is kept as credit toward the payee.
+func AllocatePaymentToTransactions(debtorDiscordID, payeeDiscordID string, txIDs []int, amount float64, strategy string) (*PaymentAllocation, error) {
+	if len(txIDs) == 0 {
+		return nil, fmt.Errorf("no transactions to allocate the payment to")
+	}
+	return allocatePayment(debtorDiscordID, payeeDiscordID, txIDs, amount, strategy)
+}
+
+// allocatePayment implements AllocatePayment, restricted to txIDs unless it is nil
+func allocatePayment(debtorDiscordID, payeeDiscordID string, txIDs []int, amount float64, strategy string) (*PaymentAllocation, error) {
 	debtorDbID, err := GetOrCreateUser(debtorDiscordID)
 	if err != nil {
-		return fmt.Errorf("ไม่พบผู้จ่ายเงิน %s ใน DB: %w", debtorDiscordID, err)
+		return nil, fmt.Errorf("ไม่พบผู้จ่ายเงิน %s ใน DB: %w", debtorDiscordID, err)
 	}
 	payeeDbID, err := GetOrCreateUser(payeeDiscordID)
 	if err != nil {
-		return fmt.Errorf("ไม่พบผู้รับเงิน %s ใน DB: %w", payeeDiscordID, err)
+		return nil, fmt.Errorf("ไม่พบผู้รับเงิน %s ใน DB: %w", payeeDiscordID, err)
+	}
+
+	order, ok := allocationOrder[strings.ToLower(strategy)]
+	if !ok {
+		order = allocationOrder[AllocationFIFO]
 	}
 
 	tx, err := Pool.Begin(context.Background())
 	if err != nil {
-		return fmt.Errorf("ไม่สามารถเริ่ม Transaction ได้: %w", err)
+		return nil, fmt.Errorf("ไม่สามารถเริ่ม Transaction ได้: %w", err)
 	}
 	defer tx.Rollback(context.Background()) // Rollback if commit isn't called
 
-	result, err := tx.Exec(context.Background(),
-		`UPDATE user_debts SET amount = amount - $1, updated_at = CURRENT_TIMESTAMP
-         WHERE debtor_id = $2 AND creditor_id = $3 AND amount > 0.009`, // only update if there's existing debt
-		amount, debtorDbID, payeeDbID)
+	allocation, err := allocateToTransactions(tx, debtorDbID, payeeDbID, txIDs, amount, order, true)
+	if err != nil {
+		return nil, err
+	}
 
+	// Reduce the summary balance by the part of the payment that covered transactions
+	_, err = tx.Exec(context.Background(),
+		`UPDATE user_debts SET amount = GREATEST(amount - $1, 0), updated_at = CURRENT_TIMESTAMP
+         WHERE debtor_id = $2 AND creditor_id = $3`,
+		amount-allocation.Unallocated, debtorDbID, payeeDbID)
 	if err != nil {
-		return fmt.Errorf("เกิดข้อผิดพลาดขณะอัปเดตหนี้สินรวม: %w", err)
-	}
-
-	rowsAffected := result.RowsAffected()
-	if rowsAffected == 0 {
-		// This could mean the debt was already 0, or became < 0 due to overpayment.
-		// If it became <0 and we want to zero it out, we could do another update.
-		// For now, just log. If debt was paid, `user_debts.amount` would be <= 0.
-		log.Printf("Debt reduction update affected 0 rows for debtor %d paying creditor %d amount %.2f. Debt might be zero or negative already, or there was no debt record.", debtorDbID, payeeDbID, amount)
-		// Optionally, ensure it doesn't go negative or create a debt if none existed (though should not happen with `amount > 0.009` guard)
-		// One strategy could be to set to 0 if amount - $1 < 0
-		zeroResult, errZero := tx.Exec(context.Background(),
-			`UPDATE user_debts SET amount = 0, updated_at = CURRENT_TIMESTAMP
-		   WHERE debtor_id = $1 AND creditor_id = $2 AND amount > 0.009 AND amount < $3`, // Only zero if original amount was less than payment
-			debtorDbID, payeeDbID, amount)
-		if errZero != nil {
-			log.Printf("Warning/Error trying to zero out remaining debt for debtor %d creditor %d amount %.2f: %v", debtorDbID, payeeDbID, amount, errZero)
-		} else if zeroResult.RowsAffected() > 0 {
-			log.Printf("Zeroed out remaining debt for debtor %d paying creditor %d (Payment %.2f)", debtorDbID, payeeDbID, amount)
+		return nil, fmt.Errorf("เกิดข้อผิดพลาดขณะอัปเดตหนี้สินรวม: %w", err)
+	}
+
+	// Keep the overpayment as credit toward the payee's future bills
+	if allocation.Unallocated > 0 {
+		if err := addUserCredit(tx, debtorDbID, payeeDbID, allocation.Unallocated); err != nil {
+			return nil, err
 		}
+		allocation.Credited = allocation.Unallocated
 	}
 
 	if err = tx.Commit(context.Background()); err != nil {
-		return fmt.Errorf("ไม่สามารถ Commit Transaction ได้: %w", err)
+		return nil, fmt.Errorf("ไม่สามารถ Commit Transaction ได้: %w", err)
 	}
 
-	log.Printf("General debt reduction successful: Debtor %d, Creditor %d, Amount %.2f", debtorDbID, payeeDbID, amount)
-	return nil
+	log.Printf("Payment allocated: Debtor %d, Creditor %d, Amount %.2f, Settled %v, Credited %.2f",
+		debtorDbID, payeeDbID, amount, allocation.SettledTxIDs(), allocation.Credited)
+	return allocation, nil
+}
+
+// allocateToTransactions spreads amount over the debtor's unpaid transactions toward the payee inside tx.
+// If txIDs is nil every unpaid transaction of the pair is eligible, otherwise only the listed ones.
+// Settled transactions are ranked for gamification only when rank is set.
+// user_debts is left untouched, callers adjust it by the allocated amount.
+func allocateToTransactions(tx pgx.Tx, debtorDbID, payeeDbID int, txIDs []int, amount float64, order string, rank bool) (*PaymentAllocation, error) {
+	type outstandingTx struct {
+		id          int
+		outstanding float64
+		createdAt   time.Time
+	}
+
+	rows, err := tx.Query(context.Background(), `
+		SELECT id, amount - paid_amount, created_at
+		FROM transactions
+		WHERE payer_id = $1 AND payee_id = $2 AND already_paid = false AND status = 'active'
+		AND ($3::int[] IS NULL OR id = ANY($3))
+		ORDER BY `+order+`
+		FOR UPDATE`, debtorDbID, payeeDbID, txIDs)
+	if err != nil {
+		return nil, fmt.Errorf("เกิดข้อผิดพลาดขณะดึงรายการที่ค้างชำระ: %w", err)
+	}
+	var outstanding []outstandingTx
+	for rows.Next() {
+		var o outstandingTx
+		if err := rows.Scan(&o.id, &o.outstanding, &o.createdAt); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("เกิดข้อผิดพลาดขณะอ่านรายการที่ค้างชำระ: %w", err)
+		}
+		outstanding = append(outstanding, o)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("เกิดข้อผิดพลาดขณะอ่านรายการที่ค้างชำระ: %w", err)
+	}
+
+	allocation := &PaymentAllocation{Amount: amount}
+	remaining := math.Round(amount*100) / 100
+	paidAt := time.Now()
+
+	for _, o := range outstanding {
+		if remaining <= 0.009 {
+			break
+		}
+
+		applied := math.Min(remaining, o.outstanding)
+		left := math.Round((o.outstanding-applied)*100) / 100
+		if left <= 0.009 {
+			_, err = tx.Exec(context.Background(),
+				`UPDATE transactions SET already_paid = TRUE, paid_amount = amount, paid_at = $2 WHERE id = $1`, o.id, paidAt)
+			if err != nil {
+				return nil, fmt.Errorf("failed to mark transaction %d as paid: %w", o.id, err)
+			}
+			if rank {
+				recordPaymentRanking(tx, o.id, debtorDbID, o.createdAt, paidAt)
+			}
+			left = 0
+		} else {
+			_, err = tx.Exec(context.Background(),
+				`UPDATE transactions SET paid_amount = paid_amount + $2 WHERE id = $1`, o.id, applied)
+			if err != nil {
+				return nil, fmt.Errorf("failed to record partial payment for transaction %d: %w", o.id, err)
+			}
+		}
+
+		allocation.Allocations = append(allocation.Allocations, TxAllocation{TxID: o.id, Applied: applied, Remaining: left})
+		remaining = math.Round((remaining-applied)*100) / 100
+	}
+	if remaining > 0.009 {
+		allocation.Unallocated = remaining
+	}
+	return allocation, nil
 }
 
 // GetPayeeDbIDFromTx gets the payee database ID from a transaction
@@ -202,9 +412,9 @@ func GetPayeeDbIDFromTx(txID int) (int, error) {
 // GetUnpaidTransactionIDsAndDetails gets unpaid transaction IDs and details between users
 func GetUnpaidTransactionIDsAndDetails(debtorDbID, creditorDbID int, detailLimit int) ([]int, string, float64, error) {
 	query := `
-        SELECT id, amount, description
+        SELECT id, amount - paid_amount, description
         FROM transactions
-        WHERE payer_id = $1 AND payee_id = $2 AND already_paid = false
+        WHERE payer_id = $1 AND payee_id = $2 AND already_paid = false AND status = 'active'
         ORDER BY created_at ASC;
     `
 	rows, err := Pool.Query(context.Background(), query, debtorDbID, creditorDbID)
@@ -308,9 +518,10 @@ func MarkTransactionPaidAndUpdateDebt(txID int) error {
 	}
 	defer tx.Rollback(context.Background()) // Ensure rollback if not committed
 
-	// Retrieve transaction details and lock the row for update
+	// Retrieve transaction details and lock the row for update.
+	// amount is what is still outstanding, part of it may already be covered by earlier partial payments.
 	err = tx.QueryRow(context.Background(),
-		`SELECT payer_id, payee_id, amount, created_at FROM transactions WHERE id = $1 AND already_paid = false FOR UPDATE`, txID,
+		`SELECT payer_id, payee_id, amount - paid_amount, created_at FROM transactions WHERE id = $1 AND already_paid = false AND status = 'active' FOR UPDATE`, txID,
 	).Scan(&payerDbID, &payeeDbID, &amount, &createdAt)
 	if err != nil {
 		if err == sql.ErrNoRows || strings.Contains(err.Error(), "no rows in result set") {
@@ -325,7 +536,7 @@ func MarkTransactionPaidAndUpdateDebt(txID int) error {
 	paidAt := time.Now()
 
 	// Mark the transaction as paid
-	_, err = tx.Exec(context.Background(), `UPDATE transactions SET already_paid = TRUE, paid_at = $2 WHERE id = $1`, txID, paidAt)
+	_, err = tx.Exec(context.Background(), `UPDATE transactions SET already_paid = TRUE, paid_amount = amount, paid_at = $2 WHERE id = $1`, txID, paidAt)
 	if err != nil {
 		return fmt.Errorf("failed to mark transaction %d as paid: %w", txID, err)
 	}
@@ -343,12 +554,25 @@ func MarkTransactionPaidAndUpdateDebt(txID int) error {
 	}
 
 	// Record payment ranking
+	recordPaymentRanking(tx, txID, payerDbID, createdAt, paidAt)
+
+	// Commit the database transaction
+	if err = tx.Commit(context.Background()); err != nil {
+		return fmt.Errorf("failed to commit database transaction for txID %d: %w", txID, err)
+	}
+	log.Printf("Transaction ID %d marked as paid and debts updated.", txID)
+	return nil
+}
+
+// recordPaymentRanking records the payer's rank for a settled transaction and updates their streak.
+// Errors are only logged, a failed ranking must not undo the payment.
+func recordPaymentRanking(tx pgx.Tx, txID, payerDbID int, createdAt, paidAt time.Time) {
 	// Calculate duration from creation to payment
 	durationSeconds := int(paidAt.Sub(createdAt).Seconds())
 
 	// Get current payment rank for this transaction
 	var existingRankCount int
-	err = tx.QueryRow(context.Background(), `
+	err := tx.QueryRow(context.Background(), `
 		SELECT COUNT(*) FROM bill_payment_ranking
 		WHERE bill_id = $1
 	`, txID).Scan(&existingRankCount)
@@ -361,17 +585,10 @@ func MarkTransactionPaidAndUpdateDebt(txID int) error {
 	newRank := existingRankCount + 1
 	if newRank <= 3 { // Only track top 3 ranks
 		// Use the shared utility function to update payment ranking and streak
-		err = UpdatePaymentRankAndStreak(tx.(pgx.Tx), txID, payerDbID, newRank, paidAt, durationSeconds)
+		err = UpdatePaymentRankAndStreak(tx, txID, payerDbID, newRank, paidAt, durationSeconds)
 		if err != nil {
 			log.Printf("Error updating payment rank and streak: %v", err)
 			// Continue despite error - we still want to mark the transaction as paid
 		}
 	}
-
-	// Commit the database transaction
-	if err = tx.Commit(context.Background()); err != nil {
-		return fmt.Errorf("failed to commit database transaction for txID %d: %w", txID, err)
-	}
-	log.Printf("Transaction ID %d marked as paid and debts updated.", txID)
-	return nil
 }
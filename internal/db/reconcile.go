@@ -0,0 +1,166 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// DebtDriftTolerance is the largest difference between user_debts and the ledger that is treated as rounding
+const DebtDriftTolerance = 0.009
+
+// DebtDrift describes a debtor/creditor pair whose user_debts balance doesn't match the sum of unpaid transactions
+type DebtDrift struct {
+	DebtorID          int     `json:"debtor_id"`
+	CreditorID        int     `json:"creditor_id"`
+	DebtorDiscordID   string  `json:"debtor_discord_id"`
+	CreditorDiscordID string  `json:"creditor_discord_id"`
+	RecordedAmount    float64 `json:"recorded_amount"` // Balance stored in user_debts
+	LedgerAmount      float64 `json:"ledger_amount"`   // Sum of unpaid transactions
+}
+
+// Difference returns how much user_debts is above (positive) or below (negative) the ledger
+func (d DebtDrift) Difference() float64 {
+	return d.RecordedAmount - d.LedgerAmount
+}
+
+// DebtCorrection is a logged rebuild of a user_debts balance from the ledger
+type DebtCorrection struct {
+	ID          int       `json:"id"`
+	DebtDrift             // Balances before the correction
+	TriggeredBy string    `json:"triggered_by"` // Discord ID of the admin, or "scheduler"
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// MigrateReconciliationTables creates the debt_corrections table if it doesn't exist
+func MigrateReconciliationTables() error {
+	_, err := Pool.Exec(context.Background(), `
+	CREATE TABLE IF NOT EXISTS debt_corrections (
+		id SERIAL PRIMARY KEY,
+		debtor_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		creditor_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		recorded_amount NUMERIC(10, 2) NOT NULL,
+		ledger_amount NUMERIC(10, 2) NOT NULL,
+		triggered_by TEXT NOT NULL,
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_debt_corrections_pair ON debt_corrections(debtor_id, creditor_id);
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating debt_corrections table: %w", err)
+	}
+
+	log.Println("Reconciliation tables migrated successfully")
+	return nil
+}
+
+// debtDriftQuery compares every user_debts balance with the sum of unpaid transactions for the same pair.
+// Pairs that only exist on one side are included, so missing and stale user_debts rows are both found.
+const debtDriftQuery = `
+	WITH ledger AS (
+		SELECT payer_id AS debtor_id, payee_id AS creditor_id, SUM(amount - paid_amount) AS amount
+		FROM transactions
+		WHERE already_paid = false AND status = 'active'
+		GROUP BY payer_id, payee_id
+	)
+	SELECT pair.debtor_id, pair.creditor_id, d.discord_id, c.discord_id, pair.recorded_amount, pair.ledger_amount
+	FROM (
+		SELECT COALESCE(ud.debtor_id, l.debtor_id) AS debtor_id,
+			COALESCE(ud.creditor_id, l.creditor_id) AS creditor_id,
+			COALESCE(ud.amount, 0) AS recorded_amount,
+			COALESCE(l.amount, 0) AS ledger_amount
+		FROM user_debts ud
+		FULL OUTER JOIN ledger l ON ud.debtor_id = l.debtor_id AND ud.creditor_id = l.creditor_id
+	) pair
+	JOIN users d ON pair.debtor_id = d.id
+	JOIN users c ON pair.creditor_id = c.id
+	WHERE ABS(pair.recorded_amount - pair.ledger_amount) > $1
+	ORDER BY ABS(pair.recorded_amount - pair.ledger_amount) DESC
+`
+
+// scanDebtDrifts reads the rows produced by debtDriftQuery
+func scanDebtDrifts(rows pgx.Rows) ([]DebtDrift, error) {
+	defer rows.Close()
+
+	var drifts []DebtDrift
+	for rows.Next() {
+		var drift DebtDrift
+		if err := rows.Scan(&drift.DebtorID, &drift.CreditorID, &drift.DebtorDiscordID, &drift.CreditorDiscordID,
+			&drift.RecordedAmount, &drift.LedgerAmount); err != nil {
+			return nil, fmt.Errorf("error scanning debt drift: %w", err)
+		}
+		drifts = append(drifts, drift)
+	}
+	return drifts, rows.Err()
+}
+
+// FindDebtDrift returns every debtor/creditor pair whose user_debts balance doesn't match the unpaid transactions
+func FindDebtDrift() ([]DebtDrift, error) {
+	rows, err := Pool.Query(context.Background(), debtDriftQuery, DebtDriftTolerance)
+	if err != nil {
+		return nil, fmt.Errorf("error querying debt drift: %w", err)
+	}
+	return scanDebtDrifts(rows)
+}
+
+// RebuildUserDebts sets every drifting user_debts balance to the sum of its unpaid transactions.
+// The drift is recomputed inside one DB transaction and each correction is logged in debt_corrections.
+func RebuildUserDebts(triggeredBy string) ([]DebtCorrection, error) {
+	tx, err := Pool.Begin(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("ไม่สามารถเริ่ม Transaction ได้: %w", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	// Block concurrent debt updates while the balances are rebuilt
+	if _, err := tx.Exec(context.Background(), `LOCK TABLE user_debts IN SHARE ROW EXCLUSIVE MODE`); err != nil {
+		return nil, fmt.Errorf("error locking user_debts: %w", err)
+	}
+
+	rows, err := tx.Query(context.Background(), debtDriftQuery, DebtDriftTolerance)
+	if err != nil {
+		return nil, fmt.Errorf("error querying debt drift: %w", err)
+	}
+	drifts, err := scanDebtDrifts(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	corrections := make([]DebtCorrection, 0, len(drifts))
+	for _, drift := range drifts {
+		ledgerAmount := math.Round(drift.LedgerAmount*100) / 100
+		_, err := tx.Exec(context.Background(), `
+			INSERT INTO user_debts (debtor_id, creditor_id, amount, created_at, updated_at)
+			VALUES ($1, $2, $3, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+			ON CONFLICT (debtor_id, creditor_id)
+			DO UPDATE SET amount = EXCLUDED.amount, updated_at = CURRENT_TIMESTAMP
+		`, drift.DebtorID, drift.CreditorID, ledgerAmount)
+		if err != nil {
+			return nil, fmt.Errorf("error rebuilding user_debts for debtor %d, creditor %d: %w", drift.DebtorID, drift.CreditorID, err)
+		}
+
+		correction := DebtCorrection{DebtDrift: drift, TriggeredBy: triggeredBy}
+		err = tx.QueryRow(context.Background(), `
+			INSERT INTO debt_corrections (debtor_id, creditor_id, recorded_amount, ledger_amount, triggered_by)
+			VALUES ($1, $2, $3, $4, $5)
+			RETURNING id, created_at
+		`, drift.DebtorID, drift.CreditorID, drift.RecordedAmount, ledgerAmount, triggeredBy).Scan(&correction.ID, &correction.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("error logging debt correction for debtor %d, creditor %d: %w", drift.DebtorID, drift.CreditorID, err)
+		}
+		corrections = append(corrections, correction)
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		return nil, fmt.Errorf("ไม่สามารถ Commit Transaction ได้: %w", err)
+	}
+
+	if len(corrections) > 0 {
+		log.Printf("Rebuilt %d user_debts balances from the ledger (triggered by %s)", len(corrections), triggeredBy)
+	}
+	return corrections, nil
+}
@@ -0,0 +1,187 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Slip review statuses
+const (
+	SlipReviewPending  = "pending"
+	SlipReviewApproved = "approved"
+	SlipReviewRejected = "rejected"
+	SlipReviewAdjusted = "adjusted"
+)
+
+// pendingSlipReviewForTxCondition matches a slip still waiting for review that pays transaction t, either by TxID
+// or, for reviews without TxIDs, by the debtor/creditor pair
+const pendingSlipReviewForTxCondition = `
+	EXISTS (
+		SELECT 1 FROM slip_reviews sr
+		WHERE sr.status = 'pending'
+		AND (t.id = ANY(sr.tx_ids) OR (cardinality(sr.tx_ids) = 0 AND sr.debtor_id = t.payer_id AND sr.creditor_id = t.payee_id))
+	)`
+
+// SlipReview represents a payment slip waiting for (or resolved by) a creditor's manual review
+type SlipReview struct {
+	ID                int        `json:"id"`
+	DebtorID          int        `json:"debtor_id"`
+	CreditorID        int        `json:"creditor_id"`
+	DebtorDiscordID   string     `json:"debtor_discord_id"`
+	CreditorDiscordID string     `json:"creditor_discord_id"`
+	ExpectedAmount    float64    `json:"expected_amount"` // Amount requested by the QR message
+	SlipAmount        float64    `json:"slip_amount"`     // Amount read from the slip, 0 if unknown
+	ResolvedAmount    float64    `json:"resolved_amount"` // Amount the creditor accepted
+	SlipURL           string     `json:"slip_url"`
+	SlipImageID       int        `json:"slip_image_id"` // Archived slip image, 0 if it couldn't be archived
+	SlipData          string     `json:"slip_data"`     // Raw JSON returned by the slip verifier, if any
+	TxIDs             []int      `json:"tx_ids"`
+	Reason            string     `json:"reason"`
+	Status            string     `json:"status"`
+	ChannelID         string     `json:"channel_id"`
+	CreatedAt         time.Time  `json:"created_at"`
+	ResolvedAt        *time.Time `json:"resolved_at"`
+}
+
+// MigrateSlipReviewTables creates the slip_reviews table if it doesn't exist
+func MigrateSlipReviewTables() error {
+	_, err := Pool.Exec(context.Background(), `
+	CREATE TABLE IF NOT EXISTS slip_reviews (
+		id SERIAL PRIMARY KEY,
+		debtor_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		creditor_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		expected_amount NUMERIC(10, 2) NOT NULL,
+		slip_amount NUMERIC(10, 2) NOT NULL DEFAULT 0,
+		resolved_amount NUMERIC(10, 2),
+		slip_url TEXT NOT NULL,
+		slip_data JSONB,
+		tx_ids INTEGER[] NOT NULL DEFAULT '{}',
+		reason TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending', -- 'pending', 'approved', 'rejected', 'adjusted'
+		channel_id TEXT NOT NULL,
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		resolved_at TIMESTAMPTZ
+	);
+	CREATE INDEX IF NOT EXISTS idx_slip_reviews_creditor_status ON slip_reviews(creditor_id, status);
+	CREATE INDEX IF NOT EXISTS idx_slip_reviews_debtor_status ON slip_reviews(debtor_id, status);
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating slip_reviews table: %w", err)
+	}
+
+	log.Println("Slip review tables migrated successfully")
+	return nil
+}
+
+// CreateSlipReview stores a slip that needs the creditor's manual review and returns its ID
+func CreateSlipReview(debtorDbID, creditorDbID int, expectedAmount, slipAmount float64, slipURL string, slipImageID int, slipData string, txIDs []int, reason, channelID string) (int, error) {
+	var slipDataParam interface{}
+	if slipData != "" {
+		slipDataParam = []byte(slipData)
+	}
+	var slipImageIDParam interface{}
+	if slipImageID > 0 {
+		slipImageIDParam = slipImageID
+	}
+	if txIDs == nil {
+		txIDs = []int{}
+	}
+
+	var reviewID int
+	err := Pool.QueryRow(context.Background(), `
+		INSERT INTO slip_reviews (debtor_id, creditor_id, expected_amount, slip_amount, slip_url, slip_image_id, slip_data, tx_ids, reason, channel_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING id
+	`, debtorDbID, creditorDbID, expectedAmount, slipAmount, slipURL, slipImageIDParam, slipDataParam, txIDs, reason, channelID).Scan(&reviewID)
+	if err != nil {
+		return 0, fmt.Errorf("error creating slip review: %w", err)
+	}
+	return reviewID, nil
+}
+
+// slipReviewSelect is the shared SELECT used to load slip reviews with Discord IDs
+const slipReviewSelect = `
+	SELECT r.id, r.debtor_id, r.creditor_id, d.discord_id, c.discord_id,
+		r.expected_amount, r.slip_amount, COALESCE(r.resolved_amount, 0),
+		r.slip_url, COALESCE(r.slip_image_id, 0), COALESCE(r.slip_data::text, ''), r.tx_ids, r.reason, r.status, r.channel_id,
+		r.created_at, r.resolved_at
+	FROM slip_reviews r
+	JOIN users d ON r.debtor_id = d.id
+	JOIN users c ON r.creditor_id = c.id
+`
+
+// scanSlipReview scans a row produced by slipReviewSelect
+func scanSlipReview(row interface{ Scan(dest ...any) error }) (*SlipReview, error) {
+	var review SlipReview
+	err := row.Scan(
+		&review.ID, &review.DebtorID, &review.CreditorID, &review.DebtorDiscordID, &review.CreditorDiscordID,
+		&review.ExpectedAmount, &review.SlipAmount, &review.ResolvedAmount,
+		&review.SlipURL, &review.SlipImageID, &review.SlipData, &review.TxIDs, &review.Reason, &review.Status, &review.ChannelID,
+		&review.CreatedAt, &review.ResolvedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &review, nil
+}
+
+// GetSlipReview retrieves a slip review by ID
+func GetSlipReview(reviewID int) (*SlipReview, error) {
+	review, err := scanSlipReview(Pool.QueryRow(context.Background(), slipReviewSelect+` WHERE r.id = $1`, reviewID))
+	if err != nil {
+		return nil, fmt.Errorf("ไม่พบรายการตรวจสอบสลิป ID %d: %w", reviewID, err)
+	}
+	return review, nil
+}
+
+// GetPendingSlipReviews retrieves all pending slip reviews awaiting a creditor's decision
+func GetPendingSlipReviews(creditorDbID int) ([]SlipReview, error) {
+	rows, err := Pool.Query(context.Background(),
+		slipReviewSelect+` WHERE r.creditor_id = $1 AND r.status = 'pending' ORDER BY r.created_at ASC`, creditorDbID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying pending slip reviews: %w", err)
+	}
+	defer rows.Close()
+
+	var reviews []SlipReview
+	for rows.Next() {
+		review, err := scanSlipReview(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning slip review: %w", err)
+		}
+		reviews = append(reviews, *review)
+	}
+	return reviews, rows.Err()
+}
+
+// ResolveSlipReview moves a pending slip review to its final status.
+// It fails if the review was already resolved so a payment is never applied twice.
+func ResolveSlipReview(reviewID int, status string, resolvedAmount float64) error {
+	result, err := Pool.Exec(context.Background(), `
+		UPDATE slip_reviews
+		SET status = $2, resolved_amount = $3, resolved_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND status = 'pending'
+	`, reviewID, status, resolvedAmount)
+	if err != nil {
+		return fmt.Errorf("error resolving slip review %d: %w", reviewID, err)
+	}
+	if result.RowsAffected() == 0 {
+		return fmt.Errorf("รายการตรวจสอบสลิป ID %d ถูกดำเนินการไปแล้ว", reviewID)
+	}
+	return nil
+}
+
+// ReopenSlipReview puts a resolved review back to pending, used when its payment could not be applied
+func ReopenSlipReview(reviewID int, status string) error {
+	_, err := Pool.Exec(context.Background(), `
+		UPDATE slip_reviews
+		SET status = 'pending', resolved_amount = NULL, resolved_at = NULL
+		WHERE id = $1 AND status = $2
+	`, reviewID, status)
+	if err != nil {
+		return fmt.Errorf("error reopening slip review %d: %w", reviewID, err)
+	}
+	return nil
+}
@@ -15,16 +15,18 @@ func GetUserTransactions(userDbID int, isDebtor bool, isPaid bool, limit int) ([
 
 	if isDebtor {
 		// User is the payer
-		query := `SELECT t.id, t.amount, t.description, t.created_at, t.already_paid, u.discord_id 
+		query := `SELECT t.id, t.amount, t.description, t.created_at, t.already_paid, u.discord_id,
+				 ` + openDisputeForTxCondition + ` as disputed, t.due_date, ` + overdueTxCondition + ` as overdue
 				 FROM transactions t JOIN users u ON t.payee_id = u.id 
-				 WHERE t.payer_id = $1 AND t.already_paid = $2 
+				 WHERE t.payer_id = $1 AND t.already_paid = $2 AND t.status = 'active' 
 				 ORDER BY t.created_at DESC LIMIT $3`
 		rows, err = Pool.Query(context.Background(), query, userDbID, isPaid, limit)
 	} else {
 		// User is the payee
-		query := `SELECT t.id, t.amount, t.description, t.created_at, t.already_paid, u.discord_id 
+		query := `SELECT t.id, t.amount, t.description, t.created_at, t.already_paid, u.discord_id,
+				 ` + openDisputeForTxCondition + ` as disputed, t.due_date, ` + overdueTxCondition + ` as overdue
 				 FROM transactions t JOIN users u ON t.payer_id = u.id 
-				 WHERE t.payee_id = $1 AND t.already_paid = $2 
+				 WHERE t.payee_id = $1 AND t.already_paid = $2 AND t.status = 'active' 
 				 ORDER BY t.created_at DESC LIMIT $3`
 		rows, err = Pool.Query(context.Background(), query, userDbID, isPaid, limit)
 	}
@@ -42,20 +44,29 @@ func GetUserTransactions(userDbID int, isDebtor bool, isPaid bool, limit int) ([
 		var createdAt time.Time
 		var alreadyPaid bool
 		var otherPartyDiscordID string
+		var disputed bool
+		var dueDate *time.Time
+		var overdue bool
 
-		err := rows.Scan(&id, &amount, &description, &createdAt, &alreadyPaid, &otherPartyDiscordID)
+		err := rows.Scan(&id, &amount, &description, &createdAt, &alreadyPaid, &otherPartyDiscordID, &disputed, &dueDate, &overdue)
 		if err != nil {
 			return nil, fmt.Errorf("error scanning row: %w", err)
 		}
 
-		result = append(result, map[string]interface{}{
+		txMap := map[string]interface{}{
 			"id":                     id,
 			"amount":                 amount,
 			"description":            description,
 			"created_at":             createdAt.Format(time.RFC3339),
 			"already_paid":           alreadyPaid,
 			"other_party_discord_id": otherPartyDiscordID,
-		})
+			"disputed":               disputed,
+			"overdue":                overdue,
+		}
+		if dueDate != nil {
+			txMap["due_date"] = *dueDate
+		}
+		result = append(result, txMap)
 	}
 
 	if err = rows.Err(); err != nil {
@@ -70,11 +81,12 @@ func GetAllUserTransactions(userDbID int, limit int) ([]map[string]interface{},
 	query := `
 		SELECT t.id, t.amount, t.description, t.created_at, t.already_paid, 
                CASE WHEN t.payer_id = $1 THEN u.discord_id ELSE u2.discord_id END as other_party_discord_id,
-               CASE WHEN t.payer_id = $2 THEN 'debtor' ELSE 'creditor' END as role
+               CASE WHEN t.payer_id = $2 THEN 'debtor' ELSE 'creditor' END as role,
+               ` + openDisputeForTxCondition + ` as disputed, t.due_date, ` + overdueTxCondition + ` as overdue
         FROM transactions t 
         JOIN users u ON t.payee_id = u.id 
         JOIN users u2 ON t.payer_id = u2.id
-        WHERE t.payer_id = $3 OR t.payee_id = $4 
+        WHERE (t.payer_id = $3 OR t.payee_id = $4) AND t.status = 'active'
         ORDER BY t.created_at DESC LIMIT $5`
 
 	rows, err := Pool.Query(context.Background(), query, userDbID, userDbID, userDbID, userDbID, limit)
@@ -92,13 +104,16 @@ func GetAllUserTransactions(userDbID int, limit int) ([]map[string]interface{},
 		var alreadyPaid bool
 		var otherPartyDiscordID string
 		var role string
+		var disputed bool
+		var dueDate *time.Time
+		var overdue bool
 
-		err := rows.Scan(&id, &amount, &description, &createdAt, &alreadyPaid, &otherPartyDiscordID, &role)
+		err := rows.Scan(&id, &amount, &description, &createdAt, &alreadyPaid, &otherPartyDiscordID, &role, &disputed, &dueDate, &overdue)
 		if err != nil {
 			return nil, fmt.Errorf("error scanning row: %w", err)
 		}
 
-		result = append(result, map[string]interface{}{
+		txMap := map[string]interface{}{
 			"id":                     id,
 			"amount":                 amount,
 			"description":            description,
@@ -106,7 +121,13 @@ func GetAllUserTransactions(userDbID int, limit int) ([]map[string]interface{},
 			"already_paid":           alreadyPaid,
 			"other_party_discord_id": otherPartyDiscordID,
 			"role":                   role,
-		})
+			"disputed":               disputed,
+			"overdue":                overdue,
+		}
+		if dueDate != nil {
+			txMap["due_date"] = *dueDate
+		}
+		result = append(result, txMap)
 	}
 
 	if err = rows.Err(); err != nil {
@@ -120,7 +141,7 @@ func GetAllUserTransactions(userDbID int, limit int) ([]map[string]interface{},
 func GetRecentTransactions(debtorDbID, creditorDbID, limit int, includePaid bool) ([]map[string]interface{}, error) {
 	var whereClause string
 	if !includePaid {
-		whereClause = "AND t.already_paid = false"
+		whereClause = "AND t.already_paid = false AND t.status = 'active'"
 	}
 
 	query := fmt.Sprintf(`
@@ -0,0 +1,139 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Transaction statuses. Only active transactions count towards user_debts, payments and reminders.
+const (
+	TxStatusActive    = "active"    // A confirmed debt
+	TxStatusPending   = "pending"   // Waiting for the other party to accept it
+	TxStatusRejected  = "rejected"  // Declined by the other party, never becomes a debt
+	TxStatusVoided    = "voided"    // Removed from its bill by an edit or deletion before it was paid
+	TxStatusConverted = "converted" // Replaced by the installments of an installment plan
+)
+
+// MigrateTransactionStatusTables adds the status column to transactions
+func MigrateTransactionStatusTables() error {
+	_, err := Pool.Exec(context.Background(), `
+	ALTER TABLE transactions
+	ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'active';
+	CREATE INDEX IF NOT EXISTS idx_transactions_pending ON transactions(status) WHERE status = 'pending';
+	`)
+	if err != nil {
+		return fmt.Errorf("error adding status column to transactions: %w", err)
+	}
+
+	log.Println("Transaction status tables migrated successfully")
+	return nil
+}
+
+// CreatePendingTransaction records a transaction that does not affect user_debts until it is accepted
+func CreatePendingTransaction(payerID, payeeID int, amount float64, description string) (int, error) {
+	var txID int
+	err := Pool.QueryRow(context.Background(),
+		`INSERT INTO transactions (payer_id, payee_id, amount, description, status) VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+		payerID, payeeID, amount, description, TxStatusPending).Scan(&txID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create pending transaction: %w", err)
+	}
+	return txID, nil
+}
+
+// ActivatePendingTransactions turns pending transactions into debts, adding them to user_debts
+// in the same DB transaction. Transactions that are no longer pending are skipped.
+// Returns the IDs that were activated.
+func ActivatePendingTransactions(txIDs []int) ([]int, error) {
+	tx, err := Pool.Begin(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("ไม่สามารถเริ่ม Transaction ได้: %w", err)
+	}
+	defer tx.Rollback(context.Background()) // Rollback if commit isn't called
+
+	activated, err := activatePendingTransactions(tx, txIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(context.Background()); err != nil {
+		return nil, fmt.Errorf("ไม่สามารถ Commit Transaction ได้: %w", err)
+	}
+
+	var activatedIDs []int
+	for _, debt := range activated {
+		activatedIDs = append(activatedIDs, debt.TxID)
+	}
+	return activatedIDs, nil
+}
+
+// activatedTransaction is a pending transaction that became a debt
+type activatedTransaction struct {
+	TxID       int
+	DebtorID   int
+	CreditorID int
+	Amount     float64
+}
+
+// activatePendingTransactions activates pending transactions and adds them to user_debts within tx
+func activatePendingTransactions(tx pgx.Tx, txIDs []int) ([]activatedTransaction, error) {
+	rows, err := tx.Query(context.Background(), `
+		UPDATE transactions SET status = $2
+		WHERE id = ANY($1) AND status = $3
+		RETURNING id, payer_id, payee_id, amount`, txIDs, TxStatusActive, TxStatusPending)
+	if err != nil {
+		return nil, fmt.Errorf("error activating pending transactions: %w", err)
+	}
+
+	var activated []activatedTransaction
+	for rows.Next() {
+		var debt activatedTransaction
+		if err := rows.Scan(&debt.TxID, &debt.DebtorID, &debt.CreditorID, &debt.Amount); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error scanning activated transaction: %w", err)
+		}
+		activated = append(activated, debt)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, debt := range activated {
+		_, err = tx.Exec(context.Background(), `
+			INSERT INTO user_debts (debtor_id, creditor_id, amount, created_at, updated_at)
+			VALUES ($1, $2, $3, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+			ON CONFLICT (debtor_id, creditor_id)
+			DO UPDATE SET amount = user_debts.amount + EXCLUDED.amount, updated_at = CURRENT_TIMESTAMP
+		`, debt.DebtorID, debt.CreditorID, debt.Amount)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update user_debts: %w", err)
+		}
+	}
+	return activated, nil
+}
+
+// RejectPendingTransactions marks pending transactions as rejected. Returns the IDs that were rejected.
+func RejectPendingTransactions(txIDs []int) ([]int, error) {
+	rows, err := Pool.Query(context.Background(), `
+		UPDATE transactions SET status = $2
+		WHERE id = ANY($1) AND status = $3
+		RETURNING id`, txIDs, TxStatusRejected, TxStatusPending)
+	if err != nil {
+		return nil, fmt.Errorf("error rejecting pending transactions: %w", err)
+	}
+	defer rows.Close()
+
+	var rejected []int
+	for rows.Next() {
+		var txID int
+		if err := rows.Scan(&txID); err != nil {
+			return nil, fmt.Errorf("error scanning rejected transaction: %w", err)
+		}
+		rejected = append(rejected, txID)
+	}
+	return rejected, rows.Err()
+}
@@ -0,0 +1,313 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Trip statuses
+const (
+	TripOpen   = "open"   // Expenses in the channel are collected without QR codes
+	TripClosed = "closed" // Settled into transfers
+)
+
+// Trip collects the expenses of an event in one channel so they can be settled together at the end
+type Trip struct {
+	ID               int        `json:"id"`
+	ChannelID        string     `json:"channel_id"`
+	GuildID          string     `json:"guild_id"`
+	Name             string     `json:"name"`
+	CreatorID        int        `json:"creator_id"`
+	CreatorDiscordID string     `json:"creator_discord_id"`
+	Status           string     `json:"status"`
+	CreatedAt        time.Time  `json:"created_at"`
+	ClosedAt         *time.Time `json:"closed_at,omitempty"`
+}
+
+// TripBalance is one participant's position in a trip
+type TripBalance struct {
+	UserID    int     `json:"user_id"`
+	DiscordID string  `json:"discord_id"`
+	Paid      float64 `json:"paid"` // Paid on behalf of others
+	Owed      float64 `json:"owed"` // Owed to others
+}
+
+// Net returns how much the participant should receive (positive) or pay (negative)
+func (b TripBalance) Net() float64 {
+	return b.Paid - b.Owed
+}
+
+// TripTransfer is one payment that settles a closed trip
+type TripTransfer struct {
+	FromID        int     `json:"from_id"`
+	ToID          int     `json:"to_id"`
+	FromDiscordID string  `json:"from_discord_id"`
+	ToDiscordID   string  `json:"to_discord_id"`
+	Amount        float64 `json:"amount"`
+	TxID          int     `json:"tx_id"`
+}
+
+// MigrateTripTables creates the trips table and links transactions to it
+func MigrateTripTables() error {
+	_, err := Pool.Exec(context.Background(), `
+	CREATE TABLE IF NOT EXISTS trips (
+		id SERIAL PRIMARY KEY,
+		channel_id TEXT NOT NULL,
+		guild_id TEXT NOT NULL DEFAULT '',
+		name TEXT NOT NULL,
+		creator_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		status TEXT NOT NULL DEFAULT 'open',
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		closed_at TIMESTAMPTZ
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_trips_open_channel ON trips(channel_id) WHERE status = 'open';
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating trips table: %w", err)
+	}
+
+	_, err = Pool.Exec(context.Background(), `
+	ALTER TABLE transactions
+	ADD COLUMN IF NOT EXISTS trip_id INTEGER REFERENCES trips(id) ON DELETE SET NULL;
+	CREATE INDEX IF NOT EXISTS idx_transactions_trip_id ON transactions(trip_id);
+	`)
+	if err != nil {
+		return fmt.Errorf("error adding trip_id column to transactions: %w", err)
+	}
+
+	log.Println("Trip tables migrated successfully")
+	return nil
+}
+
+// CreateTrip opens a trip in the channel. A channel can only have one open trip.
+func CreateTrip(channelID, guildID, name string, creatorDbID int) (*Trip, error) {
+	trip := &Trip{ChannelID: channelID, GuildID: guildID, Name: name, CreatorID: creatorDbID, Status: TripOpen}
+	err := Pool.QueryRow(context.Background(), `
+		INSERT INTO trips (channel_id, guild_id, name, creator_id)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at
+	`, channelID, guildID, name, creatorDbID).Scan(&trip.ID, &trip.CreatedAt)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return nil, fmt.Errorf("ช่องนี้มีทริปที่เปิดอยู่แล้ว โปรดปิดทริปเดิมด้วย `!trip close` ก่อน")
+		}
+		return nil, fmt.Errorf("error creating trip: %w", err)
+	}
+	return trip, nil
+}
+
+// GetOpenTrip returns the open trip of the channel, or nil if there is none
+func GetOpenTrip(channelID string) (*Trip, error) {
+	var trip Trip
+	err := Pool.QueryRow(context.Background(), `
+		SELECT t.id, t.channel_id, t.guild_id, t.name, t.creator_id, u.discord_id, t.status, t.created_at, t.closed_at
+		FROM trips t
+		JOIN users u ON t.creator_id = u.id
+		WHERE t.channel_id = $1 AND t.status = $2
+	`, channelID, TripOpen).Scan(&trip.ID, &trip.ChannelID, &trip.GuildID, &trip.Name, &trip.CreatorID,
+		&trip.CreatorDiscordID, &trip.Status, &trip.CreatedAt, &trip.ClosedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error querying open trip: %w", err)
+	}
+	return &trip, nil
+}
+
+// AssignTransactionsToTrip records the transactions as expenses of the trip.
+// Their due date is cleared, since trip expenses are settled when the trip closes.
+func AssignTransactionsToTrip(txIDs []int, tripID int) error {
+	_, err := Pool.Exec(context.Background(),
+		`UPDATE transactions SET trip_id = $2, due_date = NULL WHERE id = ANY($1)`, txIDs, tripID)
+	if err != nil {
+		return fmt.Errorf("error assigning transactions to trip: %w", err)
+	}
+	return nil
+}
+
+// tripSettleableCondition matches an unpaid trip expense t of trip $1 that closing the trip may settle.
+// Disputed expenses and expenses whose slip is waiting for review are left as ordinary debts.
+const tripSettleableCondition = `t.trip_id = $1 AND t.already_paid = false AND t.status = 'active'
+	AND NOT ` + openDisputeForTxCondition + `
+	AND NOT ` + pendingSlipReviewForTxCondition
+
+// tripBalancesQuery sums the unpaid trip expenses each participant paid for others and owes to others
+const tripBalancesQuery = `
+	SELECT u.id, u.discord_id,
+		COALESCE(SUM(t.amount - t.paid_amount) FILTER (WHERE t.payee_id = u.id), 0) AS paid,
+		COALESCE(SUM(t.amount - t.paid_amount) FILTER (WHERE t.payer_id = u.id), 0) AS owed
+	FROM transactions t
+	JOIN users u ON u.id IN (t.payer_id, t.payee_id)
+	WHERE ` + tripSettleableCondition + ` AND t.payer_id <> t.payee_id
+	GROUP BY u.id, u.discord_id
+	ORDER BY u.id`
+
+// scanTripBalances reads the rows produced by tripBalancesQuery
+func scanTripBalances(rows pgx.Rows) ([]TripBalance, error) {
+	defer rows.Close()
+
+	var balances []TripBalance
+	for rows.Next() {
+		var balance TripBalance
+		if err := rows.Scan(&balance.UserID, &balance.DiscordID, &balance.Paid, &balance.Owed); err != nil {
+			return nil, fmt.Errorf("error scanning trip balance: %w", err)
+		}
+		balances = append(balances, balance)
+	}
+	return balances, rows.Err()
+}
+
+// GetTripBalances returns each participant's running totals for the trip's unsettled expenses
+func GetTripBalances(tripID int) ([]TripBalance, error) {
+	rows, err := Pool.Query(context.Background(), tripBalancesQuery, tripID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying trip balances: %w", err)
+	}
+	return scanTripBalances(rows)
+}
+
+// planTripTransfers turns net balances into a small set of transfers by repeatedly matching
+// the participant who owes the most with the one who is owed the most
+func planTripTransfers(balances []TripBalance) []TripTransfer {
+	type position struct {
+		balance TripBalance
+		amount  float64
+	}
+	var debtors, creditors []position
+	for _, balance := range balances {
+		net := math.Round(balance.Net()*100) / 100
+		if net < -0.009 {
+			debtors = append(debtors, position{balance, -net})
+		} else if net > 0.009 {
+			creditors = append(creditors, position{balance, net})
+		}
+	}
+
+	var transfers []TripTransfer
+	for len(debtors) > 0 && len(creditors) > 0 {
+		sort.Slice(debtors, func(a, b int) bool { return debtors[a].amount > debtors[b].amount })
+		sort.Slice(creditors, func(a, b int) bool { return creditors[a].amount > creditors[b].amount })
+
+		amount := math.Min(debtors[0].amount, creditors[0].amount)
+		transfers = append(transfers, TripTransfer{
+			FromID:        debtors[0].balance.UserID,
+			ToID:          creditors[0].balance.UserID,
+			FromDiscordID: debtors[0].balance.DiscordID,
+			ToDiscordID:   creditors[0].balance.DiscordID,
+			Amount:        math.Round(amount*100) / 100,
+		})
+
+		debtors[0].amount = math.Round((debtors[0].amount-amount)*100) / 100
+		creditors[0].amount = math.Round((creditors[0].amount-amount)*100) / 100
+		if debtors[0].amount <= 0.009 {
+			debtors = debtors[1:]
+		}
+		if creditors[0].amount <= 0.009 {
+			creditors = creditors[1:]
+		}
+	}
+	return transfers
+}
+
+// CloseTrip settles a trip: its unpaid expenses are marked settled and replaced by the fewest
+// transfers that leave everyone even, each created as a new transaction. user_debts is moved
+// from the expenses to the transfers in the same DB transaction. Disputed expenses and expenses
+// with a slip under review are not settled and stay owed as they were.
+// Returns the transfers and the balances they settle.
+func CloseTrip(tripID int) ([]TripTransfer, []TripBalance, error) {
+	tx, err := Pool.Begin(context.Background())
+	if err != nil {
+		return nil, nil, fmt.Errorf("ไม่สามารถเริ่ม Transaction ได้: %w", err)
+	}
+	defer tx.Rollback(context.Background()) // Rollback if commit isn't called
+
+	var name string
+	err = tx.QueryRow(context.Background(), `
+		UPDATE trips SET status = $2, closed_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND status = $3
+		RETURNING name`, tripID, TripClosed, TripOpen).Scan(&name)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil, fmt.Errorf("ทริป #%d ถูกปิดไปแล้ว", tripID)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("error closing trip: %w", err)
+	}
+
+	// Lock the trip's expenses so payments can't land on them while they are settled
+	if _, err := tx.Exec(context.Background(),
+		`SELECT t.id FROM transactions t WHERE `+tripSettleableCondition+` FOR UPDATE OF t`, tripID); err != nil {
+		return nil, nil, fmt.Errorf("error locking trip expenses: %w", err)
+	}
+
+	rows, err := tx.Query(context.Background(), tripBalancesQuery, tripID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error querying trip balances: %w", err)
+	}
+	balances, err := scanTripBalances(rows)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Remove the expenses from the pairwise balances before replacing them with transfers
+	_, err = tx.Exec(context.Background(), `
+		WITH expenses AS (
+			SELECT t.payer_id, t.payee_id, SUM(t.amount - t.paid_amount) AS amount
+			FROM transactions t
+			WHERE `+tripSettleableCondition+` AND t.payer_id <> t.payee_id
+			GROUP BY t.payer_id, t.payee_id
+		)
+		UPDATE user_debts ud
+		SET amount = GREATEST(ud.amount - e.amount, 0), updated_at = CURRENT_TIMESTAMP
+		FROM expenses e
+		WHERE ud.debtor_id = e.payer_id AND ud.creditor_id = e.payee_id`, tripID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error updating user_debts: %w", err)
+	}
+
+	_, err = tx.Exec(context.Background(), `
+		UPDATE transactions t SET already_paid = TRUE, paid_amount = t.amount, paid_at = CURRENT_TIMESTAMP
+		WHERE `+tripSettleableCondition, tripID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error settling trip expenses: %w", err)
+	}
+
+	transfers := planTripTransfers(balances)
+	for idx := range transfers {
+		transfer := &transfers[idx]
+		err = tx.QueryRow(context.Background(), `
+			INSERT INTO transactions (payer_id, payee_id, amount, description)
+			VALUES ($1, $2, $3, $4)
+			RETURNING id
+		`, transfer.FromID, transfer.ToID, transfer.Amount, fmt.Sprintf("สรุปยอดทริป %s (#%d)", name, tripID)).Scan(&transfer.TxID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create trip transfer: %w", err)
+		}
+
+		_, err = tx.Exec(context.Background(), `
+			INSERT INTO user_debts (debtor_id, creditor_id, amount, created_at, updated_at)
+			VALUES ($1, $2, $3, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+			ON CONFLICT (debtor_id, creditor_id)
+			DO UPDATE SET amount = user_debts.amount + EXCLUDED.amount, updated_at = CURRENT_TIMESTAMP
+		`, transfer.FromID, transfer.ToID, transfer.Amount)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to update user_debts: %w", err)
+		}
+	}
+
+	if err = tx.Commit(context.Background()); err != nil {
+		return nil, nil, fmt.Errorf("ไม่สามารถ Commit Transaction ได้: %w", err)
+	}
+
+	log.Printf("Trip #%d closed: %d participants settled with %d transfers", tripID, len(balances), len(transfers))
+	return transfers, balances, nil
+}
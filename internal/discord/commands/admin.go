@@ -0,0 +1,46 @@
+package commands
+
+import (
+	"github.com/oatsaysai/billing-in-discord/internal/discord/handlers"
+)
+
+// RegisterAdminCommands registers all server maintenance commands
+func RegisterAdminCommands() {
+	// Register the reconcile command
+	registerCommand(CommandDefinition{
+		Name:        "reconcile",
+		Description: "Checks debt balances against unpaid transactions (admins only)",
+		Usage:       "!reconcile [fix]",
+		Examples: []string{
+			"!reconcile",
+			"!reconcile fix",
+		},
+		Handler: handlers.HandleReconcile,
+	})
+
+	// Register the duedays command
+	registerCommand(CommandDefinition{
+		Name:        "duedays",
+		Description: "Show or set how many days after creation new bills are due (setting requires admin)",
+		Usage:       "!duedays [days]",
+		Examples: []string{
+			"!duedays",
+			"!duedays 14",
+			"!duedays 0",
+		},
+		Handler: handlers.HandleDueDays,
+	})
+
+	// Register the billconsent command
+	registerCommand(CommandDefinition{
+		Name:        "billconsent",
+		Description: "Show or set whether bill debts wait for each participant to accept them (setting requires admin)",
+		Usage:       "!billconsent [on [hours] | off]",
+		Examples: []string{
+			"!billconsent",
+			"!billconsent on 24",
+			"!billconsent off",
+		},
+		Handler: handlers.HandleBillConsent,
+	})
+}
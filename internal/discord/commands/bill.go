@@ -10,14 +10,28 @@ func RegisterBillCommands() {
 	registerCommand(CommandDefinition{
 		Name:        "bill",
 		Description: "Create a bill to split expenses among users",
-		Usage:       "!bill [promptpay_id]\n<amount> for <description> with @user1 @user2...\n...",
+		Usage:       "!bill [promptpay_id] [paidby @payer [amount] [@payer amount...]]\n<amount> for <description> with @user1 @user2...\n...",
 		Examples: []string{
 			"!bill\n100 for dinner with @user1 @user2\n50 for drinks with @user1",
 			"!bill 0812345678\n200 for lunch with @user1 @user2 @user3",
+			"!bill paidby @user1\n300 for dinner with @user1 @user2 @user3",
+			"!bill paidby @user1 600 @user2 400\n1000 for hotel with @user1 @user2 @user3 @user4",
+			"!bill\nข้าวมันไก่ 60 หาร @user1 @user2\npizza 450 split with @user1 @user2 @user3\n@user1 @user2 120 coffee",
 		},
 		Handler: handlers.HandleBillCommand,
 	})
 
+	// Register the receipt command
+	registerCommand(CommandDefinition{
+		Name:        "receipt",
+		Description: "Show the archived receipt images of a bill",
+		Usage:       "!receipt <BillID>",
+		Examples: []string{
+			"!receipt 42",
+		},
+		Handler: handlers.HandleReceiptCommand,
+	})
+
 	// Register the qr command
 	registerCommand(CommandDefinition{
 		Name:        "qr",
@@ -29,4 +43,32 @@ func RegisterBillCommands() {
 		},
 		Handler: handlers.HandleQrCommand,
 	})
+
+	// Register the installment command
+	registerCommand(CommandDefinition{
+		Name:        "installment",
+		Description: "Split a large shared purchase into dated installments, or show and pay off plans",
+		Usage:       "!installment <amount> <count> @user1 [@user2...] [for <description>] [every:<days>] | list | status <id> | payoff <id>",
+		Examples: []string{
+			"!installment 30000 6 @user1 @user2 for espresso machine",
+			"!installment 1200 4 @user every:7 for concert tickets",
+			"!installment list",
+			"!installment status 3",
+			"!installment payoff 3",
+		},
+		Handler: handlers.HandleInstallment,
+	})
+
+	// Register the trip command
+	registerCommand(CommandDefinition{
+		Name:        "trip",
+		Description: "Collect a channel's expenses during a trip and settle them into the fewest transfers at the end",
+		Usage:       "!trip start <name> | summary | close",
+		Examples: []string{
+			"!trip start Chiang Mai 2024",
+			"!trip summary",
+			"!trip close",
+		},
+		Handler: handlers.HandleTrip,
+	})
 }
@@ -60,4 +60,27 @@ func RegisterDebtCommands() {
 		},
 		Handler: handlers.HandleDuesForUser,
 	})
+
+	// Register the net command
+	registerCommand(CommandDefinition{
+		Name:        "net",
+		Description: "Offset mutual debts with another user so only the difference remains",
+		Usage:       "!net @user",
+		Examples: []string{
+			"!net @user",
+		},
+		Handler: handlers.HandleNet,
+	})
+
+	// Register the iowe command
+	registerCommand(CommandDefinition{
+		Name:        "iowe",
+		Description: "Record a debt you owe another user, it counts once they accept it",
+		Usage:       "!iowe @user <amount> [for <description>]",
+		Examples: []string{
+			"!iowe @user 200 for taxi",
+			"!iowe @user 500",
+		},
+		Handler: handlers.HandleIOwe,
+	})
 }
@@ -0,0 +1,24 @@
+package commands
+
+import (
+	"github.com/oatsaysai/billing-in-discord/internal/discord/handlers"
+)
+
+// RegisterDisputeCommands registers all dispute-related commands
+func RegisterDisputeCommands() {
+	// Register the dispute command
+	registerCommand(CommandDefinition{
+		Name:        "dispute",
+		Description: "Views and manages payment disputes",
+		Usage:       "!dispute [list|<id>|note <id> <text>|evidence <id> [text]|arbiter <id> @moderator|resolve <id> paid|unpaid [note]]",
+		Examples: []string{
+			"!dispute",
+			"!dispute 12",
+			"!dispute note 12 โอนแล้วเมื่อวาน แนบสลิปให้แล้ว",
+			"!dispute evidence 12 ขอสลิปหน่อย",
+			"!dispute arbiter 12 @moderator",
+			"!dispute resolve 12 paid",
+		},
+		Handler: handlers.HandleDispute,
+	})
+}
@@ -29,4 +29,40 @@ func RegisterPaymentCommands() {
 		},
 		Handler: handlers.HandleRequestPayment,
 	})
+
+	// Register the reviews command
+	registerCommand(CommandDefinition{
+		Name:        "reviews",
+		Description: "Lists payment slips awaiting your review",
+		Usage:       "!reviews",
+		Examples: []string{
+			"!reviews",
+		},
+		Handler: handlers.HandleListReviews,
+	})
+
+	// Register the slip command
+	registerCommand(CommandDefinition{
+		Name:        "slip",
+		Description: "Show the archived payment slips of a transaction",
+		Usage:       "!slip <TxID>",
+		Examples: []string{
+			"!slip 123",
+		},
+		Handler: handlers.HandleSlipCommand,
+	})
+
+	// Register the latefee command
+	registerCommand(CommandDefinition{
+		Name:        "latefee",
+		Description: "Show or set the late fee charged on your debtors' overdue transactions",
+		Usage:       "!latefee [off | flat <amount> | percent <rate>] [every <days>] [max <count>]",
+		Examples: []string{
+			"!latefee",
+			"!latefee flat 20 every 7 max 3",
+			"!latefee percent 2",
+			"!latefee off",
+		},
+		Handler: handlers.HandleLateFee,
+	})
 }
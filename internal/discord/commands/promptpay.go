@@ -10,10 +10,11 @@ func RegisterPromptPayCommands() {
 	registerCommand(CommandDefinition{
 		Name:        "setpromptpay",
 		Description: "Sets your PromptPay ID for receiving payments",
-		Usage:       "!setpromptpay <promptpay_id>",
+		Usage:       "!setpromptpay <promptpay_id> [ชื่อบัญชี]",
 		Examples: []string{
 			"!setpromptpay 0812345678",
 			"!setpromptpay 1234567890123",
+			"!setpromptpay 0812345678 สมชาย ใจดี",
 		},
 		Handler: handlers.HandleSetPromptPay,
 	})
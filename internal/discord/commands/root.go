@@ -39,6 +39,9 @@ func Register() {
 	// Register payment commands
 	RegisterPaymentCommands()
 
+	// Register dispute commands
+	RegisterDisputeCommands()
+
 	// Register promptpay commands
 	RegisterPromptPayCommands()
 
@@ -51,6 +54,9 @@ func Register() {
 	// Register streak commands
 	RegisterStreakCommands()
 
+	// Register admin commands
+	RegisterAdminCommands()
+
 	// Register help command
 	RegisterHelpCommand()
 }
@@ -6,9 +6,11 @@ import (
 	"log"
 	"net/http"
 	"regexp"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/oatsaysai/billing-in-discord/internal/discord/handlers"
+	"github.com/oatsaysai/billing-in-discord/pkg/blobstore"
 	"github.com/oatsaysai/billing-in-discord/pkg/firebase"
 	"github.com/oatsaysai/billing-in-discord/pkg/ocr"
 	"github.com/oatsaysai/billing-in-discord/pkg/verifier"
@@ -36,6 +38,11 @@ func SetOCRClient(client *ocr.Client) {
 	handlers.SetOCRClient(client)
 }
 
+// SetBlobStore sets the archive of receipt and slip images
+func SetBlobStore(store blobstore.Store) {
+	handlers.SetBlobStore(store)
+}
+
 // SetVerifierClient sets the verifier client
 func SetVerifierClient(client *verifier.Client) {
 	verifierClient = client
@@ -61,6 +68,14 @@ func Initialize(token string) error {
 		ProcessCommand(s, m)
 	})
 
+	// Keep bills in sync when their !bill message is edited or deleted
+	session.AddHandler(func(s *discordgo.Session, m *discordgo.MessageUpdate) {
+		go handlers.HandleBillMessageUpdate(s, m)
+	})
+	session.AddHandler(func(s *discordgo.Session, m *discordgo.MessageDelete) {
+		go handlers.HandleBillMessageDelete(s, m)
+	})
+
 	// Register component handlers for interactive UI
 	handlers.RegisterComponentHandlers(session)
 
@@ -124,7 +139,73 @@ func CleanupExpiredSites() {
 	}
 }
 
+// CleanupExpiredInteractionStates deletes interaction states of expired buttons and menus
+func CleanupExpiredInteractionStates() {
+	deleted, err := db.DeleteExpiredInteractionStates()
+	if err != nil {
+		log.Printf("Error cleaning up expired interaction states: %v", err)
+		return
+	}
+	if deleted > 0 {
+		log.Printf("Cleaned up %d expired interaction states", deleted)
+	}
+}
+
+// CleanupProcessedEvents forgets processed messages and interactions too old to be replayed
+func CleanupProcessedEvents() {
+	deleted, err := db.DeleteProcessedEventsOlderThan(7 * 24 * time.Hour)
+	if err != nil {
+		log.Printf("Error cleaning up processed events: %v", err)
+		return
+	}
+	if deleted > 0 {
+		log.Printf("Cleaned up %d processed events", deleted)
+	}
+}
+
+// CleanupExpiredOCRResults removes cached OCR results past their TTL
+func CleanupExpiredOCRResults() {
+	deleted, err := db.DeleteExpiredOCRResults()
+	if err != nil {
+		log.Printf("Error cleaning up expired OCR results: %v", err)
+		return
+	}
+	if deleted > 0 {
+		log.Printf("Cleaned up %d expired OCR results", deleted)
+	}
+}
+
+// RunDebtReconciliation is a bridge to the handler's scheduled reconciliation
+func RunDebtReconciliation(autoFix bool, reportChannelID string) {
+	handlers.RunScheduledReconciliation(autoFix, reportChannelID)
+}
+
+// RunLateFees is a bridge to the handler's scheduled late fee charging
+func RunLateFees() {
+	handlers.RunScheduledLateFees()
+}
+
+// RunInstallmentReminders is a bridge to the handler's installment reminders
+func RunInstallmentReminders() {
+	handlers.RunInstallmentReminders()
+}
+
+// RunBillConsentAutoAccept is a bridge to the handler's auto-accept of expired pending bill debts
+func RunBillConsentAutoAccept() {
+	handlers.RunBillConsentAutoAccept()
+}
+
 // HandleBillWebhookCallback is a bridge to the handler's implementation
 func HandleBillWebhookCallback(w http.ResponseWriter, r *http.Request) {
 	handlers.HandleBillWebhookCallback(w, r)
 }
+
+// HandleBillClaimsState is a bridge to the handler's live allocation state of the web page
+func HandleBillClaimsState(w http.ResponseWriter, r *http.Request) {
+	handlers.HandleBillClaimsState(w, r)
+}
+
+// HandleBillClaimsClaim is a bridge to the handler's item claiming from the web page
+func HandleBillClaimsClaim(w http.ResponseWriter, r *http.Request) {
+	handlers.HandleBillClaimsClaim(w, r)
+}
@@ -0,0 +1,299 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/oatsaysai/billing-in-discord/internal/db"
+	"github.com/oatsaysai/billing-in-discord/pkg/blobstore"
+)
+
+// archiveFilesPerMessage is the number of files Discord accepts in one message
+const archiveFilesPerMessage = 10
+
+var (
+	blobStore blobstore.Store
+)
+
+// SetBlobStore sets the store where receipt and slip images are archived
+func SetBlobStore(store blobstore.Store) {
+	blobStore = store
+}
+
+// archiveImageFile copies a downloaded receipt or slip into the blob store before its temporary file is removed.
+// The blob key is derived from the content, so an image posted again is stored once.
+// It returns the archived image ID, or 0 if the image could not be archived.
+func archiveImageFile(kind, path, imageHash string, attachment *discordgo.MessageAttachment, m *discordgo.MessageCreate) int {
+	if blobStore == nil {
+		return 0
+	}
+	if imageHash == "" {
+		var err error
+		if imageHash, err = imageContentHash(path); err != nil {
+			log.Printf("Archive: Failed to hash %s image %s: %v", kind, path, err)
+			return 0
+		}
+	}
+
+	ext := strings.ToLower(filepath.Ext(attachment.Filename))
+	if ext == "" {
+		ext = ".png"
+	}
+	blobKey := fmt.Sprintf("%ss/%s/%s%s", kind, imageHash[:2], imageHash, ext)
+
+	file, err := os.Open(path)
+	if err != nil {
+		log.Printf("Archive: Failed to open %s image %s: %v", kind, path, err)
+		return 0
+	}
+	defer file.Close()
+	if err := blobStore.Put(blobKey, file); err != nil {
+		log.Printf("Archive: %v", err)
+		return 0
+	}
+
+	imageID, err := db.ArchiveImage(&db.ArchivedImage{
+		Kind:            kind,
+		ImageHash:       imageHash,
+		BlobKey:         blobKey,
+		Filename:        attachment.Filename,
+		ContentType:     attachment.ContentType,
+		SourceMessageID: m.ID,
+		ChannelID:       m.ChannelID,
+		GuildID:         m.GuildID,
+		UploadedBy:      m.Author.ID,
+		SourceURL:       attachment.URL,
+	})
+	if err != nil {
+		log.Printf("Archive: %v", err)
+		return 0
+	}
+	return imageID
+}
+
+// linkArchivedSlip links an archived slip to the transactions it paid
+func linkArchivedSlip(imageID int, txIDs []int) {
+	if imageID == 0 || len(txIDs) == 0 {
+		return
+	}
+	if err := db.LinkArchivedImageTransactions(imageID, txIDs); err != nil {
+		log.Printf("Archive: %v", err)
+	}
+}
+
+// linkArchivedSlipURL links the archived slip downloaded from a URL to the transactions it paid
+func linkArchivedSlipURL(slipURL string, txIDs []int) {
+	imageID, err := db.GetArchivedImageIDByURL(db.ArchiveSlip, slipURL)
+	if err != nil {
+		log.Printf("Archive: %v", err)
+		return
+	}
+	linkArchivedSlip(imageID, txIDs)
+}
+
+// openArchivedImageFile opens an archived image as a file to attach to a message, nil if it isn't available.
+// The caller closes the file's reader once the message was sent.
+func openArchivedImageFile(imageID int) *discordgo.File {
+	if blobStore == nil || imageID == 0 {
+		return nil
+	}
+	image, err := db.GetArchivedImage(imageID)
+	if err != nil || image == nil {
+		if err != nil {
+			log.Printf("Archive: %v", err)
+		}
+		return nil
+	}
+	reader, err := blobStore.Open(image.BlobKey)
+	if err != nil {
+		log.Printf("Archive: Failed to open archived image %d: %v", image.ID, err)
+		return nil
+	}
+	filename := image.Filename
+	if filename == "" {
+		filename = filepath.Base(image.BlobKey)
+	}
+	return &discordgo.File{Name: filename, ContentType: image.ContentType, Reader: reader}
+}
+
+// billReceiptHint tells how to retrieve the receipts of a bill later, empty if none were archived
+func billReceiptHint(messageID string) string {
+	bill, err := db.GetBillByMessageID(messageID)
+	if err != nil || bill == nil {
+		return ""
+	}
+	images, err := db.GetBillReceiptImages(bill.ID)
+	if err != nil || len(images) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("\n🧾 ดูรูปใบเสร็จของบิลนี้ภายหลังได้ด้วย `!receipt %d`", bill.ID)
+}
+
+// canViewArchive reports whether a member may see evidence of others, as arbiters of disputes can
+func canViewArchive(s *discordgo.Session, m *discordgo.MessageCreate, guildID string) bool {
+	if m.GuildID == "" || m.GuildID != guildID {
+		return false
+	}
+	permissions, err := s.UserChannelPermissions(m.Author.ID, m.ChannelID)
+	return err == nil && permissions&arbiterPermissions != 0
+}
+
+// sendArchivedImages sends archived images from the blob store, at most archiveFilesPerMessage per message
+func sendArchivedImages(s *discordgo.Session, channelID, content string, images []db.ArchivedImage) {
+	var files []*discordgo.File
+	var closers []io.Closer
+	var missing []string
+	flush := func() {
+		if len(files) == 0 {
+			return
+		}
+		if _, err := s.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{Content: content, Files: files}); err != nil {
+			log.Printf("Archive: Failed to send archived images: %v", err)
+			SendErrorMessage(s, channelID, "ไม่สามารถส่งรูปภาพที่เก็บไว้ได้")
+		}
+		for _, closer := range closers {
+			closer.Close()
+		}
+		files, closers, content = nil, nil, ""
+	}
+
+	for _, image := range images {
+		reader, err := blobStore.Open(image.BlobKey)
+		if err != nil {
+			log.Printf("Archive: Failed to open archived image %d: %v", image.ID, err)
+			missing = append(missing, image.Filename)
+			continue
+		}
+		filename := image.Filename
+		if filename == "" {
+			filename = filepath.Base(image.BlobKey)
+		}
+		files = append(files, &discordgo.File{Name: filename, ContentType: image.ContentType, Reader: reader})
+		closers = append(closers, reader)
+		if len(files) == archiveFilesPerMessage {
+			flush()
+		}
+	}
+	flush()
+
+	if len(missing) > 0 {
+		SendErrorMessage(s, channelID, fmt.Sprintf("ไม่พบไฟล์รูปภาพในที่เก็บ: %s", strings.Join(missing, ", ")))
+	}
+}
+
+// sendArchivedImagesByDM sends archived images to the requester privately, so evidence never
+// ends up in a channel or guild other than the one it was posted in
+func sendArchivedImagesByDM(s *discordgo.Session, m *discordgo.MessageCreate, content string, images []db.ArchivedImage) {
+	dmChannel, err := s.UserChannelCreate(m.Author.ID)
+	if err != nil {
+		log.Printf("Archive: Failed to open DM with %s: %v", m.Author.ID, err)
+		SendErrorMessage(s, m.ChannelID, "ไม่สามารถส่งข้อความส่วนตัวถึงคุณได้")
+		return
+	}
+	sendArchivedImages(s, dmChannel.ID, content, images)
+	if m.GuildID != "" {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("📬 ส่งรูปภาพไปยังข้อความส่วนตัวของ <@%s> แล้ว", m.Author.ID))
+	}
+}
+
+// HandleReceiptCommand handles !receipt <BillID>, sending the archived receipt images of a bill by DM
+func HandleReceiptCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+	if len(args) < 2 {
+		SendErrorMessage(s, m.ChannelID, "รูปแบบไม่ถูกต้อง โปรดใช้ `!receipt <BillID>`")
+		return
+	}
+	if blobStore == nil {
+		SendErrorMessage(s, m.ChannelID, "ยังไม่ได้ตั้งค่าที่เก็บรูปภาพ จึงไม่สามารถดูรูปใบเสร็จได้")
+		return
+	}
+	billID, err := strconv.Atoi(strings.TrimPrefix(args[1], "#"))
+	if err != nil {
+		SendErrorMessage(s, m.ChannelID, fmt.Sprintf("BillID '%s' ไม่ถูกต้อง", args[1]))
+		return
+	}
+
+	bill, err := db.GetBill(billID)
+	if err != nil {
+		log.Printf("Archive: %v", err)
+		SendErrorMessage(s, m.ChannelID, "ไม่สามารถดึงข้อมูลบิลได้")
+		return
+	}
+	if bill == nil {
+		SendErrorMessage(s, m.ChannelID, fmt.Sprintf("ไม่พบบิล #%d", billID))
+		return
+	}
+	participant, err := db.IsBillParticipant(billID, m.Author.ID)
+	if err != nil {
+		log.Printf("Archive: %v", err)
+	}
+	if !participant && !canViewArchive(s, m, bill.GuildID) {
+		SendErrorMessage(s, m.ChannelID, fmt.Sprintf("คุณไม่ได้เกี่ยวข้องกับบิล #%d", billID))
+		return
+	}
+
+	images, err := db.GetBillReceiptImages(billID)
+	if err != nil {
+		log.Printf("Archive: %v", err)
+		SendErrorMessage(s, m.ChannelID, "ไม่สามารถดึงรูปใบเสร็จได้")
+		return
+	}
+	if len(images) == 0 {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("บิล #%d ไม่มีรูปใบเสร็จที่เก็บไว้", billID))
+		return
+	}
+	sendArchivedImagesByDM(s, m, fmt.Sprintf("🧾 **รูปใบเสร็จของบิล #%d** (%d รูป, ส่งโดย <@%s> เมื่อ %s)",
+		billID, len(images), images[0].UploadedBy, images[0].CreatedAt.Local().Format("02/01/2006 15:04")), images)
+}
+
+// HandleSlipCommand handles !slip <TxID>, sending the archived payment slips of a transaction by DM
+func HandleSlipCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+	if len(args) < 2 {
+		SendErrorMessage(s, m.ChannelID, "รูปแบบไม่ถูกต้อง โปรดใช้ `!slip <TxID>`")
+		return
+	}
+	if blobStore == nil {
+		SendErrorMessage(s, m.ChannelID, "ยังไม่ได้ตั้งค่าที่เก็บรูปภาพ จึงไม่สามารถดูรูปสลิปได้")
+		return
+	}
+	txID, err := strconv.Atoi(strings.TrimPrefix(args[1], "#"))
+	if err != nil {
+		SendErrorMessage(s, m.ChannelID, fmt.Sprintf("TxID '%s' ไม่ถูกต้อง", args[1]))
+		return
+	}
+
+	txInfo, err := db.GetTransactionInfo(txID)
+	if err != nil {
+		SendErrorMessage(s, m.ChannelID, fmt.Sprintf("ไม่พบรายการ TxID %d", txID))
+		return
+	}
+	images, err := db.GetTransactionSlipImages(txID)
+	if err != nil {
+		log.Printf("Archive: %v", err)
+		SendErrorMessage(s, m.ChannelID, "ไม่สามารถดึงรูปสลิปได้")
+		return
+	}
+
+	authorDbID, err := db.GetOrCreateUser(m.Author.ID)
+	if err != nil {
+		SendErrorMessage(s, m.ChannelID, "ไม่สามารถดึงข้อมูลผู้ใช้ได้")
+		return
+	}
+	participant := authorDbID == txInfo["payer_id"].(int) || authorDbID == txInfo["payee_id"].(int)
+	if !participant && (len(images) == 0 || !canViewArchive(s, m, images[0].GuildID)) {
+		SendErrorMessage(s, m.ChannelID, fmt.Sprintf("คุณไม่ได้เกี่ยวข้องกับรายการ TxID %d", txID))
+		return
+	}
+
+	if len(images) == 0 {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("รายการ TxID %d ไม่มีรูปสลิปที่เก็บไว้", txID))
+		return
+	}
+	sendArchivedImagesByDM(s, m, fmt.Sprintf("🧾 **รูปสลิปของรายการ TxID %d** (%d รูป, ส่งโดย <@%s> เมื่อ %s)",
+		txID, len(images), images[0].UploadedBy, images[0].CreatedAt.Local().Format("02/01/2006 15:04")), images)
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"strconv"
@@ -12,10 +13,10 @@ import (
 
 // HandleBillCommand handles the !bill command
 func HandleBillCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
-	// Check if there's an attachment (bill image)
+	// Check if there are attachments (bill images)
 	if len(m.Attachments) > 0 {
-		// Process the first attachment as a bill image
-		HandleOCRBillAttachment(s, m, m.Attachments[0])
+		// Every attached image is a receipt or part of one
+		HandleOCRBillAttachments(s, m, m.Attachments)
 		return
 	}
 
@@ -32,16 +33,37 @@ func HandleBillCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []
 		return
 	}
 
+	// An optional due:<days|date> overrides the server's default due date
+	firstLineArgs, dueDate, hasDueDate, err := extractDueDateArg(firstLineParts[1:])
+	if err != nil {
+		SendErrorMessage(s, m.ChannelID, err.Error())
+		return
+	}
+	if !hasDueDate {
+		dueDate = defaultDueDate(m.GuildID)
+	}
+
+	// An optional paidby @user [amount]... names who actually fronted the money
+	firstLineArgs, paidBy, err := extractPaidByArg(firstLineArgs, m.Author.ID)
+	if err != nil {
+		SendErrorMessage(s, m.ChannelID, err.Error())
+		return
+	}
+
 	var promptPayID string
-	if len(firstLineParts) > 1 {
-		// Check if the second part is a valid PromptPay ID
-		if db.IsValidPromptPayID(firstLineParts[1]) {
-			promptPayID = firstLineParts[1]
+	if len(firstLineArgs) > 0 {
+		// Check if the remaining argument is a valid PromptPay ID
+		if db.IsValidPromptPayID(firstLineArgs[0]) {
+			promptPayID = firstLineArgs[0]
 		} else {
-			SendErrorMessage(s, m.ChannelID, fmt.Sprintf("PromptPayID '%s' ในบรรทัดแรกดูเหมือนจะไม่ถูกต้อง", firstLineParts[1]))
+			SendErrorMessage(s, m.ChannelID, fmt.Sprintf("PromptPayID '%s' ในบรรทัดแรกดูเหมือนจะไม่ถูกต้อง", firstLineArgs[0]))
 			return
 		}
 	}
+	if promptPayID != "" && len(paidBy) > 0 {
+		SendErrorMessage(s, m.ChannelID, "ไม่สามารถระบุ PromptPay ID พร้อมกับ `paidby` ได้ ระบบจะใช้ PromptPay ID ที่ผู้จ่ายแต่ละคนตั้งค่าไว้")
+		return
+	}
 
 	payeeDiscordID := m.Author.ID
 	payeeDbID, err := db.GetOrCreateUser(payeeDiscordID)
@@ -50,8 +72,9 @@ func HandleBillCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []
 		return
 	}
 
-	// If promptPayID is not provided in the command, try to get it from the database
-	if promptPayID == "" {
+	// If promptPayID is not provided in the command, try to get it from the database.
+	// Bills paid by someone else use each payer's own PromptPay ID once they confirm.
+	if promptPayID == "" && len(paidBy) == 0 {
 		dbPromptPayID, err := db.GetUserPromptPayID(payeeDbID)
 		if err != nil {
 			// If there's no promptPayID stored, just notify the user but continue processing
@@ -62,100 +85,42 @@ func HandleBillCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []
 		}
 	}
 
-	userTotalDebts := make(map[string]float64) // payerDiscordID -> totalOwed
-	userTxIDs := make(map[string][]int)        // payerDiscordID -> list of TxIDs for this bill
-	var billItemsSummary strings.Builder
-	billItemsSummary.WriteString(fmt.Sprintf("สรุปบิลโดย <@%s>:\n", m.Author.ID))
-	totalBillAmount := 0.0
-	hasErrors := false
-
-	for i, line := range lines[1:] {
-		lineNum := i + 2 // User-facing line number
-		trimmedLine := strings.TrimSpace(line)
-		if trimmedLine == "" {
-			continue // Skip empty lines
-		}
-
-		// Try parsing as a regular bill item
-		amount, description, mentions, parseErr := parseAltBillItem(trimmedLine)
-		if parseErr != nil {
-			amount, description, mentions, parseErr = parseBillItem(trimmedLine)
-			if parseErr != nil {
-				SendErrorMessage(s, m.ChannelID, fmt.Sprintf("บรรทัดที่ %d มีข้อผิดพลาด: %v", lineNum, parseErr))
-				hasErrors = true
-				continue
-			}
-		}
-
-		totalBillAmount += amount
-		billItemsSummary.WriteString(fmt.Sprintf("- `%.2f` สำหรับ **%s**, หารกับ: ", amount, description))
-		for _, uid := range mentions {
-			billItemsSummary.WriteString(fmt.Sprintf("<@%s> ", uid))
-		}
-		billItemsSummary.WriteString("\n")
-
-		amountPerPerson := amount / float64(len(mentions))
-		if amountPerPerson < 0.01 && amount > 0 { // Avoid tiny dust amounts
-			SendErrorMessage(s, m.ChannelID, fmt.Sprintf("บรรทัดที่ %d: จำนวนเงินต่อคนน้อยเกินไป (%.4f)", lineNum, amountPerPerson))
-			hasErrors = true
-			continue
-		}
-
-		for _, payerDiscordID := range mentions {
-			payerDbID, dbErr := db.GetOrCreateUser(payerDiscordID)
-			if dbErr != nil {
-				log.Printf("Error DB user %s for item '%s' line %d: %v", payerDiscordID, description, lineNum, dbErr)
-				SendErrorMessage(s, m.ChannelID, fmt.Sprintf("บรรทัดที่ %d: เกิดข้อผิดพลาด DB สำหรับ <@%s>", lineNum, payerDiscordID))
-				hasErrors = true
-				continue // Skip this specific payer for this item
-			}
-
-			txID, txErr := db.CreateTransaction(payerDbID, payeeDbID, amountPerPerson, description)
-			if txErr != nil {
-				log.Printf("Failed to save transaction for user %s, item '%s' line %d: %v", payerDiscordID, description, lineNum, txErr)
-				SendErrorMessage(s, m.ChannelID, fmt.Sprintf("บรรทัดที่ %d: เกิดข้อผิดพลาดในการบันทึก transaction สำหรับ <@%s>", lineNum, payerDiscordID))
-				hasErrors = true
-				continue // Skip this specific payer for this item
-			}
-
-			userTotalDebts[payerDiscordID] += amountPerPerson
-			userTxIDs[payerDiscordID] = append(userTxIDs[payerDiscordID], txID)
-
-			// Update user_debts table
-			debtErr := db.UpdateUserDebt(payerDbID, payeeDbID, amountPerPerson)
-			if debtErr != nil {
-				log.Printf("Failed to update debt for user %s, item '%s' line %d: %v", payerDiscordID, description, lineNum, debtErr)
-				SendErrorMessage(s, m.ChannelID, fmt.Sprintf("บรรทัดที่ %d: เกิดข้อผิดพลาดในการอัปเดตยอดหนี้สำหรับ <@%s>", lineNum, payerDiscordID))
-				hasErrors = true // Mark error, but transaction was saved
-			}
-		}
+	items, hasErrors := parseBillLines(s, m.ChannelID, lines[1:])
+	// Nothing is written unless every line of the bill is valid
+	if hasErrors {
+		SendErrorMessage(s, m.ChannelID, "บิลมีรายการที่ผิดพลาด ยังไม่มีการบันทึกรายการใดๆ โปรดแก้ไขแล้วส่งบิลใหม่อีกครั้ง")
+		return
+	}
+	if len(items) == 0 {
+		SendErrorMessage(s, m.ChannelID, "ไม่พบรายการที่ถูกต้องในบิล")
+		return
 	}
 
-	// Send bill summary
-	s.ChannelMessageSend(m.ChannelID, billItemsSummary.String())
-
-	if len(userTotalDebts) > 0 {
-		var qrSummary strings.Builder
-		qrSummary.WriteString(fmt.Sprintf("\n**ยอดรวมทั้งสิ้น: %.2f บาท**\n", totalBillAmount))
-		if hasErrors {
-			qrSummary.WriteString("⚠️ *มีข้อผิดพลาดเกิดขึ้นในการประมวลผลบางรายการ โปรดตรวจสอบข้อความก่อนหน้า*\n")
-		}
+	// Someone else fronted the money: the debts wait for the payers to confirm
+	if len(paidBy) > 0 {
+		var billItemsSummary strings.Builder
+		totalBillAmount := writeBillItemsSummary(&billItemsSummary, m.Author.ID, items)
+		handlePaidByBill(s, m, items, paidBy, totalBillAmount, dueDate, &billItemsSummary)
+		return
+	}
 
-		// Only mention QR codes if we have a PromptPay ID
-		if promptPayID != "" {
-			qrSummary.WriteString("\nสร้าง QR Code สำหรับชำระเงิน:\n")
-		}
-		s.ChannelMessageSend(m.ChannelID, qrSummary.String())
+	// The bill is only recorded once the author confirms the preview
+	sendBillPreview(s, m, items, promptPayID, dueDate)
+}
 
-		for payerDiscordID, totalOwed := range userTotalDebts {
-			if promptPayID != "" && totalOwed > 0.009 { // Only send QR if ID provided and amount is significant
-				relevantTxIDs := userTxIDs[payerDiscordID]
-				GenerateAndSendQrCode(s, m.ChannelID, promptPayID, totalOwed, payerDiscordID, fmt.Sprintf("ยอดรวมจากบิลนี้โดย <@%s>", m.Author.ID), relevantTxIDs)
-			}
+// writeBillItemsSummary writes the bill's items to sb and returns the bill total
+func writeBillItemsSummary(sb *strings.Builder, authorDiscordID string, items []billLine) float64 {
+	sb.WriteString(fmt.Sprintf("สรุปบิลโดย <@%s>:\n", authorDiscordID))
+	totalBillAmount := 0.0
+	for _, item := range items {
+		totalBillAmount += item.Amount
+		sb.WriteString(fmt.Sprintf("- `%.2f` สำหรับ **%s**, หารกับ: ", item.Amount, item.Description))
+		for _, uid := range item.Mentions {
+			sb.WriteString(fmt.Sprintf("<@%s> ", uid))
 		}
-	} else if !hasErrors {
-		s.ChannelMessageSend(m.ChannelID, "ไม่พบรายการที่ถูกต้องในบิล")
+		sb.WriteString("\n")
 	}
+	return totalBillAmount
 }
 
 // HandleQrCommand handles the !qr command
@@ -167,7 +132,17 @@ func HandleQrCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []st
 		return
 	}
 
-	amount, toUserDiscordID, description, promptPayID, err := parseQrArgs(m.Content, payeeDbID)
+	// An optional due:<days|date> overrides the server's default due date
+	qrArgs, dueDate, hasDueDate, err := extractDueDateArg(strings.Fields(m.Content))
+	if err != nil {
+		SendErrorMessage(s, m.ChannelID, err.Error())
+		return
+	}
+	if !hasDueDate {
+		dueDate = defaultDueDate(m.GuildID)
+	}
+
+	amount, toUserDiscordID, description, promptPayID, err := parseQrArgs(strings.Join(qrArgs, " "), payeeDbID)
 	if err != nil {
 		SendErrorMessage(s, m.ChannelID, err.Error())
 		return
@@ -179,13 +154,30 @@ func HandleQrCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []st
 		return
 	}
 
-	txID, err := db.CreateTransaction(payerDbID, payeeDbID, amount, description)
+	// With the guild's consent policy the debt waits for the payer to accept it, like a bill's would
+	consentTimeout := billConsentTimeout(m.GuildID)
+	pending := consentTimeout > 0 && toUserDiscordID != payeeDiscordID
+	txID, err := db.CreateSourcedTransaction(payerDbID, payeeDbID, amount, description, m.ID, pending)
+	if errors.Is(err, db.ErrDuplicateSource) {
+		log.Printf("Skipping !qr message %s, its transaction was already created", m.ID)
+		return
+	}
 	if err != nil {
 		log.Printf("Failed to save transaction for !qr from %s to %s: %v", payeeDiscordID, toUserDiscordID, err)
 		SendErrorMessage(s, m.ChannelID, "เกิดข้อผิดพลาดในการบันทึก Transaction")
 		return
 	}
 
+	if pending {
+		summary := fmt.Sprintf("บันทึก %.2f บาท ที่ <@%s> ต้องจ่ายให้ <@%s> ค่า %s (TxID: %d)\n",
+			amount, toUserDiscordID, payeeDiscordID, description, txID)
+		if dueDateLine := setBillDueDate([]int{txID}, dueDate); dueDateLine != "" {
+			summary += dueDateLine + "\n"
+		}
+		requestBillConsent(s, m.ChannelID, m.GuildID, payeeDiscordID, promptPayID, map[string][]int{toUserDiscordID: {txID}}, summary, consentTimeout)
+		return
+	}
+
 	err = db.UpdateUserDebt(payerDbID, payeeDbID, amount)
 	if err != nil {
 		log.Printf("Failed to update debt for !qr from %s to %s: %v", payeeDiscordID, toUserDiscordID, err)
@@ -193,8 +185,25 @@ func HandleQrCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []st
 		return
 	}
 
+	// Expenses of an open trip are settled when the trip closes instead
+	if tripLine, inTrip := addBillToTrip(m.ChannelID, []int{txID}); inTrip {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("บันทึก %.2f บาท ที่ <@%s> ต้องจ่ายให้ <@%s> (TxID: %d)\n%s",
+			amount, toUserDiscordID, payeeDiscordID, txID, tripLine))
+		return
+	}
+
+	if dueDateLine := setBillDueDate([]int{txID}, dueDate); dueDateLine != "" {
+		s.ChannelMessageSend(m.ChannelID, dueDateLine)
+	}
+
+	// Settle what we can from credit and mutual debts before asking for money
+	amount, txIDs := prepareBillPayment(s, m.ChannelID, toUserDiscordID, payeeDiscordID, amount, []int{txID})
+	if amount <= 0.009 {
+		return
+	}
+
 	// Generate and send QR code
-	GenerateAndSendQrCode(s, m.ChannelID, promptPayID, amount, toUserDiscordID, description, []int{txID})
+	GenerateAndSendQrCode(s, m.ChannelID, promptPayID, amount, toUserDiscordID, description, txIDs)
 }
 
 // parseQrArgs parses the arguments for the !qr command
@@ -273,81 +282,41 @@ func parseQrArgs(content string, userDbID int) (amount float64, toUser string, d
 	return amount, toUser, description, promptPayID, nil
 }
 
-// parseBillItem parses a bill item line from the !bill command
-func parseBillItem(line string) (amount float64, description string, mentions []string, err error) {
-	normalizedContent := strings.ToLower(line)
-	parts := strings.Fields(normalizedContent)
-	if len(parts) < 4 {
-		return 0, "", nil, fmt.Errorf("รูปแบบรายการไม่ถูกต้อง โปรดใช้: `<จำนวนเงิน> for <รายละเอียด> with @user1 @user2...`")
-	}
-	amountNum, err := strconv.ParseFloat(parts[0], 64)
-	if err != nil {
-		return 0, "", nil, fmt.Errorf("จำนวนเงินในรายการไม่ถูกต้อง: '%s'", parts[0])
-	}
-	amount = amountNum
-	forIndex, withIndex := -1, -1
-	for i, p := range parts {
-		if p == "for" && forIndex == -1 {
-			forIndex = i
-		}
-		if p == "with" && withIndex == -1 {
-			withIndex = i
+// billLine is one parsed item line of a text bill
+type billLine struct {
+	LineNum     int      `json:"line_num"` // User-facing line number
+	Amount      float64  `json:"amount"`
+	Description string   `json:"description"`
+	Mentions    []string `json:"mentions"`
+}
+
+// parseBillLines parses the item lines of a text bill, reporting each invalid line in the channel.
+// It returns the valid items and whether any line had errors.
+func parseBillLines(s *discordgo.Session, channelID string, lines []string) ([]billLine, bool) {
+	var items []billLine
+	hasErrors := false
+	for i, line := range lines {
+		lineNum := i + 2 // User-facing line number
+		trimmedLine := strings.TrimSpace(line)
+		if trimmedLine == "" {
+			continue // Skip empty lines
 		}
-	}
-	if forIndex != 1 || withIndex == -1 || forIndex >= withIndex {
-		return 0, "", nil, fmt.Errorf("รูปแบบรายการไม่ถูกต้อง: โปรดตรวจสอบว่า 'for' อยู่หลังจำนวนเงิน และ 'with' อยู่หลังรายละเอียด")
-	}
-	description = strings.Join(parts[forIndex+1:withIndex], " ")
-	if description == "" {
-		return 0, "", nil, fmt.Errorf("รายละเอียดรายการห้ามว่าง")
-	}
-	mentionParts := parts[withIndex+1:]
-	if len(mentionParts) == 0 {
-		return 0, "", nil, fmt.Errorf("ไม่ได้ระบุผู้ใช้สำหรับรายการ '%s'", description)
-	}
-	var foundMentions []string
-	for _, p := range mentionParts {
-		if userMentionRegex.MatchString(p) {
-			foundMentions = append(foundMentions, userMentionRegex.FindStringSubmatch(p)[1])
-		} else {
-			return 0, "", nil, fmt.Errorf("การระบุผู้ใช้ไม่ถูกต้อง '%s' ในรายการ '%s'", p, description)
+
+		amount, description, mentions, parseErr := parseBillItem(trimmedLine)
+		if parseErr != nil {
+			SendErrorMessage(s, channelID, fmt.Sprintf("บรรทัดที่ %d มีข้อผิดพลาด: %v", lineNum, parseErr))
+			hasErrors = true
+			continue
 		}
-	}
-	if len(foundMentions) == 0 {
-		return 0, "", nil, fmt.Errorf("ไม่ได้ระบุผู้ใช้ที่ถูกต้องสำหรับรายการ '%s'", description)
-	}
-	mentions = foundMentions
-	return amount, description, mentions, nil
-}
 
-// parseAltBillItem parses an alternative format for a bill item
-func parseAltBillItem(line string) (amount float64, description string, mentions []string, err error) {
-	normalizedContent := strings.ToLower(line)
-	parts := strings.Fields(normalizedContent)
-	if len(parts) < 3 {
-		return 0, "", nil, fmt.Errorf("รูปแบบรายการไม่ถูกต้อง โปรดใช้: `<จำนวนเงิน> <รายละเอียด> @user1 @user2...`")
-	}
-	amountNum, err := strconv.ParseFloat(parts[0], 64)
-	if err != nil {
-		return 0, "", nil, fmt.Errorf("จำนวนเงินในรายการไม่ถูกต้อง: '%s'", parts[0])
-	}
-	amount = amountNum
-	description = parts[1]
-	mentionParts := parts[2:]
-	if len(mentionParts) == 0 {
-		return 0, "", nil, fmt.Errorf("ไม่ได้ระบุผู้ใช้สำหรับรายการ '%s'", description)
-	}
-	var foundMentions []string
-	for _, p := range mentionParts {
-		if userMentionRegex.MatchString(p) {
-			foundMentions = append(foundMentions, userMentionRegex.FindStringSubmatch(p)[1])
-		} else {
-			return 0, "", nil, fmt.Errorf("การระบุผู้ใช้ไม่ถูกต้อง '%s' ในรายการ '%s'", p, description)
+		amountPerPerson := amount / float64(len(mentions))
+		if amountPerPerson < 0.01 && amount > 0 { // Avoid tiny dust amounts
+			SendErrorMessage(s, channelID, fmt.Sprintf("บรรทัดที่ %d: จำนวนเงินต่อคนน้อยเกินไป (%.4f)", lineNum, amountPerPerson))
+			hasErrors = true
+			continue
 		}
+
+		items = append(items, billLine{LineNum: lineNum, Amount: amount, Description: description, Mentions: mentions})
 	}
-	if len(foundMentions) == 0 {
-		return 0, "", nil, fmt.Errorf("ไม่ได้ระบุผู้ใช้ที่ถูกต้องสำหรับรายการ '%s'", description)
-	}
-	mentions = foundMentions
-	return amount, description, mentions, nil
+	return items, hasErrors
 }
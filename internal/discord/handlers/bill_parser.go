@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// billAmountRegex matches an amount token such as 60, 1,250.50, ฿450, 120บาท or 99.-
+	billAmountRegex = regexp.MustCompile(`^(฿)?((?:\d{1,3}(?:,\d{3})+|\d+)(?:\.\d+)?)(฿|บาท|thb|baht|\.-|-)?$`)
+	// billMentionTokenRegex matches a token that is exactly one user mention
+	billMentionTokenRegex = regexp.MustCompile(`^<@!?(\d+)>$`)
+	// billDigitThaiRegex and billThaiDigitRegex find digits glued to Thai text, as in "60บาท" or "หาร3"
+	billDigitThaiRegex = regexp.MustCompile(`([0-9])(\p{Thai})`)
+	billThaiDigitRegex = regexp.MustCompile(`(\p{Thai})([0-9])`)
+)
+
+// billThaiDigits converts Thai numerals to Arabic digits
+var billThaiDigits = strings.NewReplacer("๐", "0", "๑", "1", "๒", "2", "๓", "3", "๔", "4", "๕", "5", "๖", "6", "๗", "7", "๘", "8", "๙", "9")
+
+// billCurrencyWords mark the number next to them as the amount
+var billCurrencyWords = map[string]bool{"฿": true, "บาท": true, "บ.": true, "thb": true, "baht": true}
+
+// billConnectorWords join the amount, description and participants, they are not part of the description
+var billConnectorWords = map[string]bool{
+	"for": true, "with": true, "split": true, "share": true, "shared": true, "between": true, "among": true, "and": true, "&": true,
+	"หาร": true, "หารกับ": true, "กับ": true, "แบ่ง": true, "แบ่งกับ": true, "แชร์": true, "แชร์กับ": true, "และ": true, "ระหว่าง": true,
+}
+
+// billQuantityUnits follow a quantity, so the number before them is not the amount
+var billQuantityUnits = map[string]bool{
+	"จาน": true, "แก้ว": true, "ขวด": true, "ชิ้น": true, "ถ้วย": true, "ชาม": true, "กล่อง": true, "ที่": true,
+	"อัน": true, "ห่อ": true, "ถาด": true, "ลูก": true, "ตัว": true, "คน": true,
+	"cup": true, "cups": true, "glass": true, "glasses": true, "bottle": true, "bottles": true, "plate": true, "plates": true,
+	"box": true, "boxes": true, "pc": true, "pcs": true, "piece": true, "pieces": true, "people": true,
+}
+
+// billLineExamples is shown when a line can't be understood
+const billLineExamples = "💡 ตัวอย่างที่ใช้ได้: `ข้าวมันไก่ 60 หาร @เพื่อน1 @เพื่อน2`, `pizza 450 split with @เพื่อน1 @เพื่อน2`, `@เพื่อน1 @เพื่อน2 120 coffee` หรือ `100 for dinner with @เพื่อน1`"
+
+// billToken is a word of a bill line
+type billToken struct {
+	Text     string
+	Mention  string  // Discord ID if the token is a user mention
+	Amount   float64 // Value if the token is a number
+	IsAmount bool
+	Currency bool // A currency sign or word
+}
+
+// tokenizeBillLine splits a bill line into words, separating mentions and numbers glued to other text
+func tokenizeBillLine(line string) []billToken {
+	line = billThaiDigits.Replace(line)
+	line = userMentionRegex.ReplaceAllString(line, " $0 ")
+	line = billDigitThaiRegex.ReplaceAllString(line, "$1 $2")
+	line = billThaiDigitRegex.ReplaceAllString(line, "$1 $2")
+
+	var tokens []billToken
+	for _, field := range strings.Fields(line) {
+		token := billToken{Text: field}
+		lower := strings.ToLower(field)
+		if match := billMentionTokenRegex.FindStringSubmatch(field); match != nil {
+			token.Mention = match[1]
+		} else if billCurrencyWords[lower] {
+			token.Currency = true
+		} else if match := billAmountRegex.FindStringSubmatch(lower); match != nil {
+			if value, err := strconv.ParseFloat(strings.ReplaceAll(match[2], ",", ""), 64); err == nil {
+				token.IsAmount, token.Amount = true, value
+				token.Currency = match[1] != "" || match[3] != ""
+			}
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
+
+// pickBillAmount chooses which number of a line is the amount: the one marked with a currency,
+// the only number that isn't a quantity, or the one followed by "for" as in the original format.
+// Otherwise it is ambiguous.
+func pickBillAmount(tokens []billToken) (int, error) {
+	var numbers, marked []int
+	for idx, token := range tokens {
+		if !token.IsAmount {
+			continue
+		}
+		if !token.Currency && idx+1 < len(tokens) && billQuantityUnits[strings.ToLower(tokens[idx+1].Text)] {
+			continue // "2 จาน" is a quantity, it stays in the description
+		}
+		numbers = append(numbers, idx)
+		markedBefore := idx > 0 && tokens[idx-1].Currency && !tokens[idx-1].IsAmount
+		markedAfter := idx+1 < len(tokens) && tokens[idx+1].Currency && !tokens[idx+1].IsAmount
+		if token.Currency || markedBefore || markedAfter {
+			marked = append(marked, idx)
+		}
+	}
+
+	switch {
+	case len(marked) == 1:
+		return marked[0], nil
+	case len(numbers) == 0:
+		return -1, fmt.Errorf("ไม่พบจำนวนเงินในรายการ")
+	case len(numbers) == 1:
+		return numbers[0], nil
+	}
+	if len(marked) == 0 {
+		for _, idx := range numbers {
+			if idx+1 < len(tokens) && strings.EqualFold(tokens[idx+1].Text, "for") {
+				return idx, nil
+			}
+		}
+	}
+
+	var values []string
+	for _, idx := range numbers {
+		values = append(values, tokens[idx].Text)
+	}
+	return -1, fmt.Errorf("พบตัวเลขหลายจำนวน (%s) ไม่แน่ใจว่าจำนวนใดคือราคา ลองเติม `บาท` หลังราคา เช่น `%sบาท`",
+		strings.Join(values, ", "), tokens[numbers[len(numbers)-1]].Text)
+}
+
+// trimBillConnectors removes connecting words from both ends of a run of description words
+func trimBillConnectors(words []string) []string {
+	for len(words) > 0 && billConnectorWords[strings.ToLower(words[0])] {
+		words = words[1:]
+	}
+	for len(words) > 0 && billConnectorWords[strings.ToLower(words[len(words)-1])] {
+		words = words[:len(words)-1]
+	}
+	return words
+}
+
+// parseBillItem parses an item line of a text bill. Members write items in many ways, for example
+// "100 for dinner with @A @B", "ข้าวมันไก่ 60 หาร @A @B", "pizza 450 split with @A @B @C" or "@A @B 120 coffee".
+// The amount may use Thai numerals, thousands separators and a บาท or ฿ suffix. The words that are
+// neither the amount, a mention nor a connecting word form the description, in their original casing.
+// When the line can't be understood, the error suggests how to write it.
+func parseBillItem(line string) (amount float64, description string, mentions []string, err error) {
+	tokens := tokenizeBillLine(line)
+
+	// Mentions that Discord didn't resolve arrive as plain text
+	for _, token := range tokens {
+		lower := strings.ToLower(token.Text)
+		switch {
+		case lower == "@everyone" || lower == "@here":
+			return 0, "", nil, fmt.Errorf("ไม่รองรับ %s ในรายการ โปรดแท็กผู้ร่วมจ่ายทีละคน\n%s", token.Text, billLineExamples)
+		case strings.HasPrefix(token.Text, "<@&"):
+			return 0, "", nil, fmt.Errorf("ไม่รองรับการแท็กบทบาท (role) ในรายการ โปรดแท็กผู้ร่วมจ่ายทีละคน\n%s", billLineExamples)
+		case strings.HasPrefix(token.Text, "@") && len(token.Text) > 1:
+			return 0, "", nil, fmt.Errorf("'%s' ไม่ใช่การแท็กผู้ใช้ โปรดพิมพ์ @ แล้วเลือกชื่อจากรายการที่ Discord แสดง", token.Text)
+		}
+	}
+
+	amountIdx, err := pickBillAmount(tokens)
+	if err != nil {
+		return 0, "", nil, fmt.Errorf("%v\n%s", err, billLineExamples)
+	}
+	amount = tokens[amountIdx].Amount
+	if amount <= 0 {
+		return 0, "", nil, fmt.Errorf("จำนวนเงินต้องมากกว่า 0: '%s'", tokens[amountIdx].Text)
+	}
+
+	// The description is every run of words between the amount, mentions and currency words
+	var parts, run []string
+	seen := make(map[string]bool)
+	flush := func() {
+		if words := trimBillConnectors(run); len(words) > 0 {
+			parts = append(parts, strings.Join(words, " "))
+		}
+		run = nil
+	}
+	for idx, token := range tokens {
+		switch {
+		case token.Mention != "":
+			flush()
+			if !seen[token.Mention] {
+				seen[token.Mention] = true
+				mentions = append(mentions, token.Mention)
+			}
+		case idx == amountIdx:
+			flush()
+		case token.Currency && !token.IsAmount && (idx == amountIdx-1 || idx == amountIdx+1):
+			flush()
+		default:
+			run = append(run, token.Text)
+		}
+	}
+	flush()
+	description = strings.Trim(strings.Join(parts, " "), " :,-")
+
+	if description == "" {
+		return 0, "", nil, fmt.Errorf("รายละเอียดรายการห้ามว่าง โปรดระบุว่าเป็นค่าอะไร\n%s", billLineExamples)
+	}
+	if len(mentions) == 0 {
+		return 0, "", nil, fmt.Errorf("ไม่ได้ระบุผู้ใช้สำหรับรายการ '%s' โปรดแท็กผู้ร่วมจ่ายด้วย @\n%s", description, billLineExamples)
+	}
+	return amount, description, mentions, nil
+}
@@ -0,0 +1,301 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/oatsaysai/billing-in-discord/internal/db"
+)
+
+// sendBillPreview shows a parsed !bill with per-person totals and Confirm/Cancel buttons for its author.
+// Nothing is recorded until the author confirms.
+func sendBillPreview(s *discordgo.Session, m *discordgo.MessageCreate, items []billLine, promptPayID string, dueDate time.Time) {
+	stateID := newComponentState([]string{billPreviewConfirmPrefix, billPreviewCancelPrefix}, m.Author.ID, []string{m.Author.ID},
+		billPreviewPayload{MessageID: m.ID, Content: m.Content, ChannelID: m.ChannelID, GuildID: m.GuildID, PromptPayID: promptPayID, DueDate: dueDate, Items: items},
+		true, interactionStateTTL)
+
+	_, err := s.ChannelMessageSendComplex(m.ChannelID, &discordgo.MessageSend{
+		Embed: billPreviewEmbed(m.Author.ID, items, promptPayID, dueDate),
+		Components: []discordgo.MessageComponent{
+			discordgo.ActionsRow{
+				Components: []discordgo.MessageComponent{
+					discordgo.Button{
+						Label:    "ยืนยัน",
+						Style:    discordgo.SuccessButton,
+						CustomID: billPreviewConfirmPrefix + stateID,
+					},
+					discordgo.Button{
+						Label:    "ยกเลิก",
+						Style:    discordgo.DangerButton,
+						CustomID: billPreviewCancelPrefix + stateID,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		log.Printf("Failed to send bill preview in channel %s: %v", m.ChannelID, err)
+	}
+}
+
+// billPreviewEmbed builds the preview of a bill: its items, what each person owes, and how it will be collected
+func billPreviewEmbed(payeeDiscordID string, items []billLine, promptPayID string, dueDate time.Time) *discordgo.MessageEmbed {
+	var itemsText strings.Builder
+	totalBillAmount := writeBillItemsSummary(&itemsText, payeeDiscordID, items)
+
+	perPerson := make(map[string]float64)
+	for _, item := range items {
+		amountPerPerson := item.Amount / float64(len(item.Mentions))
+		for _, uid := range item.Mentions {
+			perPerson[uid] += amountPerPerson
+		}
+	}
+	participants := make([]string, 0, len(perPerson))
+	for uid := range perPerson {
+		participants = append(participants, uid)
+	}
+	sort.Strings(participants)
+
+	var totalsText strings.Builder
+	for _, uid := range participants {
+		totalsText.WriteString(fmt.Sprintf("<@%s>: **%.2f บาท**", uid, perPerson[uid]))
+		if uid == payeeDiscordID {
+			totalsText.WriteString(" (ส่วนของคุณเอง)")
+		}
+		totalsText.WriteString("\n")
+	}
+
+	fields := []*discordgo.MessageEmbedField{
+		{Name: "ยอดต่อคน", Value: totalsText.String()},
+		{Name: "ยอดรวมทั้งสิ้น", Value: fmt.Sprintf("%.2f บาท", totalBillAmount), Inline: true},
+	}
+	if !dueDate.IsZero() {
+		fields = append(fields, &discordgo.MessageEmbedField{Name: "ครบกำหนดชำระ", Value: dueDate.Format("02/01/2006"), Inline: true})
+	}
+	if promptPayID != "" {
+		fields = append(fields, &discordgo.MessageEmbedField{Name: "PromptPay", Value: promptPayID, Inline: true})
+	}
+
+	return &discordgo.MessageEmbed{
+		Title:       "🧾 ตรวจสอบบิลก่อนบันทึก",
+		Description: itemsText.String(),
+		Color:       0xFFA500, // Orange
+		Fields:      fields,
+		Footer: &discordgo.MessageEmbedFooter{
+			Text: "กด \"ยืนยัน\" เพื่อบันทึกทุกรายการพร้อมกัน หรือ \"ยกเลิก\" หากต้องการแก้ไข",
+		},
+	}
+}
+
+// handleBillPreviewConfirmButton records the whole previewed bill in one DB transaction and asks for payment.
+// A bill whose message was edited or deleted since the preview is not recorded, as the preview no longer matches it.
+func handleBillPreviewConfirmButton(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	var payload billPreviewPayload
+	if !decodeComponentPayload(s, i, state, &payload) {
+		return
+	}
+	payeeDiscordID := state.OwnerDiscordID
+
+	if message, err := s.ChannelMessage(payload.ChannelID, payload.MessageID); err != nil || message.Content != payload.Content {
+		if err != nil {
+			log.Printf("Error fetching previewed bill message %s: %v", payload.MessageID, err)
+		}
+		err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseUpdateMessage,
+			Data: &discordgo.InteractionResponseData{
+				Content:    "❌ ข้อความบิลถูกแก้ไขหรือลบหลังจากแสดงตัวอย่าง ไม่มีการบันทึกรายการใดๆ โปรดส่ง `!bill` ใหม่อีกครั้ง",
+				Embeds:     []*discordgo.MessageEmbed{},
+				Components: []discordgo.MessageComponent{}, // Remove buttons
+			},
+		})
+		if err != nil {
+			log.Printf("Error responding to stale bill preview confirm button: %v", err)
+		}
+		return
+	}
+
+	payeeDbID, err := db.GetOrCreateUser(payeeDiscordID)
+	if err != nil {
+		respondWithError(s, i, fmt.Sprintf("เกิดข้อผิดพลาดกับฐานข้อมูลสำหรับ <@%s> ยังไม่มีการบันทึกรายการใดๆ", payeeDiscordID))
+		return
+	}
+
+	// Under the guild's consent policy the participants accept their debts before they count
+	consentTimeout := billConsentTimeout(payload.GuildID)
+
+	entries, entryDebtors, err := buildBillEntries(payeeDiscordID, payload.Items, consentTimeout > 0, payload.DueDate)
+	if err != nil {
+		respondWithError(s, i, err.Error()+" ยังไม่มีการบันทึกรายการใดๆ")
+		return
+	}
+
+	source := db.BillSource{MessageID: payload.MessageID, ChannelID: payload.ChannelID, GuildID: payload.GuildID}
+	txIDs, err := db.CreateBill(source, payeeDbID, entries)
+	if errors.Is(err, db.ErrDuplicateSource) {
+		respondWithError(s, i, "บิลจากข้อความนี้ถูกบันทึกไปแล้ว")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to save bill by %s in channel %s: %v", payeeDiscordID, payload.ChannelID, err)
+		respondWithError(s, i, "เกิดข้อผิดพลาดในการบันทึกบิล ไม่มีรายการใดถูกบันทึก โปรดส่งบิลใหม่อีกครั้ง")
+		return
+	}
+
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Content:    fmt.Sprintf("✅ บันทึกบิลแล้ว %d รายการ (TxID: %s)", len(txIDs), formatTxIDList(txIDs)),
+			Embeds:     i.Message.Embeds,               // Keep the preview as the record of what was booked
+			Components: []discordgo.MessageComponent{}, // Remove buttons
+		},
+	})
+	if err != nil {
+		log.Printf("Error responding to bill preview confirm button: %v", err)
+	}
+
+	var billItemsSummary strings.Builder
+	totalBillAmount := writeBillItemsSummary(&billItemsSummary, payeeDiscordID, payload.Items)
+	announceCreatedBill(s, &createdBill{
+		ChannelID:      payload.ChannelID,
+		GuildID:        payload.GuildID,
+		PayeeDiscordID: payeeDiscordID,
+		PromptPayID:    payload.PromptPayID,
+		DueDate:        payload.DueDate,
+		Summary:        billItemsSummary.String(),
+		Total:          totalBillAmount,
+		Entries:        entries,
+		EntryDebtors:   entryDebtors,
+		TxIDs:          txIDs,
+		ConsentTimeout: consentTimeout,
+	})
+}
+
+// createdBill is a bill whose transactions were just recorded, ready to be announced
+type createdBill struct {
+	ChannelID      string
+	GuildID        string
+	PayeeDiscordID string
+	PromptPayID    string
+	DueDate        time.Time
+	Summary        string // Items summary posted in the channel
+	Total          float64
+	Entries        []db.BillEntry
+	EntryDebtors   []string // Debtor Discord ID of each entry
+	TxIDs          []int    // TxID of each entry
+	ConsentTimeout time.Duration
+}
+
+// announceCreatedBill posts a recorded bill and asks for payment: pending debts go to the participants
+// for consent, trip expenses wait for the trip to close, and otherwise each debtor gets a QR code.
+func announceCreatedBill(s *discordgo.Session, b *createdBill) {
+	userTotalDebts := make(map[string]float64) // payerDiscordID -> totalOwed
+	userTxIDs := make(map[string][]int)        // payerDiscordID -> list of TxIDs for this bill
+	pendingTxIDs := make(map[string][]int)     // payerDiscordID -> TxIDs waiting for their consent
+	var billTxIDs []int
+	for idx, entry := range b.Entries {
+		payerDiscordID := b.EntryDebtors[idx]
+		if entry.Pending {
+			pendingTxIDs[payerDiscordID] = append(pendingTxIDs[payerDiscordID], b.TxIDs[idx])
+			continue
+		}
+		userTotalDebts[payerDiscordID] += entry.Amount
+		userTxIDs[payerDiscordID] = append(userTxIDs[payerDiscordID], b.TxIDs[idx])
+		billTxIDs = append(billTxIDs, b.TxIDs[idx])
+	}
+
+	var billItemsSummary strings.Builder
+	billItemsSummary.WriteString(b.Summary)
+
+	// Pending debts keep the bill's due date and get their trip and QR code once accepted
+	if len(pendingTxIDs) > 0 {
+		if line := dueDateLine(b.DueDate); line != "" {
+			billItemsSummary.WriteString(line + "\n")
+		}
+		billItemsSummary.WriteString(fmt.Sprintf("\n**ยอดรวมทั้งสิ้น: %.2f บาท**\n", b.Total))
+		requestBillConsent(s, b.ChannelID, b.GuildID, b.PayeeDiscordID, b.PromptPayID, pendingTxIDs, billItemsSummary.String(), b.ConsentTimeout)
+		return
+	}
+
+	// Expenses of an open trip are settled when the trip closes instead
+	if tripLine, inTrip := addBillToTrip(b.ChannelID, billTxIDs); inTrip {
+		billItemsSummary.WriteString(fmt.Sprintf("\n**ยอดรวมทั้งสิ้น: %.2f บาท**\n%s", b.Total, tripLine))
+		s.ChannelMessageSend(b.ChannelID, billItemsSummary.String())
+		return
+	}
+
+	if line := dueDateLine(b.DueDate); line != "" {
+		billItemsSummary.WriteString(line + "\n")
+	}
+
+	// Send bill summary
+	s.ChannelMessageSend(b.ChannelID, billItemsSummary.String())
+
+	var qrSummary strings.Builder
+	qrSummary.WriteString(fmt.Sprintf("\n**ยอดรวมทั้งสิ้น: %.2f บาท**\n", b.Total))
+	// Only mention QR codes if we have a PromptPay ID
+	if b.PromptPayID != "" {
+		qrSummary.WriteString("\nสร้าง QR Code สำหรับชำระเงิน:\n")
+	}
+	s.ChannelMessageSend(b.ChannelID, qrSummary.String())
+
+	for payerDiscordID, totalOwed := range userTotalDebts {
+		// Settle what we can from credit and mutual debts before asking for money
+		totalOwed, relevantTxIDs := prepareBillPayment(s, b.ChannelID, payerDiscordID, b.PayeeDiscordID, totalOwed, userTxIDs[payerDiscordID])
+		if b.PromptPayID != "" && totalOwed > 0.009 { // Only send QR if ID provided and amount is significant
+			GenerateAndSendQrCode(s, b.ChannelID, b.PromptPayID, totalOwed, payerDiscordID, fmt.Sprintf("ยอดรวมจากบิลนี้โดย <@%s>", b.PayeeDiscordID), relevantTxIDs)
+		}
+	}
+}
+
+// buildBillEntries splits the bill's items into one entry per participant and item, returning the
+// debtor Discord ID of each entry alongside. With consent, debts of everyone but the payee wait for acceptance.
+// A zero dueDate leaves the entries without their own due date.
+func buildBillEntries(payeeDiscordID string, items []billLine, consent bool, dueDate time.Time) ([]db.BillEntry, []string, error) {
+	var entries []db.BillEntry
+	var entryDebtors []string
+	userDbIDs := make(map[string]int)
+	for _, item := range items {
+		amountPerPerson := item.Amount / float64(len(item.Mentions))
+		for _, payerDiscordID := range item.Mentions {
+			payerDbID, ok := userDbIDs[payerDiscordID]
+			if !ok {
+				var err error
+				payerDbID, err = db.GetOrCreateUser(payerDiscordID)
+				if err != nil {
+					log.Printf("Error DB user %s for item '%s' line %d: %v", payerDiscordID, item.Description, item.LineNum, err)
+					return nil, nil, fmt.Errorf("บรรทัดที่ %d: เกิดข้อผิดพลาด DB สำหรับ <@%s>", item.LineNum, payerDiscordID)
+				}
+				userDbIDs[payerDiscordID] = payerDbID
+			}
+			entries = append(entries, db.BillEntry{
+				DebtorID:    payerDbID,
+				Amount:      amountPerPerson,
+				Description: item.Description,
+				Pending:     consent && payerDiscordID != payeeDiscordID,
+				DueDate:     entryDueDate(dueDate),
+			})
+			entryDebtors = append(entryDebtors, payerDiscordID)
+		}
+	}
+	return entries, entryDebtors, nil
+}
+
+// handleBillPreviewCancelButton discards a previewed bill without recording anything
+func handleBillPreviewCancelButton(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Content:    "❌ ยกเลิกบิลแล้ว ไม่มีการบันทึกรายการใดๆ",
+			Embeds:     []*discordgo.MessageEmbed{},
+			Components: []discordgo.MessageComponent{}, // Remove buttons
+		},
+	})
+	if err != nil {
+		log.Printf("Error responding to bill preview cancel button: %v", err)
+	}
+}
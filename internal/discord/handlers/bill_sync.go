@@ -0,0 +1,233 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/oatsaysai/billing-in-discord/internal/db"
+)
+
+// HandleBillMessageUpdate re-parses an edited !bill message and applies the difference to the bill's
+// unpaid transactions. Messages that never became a bill, e.g. a preview that wasn't confirmed yet, are ignored.
+// Bills paid by someone else (paidby) can't be edited, their author is told to delete and resend the bill instead.
+func HandleBillMessageUpdate(s *discordgo.Session, m *discordgo.MessageUpdate) {
+	// Embed unfurls also arrive as updates, without content or author
+	if m.Author == nil || m.Author.Bot || strings.TrimSpace(m.Content) == "" {
+		return
+	}
+
+	bill, err := db.GetBillByMessageID(m.ID)
+	if err != nil {
+		log.Printf("Error looking up bill for edited message %s: %v", m.ID, err)
+		return
+	}
+	if bill == nil {
+		rejectPayerBillEdit(s, m)
+		return
+	}
+	if bill.CreditorDiscordID != m.Author.ID {
+		return
+	}
+
+	lines := strings.Split(strings.TrimSpace(m.Content), "\n")
+	firstLineParts := strings.Fields(lines[0])
+	if len(lines) < 2 || strings.ToLower(firstLineParts[0]) != "!bill" {
+		SendErrorMessage(s, m.ChannelID, "ข้อความที่แก้ไขไม่ใช่รูปแบบ `!bill` แล้ว บิลเดิมยังคงอยู่ หากต้องการยกเลิกบิลให้ลบข้อความแทน")
+		return
+	}
+
+	// The first line may change the due date, but can't turn the bill into one paid by someone else
+	firstLineArgs, dueDate, hasDueDate, err := extractDueDateArg(firstLineParts[1:])
+	if err != nil {
+		SendErrorMessage(s, m.ChannelID, err.Error()+" การแก้ไขบิลยังไม่ถูกนำไปใช้")
+		return
+	}
+	if _, paidBy, err := extractPaidByArg(firstLineArgs, m.Author.ID); err != nil || len(paidBy) > 0 {
+		SendErrorMessage(s, m.ChannelID, "ไม่สามารถเพิ่ม `paidby` ในบิลที่บันทึกแล้วได้ การแก้ไขบิลยังไม่ถูกนำไปใช้ หากต้องการเปลี่ยนผู้จ่ายให้ลบข้อความแล้วส่งบิลใหม่")
+		return
+	}
+
+	items, hasErrors := parseBillLines(s, m.ChannelID, lines[1:])
+	if hasErrors || len(items) == 0 {
+		SendErrorMessage(s, m.ChannelID, "การแก้ไขบิลยังไม่ถูกนำไปใช้ โปรดแก้ไขรายการที่ผิดพลาดอีกครั้ง")
+		return
+	}
+
+	consentTimeout := billConsentTimeout(bill.GuildID)
+	// New entries take the edited due date, or the bill's current one
+	var entriesDueDate time.Time
+	if hasDueDate {
+		entriesDueDate = dueDate
+	}
+	entries, entryDebtors, err := buildBillEntries(bill.CreditorDiscordID, items, consentTimeout > 0, entriesDueDate)
+	if err != nil {
+		SendErrorMessage(s, m.ChannelID, err.Error()+" การแก้ไขบิลยังไม่ถูกนำไปใช้")
+		return
+	}
+	debtorDiscordIDs := make(map[int]string)
+	for idx, entry := range entries {
+		debtorDiscordIDs[entry.DebtorID] = entryDebtors[idx]
+	}
+
+	result, err := db.SyncBill(bill, entries)
+	if err != nil {
+		log.Printf("Error syncing edited bill %d: %v", bill.ID, err)
+		SendErrorMessage(s, m.ChannelID, "เกิดข้อผิดพลาดในการปรับปรุงบิลตามข้อความที่แก้ไข บิลเดิมยังคงอยู่")
+		return
+	}
+	var dueDateNotice string
+	if hasDueDate {
+		updated, err := db.SetBillDueDate(bill.ID, dueDate)
+		if err != nil {
+			log.Printf("Error setting due date of edited bill %d: %v", bill.ID, err)
+			dueDateNotice = "⚠️ ไม่สามารถบันทึกวันครบกำหนดชำระใหม่ได้"
+		} else if updated > 0 {
+			dueDateNotice = dueDateLine(dueDate)
+		}
+	}
+	if !result.Changed() && dueDateNotice == "" {
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("✏️ ปรับปรุงบิลตามข้อความที่ <@%s> แก้ไขแล้ว:\n", bill.CreditorDiscordID))
+	if dueDateNotice != "" {
+		sb.WriteString(dueDateNotice + "\n")
+	}
+	pendingTxIDs := make(map[string][]int)
+	for _, t := range result.Added {
+		debtorDiscordID := debtorDiscordIDs[t.DebtorID]
+		sb.WriteString(fmt.Sprintf("- ➕ <@%s> %.2f บาท ค่า %s (TxID: %d)", debtorDiscordID, t.Amount, t.Description, t.TxID))
+		if t.Status == db.TxStatusPending {
+			sb.WriteString(" รอการยอมรับ")
+			pendingTxIDs[debtorDiscordID] = append(pendingTxIDs[debtorDiscordID], t.TxID)
+		}
+		sb.WriteString("\n")
+	}
+	for _, t := range result.Updated {
+		description := t.Description
+		if t.NewDescription != "" {
+			description = fmt.Sprintf("%s → %s", t.Description, t.NewDescription)
+		}
+		sb.WriteString(fmt.Sprintf("- ✏️ <@%s> ค่า %s %.2f → %.2f บาท (TxID: %d)\n", t.DebtorDiscordID, description, t.Amount, t.NewAmount, t.TxID))
+	}
+	for _, t := range result.Voided {
+		sb.WriteString(fmt.Sprintf("- ➖ <@%s> %.2f บาท ค่า %s ถูกยกเลิก (TxID: %d)\n", t.DebtorDiscordID, t.Amount, t.Description, t.TxID))
+	}
+	if len(result.Protected) > 0 {
+		sb.WriteString(fmt.Sprintf("\n⚠️ <@%s> รายการต่อไปนี้ชำระแล้ว (หรือชำระบางส่วน) จึงไม่ถูกเปลี่ยนแปลง โปรดตกลงกันเองหรือใช้ `!dispute`:\n", bill.CreditorDiscordID))
+		writeProtectedBillTransactions(&sb, result.Protected)
+	}
+	if len(result.Added)+len(result.Updated)+len(result.Voided) > 0 {
+		sb.WriteString("\nQR Code ที่ส่งไปก่อนหน้านี้อาจมียอดไม่ตรง โปรดตรวจสอบยอดล่าสุดด้วย `!mydebts`")
+	}
+	s.ChannelMessageSend(m.ChannelID, sb.String())
+
+	if len(pendingTxIDs) > 0 {
+		requestBillConsent(s, m.ChannelID, bill.GuildID, bill.CreditorDiscordID, "", pendingTxIDs,
+			fmt.Sprintf("รายการใหม่จากบิลที่แก้ไขโดย <@%s>\n", bill.CreditorDiscordID), consentTimeout)
+	}
+}
+
+// rejectPayerBillEdit tells the author of an edited paidby bill that the edit was not applied
+func rejectPayerBillEdit(s *discordgo.Session, m *discordgo.MessageUpdate) {
+	bill, err := db.GetPayerBillByMessageID(m.ID)
+	if err != nil {
+		log.Printf("Error looking up payer bill for edited message %s: %v", m.ID, err)
+		return
+	}
+	if bill == nil || bill.RecordedByDiscordID != m.Author.ID {
+		return
+	}
+	SendErrorMessage(s, m.ChannelID, fmt.Sprintf("บิล #%d ที่มีผู้จ่าย (`paidby`) ไม่สามารถแก้ไขได้ การแก้ไขยังไม่ถูกนำไปใช้ "+
+		"หากต้องการเปลี่ยนแปลงให้ลบข้อความบิล (ระบบจะยกเลิกรายการที่ยังไม่ชำระ) แล้วส่งบิลใหม่", bill.ID))
+}
+
+// HandleBillMessageDelete voids the unpaid transactions of a bill whose !bill message was deleted
+func HandleBillMessageDelete(s *discordgo.Session, m *discordgo.MessageDelete) {
+	bill, err := db.GetBillByMessageID(m.ID)
+	if err != nil {
+		log.Printf("Error looking up bill for deleted message %s: %v", m.ID, err)
+		return
+	}
+	if bill == nil {
+		deletePayerBill(s, m)
+		return
+	}
+
+	voided, kept, err := db.VoidBill(bill)
+	if err != nil {
+		log.Printf("Error voiding bill %d of deleted message %s: %v", bill.ID, m.ID, err)
+		SendErrorMessage(s, bill.ChannelID, fmt.Sprintf("<@%s> ข้อความบิลถูกลบ แต่เกิดข้อผิดพลาดในการยกเลิกรายการของบิลนี้", bill.CreditorDiscordID))
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("🗑️ ข้อความบิลของ <@%s> ถูกลบ", bill.CreditorDiscordID))
+	if len(voided) > 0 {
+		var txIDs []int
+		for _, t := range voided {
+			txIDs = append(txIDs, t.TxID)
+		}
+		sb.WriteString(fmt.Sprintf(" ยกเลิกรายการที่ยังไม่ชำระแล้ว %d รายการ (TxID: %s)\n", len(voided), formatTxIDList(txIDs)))
+	} else {
+		sb.WriteString("\n")
+	}
+	if len(kept) > 0 {
+		sb.WriteString(fmt.Sprintf("⚠️ <@%s> รายการต่อไปนี้ชำระแล้ว (หรือชำระบางส่วน) จึงไม่ถูกยกเลิก:\n", bill.CreditorDiscordID))
+		writeProtectedBillTransactions(&sb, kept)
+	}
+	s.ChannelMessageSend(bill.ChannelID, sb.String())
+}
+
+// deletePayerBill cancels the paidby bill of a deleted !bill message, voiding its unpaid transactions if it was booked
+func deletePayerBill(s *discordgo.Session, m *discordgo.MessageDelete) {
+	bill, err := db.GetPayerBillByMessageID(m.ID)
+	if err != nil {
+		log.Printf("Error looking up payer bill for deleted message %s: %v", m.ID, err)
+		return
+	}
+	if bill == nil {
+		return
+	}
+
+	voided, kept, err := db.DeletePayerBill(bill.ID)
+	if err != nil {
+		log.Printf("Error deleting payer bill %d of deleted message %s: %v", bill.ID, m.ID, err)
+		SendErrorMessage(s, bill.ChannelID, fmt.Sprintf("<@%s> ข้อความบิล #%d ถูกลบ แต่เกิดข้อผิดพลาดในการยกเลิกบิลนี้", bill.RecordedByDiscordID, bill.ID))
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("🗑️ ข้อความบิล #%d ของ <@%s> ถูกลบ", bill.ID, bill.RecordedByDiscordID))
+	if len(voided) > 0 {
+		var txIDs []int
+		for _, t := range voided {
+			txIDs = append(txIDs, t.TxID)
+		}
+		sb.WriteString(fmt.Sprintf(" ยกเลิกรายการที่ยังไม่ชำระแล้ว %d รายการ (TxID: %s)\n", len(voided), formatTxIDList(txIDs)))
+	} else if bill.Status == db.PayerBillPending {
+		sb.WriteString(" บิลถูกยกเลิกก่อนที่ผู้จ่ายจะยืนยันครบ จึงไม่มีการบันทึกหนี้\n")
+	} else {
+		sb.WriteString("\n")
+	}
+	if len(kept) > 0 {
+		sb.WriteString(fmt.Sprintf("⚠️ <@%s> รายการต่อไปนี้ชำระแล้ว (หรือชำระบางส่วน) จึงไม่ถูกยกเลิก:\n", bill.RecordedByDiscordID))
+		writeProtectedBillTransactions(&sb, kept)
+	}
+	s.ChannelMessageSend(bill.ChannelID, sb.String())
+}
+
+// writeProtectedBillTransactions lists paid bill transactions that an edit or deletion couldn't change
+func writeProtectedBillTransactions(sb *strings.Builder, transactions []db.BillTransaction) {
+	for _, t := range transactions {
+		sb.WriteString(fmt.Sprintf("- <@%s> %.2f บาท ค่า %s (TxID: %d)", t.DebtorDiscordID, t.Amount, t.Description, t.TxID))
+		if t.NewAmount > 0 {
+			sb.WriteString(fmt.Sprintf(" ยอดใหม่ที่แก้ไข %.2f บาท", t.NewAmount))
+		}
+		sb.WriteString("\n")
+	}
+}
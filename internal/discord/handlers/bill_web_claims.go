@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+
+	"github.com/oatsaysai/billing-in-discord/internal/db"
+)
+
+// webClaimsItem is an item of the bill allocation web page with the claims on it
+type webClaimsItem struct {
+	Index    int            `json:"index"`
+	Name     string         `json:"name"`
+	Quantity int            `json:"quantity"`
+	Price    float64        `json:"price"`
+	Claims   []db.ItemClaim `json:"claims"`
+	Claimed  bool           `json:"claimed"`
+}
+
+// webClaimsState is the authoritative allocation state that the web page polls
+type webClaimsState struct {
+	Status       string                `json:"status"`
+	MerchantName string                `json:"merchantName"`
+	IsOwner      bool                  `json:"isOwner"`
+	OwnerID      string                `json:"ownerId"`
+	Me           string                `json:"me"` // The participant whose link opened the page, empty if it isn't a participant's link
+	Items        []webClaimsItem       `json:"items"`
+	Participants []db.ClaimParticipant `json:"participants"`
+	Totals       map[string]float64    `json:"totals"`
+	Unclaimed    float64               `json:"unclaimed"`
+	AllClaimed   bool                  `json:"allClaimed"`
+}
+
+// writeWebClaimsJSON writes a JSON response for the web page
+func writeWebClaimsJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing web claims response: %v", err)
+	}
+}
+
+// writeWebClaimsError writes an error the web page shows to the participant
+func writeWebClaimsError(w http.ResponseWriter, status int, message string) {
+	writeWebClaimsJSON(w, status, map[string]string{"status": "error", "message": message})
+}
+
+// loadWebClaimSession loads the claim session of a web page token, responding with an error otherwise
+func loadWebClaimSession(w http.ResponseWriter, token string) *db.ClaimSession {
+	if token == "" {
+		writeWebClaimsError(w, http.StatusUnauthorized, "Invalid or expired token")
+		return nil
+	}
+	session, err := db.GetClaimSessionByWebToken(token)
+	if err != nil {
+		log.Printf("Error loading web claim session: %v", err)
+		writeWebClaimsError(w, http.StatusInternalServerError, "เกิดข้อผิดพลาดในการโหลดรายการแบ่งบิล")
+		return nil
+	}
+	if session == nil {
+		writeWebClaimsError(w, http.StatusUnauthorized, "Invalid or expired token")
+		log.Printf("Invalid or expired token for web claims: %s", token)
+		return nil
+	}
+	return session
+}
+
+// isWebClaimOwner reports whether the key is the owner key of the session
+func isWebClaimOwner(session *db.ClaimSession, ownerKey string) bool {
+	return ownerKey != "" && subtle.ConstantTimeCompare([]byte(ownerKey), []byte(session.OwnerKey)) == 1
+}
+
+// webClaimParticipant returns the Discord ID of the participant whose own link carries the key,
+// or an empty string if the key belongs to nobody
+func webClaimParticipant(session *db.ClaimSession, participantKey string) string {
+	if participantKey == "" {
+		return ""
+	}
+	for discordID, key := range session.ParticipantKeys {
+		if subtle.ConstantTimeCompare([]byte(participantKey), []byte(key)) == 1 {
+			return discordID
+		}
+	}
+	return ""
+}
+
+// isItemClaimed reports whether every unit of an item has someone paying for it
+func isItemClaimed(session *db.ClaimSession, itemIndex int) bool {
+	claimedUnits := 0
+	for _, claim := range session.Claims {
+		if claim.ItemIndex != itemIndex {
+			continue
+		}
+		if claim.Units == 0 {
+			return true // Sharers take whatever is left
+		}
+		claimedUnits += claim.Units
+	}
+	return claimedUnits >= session.Items[itemIndex].Quantity
+}
+
+// unclaimedWebItems returns the names of items that still have units nobody pays for
+func unclaimedWebItems(session *db.ClaimSession) []string {
+	var names []string
+	for idx, item := range session.Items {
+		if !isItemClaimed(session, idx) {
+			names = append(names, fmt.Sprintf("%d. %s", idx+1, item.Name))
+		}
+	}
+	return names
+}
+
+// buildWebClaimsState renders a claim session for the web page
+func buildWebClaimsState(session *db.ClaimSession, isOwner bool, me string) webClaimsState {
+	totals, unclaimed := claimTotals(session)
+	for uid, amount := range totals {
+		totals[uid] = math.Round(amount*100) / 100
+	}
+	state := webClaimsState{
+		Status:       session.Status,
+		MerchantName: session.MerchantName,
+		IsOwner:      isOwner,
+		OwnerID:      session.OwnerDiscordID,
+		Me:           me,
+		Participants: session.Participants,
+		Totals:       totals,
+		Unclaimed:    math.Round(unclaimed*100) / 100,
+		AllClaimed:   true,
+	}
+	for idx, item := range session.Items {
+		webItem := webClaimsItem{
+			Index:    idx,
+			Name:     item.Name,
+			Quantity: item.Quantity,
+			Price:    item.Price,
+			Claims:   append([]db.ItemClaim{}, claimsOfItem(session.Claims, idx)...),
+			Claimed:  isItemClaimed(session, idx),
+		}
+		state.AllClaimed = state.AllClaimed && webItem.Claimed
+		state.Items = append(state.Items, webItem)
+	}
+	return state
+}
+
+// HandleBillClaimsState returns the live allocation state of a bill allocation web page, the page polls it
+func HandleBillClaimsState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session := loadWebClaimSession(w, r.URL.Query().Get("token"))
+	if session == nil {
+		return
+	}
+	query := r.URL.Query()
+	writeWebClaimsJSON(w, http.StatusOK,
+		buildWebClaimsState(session, isWebClaimOwner(session, query.Get("owner")), webClaimParticipant(session, query.Get("key"))))
+}
+
+// HandleBillClaimsClaim records a participant taking units of, sharing, or leaving an item on the bill allocation web page.
+// The participant is identified by the key in their own link, never by an ID the page sends.
+func HandleBillClaimsClaim(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var payload struct {
+		Token     string `json:"token"`
+		OwnerKey  string `json:"ownerKey"`
+		Key       string `json:"key"` // The participant key of the link the page was opened from
+		ItemIndex int    `json:"itemIndex"`
+		Claimed   bool   `json:"claimed"`
+		Units     int    `json:"units"` // Units of a multi-quantity item, zero shares the units nobody took
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Failed to parse JSON payload", http.StatusBadRequest)
+		return
+	}
+	if payload.Units < 0 {
+		writeWebClaimsError(w, http.StatusBadRequest, "จำนวนไม่ถูกต้อง")
+		return
+	}
+
+	session := loadWebClaimSession(w, payload.Token)
+	if session == nil {
+		return
+	}
+	discordID := webClaimParticipant(session, payload.Key)
+	if discordID == "" {
+		writeWebClaimsError(w, http.StatusForbidden, "ลิงก์นี้ไม่ใช่ลิงก์ส่วนตัวของผู้ร่วมจ่ายบิลนี้ โปรดเปิดลิงก์ที่บอทส่งให้คุณทาง DM")
+		return
+	}
+	if session.Status != db.ClaimSessionOpen {
+		writeWebClaimsError(w, http.StatusConflict, "รายการแบ่งบิลนี้ปิดไปแล้ว")
+		return
+	}
+
+	var err error
+	if payload.Claimed {
+		err = db.SetItemClaim(session.ID, payload.ItemIndex, discordID, payload.Units)
+	} else {
+		err = db.RemoveItemClaims(session.ID, payload.ItemIndex, discordID)
+	}
+	if err != nil {
+		writeWebClaimsError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	session, err = db.GetClaimSession(session.ID)
+	if err != nil {
+		log.Printf("Error reloading web claim session: %v", err)
+		writeWebClaimsError(w, http.StatusInternalServerError, "เกิดข้อผิดพลาดในการโหลดรายการแบ่งบิล")
+		return
+	}
+	writeWebClaimsJSON(w, http.StatusOK, buildWebClaimsState(session, isWebClaimOwner(session, payload.OwnerKey), discordID))
+}
@@ -16,17 +16,19 @@ import (
 )
 
 // handlePayDebtButton handles the pay debt button interaction
-func handlePayDebtButton(s *discordgo.Session, i *discordgo.InteractionCreate) {
-	// Extract the creditor's Discord ID from the custom ID
-	customID := i.MessageComponentData().CustomID
-	creditorDiscordID := strings.TrimPrefix(customID, payDebtButtonPrefix)
+func handlePayDebtButton(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	var payload debtPairPayload
+	if !decodeComponentPayload(s, i, state, &payload) {
+		return
+	}
+	creditorDiscordID := payload.CreditorDiscordID
 
 	if creditorDiscordID == "" {
 		respondWithError(s, i, "ไม่พบข้อมูลผู้รับเงินที่ถูกต้อง")
 		return
 	}
 
-	debtorDiscordID := i.Member.User.ID
+	debtorDiscordID := interactionUserID(i)
 
 	// Prevent paying yourself
 	if debtorDiscordID == creditorDiscordID {
@@ -73,12 +75,6 @@ func handlePayDebtButton(s *discordgo.Session, i *discordgo.InteractionCreate) {
 		// Continue even if this fails
 	}
 
-	// Build transaction list for the modal
-	txIDsString := "ไม่พบรายการ"
-	if len(unpaidTxIDs) > 0 {
-		txIDsString = fmt.Sprintf("%v", unpaidTxIDs)
-	}
-
 	var content strings.Builder
 	content.WriteString(fmt.Sprintf("**ยอดหนี้ที่คุณค้างชำระทั้งหมด: %.2f บาท**\n\n", totalDebtAmount))
 	content.WriteString(fmt.Sprintf("**PromptPay ID ของผู้รับเงิน:** `%s`\n\n", promptPayID))
@@ -145,24 +141,9 @@ func handlePayDebtButton(s *discordgo.Session, i *discordgo.InteractionCreate) {
 	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseChannelMessageWithSource,
 		Data: &discordgo.InteractionResponseData{
-			Content: content.String(),
-			Flags:   discordgo.MessageFlagsEphemeral,
-			Components: []discordgo.MessageComponent{
-				discordgo.ActionsRow{
-					Components: []discordgo.MessageComponent{
-						discordgo.Button{
-							Label:    "ยืนยันการชำระเงินด้วยสลิป",
-							Style:    discordgo.SuccessButton,
-							CustomID: fmt.Sprintf("confirm_payment_%s_%s", creditorDiscordID, txIDsString),
-						},
-						discordgo.Button{
-							Label:    "ยืนยันการชำระเงินโดยไม่มีสลิป",
-							Style:    discordgo.PrimaryButton,
-							CustomID: fmt.Sprintf("confirm_payment_no_slip_%s_%s", creditorDiscordID, txIDsString),
-						},
-					},
-				},
-			},
+			Content:    content.String(),
+			Flags:      discordgo.MessageFlagsEphemeral,
+			Components: confirmPaymentButtons(debtorDiscordID, creditorDiscordID, unpaidTxIDs),
 		},
 	})
 
@@ -171,27 +152,45 @@ func handlePayDebtButton(s *discordgo.Session, i *discordgo.InteractionCreate) {
 	}
 }
 
+// confirmPaymentButtons builds the buttons a debtor uses to confirm a payment with or without a slip.
+// Both buttons share one interaction state holding the pair and the transactions being paid.
+func confirmPaymentButtons(debtorDiscordID, creditorDiscordID string, txIDs []int) []discordgo.MessageComponent {
+	stateID := newComponentState([]string{confirmPaymentButtonPrefix, confirmPaymentNoSlipPrefix}, debtorDiscordID, []string{debtorDiscordID},
+		debtPairPayload{DebtorDiscordID: debtorDiscordID, CreditorDiscordID: creditorDiscordID, TxIDs: txIDs}, false, interactionStateTTL)
+
+	return []discordgo.MessageComponent{
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.Button{
+					Label:    "ยืนยันการชำระเงินด้วยสลิป",
+					Style:    discordgo.SuccessButton,
+					CustomID: confirmPaymentButtonPrefix + stateID,
+				},
+				discordgo.Button{
+					Label:    "ยืนยันการชำระเงินโดยไม่มีสลิป",
+					Style:    discordgo.PrimaryButton,
+					CustomID: confirmPaymentNoSlipPrefix + stateID,
+				},
+			},
+		},
+	}
+}
+
 // handleViewDetailButton handles the "View Details" button
-func handleViewDetailButton(s *discordgo.Session, i *discordgo.InteractionCreate) {
-	parts := strings.Split(i.MessageComponentData().CustomID, "_")
-	if len(parts) < 3 {
-		respondWithError(s, i, "รูปแบบ custom ID ไม่ถูกต้อง")
+func handleViewDetailButton(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	var payload viewDetailPayload
+	if !decodeComponentPayload(s, i, state, &payload) {
 		return
 	}
 
-	targetID := parts[2]
+	currentUserID := interactionUserID(i)
 	var detailsMessage string
+	var components []discordgo.MessageComponent
 
 	// Check if this is for a transaction or a general debt
-	if strings.HasPrefix(targetID, "tx") {
+	if payload.TxID > 0 {
 		// Transaction detail
-		txIDStr := strings.TrimPrefix(targetID, "tx")
-		txID, err := strconv.Atoi(txIDStr)
-		if err != nil {
-			respondWithError(s, i, fmt.Sprintf("รหัสรายการไม่ถูกต้อง: %s", txIDStr))
-			return
-		}
-
+		txID := payload.TxID
 		txInfo, err := db.GetTransactionInfo(txID)
 		if err != nil {
 			respondWithError(s, i, fmt.Sprintf("ไม่พบข้อมูลรายการ ID %d: %v", txID, err))
@@ -202,7 +201,7 @@ func handleViewDetailButton(s *discordgo.Session, i *discordgo.InteractionCreate
 		payeeDbID := txInfo["payee_id"].(int)
 		amount := txInfo["amount"].(float64)
 		description := txInfo["description"].(string)
-		created := txInfo["created_at"].(string)
+		created := txInfo["created_at"].(time.Time)
 		isPaid := txInfo["already_paid"].(bool)
 
 		payerDiscordID, _ := db.GetDiscordIDFromDbID(payerDbID)
@@ -211,6 +210,8 @@ func handleViewDetailButton(s *discordgo.Session, i *discordgo.InteractionCreate
 		status := "ค้างชำระ"
 		if isPaid {
 			status = "ชำระแล้ว"
+		} else if paidAmount := txInfo["paid_amount"].(float64); paidAmount > 0 {
+			status = fmt.Sprintf("ชำระแล้วบางส่วน %.2f บาท (คงเหลือ %.2f บาท)", paidAmount, amount-paidAmount)
 		}
 
 		detailsMessage = fmt.Sprintf("**รายละเอียดรายการ #%d**\n"+
@@ -220,33 +221,48 @@ func handleViewDetailButton(s *discordgo.Session, i *discordgo.InteractionCreate
 			"รายละเอียด: %s\n"+
 			"วันที่สร้าง: %s\n"+
 			"สถานะ: %s",
-			txID, payerDiscordID, payeeDiscordID, amount, description, created, status)
+			txID, payerDiscordID, payeeDiscordID, amount, description, created.Format("02/01/2006 15:04"), status)
+		if dueDate := formatTxDueDate(txInfo); dueDate != "" {
+			detailsMessage += "\nครบกำหนดชำระ: " + dueDate
+		}
 
-	} else {
-		// ตรวจสอบว่าเป็นการดูเงินที่คนอื่นค้างเรา หรือเราค้างคนอื่น
-		// ด้วยการดูตัวแรกของ targetID - ถ้ามี "c" นำหน้า แสดงว่าเป็นการดูเงินที่เราค้างคนอื่น
-		// ถ้ามี "d" นำหน้า แสดงว่าเป็นการดูเงินที่คนอื่นค้างเรา
-
-		var debtorID, creditorID string
-		var isOwed bool = false // เราเป็นเจ้าหนี้หรือไม่ (คนอื่นเป็นหนี้เรา)
-
-		if strings.HasPrefix(targetID, "c") {
-			// รูปแบบ "c123456789" - เราเป็นลูกหนี้ คนอื่นเป็นเจ้าหนี้
-			creditorID = strings.TrimPrefix(targetID, "c")
-			debtorID = i.Member.User.ID
-			isOwed = false
-		} else if strings.HasPrefix(targetID, "d") {
-			// รูปแบบ "d123456789" - เราเป็นเจ้าหนี้ คนอื่นเป็นลูกหนี้
-			debtorID = strings.TrimPrefix(targetID, "d")
-			creditorID = i.Member.User.ID
-			isOwed = true
-		} else {
-			// รูปแบบเดิมเพื่อความเข้ากันได้กับโค้ดเก่า
-			creditorID = targetID
-			debtorID = i.Member.User.ID
-			isOwed = false
+		// Transaction-specific buttons
+		var actionButtons []discordgo.MessageComponent
+
+		if currentUserID == payerDiscordID && !isPaid {
+			// ลูกหนี้เห็นปุ่มชำระเงินเฉพาะรายการนี้
+			actionButtons = append(actionButtons, discordgo.Button{
+				Label:    "ชำระเงินเฉพาะรายการนี้",
+				Style:    discordgo.PrimaryButton,
+				CustomID: payTxComponentID(payerDiscordID, txID),
+			})
+		}
+
+		if currentUserID == payeeDiscordID && !isPaid {
+			// เจ้าหนี้เห็นปุ่มทำเครื่องหมายว่าชำระแล้ว และขอชำระเงิน
+			actionButtons = append(actionButtons, discordgo.Button{
+				Label:    "ทำเครื่องหมายว่าชำระแล้ว",
+				Style:    discordgo.SuccessButton,
+				CustomID: markPaidComponentID(payeeDiscordID, txID),
+			})
+			actionButtons = append(actionButtons, discordgo.Button{
+				Label:    "ขอชำระเงิน",
+				Style:    discordgo.PrimaryButton,
+				CustomID: requestPaymentComponentID(payerDiscordID, payeeDiscordID),
+			})
 		}
 
+		if len(actionButtons) > 0 {
+			components = append(components, discordgo.ActionsRow{
+				Components: actionButtons,
+			})
+		}
+	} else {
+		// เราเป็นเจ้าหนี้หรือไม่ (คนอื่นเป็นหนี้เรา) ดูจากผู้ที่กดปุ่ม
+		debtorID := payload.DebtorDiscordID
+		creditorID := payload.CreditorDiscordID
+		isOwed := currentUserID == creditorID
+
 		debtorDbID, err := db.GetOrCreateUser(debtorID)
 		if err != nil {
 			respondWithError(s, i, "ไม่สามารถระบุตัวตนของลูกหนี้ในระบบ")
@@ -296,98 +312,28 @@ func handleViewDetailButton(s *discordgo.Session, i *discordgo.InteractionCreate
 					i+1, tx["amount"].(float64), tx["description"].(string), tx["id"].(int))
 			}
 		}
-	}
-
-	// Create action buttons for the message
-	var components []discordgo.MessageComponent
-
-	if strings.HasPrefix(targetID, "tx") {
-		// Transaction-specific buttons
-		txIDStr := strings.TrimPrefix(targetID, "tx")
-		txID, _ := strconv.Atoi(txIDStr)
-
-		txInfo, err := db.GetTransactionInfo(txID)
-		if err == nil {
-			isPaid := txInfo["already_paid"].(bool)
-			payeeDbID := txInfo["payee_id"].(int)
-			payerDbID := txInfo["payer_id"].(int)
-			payeeDiscordID, _ := db.GetDiscordIDFromDbID(payeeDbID)
-			payerDiscordID, _ := db.GetDiscordIDFromDbID(payerDbID)
-
-			currentUserID := i.Member.User.ID
-			var actionButtons []discordgo.MessageComponent
-
-			if currentUserID == payerDiscordID && !isPaid {
-				// ลูกหนี้เห็นปุ่มชำระเงินเฉพาะรายการนี้
-				actionButtons = append(actionButtons, discordgo.Button{
-					Label:    "ชำระเงินเฉพาะรายการนี้",
-					Style:    discordgo.PrimaryButton,
-					CustomID: fmt.Sprintf("pay_tx_%d", txID),
-					Disabled: isPaid,
-				})
-			}
-
-			if currentUserID == payeeDiscordID && !isPaid {
-				// เจ้าหนี้เห็นปุ่มทำเครื่องหมายว่าชำระแล้ว และขอชำระเงิน
-				actionButtons = append(actionButtons, discordgo.Button{
-					Label:    "ทำเครื่องหมายว่าชำระแล้ว",
-					Style:    discordgo.SuccessButton,
-					CustomID: fmt.Sprintf("%s%s", markPaidButtonPrefix, txIDStr),
-				})
-				actionButtons = append(actionButtons, discordgo.Button{
-					Label:    "ขอชำระเงิน",
-					Style:    discordgo.PrimaryButton,
-					CustomID: fmt.Sprintf("%s%s", requestPaymentButtonPrefix, payerDiscordID),
-				})
-			}
-
-			if len(actionButtons) > 0 {
-				components = append(components, discordgo.ActionsRow{
-					Components: actionButtons,
-				})
-			}
-		}
-	} else {
-		// ตรวจสอบว่าเป็นลูกหนี้หรือเจ้าหนี้จาก targetID
-		var actionButtons []discordgo.MessageComponent
-		var debtorDiscordID, creditorDiscordID string
-
-		if strings.HasPrefix(targetID, "c") {
-			// เราเป็นลูกหนี้ คนอื่นเป็นเจ้าหนี้
-			creditorDiscordID = strings.TrimPrefix(targetID, "c")
-			debtorDiscordID = i.Member.User.ID
-
-			// ลูกหนี้เห็นปุ่มชำระเงิน
-			actionButtons = append(actionButtons, discordgo.Button{
-				Label:    "ชำระเงิน",
-				Style:    discordgo.PrimaryButton,
-				CustomID: fmt.Sprintf("%s%s", payDebtButtonPrefix, creditorDiscordID),
-			})
-		} else if strings.HasPrefix(targetID, "d") {
-			// เราเป็นเจ้าหนี้ คนอื่นเป็นลูกหนี้
-			debtorDiscordID = strings.TrimPrefix(targetID, "d")
-			creditorDiscordID = i.Member.User.ID
 
+		if isOwed {
 			// เจ้าหนี้เห็นปุ่มขอชำระเงิน
-			actionButtons = append(actionButtons, discordgo.Button{
-				Label:    "ขอชำระเงิน",
-				Style:    discordgo.PrimaryButton,
-				CustomID: fmt.Sprintf("%s%s", requestPaymentButtonPrefix, debtorDiscordID),
+			components = append(components, discordgo.ActionsRow{
+				Components: []discordgo.MessageComponent{
+					discordgo.Button{
+						Label:    "ขอชำระเงิน",
+						Style:    discordgo.PrimaryButton,
+						CustomID: requestPaymentComponentID(debtorID, creditorID),
+					},
+				},
 			})
 		} else {
-			// รูปแบบเดิมเพื่อความเข้ากันได้กับโค้ดเก่า
-			creditorDiscordID = targetID
-			debtorDiscordID = i.Member.User.ID
-			actionButtons = append(actionButtons, discordgo.Button{
-				Label:    "ชำระเงิน",
-				Style:    discordgo.PrimaryButton,
-				CustomID: fmt.Sprintf("%s%s", payDebtButtonPrefix, creditorDiscordID),
-			})
-		}
-
-		if len(actionButtons) > 0 {
+			// ลูกหนี้เห็นปุ่มชำระเงิน
 			components = append(components, discordgo.ActionsRow{
-				Components: actionButtons,
+				Components: []discordgo.MessageComponent{
+					discordgo.Button{
+						Label:    "ชำระเงิน",
+						Style:    discordgo.PrimaryButton,
+						CustomID: payDebtComponentID(debtorID, creditorID),
+					},
+				},
 			})
 		}
 	}
@@ -404,17 +350,19 @@ func handleViewDetailButton(s *discordgo.Session, i *discordgo.InteractionCreate
 }
 
 // handleRequestPaymentButton handles the request payment button
-func handleRequestPaymentButton(s *discordgo.Session, i *discordgo.InteractionCreate) {
-	// Extract the debtor's Discord ID from the custom ID
-	customID := i.MessageComponentData().CustomID
-	debtorDiscordID := strings.TrimPrefix(customID, requestPaymentButtonPrefix)
+func handleRequestPaymentButton(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	var payload debtPairPayload
+	if !decodeComponentPayload(s, i, state, &payload) {
+		return
+	}
+	debtorDiscordID := payload.DebtorDiscordID
 
 	if debtorDiscordID == "" {
 		respondWithError(s, i, "ไม่พบข้อมูลลูกหนี้ที่ถูกต้อง")
 		return
 	}
 
-	creditorDiscordID := i.Member.User.ID
+	creditorDiscordID := interactionUserID(i)
 
 	// Get DB IDs
 	creditorDbID, err := db.GetOrCreateUser(creditorDiscordID)
@@ -479,18 +427,12 @@ func handleRequestPaymentButton(s *discordgo.Session, i *discordgo.InteractionCr
 }
 
 // handleConfirmPaymentButton handles the confirmation of payment button
-func handleConfirmPaymentButton(s *discordgo.Session, i *discordgo.InteractionCreate) {
-	// Extract the creditor's Discord ID and TxIDs from the custom ID
-	customID := i.MessageComponentData().CustomID
-	parts := strings.SplitN(strings.TrimPrefix(customID, confirmPaymentButtonPrefix), "_", 2)
-
-	if len(parts) != 2 {
-		respondWithError(s, i, "รูปแบบ ID ไม่ถูกต้อง")
+func handleConfirmPaymentButton(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	var payload debtPairPayload
+	if !decodeComponentPayload(s, i, state, &payload) {
 		return
 	}
-
-	creditorDiscordID := parts[0]
-	txIDsString := parts[1]
+	creditorDiscordID := payload.CreditorDiscordID
 
 	if creditorDiscordID == "" {
 		respondWithError(s, i, "ไม่พบข้อมูลผู้รับเงินที่ถูกต้อง")
@@ -501,8 +443,8 @@ func handleConfirmPaymentButton(s *discordgo.Session, i *discordgo.InteractionCr
 	content := fmt.Sprintf("โปรดตอบกลับข้อความนี้พร้อมแนบสลิปการโอนเงินเพื่อยืนยันการชำระเงินให้กับ <@%s>\n", creditorDiscordID)
 
 	// If we have TxIDs, include them in the content for reference
-	if txIDsString != "ไม่พบรายการ" {
-		content += fmt.Sprintf("(เกี่ยวข้องกับรายการ TxIDs: %s)", txIDsString)
+	if len(payload.TxIDs) > 0 {
+		content += fmt.Sprintf("(เกี่ยวข้องกับรายการ TxIDs: %s)", formatTxIDList(payload.TxIDs))
 	}
 
 	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
@@ -519,25 +461,19 @@ func handleConfirmPaymentButton(s *discordgo.Session, i *discordgo.InteractionCr
 }
 
 // handleConfirmPaymentNoSlipButton handles the confirmation of payment without slip button
-func handleConfirmPaymentNoSlipButton(s *discordgo.Session, i *discordgo.InteractionCreate) {
-	// Extract the creditor's Discord ID and TxIDs from the custom ID
-	customID := i.MessageComponentData().CustomID
-	parts := strings.SplitN(strings.TrimPrefix(customID, confirmPaymentNoSlipPrefix), "_", 2)
-
-	if len(parts) != 2 {
-		respondWithError(s, i, "รูปแบบ ID ไม่ถูกต้อง")
+func handleConfirmPaymentNoSlipButton(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	var payload debtPairPayload
+	if !decodeComponentPayload(s, i, state, &payload) {
 		return
 	}
-
-	creditorDiscordID := parts[0]
-	txIDsString := parts[1]
+	creditorDiscordID := payload.CreditorDiscordID
 
 	if creditorDiscordID == "" {
 		respondWithError(s, i, "ไม่พบข้อมูลผู้รับเงินที่ถูกต้อง")
 		return
 	}
 
-	debtorDiscordID := i.Member.User.ID
+	debtorDiscordID := interactionUserID(i)
 
 	// Get DB IDs
 	debtorDbID, err := db.GetOrCreateUser(debtorDiscordID)
@@ -589,33 +525,14 @@ func handleConfirmPaymentNoSlipButton(s *discordgo.Session, i *discordgo.Interac
 		debtorDiscordID, debtorName, totalDebtAmount)
 
 	// If we have TxIDs, include them in the content for reference
-	if txIDsString != "ไม่พบรายการ" {
-		verificationMessage += fmt.Sprintf("\n(เกี่ยวข้องกับรายการ TxIDs: %s)", txIDsString)
+	if len(payload.TxIDs) > 0 {
+		verificationMessage += fmt.Sprintf("\n(เกี่ยวข้องกับรายการ TxIDs: %s)", formatTxIDList(payload.TxIDs))
 	}
 
-	// Create unique custom IDs for the verification buttons that include both user IDs and transaction IDs
-	confirmButtonID := fmt.Sprintf("verify_payment_confirm_%s_%s_%s", debtorDiscordID, creditorDiscordID, txIDsString)
-	rejectButtonID := fmt.Sprintf("verify_payment_reject_%s_%s_%s", debtorDiscordID, creditorDiscordID, txIDsString)
-
 	// Send DM to creditor with buttons
 	_, err = s.ChannelMessageSendComplex(creditorChannel.ID, &discordgo.MessageSend{
-		Content: verificationMessage,
-		Components: []discordgo.MessageComponent{
-			discordgo.ActionsRow{
-				Components: []discordgo.MessageComponent{
-					discordgo.Button{
-						Label:    "ยืนยัน ฉันได้รับเงินแล้ว",
-						Style:    discordgo.SuccessButton,
-						CustomID: confirmButtonID,
-					},
-					discordgo.Button{
-						Label:    "ปฏิเสธ ฉันยังไม่ได้รับเงิน",
-						Style:    discordgo.DangerButton,
-						CustomID: rejectButtonID,
-					},
-				},
-			},
-		},
+		Content:    verificationMessage,
+		Components: verifyPaymentButtons(debtorDiscordID, creditorDiscordID, payload.TxIDs),
 	})
 
 	if err != nil {
@@ -632,22 +549,44 @@ func handleConfirmPaymentNoSlipButton(s *discordgo.Session, i *discordgo.Interac
 	}
 }
 
-// handleVerifyPaymentConfirmButton handles the confirmation of payment verification button
-func handleVerifyPaymentConfirmButton(s *discordgo.Session, i *discordgo.InteractionCreate) {
-	// Extract the debtor's Discord ID, creditor's Discord ID, and TxIDs from the custom ID
-	customID := i.MessageComponentData().CustomID
-	parts := strings.SplitN(strings.TrimPrefix(customID, verifyPaymentConfirmPrefix), "_", 3)
+// verifyPaymentButtons builds the confirm/reject buttons sent to a creditor to verify a payment.
+// Both buttons share one single-use interaction state, so only the first answer is applied.
+func verifyPaymentButtons(debtorDiscordID, creditorDiscordID string, txIDs []int) []discordgo.MessageComponent {
+	stateID := newComponentState([]string{verifyPaymentConfirmPrefix, verifyPaymentRejectPrefix}, creditorDiscordID, []string{creditorDiscordID},
+		debtPairPayload{DebtorDiscordID: debtorDiscordID, CreditorDiscordID: creditorDiscordID, TxIDs: txIDs}, true, longInteractionStateTTL)
+	confirmButtonID := verifyPaymentConfirmPrefix + stateID
+	rejectButtonID := verifyPaymentRejectPrefix + stateID
 
-	if len(parts) != 3 {
-		respondWithError(s, i, "รูปแบบ ID ไม่ถูกต้อง")
+	return []discordgo.MessageComponent{
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.Button{
+					Label:    "ยืนยัน ฉันได้รับเงินแล้ว",
+					Style:    discordgo.SuccessButton,
+					CustomID: confirmButtonID,
+				},
+				discordgo.Button{
+					Label:    "ปฏิเสธ ฉันยังไม่ได้รับเงิน",
+					Style:    discordgo.DangerButton,
+					CustomID: rejectButtonID,
+				},
+			},
+		},
+	}
+}
+
+// handleVerifyPaymentConfirmButton handles the confirmation of payment verification button
+func handleVerifyPaymentConfirmButton(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	var payload debtPairPayload
+	if !decodeComponentPayload(s, i, state, &payload) {
 		return
 	}
 
-	debtorDiscordID := parts[0]
-	creditorDiscordID := parts[1]
-	txIDsString := parts[2]
+	debtorDiscordID := payload.DebtorDiscordID
+	creditorDiscordID := payload.CreditorDiscordID
+	txIDs := payload.TxIDs
 
-	creditorUserID := i.Member.User.ID
+	creditorUserID := interactionUserID(i)
 
 	// Verify that the creditor is actually the person clicking the button
 	if creditorUserID != creditorDiscordID {
@@ -676,24 +615,7 @@ func handleVerifyPaymentConfirmButton(s *discordgo.Session, i *discordgo.Interac
 	}
 
 	// Update transaction records if specific TxIDs were provided
-	var txIDs []int
-	if txIDsString != "ไม่พบรายการ" && txIDsString != "[]" {
-		// Try to parse the TxIDs string (format like "[1, 2, 3]")
-		idStr := strings.Trim(txIDsString, "[]")
-		idParts := strings.Split(idStr, ",")
-
-		for _, part := range idParts {
-			// Trim spaces and convert to int
-			trimmed := strings.TrimSpace(part)
-			id, err := strconv.Atoi(trimmed)
-			if err != nil {
-				log.Printf("Error parsing TxID '%s': %v", trimmed, err)
-				continue
-			}
-			txIDs = append(txIDs, id)
-		}
-	}
-
+	allocationSummary := ""
 	if len(txIDs) > 0 {
 		// Mark specific transactions as paid
 		for _, txID := range txIDs {
@@ -704,21 +626,23 @@ func handleVerifyPaymentConfirmButton(s *discordgo.Session, i *discordgo.Interac
 			}
 		}
 	} else {
-		// If no specific transactions were provided, just reduce the debt by the total amount
-		err = db.ReduceDebtFromPayment(debtorDiscordID, creditorDiscordID, totalDebtAmount)
+		// If no specific transactions were provided, allocate the total amount to the outstanding transactions.
+		// The confirmation happens in a DM, so no praise is posted here.
+		allocation, err := allocatePayment(s, "", debtorDiscordID, creditorDiscordID, totalDebtAmount)
 		if err != nil {
-			log.Printf("Error reducing debt: %v", err)
+			log.Printf("Error allocating payment: %v", err)
 			respondWithError(s, i, "ไม่สามารถอัปเดตข้อมูลหนี้สินในระบบได้")
 			return
 		}
+		allocationSummary = "\n" + formatPaymentAllocation(allocation)
 	}
 
 	// Respond to the creditor with confirmation
 	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseUpdateMessage,
 		Data: &discordgo.InteractionResponseData{
-			Content: fmt.Sprintf("✅ คุณได้ยืนยันการรับชำระหนี้จำนวน %.2f บาท จาก <@%s> เรียบร้อยแล้ว ระบบได้อัปเดตข้อมูลหนี้สินแล้ว",
-				totalDebtAmount, debtorDiscordID),
+			Content: fmt.Sprintf("✅ คุณได้ยืนยันการรับชำระหนี้จำนวน %.2f บาท จาก <@%s> เรียบร้อยแล้ว ระบบได้อัปเดตข้อมูลหนี้สินแล้ว%s",
+				totalDebtAmount, debtorDiscordID, allocationSummary),
 			Components: []discordgo.MessageComponent{}, // Remove buttons
 		},
 	})
@@ -745,20 +669,18 @@ func handleVerifyPaymentConfirmButton(s *discordgo.Session, i *discordgo.Interac
 }
 
 // handleVerifyPaymentRejectButton handles the rejection of payment verification button
-func handleVerifyPaymentRejectButton(s *discordgo.Session, i *discordgo.InteractionCreate) {
-	// Extract the debtor's Discord ID, creditor's Discord ID, and TxIDs from the custom ID
-	customID := i.MessageComponentData().CustomID
-	parts := strings.SplitN(strings.TrimPrefix(customID, verifyPaymentRejectPrefix), "_", 3)
-
-	if len(parts) != 3 {
-		respondWithError(s, i, "รูปแบบ ID ไม่ถูกต้อง")
+// and opens a dispute so the claim isn't lost
+func handleVerifyPaymentRejectButton(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	var payload debtPairPayload
+	if !decodeComponentPayload(s, i, state, &payload) {
 		return
 	}
 
-	debtorDiscordID := parts[0]
-	creditorDiscordID := parts[1]
+	debtorDiscordID := payload.DebtorDiscordID
+	creditorDiscordID := payload.CreditorDiscordID
+	txIDs := payload.TxIDs
 
-	creditorUserID := i.Member.User.ID
+	creditorUserID := interactionUserID(i)
 
 	// Verify that the creditor is actually the person clicking the button
 	if creditorUserID != creditorDiscordID {
@@ -766,16 +688,41 @@ func handleVerifyPaymentRejectButton(s *discordgo.Session, i *discordgo.Interact
 		return
 	}
 
+	// Determine the disputed amount from the TxIDs, or the whole debt if none were given
+	var disputedAmount float64
+	var err error
+	if len(txIDs) > 0 {
+		disputedAmount, err = db.GetTransactionsTotalAmount(txIDs)
+	} else {
+		debtorDbID, userErr := db.GetOrCreateUser(debtorDiscordID)
+		creditorDbID, creditorErr := db.GetOrCreateUser(creditorDiscordID)
+		if userErr != nil || creditorErr != nil {
+			respondWithError(s, i, "ไม่สามารถดึงข้อมูลผู้ใช้ได้")
+			return
+		}
+		disputedAmount, err = db.GetTotalDebtAmount(debtorDbID, creditorDbID)
+	}
+	if err != nil {
+		log.Printf("Error determining disputed amount for %s -> %s: %v", debtorDiscordID, creditorDiscordID, err)
+	}
+
 	// Get names for the notification messages
 	debtorName := GetDiscordUsername(s, debtorDiscordID)
-	creditorName := GetDiscordUsername(s, creditorDiscordID)
+
+	dispute, err := openPaymentDispute(s, debtorDiscordID, creditorDiscordID, creditorUserID, disputedAmount, txIDs, i.GuildID, i.ChannelID,
+		"เจ้าหนี้ปฏิเสธการยืนยันรับชำระเงิน", nil)
+	if err != nil {
+		log.Printf("Error opening dispute for rejected payment %s -> %s: %v", debtorDiscordID, creditorDiscordID, err)
+		respondWithError(s, i, "ไม่สามารถเปิดข้อพิพาทได้")
+		return
+	}
 
 	// Respond to the creditor with confirmation
-	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseUpdateMessage,
 		Data: &discordgo.InteractionResponseData{
-			Content: fmt.Sprintf("❌ คุณได้ปฏิเสธการยืนยันรับชำระหนี้จาก <@%s> (**%s**) ไม่มีการเปลี่ยนแปลงข้อมูลในระบบ",
-				debtorDiscordID, debtorName),
+			Content: fmt.Sprintf("❌ คุณได้ปฏิเสธการยืนยันรับชำระหนี้จาก <@%s> (**%s**) ไม่มีการเปลี่ยนแปลงข้อมูลในระบบ และได้เปิดข้อพิพาท #%d แล้ว",
+				debtorDiscordID, debtorName, dispute.ID),
 			Components: []discordgo.MessageComponent{}, // Remove buttons
 		},
 	})
@@ -783,23 +730,15 @@ func handleVerifyPaymentRejectButton(s *discordgo.Session, i *discordgo.Interact
 	if err != nil {
 		log.Printf("Error responding to verification reject button: %v", err)
 	}
-
-	// Notify the debtor via DM
-	debtorChannel, err := s.UserChannelCreate(debtorDiscordID)
-	if err != nil {
-		log.Printf("Could not create DM channel with debtor %s: %v", debtorDiscordID, err)
-	} else {
-		_, err = s.ChannelMessageSend(debtorChannel.ID, fmt.Sprintf("❌ <@%s> (**%s**) ได้ปฏิเสธการยืนยันรับชำระหนี้จากคุณ โปรดติดต่อเจ้าหนี้โดยตรงเพื่อตรวจสอบการชำระเงิน",
-			creditorDiscordID, creditorName))
-
-		if err != nil {
-			log.Printf("Error sending DM to debtor: %v", err)
-		}
-	}
 }
 
 // handleDebtDropdown handles the debt selection dropdown
-func handleDebtDropdown(s *discordgo.Session, i *discordgo.InteractionCreate) {
+func handleDebtDropdown(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	var payload txListPayload
+	if !decodeComponentPayload(s, i, state, &payload) {
+		return
+	}
+
 	// Get the selected value
 	values := i.MessageComponentData().Values
 	if len(values) == 0 {
@@ -810,7 +749,7 @@ func handleDebtDropdown(s *discordgo.Session, i *discordgo.InteractionCreate) {
 	// Extract the transaction ID
 	txIDStr := strings.TrimPrefix(values[0], "tx_")
 	txID, err := strconv.Atoi(txIDStr)
-	if err != nil {
+	if err != nil || !containsInt(payload.TxIDs, txID) {
 		respondWithError(s, i, "รหัสรายการไม่ถูกต้อง")
 		return
 	}
@@ -833,6 +772,8 @@ func handleDebtDropdown(s *discordgo.Session, i *discordgo.InteractionCreate) {
 	paidStatus := "🔴 ยังไม่ชำระ"
 	if isPaid {
 		paidStatus = "✅ ชำระแล้ว"
+	} else if paidAmount := txInfo["paid_amount"].(float64); paidAmount > 0 {
+		paidStatus = fmt.Sprintf("🟡 ชำระแล้วบางส่วน %.2f บาท (คงเหลือ %.2f บาท)", paidAmount, amount-paidAmount)
 	}
 
 	payerDiscordID, _ := db.GetDiscordIDFromDbID(txInfo["payer_id"].(int))
@@ -845,12 +786,15 @@ func handleDebtDropdown(s *discordgo.Session, i *discordgo.InteractionCreate) {
 	content.WriteString(fmt.Sprintf("**สถานะ:** %s\n", paidStatus))
 	content.WriteString(fmt.Sprintf("**รายละเอียด:** %s\n", description))
 	content.WriteString(fmt.Sprintf("**วันที่สร้าง:** %s\n", createdAt.Format("02/01/2006 15:04:05")))
+	if dueDate := formatTxDueDate(txInfo); dueDate != "" {
+		content.WriteString(fmt.Sprintf("**ครบกำหนดชำระ:** %s\n", dueDate))
+	}
 	content.WriteString(fmt.Sprintf("**ผู้จ่าย:** %s (<@%s>)\n", payerName, payerDiscordID))
 	content.WriteString(fmt.Sprintf("**ผู้รับ:** %s (<@%s>)\n", payeeName, payeeDiscordID))
 
 	// Add buttons based on the transaction status and user role
 	var components []discordgo.MessageComponent
-	userDiscordID := i.Member.User.ID
+	userDiscordID := interactionUserID(i)
 
 	if !isPaid {
 		if userDiscordID == payerDiscordID {
@@ -860,7 +804,7 @@ func handleDebtDropdown(s *discordgo.Session, i *discordgo.InteractionCreate) {
 					discordgo.Button{
 						Label:    "ชำระเงินเฉพาะรายการนี้",
 						Style:    discordgo.PrimaryButton,
-						CustomID: fmt.Sprintf("pay_tx_%d", txID),
+						CustomID: payTxComponentID(payerDiscordID, txID),
 					},
 				},
 			})
@@ -871,12 +815,12 @@ func handleDebtDropdown(s *discordgo.Session, i *discordgo.InteractionCreate) {
 					discordgo.Button{
 						Label:    "ทำเครื่องหมายว่าชำระแล้ว",
 						Style:    discordgo.SuccessButton,
-						CustomID: fmt.Sprintf("mark_paid_%d", txID),
+						CustomID: markPaidComponentID(payeeDiscordID, txID),
 					},
 					discordgo.Button{
 						Label:    "ขอชำระเงิน",
 						Style:    discordgo.PrimaryButton,
-						CustomID: fmt.Sprintf("%s%s", requestPaymentButtonPrefix, payerDiscordID),
+						CustomID: requestPaymentComponentID(payerDiscordID, payeeDiscordID),
 					},
 				},
 			})
@@ -899,19 +843,15 @@ func handleDebtDropdown(s *discordgo.Session, i *discordgo.InteractionCreate) {
 }
 
 // handleBillSkipButton handles the bill skip button
-func handleBillSkipButton(s *discordgo.Session, i *discordgo.InteractionCreate) {
-	// Extract the item index from the custom ID
-	customID := i.MessageComponentData().CustomID
-	itemIndexStr := strings.TrimPrefix(customID, "bill_skip_")
-
-	itemIndex, err := strconv.Atoi(itemIndexStr)
-	if err != nil {
-		respondWithError(s, i, "รหัสรายการไม่ถูกต้อง")
+func handleBillSkipButton(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	var payload billPayload
+	if !decodeComponentPayload(s, i, state, &payload) {
 		return
 	}
+	itemIndex := payload.ItemIndex
 
 	// Respond with a confirmation message
-	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseChannelMessageWithSource,
 		Data: &discordgo.InteractionResponseData{
 			Content: fmt.Sprintf("ข้ามรายการที่ %d แล้ว", itemIndex+1),
@@ -929,7 +869,7 @@ func handleBillSkipButton(s *discordgo.Session, i *discordgo.InteractionCreate)
 }
 
 // handleBillCancelButton handles the cancel button for bills
-func handleBillCancelButton(s *discordgo.Session, i *discordgo.InteractionCreate) {
+func handleBillCancelButton(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
 	// Respond by updating the message to indicate cancellation
 	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseUpdateMessage,
@@ -945,19 +885,15 @@ func handleBillCancelButton(s *discordgo.Session, i *discordgo.InteractionCreate
 }
 
 // handleMarkPaidButton handles the mark-paid button interaction
-func handleMarkPaidButton(s *discordgo.Session, i *discordgo.InteractionCreate) {
-	// Extract transaction ID from the custom ID
-	customID := i.MessageComponentData().CustomID
-	txIDStr := strings.TrimPrefix(customID, markPaidButtonPrefix)
-
-	txID, err := strconv.Atoi(txIDStr)
-	if err != nil {
-		respondWithError(s, i, "รหัสรายการไม่ถูกต้อง")
+func handleMarkPaidButton(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	var payload txPayload
+	if !decodeComponentPayload(s, i, state, &payload) {
 		return
 	}
+	txID := payload.TxID
 
 	// Verify that the current user is actually the creditor
-	userID := i.Member.User.ID
+	userID := interactionUserID(i)
 
 	// Get the transaction details
 	txInfo, err := db.GetTransactionInfo(txID)
@@ -1031,7 +967,8 @@ func followUpMessage(s *discordgo.Session, i *discordgo.InteractionCreate, messa
 	}
 }
 
-// followUpError sends an error follow-up message
+// followUpError sends an error follow-up message and, like respondWithError, releases a single-use component
 func followUpError(s *discordgo.Session, i *discordgo.InteractionCreate, message string) {
+	releaseClaimedState(i)
 	followUpMessage(s, i, "⚠️ "+message)
 }
@@ -0,0 +1,625 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/oatsaysai/billing-in-discord/internal/db"
+)
+
+// Limits of the claim board, Discord allows 25 options per select menu and 5 rows per message
+const (
+	claimItemsPerSelect  = 25
+	claimMaxItemSelects  = 4  // The fifth row holds the buttons
+	claimMaxUnitOptions  = 23 // Leaves room for the share and remove options
+	claimBoardMaxContent = 4000
+)
+
+// handleBillClaimStartButton turns the OCR'd bill into a claim board where each participant picks their own items
+func handleBillClaimStartButton(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	var payload billPayload
+	if !decodeComponentPayload(s, i, state, &payload) {
+		return
+	}
+
+	billData := getBillOCRData(payload.MessageID)
+	if billData == nil {
+		respondWithError(s, i, "ไม่พบข้อมูลบิล หรือข้อมูลหมดอายุแล้ว")
+		return
+	}
+	if len(billData.Items) == 0 {
+		respondWithError(s, i, "ไม่พบรายการในบิลนี้")
+		return
+	}
+	if len(billData.Items) > claimItemsPerSelect*claimMaxItemSelects {
+		respondWithError(s, i, fmt.Sprintf("บิลนี้มีรายการมากกว่า %d รายการ โปรดใช้ปุ่ม \"ระบุรายการของแต่ละคน\" แทน", claimItemsPerSelect*claimMaxItemSelects))
+		return
+	}
+
+	session := &db.ClaimSession{
+		ChannelID:       i.ChannelID,
+		GuildID:         i.GuildID,
+		OwnerDiscordID:  state.OwnerDiscordID,
+		SourceMessageID: payload.MessageID,
+		MerchantName:    billData.MerchantName,
+		BillDatetime:    billData.Datetime,
+		ExtraCharges:    billData.VAT + billData.ServiceCharge,
+		Status:          db.ClaimSessionOpen,
+	}
+	for _, item := range billData.Items {
+		quantity := item.Quantity
+		if quantity < 1 {
+			quantity = 1 // OCR sometimes misses the quantity of single items
+		}
+		session.Items = append(session.Items, db.ClaimItem{Name: item.Name, Price: item.Price, Quantity: quantity})
+	}
+
+	sessionID, err := db.CreateClaimSession(session)
+	if err != nil {
+		log.Printf("Error creating claim session for message %s: %v", payload.MessageID, err)
+		respondWithError(s, i, "เกิดข้อผิดพลาดในการสร้างรายการแบ่งบิล")
+		return
+	}
+	session.ID = sessionID
+
+	boardMsg, err := s.ChannelMessageSendComplex(i.ChannelID, &discordgo.MessageSend{
+		Content:    "🙋 ทุกคนที่ร่วมจ่าย เลือกรายการที่ตัวเองสั่งจากเมนูด้านล่าง",
+		Embed:      claimBoardEmbed(session),
+		Components: claimBoardComponents(session),
+	})
+	if err != nil {
+		log.Printf("Error sending claim board for session %d: %v", sessionID, err)
+		respondWithError(s, i, "ไม่สามารถส่งรายการแบ่งบิลได้")
+		return
+	}
+	if err := db.SetClaimSessionMessage(sessionID, boardMsg.ID); err != nil {
+		log.Printf("Error saving claim board message of session %d: %v", sessionID, err)
+	}
+
+	respondEphemeral(s, i, "✅ สร้างรายการแบ่งบิลแล้ว เมื่อทุกคนเลือกรายการครบ กด \"สร้างบิล\" เพื่อบันทึกหนี้")
+}
+
+// claimBoardComponents builds the item select menus and the buttons of a claim board
+func claimBoardComponents(session *db.ClaimSession) []discordgo.MessageComponent {
+	payload := claimSessionPayload{SessionID: session.ID}
+	var rows []discordgo.MessageComponent
+	for start := 0; start < len(session.Items); start += claimItemsPerSelect {
+		end := start + claimItemsPerSelect
+		if end > len(session.Items) {
+			end = len(session.Items)
+		}
+		var options []discordgo.SelectMenuOption
+		for idx := start; idx < end; idx++ {
+			item := session.Items[idx]
+			options = append(options, discordgo.SelectMenuOption{
+				Label:       truncateText(fmt.Sprintf("%d. %s (x%d)", idx+1, item.Name, item.Quantity), 100),
+				Value:       strconv.Itoa(idx),
+				Description: fmt.Sprintf("%.2f บาท", item.Price),
+			})
+		}
+		rows = append(rows, discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.SelectMenu{
+					// Each menu needs its own custom ID, so each gets its own state
+					CustomID:    newComponentID(claimItemSelectPrefix, session.OwnerDiscordID, nil, payload, false, interactionStateTTL),
+					Placeholder: fmt.Sprintf("เลือกรายการที่คุณสั่ง (%d-%d)", start+1, end),
+					Options:     options,
+				},
+			},
+		})
+	}
+
+	stateID := newComponentState([]string{claimClearButtonPrefix, claimFinalizeButtonPrefix, claimCancelButtonPrefix},
+		session.OwnerDiscordID, nil, payload, false, interactionStateTTL)
+	rows = append(rows, discordgo.ActionsRow{
+		Components: []discordgo.MessageComponent{
+			discordgo.Button{
+				Label:    "ล้างรายการของฉัน",
+				Style:    discordgo.SecondaryButton,
+				CustomID: claimClearButtonPrefix + stateID,
+			},
+			discordgo.Button{
+				Label:    "สร้างบิล",
+				Style:    discordgo.SuccessButton,
+				CustomID: claimFinalizeButtonPrefix + stateID,
+			},
+			discordgo.Button{
+				Label:    "ยกเลิก",
+				Style:    discordgo.DangerButton,
+				CustomID: claimCancelButtonPrefix + stateID,
+			},
+		},
+	})
+	return rows
+}
+
+// validateItemClaims checks that the claims on an item never take more units than the item has
+func validateItemClaims(item db.ClaimItem, claims []db.ItemClaim) error {
+	claimedUnits := 0
+	for _, claim := range claims {
+		if claim.Units < 0 {
+			return fmt.Errorf("จำนวนของ %s ไม่ถูกต้อง", item.Name)
+		}
+		claimedUnits += claim.Units
+	}
+	if claimedUnits > item.Quantity {
+		return fmt.Errorf("%s มีเพียง %d ชิ้น แต่ถูกเลือกไป %d ชิ้น", item.Name, item.Quantity, claimedUnits)
+	}
+	return nil
+}
+
+// splitClaimedItem works out what each claimant of one item owes at the item's per-unit price.
+// Claims with units pay for those units, sharers split the units nobody claimed individually,
+// and what nobody pays for is returned as unclaimed.
+func splitClaimedItem(item db.ClaimItem, claims []db.ItemClaim) (map[string]float64, float64) {
+	amounts := make(map[string]float64)
+	unitPrice := item.Price / float64(item.Quantity)
+
+	claimedUnits := 0
+	var sharers []string
+	for _, claim := range claims {
+		if claim.Units == 0 {
+			sharers = append(sharers, claim.DiscordID)
+			continue
+		}
+		claimedUnits += claim.Units
+		amounts[claim.DiscordID] += float64(claim.Units) * unitPrice
+	}
+
+	rest := float64(item.Quantity-claimedUnits) * unitPrice
+	if len(sharers) == 0 {
+		return amounts, rest
+	}
+	for _, uid := range sharers {
+		amounts[uid] += rest / float64(len(sharers))
+	}
+	return amounts, 0
+}
+
+// claimsOfItem returns the claims on one item
+func claimsOfItem(claims []db.ItemClaim, itemIndex int) []db.ItemClaim {
+	var itemClaims []db.ItemClaim
+	for _, claim := range claims {
+		if claim.ItemIndex == itemIndex {
+			itemClaims = append(itemClaims, claim)
+		}
+	}
+	return itemClaims
+}
+
+// claimTotals works out what each participant owes for their claims, VAT and service charge included,
+// and how much of the bill nobody claimed
+func claimTotals(session *db.ClaimSession) (map[string]float64, float64) {
+	totals := make(map[string]float64)
+	unclaimed := 0.0
+	itemsTotal := 0.0
+	for idx, item := range session.Items {
+		itemsTotal += item.Price
+		amounts, rest := splitClaimedItem(item, claimsOfItem(session.Claims, idx))
+		for uid, amount := range amounts {
+			totals[uid] += amount
+		}
+		unclaimed += rest
+	}
+
+	// VAT and service charge follow each person's share of the items
+	if session.ExtraCharges > 0 && itemsTotal > 0 {
+		for uid, amount := range totals {
+			totals[uid] = amount + session.ExtraCharges*amount/itemsTotal
+		}
+		unclaimed += session.ExtraCharges * unclaimed / itemsTotal
+	}
+	return totals, unclaimed
+}
+
+// claimBoardEmbed renders the items, who claimed them, and the live per-person totals
+func claimBoardEmbed(session *db.ClaimSession) *discordgo.MessageEmbed {
+	claimsByItem := make(map[int][]db.ItemClaim)
+	for _, claim := range session.Claims {
+		claimsByItem[claim.ItemIndex] = append(claimsByItem[claim.ItemIndex], claim)
+	}
+
+	var itemsText strings.Builder
+	for idx, item := range session.Items {
+		itemsText.WriteString(fmt.Sprintf("**%d. %s** x%d — %.2f บาท", idx+1, item.Name, item.Quantity, item.Price))
+		if item.Quantity > 1 {
+			itemsText.WriteString(fmt.Sprintf(" (ชิ้นละ %.2f)", item.Price/float64(item.Quantity)))
+		}
+		itemsText.WriteString("\n")
+		claims := claimsByItem[idx]
+		if len(claims) == 0 {
+			continue
+		}
+		var parts []string
+		claimedUnits := 0
+		for _, claim := range claims {
+			if claim.Units == 0 {
+				parts = append(parts, fmt.Sprintf("<@%s> แบ่ง", claim.DiscordID))
+			} else {
+				parts = append(parts, fmt.Sprintf("<@%s> x%d", claim.DiscordID, claim.Units))
+				claimedUnits += claim.Units
+			}
+		}
+		itemsText.WriteString("  ↳ " + strings.Join(parts, ", "))
+		if left := item.Quantity - claimedUnits; left > 0 {
+			itemsText.WriteString(fmt.Sprintf(" · เหลือ %d", left))
+		}
+		itemsText.WriteString("\n")
+	}
+
+	totals, unclaimed := claimTotals(session)
+	participants := make([]string, 0, len(totals))
+	for uid := range totals {
+		participants = append(participants, uid)
+	}
+	sort.Strings(participants)
+	var totalsText strings.Builder
+	for _, uid := range participants {
+		totalsText.WriteString(fmt.Sprintf("<@%s>: **%.2f บาท**\n", uid, totals[uid]))
+	}
+	if totalsText.Len() == 0 {
+		totalsText.WriteString("ยังไม่มีใครเลือกรายการ")
+	}
+
+	fields := []*discordgo.MessageEmbedField{
+		{Name: "ยอดต่อคน", Value: truncateText(totalsText.String(), 1024)},
+	}
+	if unclaimed > 0.009 {
+		fields = append(fields, &discordgo.MessageEmbedField{Name: "ยังไม่มีคนรับ", Value: fmt.Sprintf("%.2f บาท", unclaimed), Inline: true})
+	}
+	if session.ExtraCharges > 0 {
+		fields = append(fields, &discordgo.MessageEmbedField{Name: "VAT และค่าบริการ", Value: fmt.Sprintf("%.2f บาท (เฉลี่ยตามยอดของแต่ละคน)", session.ExtraCharges), Inline: true})
+	}
+
+	embed := &discordgo.MessageEmbed{
+		Title:       fmt.Sprintf("🧾 แบ่งรายการบิล %s", session.MerchantName),
+		Description: truncateText(itemsText.String(), claimBoardMaxContent),
+		Color:       0x3498DB, // Blue
+		Fields:      fields,
+		Footer: &discordgo.MessageEmbedFooter{
+			Text: "เลือกรายการจากเมนูด้านล่าง · ยอดที่ไม่มีคนรับถือเป็นส่วนของเจ้าของบิล",
+		},
+	}
+	switch session.Status {
+	case db.ClaimSessionFinalized:
+		embed.Color = 0x00FF00 // Green
+		embed.Footer.Text = "สร้างบิลจากรายการที่เลือกแล้ว"
+	case db.ClaimSessionCancelled:
+		embed.Color = 0x808080 // Grey
+		embed.Footer.Text = "ยกเลิกการแบ่งบิลแล้ว"
+	}
+	return embed
+}
+
+// truncateText cuts text to at most limit characters
+func truncateText(text string, limit int) string {
+	runes := []rune(text)
+	if len(runes) <= limit {
+		return text
+	}
+	return string(runes[:limit-1]) + "…"
+}
+
+// refreshClaimBoard re-renders the claim board after its claims changed
+func refreshClaimBoard(s *discordgo.Session, sessionID int) {
+	session, err := db.GetClaimSession(sessionID)
+	if err != nil {
+		log.Printf("Error loading claim session %d: %v", sessionID, err)
+		return
+	}
+	if session.MessageID == "" {
+		return
+	}
+	embeds := []*discordgo.MessageEmbed{claimBoardEmbed(session)}
+	_, err = s.ChannelMessageEditComplex(&discordgo.MessageEdit{
+		ID:      session.MessageID,
+		Channel: session.ChannelID,
+		Embeds:  &embeds,
+	})
+	if err != nil {
+		log.Printf("Error updating claim board of session %d: %v", sessionID, err)
+	}
+}
+
+// handleClaimItemSelect asks the participant how many of the selected item they had
+func handleClaimItemSelect(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	var payload claimSessionPayload
+	if !decodeComponentPayload(s, i, state, &payload) {
+		return
+	}
+	values := i.MessageComponentData().Values
+	if len(values) == 0 {
+		return
+	}
+	itemIndex, err := strconv.Atoi(values[0])
+	if err != nil {
+		respondWithError(s, i, "ไม่พบรายการที่เลือก")
+		return
+	}
+
+	session, err := db.GetClaimSession(payload.SessionID)
+	if err != nil {
+		respondWithError(s, i, err.Error())
+		return
+	}
+	if session.Status != db.ClaimSessionOpen {
+		respondWithError(s, i, "รายการแบ่งบิลนี้ปิดไปแล้ว")
+		return
+	}
+	if itemIndex < 0 || itemIndex >= len(session.Items) {
+		respondWithError(s, i, "ไม่พบรายการที่เลือก")
+		return
+	}
+	item := session.Items[itemIndex]
+
+	userID := interactionUserID(i)
+	available := item.Quantity
+	for _, claim := range session.Claims {
+		if claim.ItemIndex == itemIndex && claim.DiscordID != userID {
+			available -= claim.Units
+		}
+	}
+
+	var options []discordgo.SelectMenuOption
+	for units := 1; units <= available && units <= claimMaxUnitOptions; units++ {
+		label := fmt.Sprintf("%d ชิ้น", units)
+		if item.Quantity == 1 {
+			label = "รับทั้งหมดคนเดียว"
+		}
+		options = append(options, discordgo.SelectMenuOption{
+			Label:       label,
+			Value:       strconv.Itoa(units),
+			Description: fmt.Sprintf("%.2f บาท", item.Price*float64(units)/float64(item.Quantity)),
+		})
+	}
+	options = append(options,
+		discordgo.SelectMenuOption{Label: "แบ่งกันจ่าย", Value: "share", Description: "หารส่วนที่ยังไม่มีคนรับกับคนอื่นที่เลือกแบ่ง"},
+		discordgo.SelectMenuOption{Label: "ไม่เอารายการนี้", Value: "none"},
+	)
+
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: fmt.Sprintf("**%s** (x%d, %.2f บาท) เหลือให้รับ %d ชิ้น คุณได้รายการนี้เท่าไร?", item.Name, item.Quantity, item.Price, available),
+			Components: []discordgo.MessageComponent{
+				discordgo.ActionsRow{
+					Components: []discordgo.MessageComponent{
+						discordgo.SelectMenu{
+							CustomID: newComponentID(claimUnitsSelectPrefix, userID, []string{userID},
+								claimItemPayload{SessionID: session.ID, ItemIndex: itemIndex}, false, interactionStateTTL),
+							Placeholder: "เลือกจำนวน",
+							Options:     options,
+						},
+					},
+				},
+			},
+			Flags: discordgo.MessageFlagsEphemeral,
+		},
+	})
+	if err != nil {
+		log.Printf("Error sending claim quantity menu for session %d: %v", session.ID, err)
+	}
+}
+
+// handleClaimUnitsSelect records the participant's claim on an item and updates the board
+func handleClaimUnitsSelect(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	var payload claimItemPayload
+	if !decodeComponentPayload(s, i, state, &payload) {
+		return
+	}
+	values := i.MessageComponentData().Values
+	if len(values) == 0 {
+		return
+	}
+	userID := interactionUserID(i)
+
+	var err error
+	var content string
+	switch values[0] {
+	case "none":
+		err = db.RemoveItemClaims(payload.SessionID, payload.ItemIndex, userID)
+		content = "✅ นำรายการนี้ออกจากรายการของคุณแล้ว"
+	case "share":
+		err = db.SetItemClaim(payload.SessionID, payload.ItemIndex, userID, 0)
+		content = "✅ คุณแบ่งจ่ายรายการนี้กับคนอื่นที่เลือกแบ่ง"
+	default:
+		units, convErr := strconv.Atoi(values[0])
+		if convErr != nil || units < 1 {
+			respondWithError(s, i, "จำนวนไม่ถูกต้อง")
+			return
+		}
+		err = db.SetItemClaim(payload.SessionID, payload.ItemIndex, userID, units)
+		content = fmt.Sprintf("✅ บันทึกว่าคุณได้รายการนี้ %d ชิ้น", units)
+	}
+	if err != nil {
+		respondWithError(s, i, err.Error())
+		return
+	}
+
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Content:    content,
+			Components: []discordgo.MessageComponent{}, // Remove the quantity menu
+		},
+	})
+	if err != nil {
+		log.Printf("Error responding to claim quantity menu: %v", err)
+	}
+	refreshClaimBoard(s, payload.SessionID)
+}
+
+// handleClaimClearButton removes all of the participant's claims
+func handleClaimClearButton(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	var payload claimSessionPayload
+	if !decodeComponentPayload(s, i, state, &payload) {
+		return
+	}
+	if err := db.RemoveItemClaims(payload.SessionID, -1, interactionUserID(i)); err != nil {
+		log.Printf("Error clearing claims in session %d: %v", payload.SessionID, err)
+		respondWithError(s, i, "เกิดข้อผิดพลาดในการล้างรายการ")
+		return
+	}
+	respondEphemeral(s, i, "✅ ล้างรายการที่คุณเลือกทั้งหมดแล้ว")
+	refreshClaimBoard(s, payload.SessionID)
+}
+
+// loadOwnedClaimSession loads an open claim session for its owner, responding with an error otherwise
+func loadOwnedClaimSession(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) *db.ClaimSession {
+	var payload claimSessionPayload
+	if !decodeComponentPayload(s, i, state, &payload) {
+		return nil
+	}
+	session, err := db.GetClaimSession(payload.SessionID)
+	if err != nil {
+		respondWithError(s, i, err.Error())
+		return nil
+	}
+	if interactionUserID(i) != session.OwnerDiscordID {
+		respondWithError(s, i, "เฉพาะเจ้าของบิลเท่านั้นที่ทำรายการนี้ได้")
+		return nil
+	}
+	if session.Status != db.ClaimSessionOpen {
+		respondWithError(s, i, "รายการแบ่งบิลนี้ปิดไปแล้ว")
+		return nil
+	}
+	return session
+}
+
+// handleClaimFinalizeButton turns the claims into the bill's transactions
+func handleClaimFinalizeButton(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	session := loadOwnedClaimSession(s, i, state)
+	if session == nil {
+		return
+	}
+	payeeDiscordID := session.OwnerDiscordID
+
+	totals, unclaimed := claimTotals(session)
+	var debtors []string
+	for uid, amount := range totals {
+		if uid != payeeDiscordID && math.Round(amount*100) >= 1 {
+			debtors = append(debtors, uid)
+		}
+	}
+	if len(debtors) == 0 {
+		respondWithError(s, i, "ยังไม่มีผู้อื่นเลือกรายการ ไม่มีหนี้ที่ต้องบันทึก")
+		return
+	}
+	sort.Strings(debtors)
+
+	payeeDbID, err := db.GetOrCreateUser(payeeDiscordID)
+	if err != nil {
+		respondWithError(s, i, fmt.Sprintf("เกิดข้อผิดพลาดกับฐานข้อมูลสำหรับ <@%s>", payeeDiscordID))
+		return
+	}
+
+	consentTimeout := billConsentTimeout(session.GuildID)
+	dueDate := defaultDueDate(session.GuildID)
+	description := fmt.Sprintf("รายการที่เลือกจากบิล %s วันที่ %s", session.MerchantName, session.BillDatetime)
+	var entries []db.BillEntry
+	for _, uid := range debtors {
+		debtorDbID, err := db.GetOrCreateUser(uid)
+		if err != nil {
+			respondWithError(s, i, fmt.Sprintf("เกิดข้อผิดพลาด DB สำหรับ <@%s> ยังไม่มีการบันทึกรายการใดๆ", uid))
+			return
+		}
+		entries = append(entries, db.BillEntry{
+			DebtorID:    debtorDbID,
+			Amount:      math.Round(totals[uid]*100) / 100,
+			Description: description,
+			Pending:     consentTimeout > 0,
+			DueDate:     entryDueDate(dueDate),
+		})
+	}
+
+	source := db.BillSource{MessageID: session.SourceMessageID, ChannelID: session.ChannelID, GuildID: session.GuildID}
+	txIDs, err := db.CreateBill(source, payeeDbID, entries)
+	if errors.Is(err, db.ErrDuplicateSource) {
+		respondWithError(s, i, "บิลจากรายการนี้ถูกบันทึกไปแล้ว")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to save claimed bill of session %d: %v", session.ID, err)
+		respondWithError(s, i, "เกิดข้อผิดพลาดในการบันทึกบิล ไม่มีรายการใดถูกบันทึก")
+		return
+	}
+	if err := db.CloseClaimSession(session.ID, db.ClaimSessionFinalized); err != nil {
+		log.Printf("Error finalizing claim session %d: %v", session.ID, err)
+	}
+	session.Status = db.ClaimSessionFinalized
+	recordBilledReceipt(session.GuildID, session.ChannelID, session.SourceMessageID)
+
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Content:    fmt.Sprintf("✅ สร้างบิลแล้ว (TxID: %s)", formatTxIDList(txIDs)) + billReceiptHint(session.SourceMessageID),
+			Embeds:     []*discordgo.MessageEmbed{claimBoardEmbed(session)},
+			Components: []discordgo.MessageComponent{}, // Remove the menus and buttons
+		},
+	})
+	if err != nil {
+		log.Printf("Error responding to claim finalize button: %v", err)
+	}
+
+	var summary strings.Builder
+	summary.WriteString(fmt.Sprintf("**สรุปบิล %s จากรายการที่แต่ละคนเลือก โดย <@%s>:**\n", session.MerchantName, payeeDiscordID))
+	total := session.ExtraCharges
+	for _, item := range session.Items {
+		total += item.Price
+	}
+	for idx, uid := range debtors {
+		summary.WriteString(fmt.Sprintf("- <@%s>: `%.2f` บาท\n", uid, entries[idx].Amount))
+	}
+	if own := totals[payeeDiscordID] + unclaimed; own > 0.009 {
+		summary.WriteString(fmt.Sprintf("- ส่วนของ <@%s> เอง (รวมรายการที่ไม่มีคนรับ): `%.2f` บาท\n", payeeDiscordID, own))
+	}
+
+	promptPayID, err := db.GetUserPromptPayID(payeeDbID)
+	if err != nil {
+		promptPayID = ""
+	}
+	announceCreatedBill(s, &createdBill{
+		ChannelID:      session.ChannelID,
+		GuildID:        session.GuildID,
+		PayeeDiscordID: payeeDiscordID,
+		PromptPayID:    promptPayID,
+		DueDate:        dueDate,
+		Summary:        summary.String(),
+		Total:          total,
+		Entries:        entries,
+		EntryDebtors:   debtors,
+		TxIDs:          txIDs,
+		ConsentTimeout: consentTimeout,
+	})
+}
+
+// handleClaimCancelButton closes the claim board without recording anything
+func handleClaimCancelButton(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	session := loadOwnedClaimSession(s, i, state)
+	if session == nil {
+		return
+	}
+	if err := db.CloseClaimSession(session.ID, db.ClaimSessionCancelled); err != nil {
+		respondWithError(s, i, err.Error())
+		return
+	}
+	session.Status = db.ClaimSessionCancelled
+
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Content:    "❌ ยกเลิกการแบ่งบิลแล้ว ไม่มีการบันทึกรายการใดๆ",
+			Embeds:     []*discordgo.MessageEmbed{claimBoardEmbed(session)},
+			Components: []discordgo.MessageComponent{}, // Remove the menus and buttons
+		},
+	})
+	if err != nil {
+		log.Printf("Error responding to claim cancel button: %v", err)
+	}
+}
@@ -2,12 +2,13 @@ package handlers
 
 import (
 	"log"
-	"strings"
 
 	"github.com/bwmarrin/discordgo"
+	"github.com/oatsaysai/billing-in-discord/internal/db"
 )
 
-// Component Custom IDs - shared constants for all interactive components
+// Component Custom IDs - shared constants for all interactive components.
+// A custom ID is always "<prefix><interaction state ID>", the data behind it is stored in the database.
 const (
 	payDebtButtonPrefix        = "pay_debt_"
 	payTxButtonPrefix          = "pay_tx_"
@@ -18,16 +19,48 @@ const (
 	confirmPaymentNoSlipPrefix = "confirm_payment_no_slip_"
 	verifyPaymentConfirmPrefix = "verify_payment_confirm_"
 	verifyPaymentRejectPrefix  = "verify_payment_reject_"
+	slipReviewApprovePrefix    = "slip_review_approve_"
+	slipReviewRejectPrefix     = "slip_review_reject_"
+	slipReviewAdjustPrefix     = "slip_review_adjust_"
 	billAllocateButtonPrefix   = "bill_allocate_"
 	billSkipButtonPrefix       = "bill_skip_"
-	billCancelButtonID         = "bill_cancel"
+	billCancelButtonPrefix     = "bill_cancel_"
 	billUsersSelectPrefix      = "bill_users_select_"
-	debtDropdownID             = "debt_dropdown"
+	debtDropdownPrefix         = "debt_dropdown_"
+	payerBillConfirmPrefix     = "payer_bill_confirm_"
+	payerBillRejectPrefix      = "payer_bill_reject_"
+	iouAcceptPrefix            = "iou_accept_"
+	iouRejectPrefix            = "iou_reject_"
+	billConsentAcceptPrefix    = "bill_consent_accept_"
+	billConsentDisputePrefix   = "bill_consent_dispute_"
+	billPreviewConfirmPrefix   = "bill_preview_confirm_"
+	billPreviewCancelPrefix    = "bill_preview_cancel_"
+	billClaimStartPrefix       = "bill_claim_start_"
+	claimItemSelectPrefix      = "claim_item_select_"
+	claimUnitsSelectPrefix     = "claim_units_select_"
+	claimClearButtonPrefix     = "claim_clear_"
+	claimFinalizeButtonPrefix  = "claim_finalize_"
+	claimCancelButtonPrefix    = "claim_cancel_"
+	ocrItemEditSelectPrefix    = "ocr_item_edit_select_"
+	ocrItemRemoveSelectPrefix  = "ocr_item_remove_select_"
+	ocrItemAddButtonPrefix     = "ocr_item_add_"
+	ocrTotalsEditButtonPrefix  = "ocr_totals_edit_"
+	ocrItemsPageButtonPrefix   = "ocr_items_page_"
+
+	payDebtModalPrefix          = "modal_pay_debt_"
+	slipReviewAdjustModalPrefix = "modal_slip_review_adjust_"
+	ocrItemEditModalPrefix      = "modal_ocr_item_edit_"
+	ocrItemAddModalPrefix       = "modal_ocr_item_add_"
+	ocrTotalsEditModalPrefix    = "modal_ocr_totals_edit_"
 )
 
 // RegisterComponentHandlers registers the interaction handlers for components
 func RegisterComponentHandlers(s *discordgo.Session) {
 	s.AddHandler(func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		if (i.Type == discordgo.InteractionMessageComponent || i.Type == discordgo.InteractionModalSubmit) &&
+			!ClaimEvent(db.EventInteraction, i.ID) {
+			return
+		}
 		if i.Type == discordgo.InteractionMessageComponent {
 			handleMessageComponentInteraction(s, i)
 		} else if i.Type == discordgo.InteractionModalSubmit {
@@ -40,43 +73,95 @@ func RegisterComponentHandlers(s *discordgo.Session) {
 func handleMessageComponentInteraction(s *discordgo.Session, i *discordgo.InteractionCreate) {
 	customID := i.MessageComponentData().CustomID
 
-	switch {
-	case strings.HasPrefix(customID, payDebtButtonPrefix):
-		handlePayDebtButton(s, i)
-	case strings.HasPrefix(customID, payTxButtonPrefix):
-		handlePayTxButton(s, i)
-	case strings.HasPrefix(customID, viewDetailButtonPrefix):
-		handleViewDetailButton(s, i)
-	case strings.HasPrefix(customID, requestPaymentButtonPrefix):
-		handleRequestPaymentButton(s, i)
-	case strings.HasPrefix(customID, markPaidButtonPrefix):
-		handleMarkPaidButton(s, i)
-	case strings.HasPrefix(customID, confirmPaymentButtonPrefix):
-		handleConfirmPaymentButton(s, i)
-	case strings.HasPrefix(customID, confirmPaymentNoSlipPrefix):
-		handleConfirmPaymentNoSlipButton(s, i)
-	case strings.HasPrefix(customID, verifyPaymentConfirmPrefix):
-		handleVerifyPaymentConfirmButton(s, i)
-	case strings.HasPrefix(customID, verifyPaymentRejectPrefix):
-		handleVerifyPaymentRejectButton(s, i)
-	case customID == debtDropdownID:
-		handleDebtDropdown(s, i)
-	case strings.HasPrefix(customID, billAllocateButtonPrefix):
-		handleBillAllocateButton(s, i)
-	case strings.HasPrefix(customID, billSkipButtonPrefix):
-		handleBillSkipButton(s, i)
-	case customID == billCancelButtonID:
-		handleBillCancelButton(s, i)
-	case strings.HasPrefix(customID, billUsersSelectPrefix):
-		handleUserSelectSubmit(s, i)
+	prefix, state := loadComponentState(s, i, customID)
+	if state == nil {
+		return
+	}
+	defer finishClaimedState(i)
+
+	switch prefix {
+	case payDebtButtonPrefix:
+		handlePayDebtButton(s, i, state)
+	case payTxButtonPrefix:
+		handlePayTxButton(s, i, state)
+	case viewDetailButtonPrefix:
+		handleViewDetailButton(s, i, state)
+	case requestPaymentButtonPrefix:
+		handleRequestPaymentButton(s, i, state)
+	case markPaidButtonPrefix:
+		handleMarkPaidButton(s, i, state)
+	case confirmPaymentButtonPrefix:
+		handleConfirmPaymentButton(s, i, state)
+	case confirmPaymentNoSlipPrefix:
+		handleConfirmPaymentNoSlipButton(s, i, state)
+	case verifyPaymentConfirmPrefix:
+		handleVerifyPaymentConfirmButton(s, i, state)
+	case verifyPaymentRejectPrefix:
+		handleVerifyPaymentRejectButton(s, i, state)
+	case slipReviewApprovePrefix:
+		handleSlipReviewApproveButton(s, i, state)
+	case slipReviewRejectPrefix:
+		handleSlipReviewRejectButton(s, i, state)
+	case slipReviewAdjustPrefix:
+		handleSlipReviewAdjustButton(s, i, state)
+	case debtDropdownPrefix:
+		handleDebtDropdown(s, i, state)
+	case billAllocateButtonPrefix:
+		handleBillAllocateButton(s, i, state)
+	case billSkipButtonPrefix:
+		handleBillSkipButton(s, i, state)
+	case billCancelButtonPrefix:
+		handleBillCancelButton(s, i, state)
+	case billUsersSelectPrefix:
+		handleUserSelectSubmit(s, i, state)
+	case payerBillConfirmPrefix:
+		handlePayerBillConfirmButton(s, i, state)
+	case payerBillRejectPrefix:
+		handlePayerBillRejectButton(s, i, state)
+	case iouAcceptPrefix:
+		handleIOUAcceptButton(s, i, state)
+	case iouRejectPrefix:
+		handleIOURejectButton(s, i, state)
+	case billConsentAcceptPrefix:
+		handleBillConsentAcceptButton(s, i, state)
+	case billConsentDisputePrefix:
+		handleBillConsentDisputeButton(s, i, state)
+	case billPreviewConfirmPrefix:
+		handleBillPreviewConfirmButton(s, i, state)
+	case billPreviewCancelPrefix:
+		handleBillPreviewCancelButton(s, i, state)
+	case billClaimStartPrefix:
+		handleBillClaimStartButton(s, i, state)
+	case claimItemSelectPrefix:
+		handleClaimItemSelect(s, i, state)
+	case claimUnitsSelectPrefix:
+		handleClaimUnitsSelect(s, i, state)
+	case claimClearButtonPrefix:
+		handleClaimClearButton(s, i, state)
+	case claimFinalizeButtonPrefix:
+		handleClaimFinalizeButton(s, i, state)
+	case claimCancelButtonPrefix:
+		handleClaimCancelButton(s, i, state)
+	case ocrItemEditSelectPrefix:
+		handleOCRItemEditSelect(s, i, state)
+	case ocrItemRemoveSelectPrefix:
+		handleOCRItemRemoveSelect(s, i, state)
+	case ocrItemAddButtonPrefix:
+		handleOCRItemAddButton(s, i, state)
+	case ocrTotalsEditButtonPrefix:
+		handleOCRTotalsEditButton(s, i, state)
+	case ocrItemsPageButtonPrefix:
+		handleOCRItemsPageButton(s, i, state)
 	default:
 		log.Printf("Unknown component interaction: %s", customID)
 		respondWithError(s, i, "ไม่รู้จัก interaction นี้ โปรดติดต่อผู้ดูแลระบบ")
 	}
 }
 
-// respondWithError sends an ephemeral error message
+// respondWithError sends an ephemeral error message.
+// A single-use component whose handler fails is released, so the user can try again.
 func respondWithError(s *discordgo.Session, i *discordgo.InteractionCreate, message string) {
+	releaseClaimedState(i)
 	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseChannelMessageWithSource,
 		Data: &discordgo.InteractionResponseData{
@@ -86,12 +171,49 @@ func respondWithError(s *discordgo.Session, i *discordgo.InteractionCreate, mess
 	})
 }
 
+// respondEphemeral answers an interaction with a message only the clicking user sees
+func respondEphemeral(s *discordgo.Session, i *discordgo.InteractionCreate, message string) {
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: message,
+			Flags:   discordgo.MessageFlagsEphemeral,
+		},
+	})
+}
+
+// interactionUserID returns the ID of the user who triggered an interaction.
+// Member is only set for interactions inside a guild, DMs carry the User instead.
+func interactionUserID(i *discordgo.InteractionCreate) string {
+	if i.Member != nil && i.Member.User != nil {
+		return i.Member.User.ID
+	}
+	if i.User != nil {
+		return i.User.ID
+	}
+	return ""
+}
+
 // handleModalSubmit handles modal submission interactions
 func handleModalSubmit(s *discordgo.Session, i *discordgo.InteractionCreate) {
 	customID := i.ModalSubmitData().CustomID
 
-	if strings.HasPrefix(customID, "modal_pay_debt_") {
-		handlePayDebtModalSubmit(s, i)
+	prefix, state := loadComponentState(s, i, customID)
+	if state == nil {
+		return
+	}
+	defer finishClaimedState(i)
+
+	if prefix == payDebtModalPrefix {
+		handlePayDebtModalSubmit(s, i, state)
+	} else if prefix == slipReviewAdjustModalPrefix {
+		handleSlipReviewAdjustModalSubmit(s, i, state)
+	} else if prefix == ocrItemEditModalPrefix {
+		handleOCRItemEditModalSubmit(s, i, state)
+	} else if prefix == ocrItemAddModalPrefix {
+		handleOCRItemAddModalSubmit(s, i, state)
+	} else if prefix == ocrTotalsEditModalPrefix {
+		handleOCRTotalsEditModalSubmit(s, i, state)
 	} else {
 		log.Printf("Unknown modal interaction: %s", customID)
 		respondWithError(s, i, "ไม่รู้จัก modal interaction นี้ โปรดติดต่อผู้ดูแลระบบ")
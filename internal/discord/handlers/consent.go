@@ -0,0 +1,306 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/oatsaysai/billing-in-discord/internal/db"
+	"github.com/spf13/viper"
+)
+
+// billConsentUsage is shown when !billconsent can't be parsed
+const billConsentUsage = "รูปแบบไม่ถูกต้อง โปรดใช้ `!billconsent on [จำนวนชั่วโมง]` หรือ `!billconsent off`"
+
+// billConsentTimeout returns how long new bill debts in the guild wait for their participants,
+// or 0 if the guild doesn't require consent
+func billConsentTimeout(guildID string) time.Duration {
+	if guildID == "" {
+		return 0
+	}
+
+	enabled := viper.GetBool("BillConsent.Enabled")
+	hours := viper.GetInt("BillConsent.TimeoutHours")
+	policy, ok, err := db.GetBillConsentPolicy(guildID)
+	if err != nil {
+		log.Printf("Error getting bill consent policy for guild %s: %v", guildID, err)
+	} else if ok {
+		enabled, hours = policy.Enabled, policy.TimeoutHours
+	}
+
+	if !enabled || hours <= 0 {
+		return 0
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// HandleBillConsent handles !billconsent [on [hours] | off].
+// Admins decide whether new bill debts wait for each participant to accept them.
+func HandleBillConsent(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+	if m.GuildID == "" {
+		SendErrorMessage(s, m.ChannelID, "โปรดใช้คำสั่งนี้ในช่องของเซิร์ฟเวอร์")
+		return
+	}
+
+	if len(args) < 2 {
+		if timeout := billConsentTimeout(m.GuildID); timeout > 0 {
+			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("บิลใหม่ในเซิร์ฟเวอร์นี้ต้องให้ผู้ที่ถูกระบุกดยอมรับก่อน (ยอมรับอัตโนมัติภายใน %d ชั่วโมง)", int(timeout.Hours())))
+		} else {
+			s.ChannelMessageSend(m.ChannelID, "บิลใหม่ในเซิร์ฟเวอร์นี้จะบันทึกหนี้ทันทีโดยไม่ต้องรอการยอมรับ")
+		}
+		return
+	}
+
+	permissions, err := s.UserChannelPermissions(m.Author.ID, m.ChannelID)
+	if err != nil || permissions&adminPermissions == 0 {
+		SendErrorMessage(s, m.ChannelID, "การตั้งค่านี้ใช้ได้เฉพาะผู้ดูแลเซิร์ฟเวอร์เท่านั้น")
+		return
+	}
+
+	hours := viper.GetInt("BillConsent.TimeoutHours")
+	var enabled bool
+	switch strings.ToLower(args[1]) {
+	case "on":
+		enabled = true
+		if len(args) > 2 {
+			hours, err = strconv.Atoi(args[2])
+			if err != nil || hours <= 0 {
+				SendErrorMessage(s, m.ChannelID, billConsentUsage)
+				return
+			}
+		}
+	case "off":
+		enabled = false
+	default:
+		SendErrorMessage(s, m.ChannelID, billConsentUsage)
+		return
+	}
+	if hours <= 0 {
+		hours = 48
+	}
+
+	if err := db.SetBillConsentPolicy(m.GuildID, enabled, hours); err != nil {
+		log.Printf("Error setting bill consent policy for guild %s: %v", m.GuildID, err)
+		SendErrorMessage(s, m.ChannelID, "ไม่สามารถบันทึกการตั้งค่าได้")
+		return
+	}
+
+	if enabled {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("✅ บิลใหม่ในเซิร์ฟเวอร์นี้จะรอให้ผู้ที่ถูกระบุกดยอมรับ หากไม่ตอบภายใน %d ชั่วโมงจะยอมรับอัตโนมัติ", hours))
+	} else {
+		s.ChannelMessageSend(m.ChannelID, "✅ บิลใหม่ในเซิร์ฟเวอร์นี้จะบันทึกหนี้ทันทีโดยไม่ต้องรอการยอมรับ")
+	}
+}
+
+// requestBillConsent posts a bill summary whose debts are still pending, with accept/dispute buttons
+// for the mentioned participants. The debts are accepted automatically at the deadline.
+func requestBillConsent(s *discordgo.Session, channelID, guildID, creditorDiscordID, promptPayID string, userTxIDs map[string][]int, summary string, timeout time.Duration) {
+	var allTxIDs []int
+	var participants []string
+	for debtorDiscordID, txIDs := range userTxIDs {
+		allTxIDs = append(allTxIDs, txIDs...)
+		participants = append(participants, debtorDiscordID)
+	}
+	sort.Strings(participants)
+
+	deadline := time.Now().Add(timeout)
+	if err := db.AddBillConsents(allTxIDs, channelID, guildID, deadline); err != nil {
+		log.Printf("Failed to schedule auto-accept for transactions %v: %v", allTxIDs, err)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(summary)
+	sb.WriteString("\n⏳ **หนี้จากบิลนี้ยังไม่ถูกบันทึก** ")
+	for _, debtorDiscordID := range participants {
+		sb.WriteString(fmt.Sprintf("<@%s> ", debtorDiscordID))
+	}
+	sb.WriteString(fmt.Sprintf("โปรดกดยอมรับหรือโต้แย้งรายการของคุณ หากไม่ตอบภายใน %s ระบบจะยอมรับให้อัตโนมัติ",
+		deadline.Format("02/01/2006 15:04")))
+
+	stateID := newComponentState([]string{billConsentAcceptPrefix, billConsentDisputePrefix}, creditorDiscordID, participants,
+		billConsentPayload{CreditorDiscordID: creditorDiscordID, PromptPayID: promptPayID, ChannelID: channelID, GuildID: guildID, TxIDs: userTxIDs},
+		false, timeout)
+	_, err := s.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+		Content: sb.String(),
+		Components: []discordgo.MessageComponent{
+			discordgo.ActionsRow{
+				Components: []discordgo.MessageComponent{
+					discordgo.Button{
+						Label:    "ยอมรับ",
+						Style:    discordgo.SuccessButton,
+						CustomID: billConsentAcceptPrefix + stateID,
+					},
+					discordgo.Button{
+						Label:    "โต้แย้ง",
+						Style:    discordgo.DangerButton,
+						CustomID: billConsentDisputePrefix + stateID,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		log.Printf("Failed to send bill consent request in channel %s: %v", channelID, err)
+	}
+}
+
+// handleBillConsentAcceptButton activates the clicking participant's pending debts of a bill
+func handleBillConsentAcceptButton(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	var payload billConsentPayload
+	if !decodeComponentPayload(s, i, state, &payload) {
+		return
+	}
+	debtorDiscordID := interactionUserID(i)
+	txIDs := payload.TxIDs[debtorDiscordID]
+	if len(txIDs) == 0 {
+		respondWithError(s, i, "คุณไม่มีรายการในบิลนี้")
+		return
+	}
+
+	activated, err := db.ActivatePendingTransactions(txIDs)
+	if err != nil {
+		log.Printf("Error accepting bill debts %v: %v", txIDs, err)
+		respondWithError(s, i, "เกิดข้อผิดพลาดในการบันทึกหนี้")
+		return
+	}
+	if len(activated) == 0 {
+		respondWithError(s, i, "รายการของคุณในบิลนี้ถูกดำเนินการไปแล้ว")
+		return
+	}
+
+	respondEphemeral(s, i, fmt.Sprintf("✅ คุณยอมรับรายการในบิลนี้แล้ว (TxID: %s)", formatTxIDList(activated)))
+	announceAcceptedBillDebt(s, payload.ChannelID, payload.GuildID, debtorDiscordID, payload.CreditorDiscordID, payload.PromptPayID, activated, false)
+}
+
+// handleBillConsentDisputeButton opens a dispute over the clicking participant's pending debts of a bill.
+// The debts stay pending, without auto-accepting, until the creditor or an arbiter resolves the dispute.
+func handleBillConsentDisputeButton(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	var payload billConsentPayload
+	if !decodeComponentPayload(s, i, state, &payload) {
+		return
+	}
+	debtorDiscordID := interactionUserID(i)
+	txIDs := payload.TxIDs[debtorDiscordID]
+	if len(txIDs) == 0 {
+		respondWithError(s, i, "คุณไม่มีรายการในบิลนี้")
+		return
+	}
+
+	disputed, err := db.WithdrawBillConsents(txIDs)
+	if err != nil {
+		log.Printf("Error disputing bill debts %v: %v", txIDs, err)
+		respondWithError(s, i, "เกิดข้อผิดพลาดในการโต้แย้งรายการ")
+		return
+	}
+	if len(disputed) == 0 {
+		respondWithError(s, i, "รายการของคุณในบิลนี้ถูกดำเนินการไปแล้ว")
+		return
+	}
+
+	amount, err := db.GetTransactionsTotalAmount(disputed)
+	if err == nil {
+		var dispute *db.Dispute
+		dispute, err = openPaymentDispute(s, debtorDiscordID, payload.CreditorDiscordID, debtorDiscordID, amount, disputed,
+			payload.GuildID, payload.ChannelID, "ลูกหนี้โต้แย้งรายการในบิล", nil)
+		if err == nil {
+			respondEphemeral(s, i, fmt.Sprintf("⚖️ คุณโต้แย้งรายการในบิลนี้แล้ว (TxID: %s) เปิดข้อพิพาท #%d รายการเหล่านี้จะยังไม่ถูกบันทึกเป็นหนี้จนกว่าข้อพิพาทจะได้รับการตัดสิน",
+				formatTxIDList(disputed), dispute.ID))
+			s.ChannelMessageSend(payload.ChannelID, fmt.Sprintf("⚖️ <@%s> โต้แย้งรายการของตนในบิลของ <@%s> (TxID: %s) เปิดข้อพิพาท #%d แล้ว\n"+
+				"รายการเหล่านี้จะรอจนกว่าเจ้าหนี้หรือผู้ตัดสินจะใช้ `!dispute resolve %d paid|unpaid` (`paid` = ไม่ต้องชำระ, `unpaid` = บันทึกเป็นหนี้)",
+				debtorDiscordID, payload.CreditorDiscordID, formatTxIDList(disputed), dispute.ID, dispute.ID))
+			return
+		}
+	}
+
+	// Put the debts back on the auto-accept schedule so they aren't left pending forever
+	log.Printf("Error opening dispute for bill debts %v: %v", disputed, err)
+	if err := db.AddBillConsents(disputed, payload.ChannelID, payload.GuildID, time.Now().Add(billConsentTimeout(payload.GuildID))); err != nil {
+		log.Printf("Error restoring bill consents %v: %v", disputed, err)
+	}
+	respondWithError(s, i, "เกิดข้อผิดพลาดในการเปิดข้อพิพาท โปรดลองใหม่อีกครั้ง")
+}
+
+// announceAcceptedBillDebt posts an accepted bill debt and asks for payment like a new bill would
+func announceAcceptedBillDebt(s *discordgo.Session, channelID, guildID, debtorDiscordID, creditorDiscordID, promptPayID string, txIDs []int, automatic bool) {
+	amount, err := db.GetTransactionsTotalAmount(txIDs)
+	if err != nil {
+		log.Printf("Error summing accepted transactions %v: %v", txIDs, err)
+		return
+	}
+
+	var sb strings.Builder
+	if automatic {
+		sb.WriteString(fmt.Sprintf("⌛ <@%s> ไม่ได้ตอบภายในเวลาที่กำหนด ระบบยอมรับหนี้ %.2f บาท ให้ <@%s> อัตโนมัติ (TxID: %s)",
+			debtorDiscordID, amount, creditorDiscordID, formatTxIDList(txIDs)))
+	} else {
+		sb.WriteString(fmt.Sprintf("✅ <@%s> ยอมรับหนี้ %.2f บาท ให้ <@%s> แล้ว (TxID: %s)",
+			debtorDiscordID, amount, creditorDiscordID, formatTxIDList(txIDs)))
+	}
+
+	// Expenses of an open trip are settled when the trip closes instead
+	if tripLine, inTrip := addBillToTrip(channelID, txIDs); inTrip {
+		s.ChannelMessageSend(channelID, sb.String()+"\n"+tripLine)
+		return
+	}
+	// A due date given with the bill was stored on the pending transactions, others get the guild default
+	dueDate, err := db.GetTransactionsDueDate(txIDs)
+	if err != nil {
+		log.Printf("Error getting due date of accepted transactions %v: %v", txIDs, err)
+	}
+	if dueDate.IsZero() {
+		dueDate = defaultDueDate(guildID)
+	}
+	if dueDateLine := setBillDueDate(txIDs, dueDate); dueDateLine != "" {
+		sb.WriteString("\n" + dueDateLine)
+	}
+	s.ChannelMessageSend(channelID, sb.String())
+
+	// Settle what we can from credit and mutual debts before asking for money
+	amount, txIDs = prepareBillPayment(s, channelID, debtorDiscordID, creditorDiscordID, amount, txIDs)
+	if amount <= 0.009 {
+		return
+	}
+	if promptPayID == "" {
+		creditorDbID, err := db.GetOrCreateUser(creditorDiscordID)
+		if err != nil {
+			return
+		}
+		if promptPayID, err = db.GetUserPromptPayID(creditorDbID); err != nil || promptPayID == "" {
+			return
+		}
+	}
+	GenerateAndSendQrCode(s, channelID, promptPayID, amount, debtorDiscordID, fmt.Sprintf("ยอดรวมจากบิลโดย <@%s>", creditorDiscordID), txIDs)
+}
+
+// RunBillConsentAutoAccept accepts pending bill debts whose participants didn't respond before the deadline
+func RunBillConsentAutoAccept() {
+	accepted, err := db.ClaimExpiredBillConsents()
+	if err != nil {
+		log.Printf("Bill consent: error auto-accepting expired debts: %v", err)
+		return
+	}
+	if session == nil || len(accepted) == 0 {
+		return
+	}
+
+	// Announce one message and QR code per bill channel, debtor and creditor
+	type consentGroup struct{ channelID, guildID, debtor, creditor string }
+	var groups []consentGroup
+	groupTxIDs := make(map[consentGroup][]int)
+	for _, debt := range accepted {
+		group := consentGroup{debt.ChannelID, debt.GuildID, debt.DebtorDiscordID, debt.CreditorDiscordID}
+		if _, ok := groupTxIDs[group]; !ok {
+			groups = append(groups, group)
+		}
+		groupTxIDs[group] = append(groupTxIDs[group], debt.TxID)
+	}
+
+	for _, group := range groups {
+		announceAcceptedBillDebt(session, group.channelID, group.guildID, group.debtor, group.creditor, "", groupTxIDs[group], true)
+	}
+	log.Printf("Bill consent: auto-accepted %d pending transactions", len(accepted))
+}
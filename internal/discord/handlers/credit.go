@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/oatsaysai/billing-in-discord/internal/db"
+)
+
+// applyCreditToNewBill pays a bill's new transactions from the debtor's credit toward the creditor.
+// It returns the amount and transactions still to be paid, which the caller uses for the QR code,
+// and posts a note to the channel when credit was used.
+func applyCreditToNewBill(s *discordgo.Session, channelID, debtorDiscordID, creditorDiscordID string, amount float64, txIDs []int) (float64, []int) {
+	debtorDbID, err := db.GetOrCreateUser(debtorDiscordID)
+	if err != nil {
+		log.Printf("Error DB user %s while applying credit: %v", debtorDiscordID, err)
+		return amount, txIDs
+	}
+	creditorDbID, err := db.GetOrCreateUser(creditorDiscordID)
+	if err != nil {
+		log.Printf("Error DB user %s while applying credit: %v", creditorDiscordID, err)
+		return amount, txIDs
+	}
+
+	allocation, err := db.ApplyUserCredit(debtorDbID, creditorDbID, txIDs)
+	if err != nil {
+		log.Printf("Failed to apply credit of %s toward %s: %v", debtorDiscordID, creditorDiscordID, err)
+		return amount, txIDs
+	}
+	if allocation == nil {
+		return amount, txIDs
+	}
+
+	settled := allocation.SettledTxIDs()
+	var remainingTxIDs []int
+	for _, txID := range txIDs {
+		if !containsInt(settled, txID) {
+			remainingTxIDs = append(remainingTxIDs, txID)
+		}
+	}
+	remaining := math.Max(math.Round((amount-allocation.Amount)*100)/100, 0)
+
+	var note strings.Builder
+	note.WriteString(fmt.Sprintf("💳 ใช้เครดิตของ <@%s> ที่มีกับ <@%s> จำนวน %.2f บาท\n", debtorDiscordID, creditorDiscordID, allocation.Amount))
+	note.WriteString(formatPaymentAllocation(allocation))
+	if remaining <= 0.009 {
+		note.WriteString("\nบิลนี้ชำระครบด้วยเครดิตแล้ว ไม่ต้องสร้าง QR Code")
+	} else {
+		note.WriteString(fmt.Sprintf("\nยอดที่ต้องชำระเพิ่ม: %.2f บาท", remaining))
+	}
+	s.ChannelMessageSend(channelID, note.String())
+
+	return remaining, remainingTxIDs
+}
+
+// writeCreditLines appends the principal's credit balances to a !mydebts or !mydues response
+func writeCreditLines(s *discordgo.Session, response *strings.Builder, principalDbID int, isDebtor bool) {
+	credits, err := db.GetUserCredits(principalDbID, isDebtor)
+	if err != nil {
+		log.Printf("Error querying credits for dbID %d: %v", principalDbID, err)
+		return
+	}
+	if len(credits) == 0 {
+		return
+	}
+
+	if isDebtor {
+		response.WriteString("\n**เครดิตจากการชำระเกิน (จะถูกหักจากบิลถัดไปโดยอัตโนมัติ):**\n")
+	} else {
+		response.WriteString("\n**เครดิตที่ผู้อื่นชำระเกินให้ (จะถูกหักจากบิลถัดไปของคุณ):**\n")
+	}
+	for _, credit := range credits {
+		otherPartyName := GetDiscordUsername(s, credit.OtherPartyDiscordID)
+		if isDebtor {
+			response.WriteString(fmt.Sprintf("- เครดิต **%.2f บาท** กับ %s (<@%s>)\n",
+				credit.Amount, otherPartyName, credit.OtherPartyDiscordID))
+		} else {
+			response.WriteString(fmt.Sprintf("- %s (<@%s>) มีเครดิต **%.2f บาท**\n",
+				otherPartyName, credit.OtherPartyDiscordID, credit.Amount))
+		}
+	}
+}
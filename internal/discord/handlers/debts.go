@@ -94,15 +94,18 @@ func queryAndSendDebts(s *discordgo.Session, m *discordgo.MessageCreate, princip
 
 			// Format based on the mode
 			if isDebtor {
-				response.WriteString(fmt.Sprintf("- **%.2f บาท** ให้ %s (<@%s>) (รายละเอียดล่าสุด: %s)\n",
-					debt.Amount, otherPartyName, debt.OtherPartyDiscordID, details))
+				response.WriteString(fmt.Sprintf("- **%.2f บาท** ให้ %s (<@%s>)%s%s (รายละเอียดล่าสุด: %s)\n",
+					debt.Amount, otherPartyName, debt.OtherPartyDiscordID, overdueFlag(debt.OverdueAmount), disputeFlag(debt.HasOpenDispute), details))
 			} else {
-				response.WriteString(fmt.Sprintf("- %s (<@%s>) เป็นหนี้ **%.2f บาท** (รายละเอียดล่าสุด: %s)\n",
-					otherPartyName, debt.OtherPartyDiscordID, debt.Amount, details))
+				response.WriteString(fmt.Sprintf("- %s (<@%s>) เป็นหนี้ **%.2f บาท**%s%s (รายละเอียดล่าสุด: %s)\n",
+					otherPartyName, debt.OtherPartyDiscordID, debt.Amount, overdueFlag(debt.OverdueAmount), disputeFlag(debt.HasOpenDispute), details))
 			}
 		}
 	}
 
+	// Overpayments kept as credit between the principal and others
+	writeCreditLines(s, &response, principalDbID, isDebtor)
+
 	// Send the response
 	s.ChannelMessageSend(m.ChannelID, response.String())
 }
@@ -0,0 +1,463 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/oatsaysai/billing-in-discord/internal/db"
+)
+
+// arbiterPermissions are the guild permissions that allow a member to arbitrate disputes
+const arbiterPermissions = discordgo.PermissionAdministrator | discordgo.PermissionManageServer |
+	discordgo.PermissionManageMessages | discordgo.PermissionModerateMembers
+
+// disputeStatusText returns a Thai label for a dispute status
+func disputeStatusText(status string) string {
+	switch status {
+	case db.DisputeOpen:
+		return "เปิดอยู่"
+	case db.DisputeEvidenceRequested:
+		return "รอหลักฐานเพิ่มเติม"
+	case db.DisputeResolvedPaid:
+		return "ตัดสินแล้ว: ชำระแล้ว"
+	case db.DisputeResolvedUnpaid:
+		return "ตัดสินแล้ว: ยังไม่ได้ชำระ"
+	default:
+		return status
+	}
+}
+
+// disputeFlag returns a marker appended to debts that have an unresolved dispute
+func disputeFlag(hasOpenDispute bool) string {
+	if hasOpenDispute {
+		return " ⚖️ (มีข้อพิพาท)"
+	}
+	return ""
+}
+
+// openPaymentDispute opens a dispute for a rejected payment confirmation and notifies both parties
+func openPaymentDispute(s *discordgo.Session, debtorDiscordID, creditorDiscordID, openedByDiscordID string, amount float64, txIDs []int, guildID, channelID, note string, attachmentURLs []string) (*db.Dispute, error) {
+	debtorDbID, err := db.GetOrCreateUser(debtorDiscordID)
+	if err != nil {
+		return nil, fmt.Errorf("ไม่สามารถดึงข้อมูลลูกหนี้ได้: %w", err)
+	}
+	creditorDbID, err := db.GetOrCreateUser(creditorDiscordID)
+	if err != nil {
+		return nil, fmt.Errorf("ไม่สามารถดึงข้อมูลเจ้าหนี้ได้: %w", err)
+	}
+	openedByDbID, err := db.GetOrCreateUser(openedByDiscordID)
+	if err != nil {
+		return nil, fmt.Errorf("ไม่สามารถดึงข้อมูลผู้เปิดข้อพิพาทได้: %w", err)
+	}
+
+	disputeID, err := db.CreateDispute(debtorDbID, creditorDbID, openedByDbID, amount, txIDs, guildID, channelID)
+	if err != nil {
+		return nil, err
+	}
+
+	if note != "" || len(attachmentURLs) > 0 {
+		if err := db.AddDisputeNote(disputeID, openedByDbID, note, attachmentURLs); err != nil {
+			log.Printf("Dispute: Failed to add initial note to dispute %d: %v", disputeID, err)
+		}
+	}
+
+	dispute, err := db.GetDispute(disputeID)
+	if err != nil {
+		return nil, err
+	}
+
+	txText := ""
+	if len(dispute.TxIDs) > 0 {
+		txText = fmt.Sprintf(" (TxIDs: %s)", formatTxIDList(dispute.TxIDs))
+	}
+	message := fmt.Sprintf("⚖️ เปิดข้อพิพาท **#%d** ระหว่าง <@%s> (ลูกหนี้) และ <@%s> (เจ้าหนี้) จำนวน %.2f บาท%s\n"+
+		"ใช้ `!dispute %d` เพื่อดูรายละเอียด, `!dispute note %d <ข้อความ>` (แนบรูปได้) เพื่อเพิ่มหลักฐาน "+
+		"หรือ `!dispute arbiter %d @ผู้ดูแล` เพื่อขอให้ผู้ดูแลเซิร์ฟเวอร์ช่วยตัดสิน",
+		dispute.ID, dispute.DebtorDiscordID, dispute.CreditorDiscordID, dispute.Amount, txText,
+		dispute.ID, dispute.ID, dispute.ID)
+	notifyDisputeParties(s, dispute, "", message)
+
+	return dispute, nil
+}
+
+// notifyDisputeParties DMs the debtor, creditor and arbiter of a dispute, skipping the user who triggered the update
+func notifyDisputeParties(s *discordgo.Session, dispute *db.Dispute, actorDiscordID, message string) {
+	recipients := []string{dispute.DebtorDiscordID, dispute.CreditorDiscordID}
+	if dispute.ArbiterDiscordID != "" {
+		recipients = append(recipients, dispute.ArbiterDiscordID)
+	}
+	for _, recipient := range recipients {
+		if recipient == actorDiscordID {
+			continue
+		}
+		SendDirectMessage(s, recipient, message)
+	}
+}
+
+// HandleDispute handles the !dispute command and its subcommands
+func HandleDispute(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+	if len(args) < 2 || strings.ToLower(args[1]) == "list" {
+		listDisputes(s, m)
+		return
+	}
+
+	switch strings.ToLower(args[1]) {
+	case "note":
+		handleDisputeNote(s, m, args)
+	case "evidence":
+		handleDisputeEvidenceRequest(s, m, args)
+	case "arbiter":
+		handleDisputeArbiter(s, m, args)
+	case "resolve":
+		handleDisputeResolve(s, m, args)
+	default:
+		if _, err := strconv.Atoi(strings.TrimPrefix(args[1], "#")); err != nil {
+			SendErrorMessage(s, m.ChannelID, "รูปแบบไม่ถูกต้อง โปรดใช้ `!dispute [list|<id>|note|evidence|arbiter|resolve]`")
+			return
+		}
+		showDispute(s, m, args[1])
+	}
+}
+
+// getDisputeForParticipant parses a dispute ID and checks that the author is a party or the arbiter
+func getDisputeForParticipant(s *discordgo.Session, m *discordgo.MessageCreate, idArg string) *db.Dispute {
+	disputeID, err := strconv.Atoi(strings.TrimPrefix(idArg, "#"))
+	if err != nil {
+		SendErrorMessage(s, m.ChannelID, fmt.Sprintf("ID ข้อพิพาท '%s' ไม่ถูกต้อง", idArg))
+		return nil
+	}
+
+	dispute, err := db.GetDispute(disputeID)
+	if err != nil {
+		SendErrorMessage(s, m.ChannelID, err.Error())
+		return nil
+	}
+
+	authorID := m.Author.ID
+	if authorID != dispute.DebtorDiscordID && authorID != dispute.CreditorDiscordID && authorID != dispute.ArbiterDiscordID {
+		SendErrorMessage(s, m.ChannelID, fmt.Sprintf("คุณไม่ได้เกี่ยวข้องกับข้อพิพาท #%d", dispute.ID))
+		return nil
+	}
+
+	return dispute
+}
+
+// listDisputes lists the unresolved disputes involving the author
+func listDisputes(s *discordgo.Session, m *discordgo.MessageCreate) {
+	userDbID, err := db.GetOrCreateUser(m.Author.ID)
+	if err != nil {
+		SendErrorMessage(s, m.ChannelID, "ไม่สามารถดึงข้อมูลผู้ใช้ได้")
+		return
+	}
+
+	disputes, err := db.GetUserDisputes(userDbID, false)
+	if err != nil {
+		SendErrorMessage(s, m.ChannelID, "ไม่สามารถดึงข้อมูลข้อพิพาทได้")
+		log.Printf("Error fetching disputes for %s: %v", m.Author.ID, err)
+		return
+	}
+
+	if len(disputes) == 0 {
+		s.ChannelMessageSend(m.ChannelID, "ไม่มีข้อพิพาทที่ยังไม่ได้ตัดสิน 👍")
+		return
+	}
+
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("⚖️ **ข้อพิพาทที่ยังไม่ได้ตัดสินของ <@%s>:**\n", m.Author.ID))
+	for _, dispute := range disputes {
+		response.WriteString(fmt.Sprintf("- **#%d**: <@%s> → <@%s> %.2f บาท (%s)\n",
+			dispute.ID, dispute.DebtorDiscordID, dispute.CreditorDiscordID, dispute.Amount, disputeStatusText(dispute.Status)))
+	}
+	response.WriteString("\nใช้ `!dispute <id>` เพื่อดูรายละเอียด")
+	s.ChannelMessageSend(m.ChannelID, response.String())
+}
+
+// showDispute shows the details and notes of a dispute
+func showDispute(s *discordgo.Session, m *discordgo.MessageCreate, idArg string) {
+	dispute := getDisputeForParticipant(s, m, idArg)
+	if dispute == nil {
+		return
+	}
+
+	notes, err := db.GetDisputeNotes(dispute.ID)
+	if err != nil {
+		log.Printf("Error fetching notes for dispute %d: %v", dispute.ID, err)
+	}
+
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("⚖️ **ข้อพิพาท #%d** (%s)\n", dispute.ID, disputeStatusText(dispute.Status)))
+	response.WriteString(fmt.Sprintf("- ลูกหนี้: <@%s>\n- เจ้าหนี้: <@%s>\n- จำนวน: %.2f บาท\n",
+		dispute.DebtorDiscordID, dispute.CreditorDiscordID, dispute.Amount))
+	if len(dispute.TxIDs) > 0 {
+		response.WriteString(fmt.Sprintf("- TxIDs: %s\n", formatTxIDList(dispute.TxIDs)))
+	}
+	if dispute.ArbiterDiscordID != "" {
+		response.WriteString(fmt.Sprintf("- ผู้ตัดสิน: <@%s>\n", dispute.ArbiterDiscordID))
+	}
+	response.WriteString(fmt.Sprintf("- เปิดโดย: <@%s> เมื่อ %s\n", dispute.OpenedByDiscordID, dispute.CreatedAt.Local().Format("02/01/2006 15:04")))
+	if dispute.ResolutionNote != "" {
+		response.WriteString(fmt.Sprintf("- หมายเหตุการตัดสิน: %s\n", dispute.ResolutionNote))
+	}
+
+	if len(notes) > 0 {
+		response.WriteString("\n**บันทึกและหลักฐาน:**\n")
+		for _, note := range notes {
+			response.WriteString(fmt.Sprintf("- <@%s> (%s): %s", note.AuthorDiscordID, note.CreatedAt.Local().Format("02/01 15:04"), note.Note))
+			for _, url := range note.AttachmentURLs {
+				response.WriteString(fmt.Sprintf("\n  📎 %s", url))
+			}
+			response.WriteString("\n")
+		}
+	}
+
+	s.ChannelMessageSend(m.ChannelID, response.String())
+}
+
+// handleDisputeNote handles !dispute note <id> <text> with optional attachments
+func handleDisputeNote(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+	if len(args) < 3 {
+		SendErrorMessage(s, m.ChannelID, "รูปแบบไม่ถูกต้อง โปรดใช้ `!dispute note <id> <ข้อความ>` (แนบรูปภาพเป็นหลักฐานได้)")
+		return
+	}
+
+	dispute := getDisputeForParticipant(s, m, args[2])
+	if dispute == nil {
+		return
+	}
+	if dispute.IsResolved() {
+		SendErrorMessage(s, m.ChannelID, fmt.Sprintf("ข้อพิพาท #%d ได้รับการตัดสินไปแล้ว", dispute.ID))
+		return
+	}
+
+	note := strings.TrimSpace(strings.Join(args[3:], " "))
+	var attachmentURLs []string
+	for _, att := range m.Attachments {
+		attachmentURLs = append(attachmentURLs, att.URL)
+	}
+	if note == "" && len(attachmentURLs) == 0 {
+		SendErrorMessage(s, m.ChannelID, "โปรดระบุข้อความหรือแนบไฟล์หลักฐาน")
+		return
+	}
+
+	authorDbID, err := db.GetOrCreateUser(m.Author.ID)
+	if err != nil {
+		SendErrorMessage(s, m.ChannelID, "ไม่สามารถดึงข้อมูลผู้ใช้ได้")
+		return
+	}
+
+	if err := db.AddDisputeNote(dispute.ID, authorDbID, note, attachmentURLs); err != nil {
+		SendErrorMessage(s, m.ChannelID, "ไม่สามารถบันทึกข้อความได้")
+		log.Printf("Error adding note to dispute %d: %v", dispute.ID, err)
+		return
+	}
+
+	// Evidence from the debtor answers an evidence request, so the dispute goes back to open
+	if dispute.Status == db.DisputeEvidenceRequested && m.Author.ID == dispute.DebtorDiscordID {
+		if err := db.SetDisputeStatus(dispute.ID, db.DisputeOpen); err != nil {
+			log.Printf("Error reopening dispute %d after evidence: %v", dispute.ID, err)
+		}
+	}
+
+	s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("📝 บันทึกข้อความในข้อพิพาท #%d แล้ว (ไฟล์แนบ %d รายการ)", dispute.ID, len(attachmentURLs)))
+	notifyDisputeParties(s, dispute, m.Author.ID, fmt.Sprintf("📝 <@%s> เพิ่มบันทึกในข้อพิพาท #%d: %s\nใช้ `!dispute %d` เพื่อดูรายละเอียด",
+		m.Author.ID, dispute.ID, note, dispute.ID))
+}
+
+// handleDisputeEvidenceRequest handles !dispute evidence <id> [message]
+func handleDisputeEvidenceRequest(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+	if len(args) < 3 {
+		SendErrorMessage(s, m.ChannelID, "รูปแบบไม่ถูกต้อง โปรดใช้ `!dispute evidence <id> [ข้อความ]`")
+		return
+	}
+
+	dispute := getDisputeForParticipant(s, m, args[2])
+	if dispute == nil {
+		return
+	}
+	if m.Author.ID == dispute.DebtorDiscordID {
+		SendErrorMessage(s, m.ChannelID, "เฉพาะเจ้าหนี้หรือผู้ตัดสินเท่านั้นที่สามารถขอหลักฐานเพิ่มเติมได้")
+		return
+	}
+
+	if err := db.SetDisputeStatus(dispute.ID, db.DisputeEvidenceRequested); err != nil {
+		SendErrorMessage(s, m.ChannelID, err.Error())
+		return
+	}
+
+	message := strings.TrimSpace(strings.Join(args[3:], " "))
+	if message != "" {
+		if authorDbID, err := db.GetOrCreateUser(m.Author.ID); err == nil {
+			if err := db.AddDisputeNote(dispute.ID, authorDbID, message, nil); err != nil {
+				log.Printf("Error adding evidence request note to dispute %d: %v", dispute.ID, err)
+			}
+		}
+	}
+
+	s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("📨 ขอหลักฐานเพิ่มเติมสำหรับข้อพิพาท #%d จาก <@%s> แล้ว", dispute.ID, dispute.DebtorDiscordID))
+	SendDirectMessage(s, dispute.DebtorDiscordID, fmt.Sprintf("📨 <@%s> ขอหลักฐานการชำระเงินเพิ่มเติมสำหรับข้อพิพาท #%d %s\nโปรดส่งด้วย `!dispute note %d <ข้อความ>` พร้อมแนบรูปภาพ",
+		m.Author.ID, dispute.ID, message, dispute.ID))
+}
+
+// handleDisputeArbiter handles !dispute arbiter <id> @moderator
+func handleDisputeArbiter(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+	if len(args) < 4 || !userMentionRegex.MatchString(args[3]) {
+		SendErrorMessage(s, m.ChannelID, "รูปแบบไม่ถูกต้อง โปรดใช้ `!dispute arbiter <id> @ผู้ดูแล`")
+		return
+	}
+	if m.GuildID == "" {
+		SendErrorMessage(s, m.ChannelID, "โปรดใช้คำสั่งนี้ในช่องของเซิร์ฟเวอร์ เพื่อให้ตรวจสอบสิทธิ์ผู้ดูแลได้")
+		return
+	}
+
+	dispute := getDisputeForParticipant(s, m, args[2])
+	if dispute == nil {
+		return
+	}
+	if m.Author.ID != dispute.DebtorDiscordID && m.Author.ID != dispute.CreditorDiscordID {
+		SendErrorMessage(s, m.ChannelID, "เฉพาะคู่กรณีเท่านั้นที่สามารถเลือกผู้ตัดสินได้")
+		return
+	}
+
+	arbiterDiscordID := userMentionRegex.FindStringSubmatch(args[3])[1]
+	if arbiterDiscordID == dispute.DebtorDiscordID || arbiterDiscordID == dispute.CreditorDiscordID {
+		SendErrorMessage(s, m.ChannelID, "ผู้ตัดสินต้องไม่ใช่คู่กรณี")
+		return
+	}
+	// The arbiter's permissions are checked in this channel, so it must belong to the dispute's guild
+	if dispute.GuildID == "" {
+		SendErrorMessage(s, m.ChannelID, "ข้อพิพาทนี้ไม่ได้เปิดในเซิร์ฟเวอร์ใด จึงไม่สามารถแต่งตั้งผู้ตัดสินได้")
+		return
+	}
+	if m.GuildID != dispute.GuildID {
+		SendErrorMessage(s, m.ChannelID, "โปรดใช้คำสั่งนี้ในเซิร์ฟเวอร์เดียวกับที่เปิดข้อพิพาท")
+		return
+	}
+
+	permissions, err := s.UserChannelPermissions(arbiterDiscordID, m.ChannelID)
+	if err != nil || permissions&arbiterPermissions == 0 {
+		SendErrorMessage(s, m.ChannelID, fmt.Sprintf("<@%s> ไม่ใช่ผู้ดูแลของเซิร์ฟเวอร์นี้", arbiterDiscordID))
+		return
+	}
+
+	arbiterDbID, err := db.GetOrCreateUser(arbiterDiscordID)
+	if err != nil {
+		SendErrorMessage(s, m.ChannelID, "ไม่สามารถดึงข้อมูลผู้ตัดสินได้")
+		return
+	}
+
+	if err := db.SetDisputeArbiter(dispute.ID, arbiterDbID); err != nil {
+		SendErrorMessage(s, m.ChannelID, err.Error())
+		return
+	}
+	dispute.ArbiterDiscordID = arbiterDiscordID
+
+	s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("⚖️ <@%s> ได้รับการแต่งตั้งเป็นผู้ตัดสินข้อพิพาท #%d", arbiterDiscordID, dispute.ID))
+	SendDirectMessage(s, arbiterDiscordID, fmt.Sprintf("⚖️ คุณได้รับการแต่งตั้งให้ตัดสินข้อพิพาท #%d ระหว่าง <@%s> และ <@%s> จำนวน %.2f บาท\n"+
+		"ใช้ `!dispute %d` เพื่อดูหลักฐาน และ `!dispute resolve %d paid|unpaid [หมายเหตุ]` เพื่อตัดสิน",
+		dispute.ID, dispute.DebtorDiscordID, dispute.CreditorDiscordID, dispute.Amount, dispute.ID, dispute.ID))
+}
+
+// handleDisputeResolve handles !dispute resolve <id> paid|unpaid [note].
+// The arbiter may resolve either way; otherwise each party may only concede (creditor: paid, debtor: unpaid).
+func handleDisputeResolve(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+	if len(args) < 4 {
+		SendErrorMessage(s, m.ChannelID, "รูปแบบไม่ถูกต้อง โปรดใช้ `!dispute resolve <id> paid|unpaid [หมายเหตุ]`")
+		return
+	}
+
+	dispute := getDisputeForParticipant(s, m, args[2])
+	if dispute == nil {
+		return
+	}
+
+	var status string
+	switch strings.ToLower(args[3]) {
+	case "paid":
+		status = db.DisputeResolvedPaid
+	case "unpaid":
+		status = db.DisputeResolvedUnpaid
+	default:
+		SendErrorMessage(s, m.ChannelID, "ผลการตัดสินต้องเป็น `paid` หรือ `unpaid`")
+		return
+	}
+
+	authorID := m.Author.ID
+	allowed := authorID == dispute.ArbiterDiscordID ||
+		(status == db.DisputeResolvedPaid && authorID == dispute.CreditorDiscordID) ||
+		(status == db.DisputeResolvedUnpaid && authorID == dispute.DebtorDiscordID)
+	if !allowed {
+		SendErrorMessage(s, m.ChannelID, "คุณไม่มีสิทธิ์ตัดสินข้อพิพาทนี้ในทางนี้ (ผู้ตัดสินตัดสินได้ทั้งสองทาง, เจ้าหนี้ยอมรับว่าได้รับเงินแล้วได้, ลูกหนี้ยอมรับว่ายังไม่ได้ชำระได้)")
+		return
+	}
+
+	note := strings.TrimSpace(strings.Join(args[4:], " "))
+	if err := db.ResolveDispute(dispute.ID, status, note); err != nil {
+		SendErrorMessage(s, m.ChannelID, err.Error())
+		return
+	}
+
+	summary := "หนี้สินยังคงค้างชำระตามเดิม"
+	if status == db.DisputeResolvedPaid {
+		summary = settleDisputedPayment(s, m.ChannelID, dispute)
+	} else if len(dispute.TxIDs) > 0 {
+		// Disputed bill debts still waiting for consent become debts
+		activated, err := db.ActivatePendingTransactions(dispute.TxIDs)
+		if err != nil {
+			log.Printf("Dispute: Failed to activate pending TxIDs for dispute %d: %v", dispute.ID, err)
+			summary = fmt.Sprintf("⚠️ ไม่สามารถบันทึกรายการที่รอการยืนยันเป็นหนี้ได้: %v", err)
+		} else if len(activated) > 0 {
+			summary = fmt.Sprintf("บันทึกรายการที่โต้แย้งเป็นหนี้แล้ว (TxIDs: %s)", formatTxIDList(activated))
+		}
+	}
+
+	message := fmt.Sprintf("⚖️ ข้อพิพาท #%d ได้รับการตัดสินโดย <@%s>: **%s**\n%s", dispute.ID, authorID, disputeStatusText(status), summary)
+	if note != "" {
+		message += fmt.Sprintf("\nหมายเหตุ: %s", note)
+	}
+	s.ChannelMessageSend(m.ChannelID, message)
+	notifyDisputeParties(s, dispute, authorID, message)
+}
+
+// settleDisputedPayment marks the disputed debt as paid and returns a summary of the update
+func settleDisputedPayment(s *discordgo.Session, channelID string, dispute *db.Dispute) string {
+	if len(dispute.TxIDs) == 0 {
+		allocation, err := allocatePayment(s, channelID, dispute.DebtorDiscordID, dispute.CreditorDiscordID, dispute.Amount)
+		if err != nil {
+			log.Printf("Dispute: Failed to allocate payment for dispute %d: %v", dispute.ID, err)
+			return fmt.Sprintf("⚠️ ไม่สามารถอัปเดตข้อมูลหนี้สินได้: %v", err)
+		}
+		return formatPaymentAllocation(allocation)
+	}
+
+	// Disputed bill debts still waiting for consent are not owed, so they never become debts
+	rejected, err := db.RejectPendingTransactions(dispute.TxIDs)
+	if err != nil {
+		log.Printf("Dispute: Failed to reject pending TxIDs for dispute %d: %v", dispute.ID, err)
+		return fmt.Sprintf("⚠️ ไม่สามารถอัปเดตข้อมูลหนี้สินได้: %v", err)
+	}
+	if len(rejected) == len(dispute.TxIDs) {
+		return fmt.Sprintf("ยกเลิกรายการที่โต้แย้ง ไม่ต้องชำระ (TxIDs: %s)", formatTxIDList(rejected))
+	}
+	isRejected := make(map[int]bool, len(rejected))
+	for _, txID := range rejected {
+		isRejected[txID] = true
+	}
+
+	successCount := 0
+	for _, txID := range dispute.TxIDs {
+		if isRejected[txID] {
+			successCount++
+			continue
+		}
+		if err := db.MarkTransactionPaidAndUpdateDebt(txID); err != nil {
+			log.Printf("Dispute: Failed to mark TxID %d paid for dispute %d: %v", txID, dispute.ID, err)
+			continue
+		}
+		successCount++
+		CheckAndSendAutomaticPraise(s, channelID, txID, dispute.DebtorDiscordID)
+	}
+	return fmt.Sprintf("อัปเดตสำเร็จ %d/%d รายการธุรกรรม (TxIDs: %s)", successCount, len(dispute.TxIDs), formatTxIDList(dispute.TxIDs))
+}
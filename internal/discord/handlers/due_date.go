@@ -0,0 +1,294 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/oatsaysai/billing-in-discord/internal/db"
+	"github.com/spf13/viper"
+)
+
+// dueDateArgPrefix marks the optional due date argument of !bill and !qr, e.g. due:14 or due:2026-12-31
+const dueDateArgPrefix = "due:"
+
+// dueDateLayout is how due dates are shown to users
+const dueDateLayout = "02/01/2006"
+
+// parseDueDateArg parses the value of a due: argument.
+// It accepts a number of days from now (14 or 14d), a date (2026-12-31 or 31/12/2026), or "none".
+// A zero time means the bill has no due date.
+func parseDueDateArg(value string) (time.Time, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "none" || value == "0" {
+		return time.Time{}, nil
+	}
+
+	if days, err := strconv.Atoi(strings.TrimSuffix(value, "d")); err == nil {
+		if days < 0 {
+			return time.Time{}, fmt.Errorf("จำนวนวันครบกำหนดต้องไม่ติดลบ")
+		}
+		return endOfDay(time.Now().AddDate(0, 0, days)), nil
+	}
+
+	for _, layout := range []string{"2006-01-02", dueDateLayout} {
+		if date, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			if endOfDay(date).Before(time.Now()) {
+				return time.Time{}, fmt.Errorf("วันครบกำหนด '%s' ผ่านไปแล้ว", value)
+			}
+			return endOfDay(date), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("วันครบกำหนด '%s' ไม่ถูกต้อง โปรดใช้จำนวนวัน (เช่น `due:7`) หรือวันที่ (เช่น `due:2026-12-31`)", value)
+}
+
+// endOfDay returns the last second of t's day, so a bill due on a date can be paid all that day
+func endOfDay(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 23, 59, 59, 0, t.Location())
+}
+
+// extractDueDateArg removes a due: argument from args and parses it.
+// found is false if args has no due: argument.
+func extractDueDateArg(args []string) (rest []string, dueDate time.Time, found bool, err error) {
+	for _, arg := range args {
+		if strings.HasPrefix(strings.ToLower(arg), dueDateArgPrefix) && !found {
+			dueDate, err = parseDueDateArg(arg[len(dueDateArgPrefix):])
+			if err != nil {
+				return nil, time.Time{}, true, err
+			}
+			found = true
+			continue
+		}
+		rest = append(rest, arg)
+	}
+	return rest, dueDate, found, nil
+}
+
+// defaultDueDate returns the due date for a new bill in the guild: the guild's default if an admin
+// set one with !duedays, otherwise Payment.DefaultDueDays. A zero time means no due date.
+func defaultDueDate(guildID string) time.Time {
+	days := viper.GetInt("Payment.DefaultDueDays")
+	if guildID != "" {
+		guildDays, ok, err := db.GetGuildDefaultDueDays(guildID)
+		if err != nil {
+			log.Printf("Error getting default due days for guild %s: %v", guildID, err)
+		} else if ok {
+			days = guildDays
+		}
+	}
+	if days <= 0 {
+		return time.Time{}
+	}
+	return endOfDay(time.Now().AddDate(0, 0, days))
+}
+
+// setBillDueDate stores the due date on a bill's transactions and returns the line announcing it,
+// or an empty string if the bill has no due date
+func setBillDueDate(txIDs []int, dueDate time.Time) string {
+	if dueDate.IsZero() || len(txIDs) == 0 {
+		return ""
+	}
+	if err := db.SetTransactionsDueDate(txIDs, dueDate); err != nil {
+		log.Printf("Failed to set due date for transactions %v: %v", txIDs, err)
+		return "⚠️ ไม่สามารถบันทึกวันครบกำหนดชำระได้"
+	}
+	return dueDateLine(dueDate)
+}
+
+// dueDateLine announces a due date already stored with a bill, empty if it has none
+func dueDateLine(dueDate time.Time) string {
+	if dueDate.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf("📅 ครบกำหนดชำระ: %s", dueDate.Format(dueDateLayout))
+}
+
+// entryDueDate returns the due date to store with a bill entry, nil if the bill has none
+func entryDueDate(dueDate time.Time) *time.Time {
+	if dueDate.IsZero() {
+		return nil
+	}
+	return &dueDate
+}
+
+// overdueFlag returns a marker appended to debts that include overdue transactions
+func overdueFlag(overdueAmount float64) string {
+	if overdueAmount > 0.009 {
+		return fmt.Sprintf(" ⏰ (เกินกำหนด %.2f บาท)", overdueAmount)
+	}
+	return ""
+}
+
+// formatTxDueDate describes a transaction's due date for detail views, empty if it has none
+func formatTxDueDate(txInfo map[string]interface{}) string {
+	dueDate, ok := txInfo["due_date"].(time.Time)
+	if !ok {
+		return ""
+	}
+	if !txInfo["already_paid"].(bool) && time.Now().After(dueDate) {
+		return fmt.Sprintf("%s (⏰ เกินกำหนด)", dueDate.Format(dueDateLayout))
+	}
+	return dueDate.Format(dueDateLayout)
+}
+
+// HandleDueDays handles !duedays [days].
+// It shows or sets how many days after creation new bills in this server are due, 0 for no due date.
+func HandleDueDays(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+	if m.GuildID == "" {
+		SendErrorMessage(s, m.ChannelID, "โปรดใช้คำสั่งนี้ในช่องของเซิร์ฟเวอร์")
+		return
+	}
+
+	if len(args) < 2 {
+		days, ok, err := db.GetGuildDefaultDueDays(m.GuildID)
+		if err != nil {
+			log.Printf("Error getting default due days for guild %s: %v", m.GuildID, err)
+			SendErrorMessage(s, m.ChannelID, "ไม่สามารถดึงการตั้งค่าของเซิร์ฟเวอร์ได้")
+			return
+		}
+		if !ok {
+			days = viper.GetInt("Payment.DefaultDueDays")
+		}
+		if days <= 0 {
+			s.ChannelMessageSend(m.ChannelID, "บิลใหม่ในเซิร์ฟเวอร์นี้ไม่มีวันครบกำหนดชำระ")
+		} else {
+			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("บิลใหม่ในเซิร์ฟเวอร์นี้ครบกำหนดชำระภายใน %d วัน", days))
+		}
+		return
+	}
+
+	permissions, err := s.UserChannelPermissions(m.Author.ID, m.ChannelID)
+	if err != nil || permissions&adminPermissions == 0 {
+		SendErrorMessage(s, m.ChannelID, "การตั้งค่านี้ใช้ได้เฉพาะผู้ดูแลเซิร์ฟเวอร์เท่านั้น")
+		return
+	}
+
+	days, err := strconv.Atoi(args[1])
+	if err != nil || days < 0 {
+		SendErrorMessage(s, m.ChannelID, "รูปแบบไม่ถูกต้อง โปรดใช้ `!duedays <จำนวนวัน>` (0 = ไม่มีวันครบกำหนด)")
+		return
+	}
+	if err := db.SetGuildDefaultDueDays(m.GuildID, days); err != nil {
+		log.Printf("Error setting default due days for guild %s: %v", m.GuildID, err)
+		SendErrorMessage(s, m.ChannelID, "ไม่สามารถบันทึกการตั้งค่าได้")
+		return
+	}
+
+	if days == 0 {
+		s.ChannelMessageSend(m.ChannelID, "✅ บิลใหม่ในเซิร์ฟเวอร์นี้จะไม่มีวันครบกำหนดชำระ")
+	} else {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("✅ บิลใหม่ในเซิร์ฟเวอร์นี้จะครบกำหนดชำระภายใน %d วัน", days))
+	}
+}
+
+// HandleLateFee handles !latefee [off | flat <amount> | percent <rate>] [every <days>] [max <count>].
+// Creditors opt in to having a late fee transaction added to their debtors' overdue transactions.
+func HandleLateFee(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+	usage := "รูปแบบไม่ถูกต้อง โปรดใช้ `!latefee flat <บาท> [every <วัน>] [max <ครั้ง>]`, `!latefee percent <เปอร์เซ็นต์> [every <วัน>] [max <ครั้ง>]` หรือ `!latefee off`"
+
+	creditorDbID, err := db.GetOrCreateUser(m.Author.ID)
+	if err != nil {
+		SendErrorMessage(s, m.ChannelID, "ไม่สามารถยืนยันบัญชีผู้ใช้ของคุณสำหรับการดำเนินการนี้")
+		return
+	}
+
+	if len(args) < 2 {
+		rule, err := db.GetLateFeeRule(creditorDbID)
+		if err != nil {
+			log.Printf("Error getting late fee rule for %s: %v", m.Author.ID, err)
+			SendErrorMessage(s, m.ChannelID, "ไม่สามารถดึงการตั้งค่าค่าปรับได้")
+			return
+		}
+		if rule == nil || !rule.Enabled {
+			s.ChannelMessageSend(m.ChannelID, "คุณยังไม่ได้เปิดใช้ค่าปรับชำระล่าช้า")
+			return
+		}
+		s.ChannelMessageSend(m.ChannelID, "ค่าปรับชำระล่าช้าของคุณ: "+formatLateFeeRule(rule))
+		return
+	}
+
+	if strings.ToLower(args[1]) == "off" {
+		if err := db.DisableLateFeeRule(creditorDbID); err != nil {
+			log.Printf("Error disabling late fee rule for %s: %v", m.Author.ID, err)
+			SendErrorMessage(s, m.ChannelID, "ไม่สามารถปิดค่าปรับได้")
+			return
+		}
+		s.ChannelMessageSend(m.ChannelID, "✅ ปิดค่าปรับชำระล่าช้าแล้ว ค่าปรับที่เรียกเก็บไปแล้วยังคงอยู่")
+		return
+	}
+
+	if len(args) < 3 {
+		SendErrorMessage(s, m.ChannelID, usage)
+		return
+	}
+	rule := db.LateFeeRule{CreditorID: creditorDbID, FeeType: strings.ToLower(args[1]), IntervalDays: 7, MaxCharges: 1}
+	if rule.FeeType != db.LateFeeFlat && rule.FeeType != db.LateFeePercent {
+		SendErrorMessage(s, m.ChannelID, usage)
+		return
+	}
+	rule.Amount, err = strconv.ParseFloat(strings.TrimSuffix(args[2], "%"), 64)
+	if err != nil || rule.Amount <= 0 {
+		SendErrorMessage(s, m.ChannelID, fmt.Sprintf("จำนวน '%s' ไม่ถูกต้อง", args[2]))
+		return
+	}
+	for idx := 3; idx < len(args); idx += 2 {
+		if idx+1 >= len(args) {
+			SendErrorMessage(s, m.ChannelID, usage)
+			return
+		}
+		value, err := strconv.Atoi(args[idx+1])
+		if err != nil || value <= 0 {
+			SendErrorMessage(s, m.ChannelID, fmt.Sprintf("ค่า '%s' ต้องเป็นจำนวนเต็มบวก", args[idx+1]))
+			return
+		}
+		switch strings.ToLower(args[idx]) {
+		case "every":
+			rule.IntervalDays = value
+		case "max":
+			rule.MaxCharges = value
+		default:
+			SendErrorMessage(s, m.ChannelID, usage)
+			return
+		}
+	}
+
+	if err := db.SetLateFeeRule(rule); err != nil {
+		log.Printf("Error setting late fee rule for %s: %v", m.Author.ID, err)
+		SendErrorMessage(s, m.ChannelID, "ไม่สามารถบันทึกค่าปรับได้")
+		return
+	}
+	s.ChannelMessageSend(m.ChannelID, "✅ เปิดใช้ค่าปรับชำระล่าช้าแล้ว: "+formatLateFeeRule(&rule))
+}
+
+// formatLateFeeRule describes a late fee rule in one line
+func formatLateFeeRule(rule *db.LateFeeRule) string {
+	fee := fmt.Sprintf("%.2f บาท", rule.Amount)
+	if rule.FeeType == db.LateFeePercent {
+		fee = fmt.Sprintf("%.2f%% ของยอดรายการ", rule.Amount)
+	}
+	return fmt.Sprintf("%s ทุก %d วันที่เกินกำหนด สูงสุด %d ครั้งต่อรายการ", fee, rule.IntervalDays, rule.MaxCharges)
+}
+
+// RunScheduledLateFees charges the late fees that are due and tells each debtor by DM
+func RunScheduledLateFees() {
+	charges, err := db.ChargeLateFees()
+	if err != nil {
+		log.Printf("Scheduled late fees: error charging late fees: %v", err)
+		return
+	}
+	if session == nil {
+		return
+	}
+
+	for _, charge := range charges {
+		message := fmt.Sprintf("⏰ รายการ TxID %d ที่คุณต้องชำระให้ <@%s> เกินกำหนดแล้ว จึงมีค่าปรับชำระล่าช้าครั้งที่ %d จำนวน %.2f บาท (TxID %d)\nดูยอดทั้งหมดได้ด้วย `!mydebts`",
+			charge.TxID, charge.CreditorDiscordID, charge.ChargeNumber, charge.Amount, charge.FeeTxID)
+		if err := SendDirectMessage(session, charge.DebtorDiscordID, message); err != nil {
+			log.Printf("Scheduled late fees: failed to notify %s: %v", charge.DebtorDiscordID, err)
+		}
+	}
+}
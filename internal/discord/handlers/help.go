@@ -8,14 +8,33 @@ import (
 func HandleHelpCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
 	helpMessage := `
 **คำสั่งพื้นฐาน:**
-- ` + "`!bill [promptpay_id]`" + ` - สร้างบิลแบ่งจ่าย (ต้องตามด้วยรายการในบรรทัดถัดไป หรือแนบรูปภาพบิล)
-- ` + "`!qr <amount> to @user [for <description>] [promptpay_id]`" + ` - สร้าง QR รับชำระจากผู้ใช้
+- ` + "`!bill [promptpay_id] [due:<วัน|วันที่>]`" + ` - สร้างบิลแบ่งจ่าย (ต้องตามด้วยรายการในบรรทัดถัดไป เช่น ` + "`ข้าวมันไก่ 60 หาร @A @B`" + ` หรือแนบรูปภาพบิล)
+- ` + "`!bill paidby @ผู้จ่าย [ยอด] [@ผู้จ่าย ยอด...]`" + ` - บันทึกบิลที่ผู้อื่นเป็นคนจ่าย (หรือหลายคนช่วยกันจ่าย) หนี้จะถูกบันทึกเมื่อผู้จ่ายทุกคนยืนยัน
+- ` + "`!qr <amount> to @user [for <description>] [promptpay_id] [due:<วัน|วันที่>]`" + ` - สร้าง QR รับชำระจากผู้ใช้
 - ` + "`!mydebts`" + ` - ดูยอดหนี้ที่คุณต้องจ่ายผู้อื่น
 - ` + "`!mydues`" + ` (หรือ ` + "`!owedtome`" + `) - ดูยอดเงินที่ผู้อื่นเป็นหนี้คุณ
 - ` + "`!debts @user`" + ` - ดูยอดหนี้ที่ผู้ใช้รายนั้นเป็นหนี้ผู้อื่น
 - ` + "`!dues @user`" + ` - ดูยอดเงินที่ผู้อื่นเป็นหนี้ผู้ใช้รายนั้น
+- ` + "`!iowe @user <จำนวนเงิน> [for <รายละเอียด>]`" + ` - บันทึกว่าคุณเป็นหนี้ผู้ใช้รายนั้นเอง หนี้จะถูกบันทึกเมื่อเจ้าหนี้กดยอมรับ
+- ` + "`!net @user`" + ` - หักกลบหนี้ที่คุณและผู้ใช้รายนั้นติดค้างกัน ให้เหลือเฉพาะส่วนต่าง (ระบบจะหักกลบให้อัตโนมัติเมื่อสร้างบิลใหม่)
 - ` + "`!request @user [promptpay_id]`" + ` - ส่งคำขอชำระเงินไปยังผู้ใช้
 - ` + "`!paid <txID>`" + ` - ทำเครื่องหมายว่ารายการชำระแล้ว (ต้องเป็นผู้รับเงินเท่านั้น)
+- ` + "`!reviews`" + ` - ดูสลิปที่รอให้คุณตรวจสอบ (อนุมัติ/ปฏิเสธ/แก้ไขจำนวน)
+- ` + "`!receipt <BillID>`" + ` - ดูรูปใบเสร็จที่ใช้สร้างบิล (ส่งทางข้อความส่วนตัว)
+- ` + "`!slip <TxID>`" + ` - ดูรูปสลิปที่ใช้ชำระรายการ (ส่งทางข้อความส่วนตัว)
+- ` + "`!installment <TxID> <จำนวนงวด> [every:<วัน>]`" + ` - แบ่งหนี้ที่ค้างชำระ (เช่น ส่วนแบ่งค่าของที่ซื้อร่วม) เป็นงวดผ่อนรายเดือน (หรือทุก N วัน) แต่ละงวดมี QR ของตัวเอง
+- ` + "`!installment list|status <id>|payoff <id>`" + ` - ดูความคืบหน้าแผนผ่อน หรือปิดยอดก่อนกำหนด
+- ` + "`!trip start <ชื่อทริป>`" + ` - เริ่มทริปในช่องนี้ บิลระหว่างทริปจะถูกบันทึกโดยยังไม่สร้าง QR Code
+- ` + "`!trip summary|close`" + ` - ดูยอดของแต่ละคนระหว่างทริป หรือปิดทริปเพื่อสรุปยอดโอนให้น้อยรายการที่สุดพร้อม QR Code
+- ` + "`!latefee [off | flat <บาท> | percent <เปอร์เซ็นต์>] [every <วัน>] [max <ครั้ง>]`" + ` - ตั้งค่าปรับชำระล่าช้าที่จะเพิ่มให้ลูกหนี้ของคุณโดยอัตโนมัติเมื่อเกินกำหนด
+
+**คำสั่งจัดการข้อพิพาท:**
+- ` + "`!dispute [list]`" + ` - ดูข้อพิพาทที่ยังไม่ได้ตัดสิน
+- ` + "`!dispute <id>`" + ` - ดูรายละเอียดและหลักฐานของข้อพิพาท
+- ` + "`!dispute note <id> <ข้อความ>`" + ` - เพิ่มบันทึกหรือหลักฐาน (แนบรูปได้)
+- ` + "`!dispute evidence <id> [ข้อความ]`" + ` - ขอหลักฐานเพิ่มเติมจากลูกหนี้
+- ` + "`!dispute arbiter <id> @ผู้ดูแล`" + ` - ให้ผู้ดูแลเซิร์ฟเวอร์ช่วยตัดสิน
+- ` + "`!dispute resolve <id> paid|unpaid [หมายเหตุ]`" + ` - ตัดสินข้อพิพาท
 
 **คำสั่ง Interactive UI:**
 - ` + "`!imydebts`" + ` - แสดงยอดหนี้พร้อมปุ่มชำระเงินและดูรายละเอียด
@@ -24,9 +43,15 @@ func HandleHelpCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []
 - ` + "`!irequest @user`" + ` - ส่งคำขอชำระเงินแบบอินเตอร์แอคทีฟ
 
 **คำสั่งจัดการ PromptPay ID:**
-- ` + "`!setpromptpay <promptpay_id>`" + ` - ตั้งค่า PromptPay ID ของคุณ
+- ` + "`!setpromptpay <promptpay_id> [ชื่อบัญชี]`" + ` - ตั้งค่า PromptPay ID ของคุณ (ชื่อบัญชีใช้ตรวจสอบชื่อผู้รับในสลิป)
 - ` + "`!mypromptpay`" + ` - แสดง PromptPay ID ที่คุณบันทึกไว้
 
+**คำสั่งสำหรับผู้ดูแล:**
+- ` + "`!reconcile`" + ` - (ผู้ดูแลบอท) ตรวจสอบยอดหนี้ทั้งระบบเทียบกับรายการที่ยังไม่ได้ชำระ รายงานส่งทางข้อความส่วนตัว
+- ` + "`!reconcile fix`" + ` - ปรับยอดหนี้ให้ตรงกับรายการ พร้อมรายงานทุกการแก้ไข
+- ` + "`!duedays [จำนวนวัน]`" + ` - ดูหรือตั้งจำนวนวันครบกำหนดชำระเริ่มต้นของบิลในเซิร์ฟเวอร์ (0 = ไม่มีวันครบกำหนด)
+- ` + "`!billconsent [on [จำนวนชั่วโมง] | off]`" + ` - ดูหรือตั้งให้หนี้จากบิลต้องรอผู้ที่ถูกระบุกดยอมรับก่อน (ยอมรับอัตโนมัติเมื่อครบเวลา)
+
 **คำสั่ง Gamification:**
 - ` + "`!badges [@user]`" + ` - แสดงเหรียญตราและความสำเร็จที่ได้รับ
 - ` + "`!streak [@user]`" + ` - แสดงสถิติและข้อมูล streak การชำระเงินที่ติด Top 3
@@ -36,6 +61,10 @@ func HandleHelpCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []
 - บรรทัดถัดไป (รายการ): ` + "`<amount> for <description> with @user1 @user2...`" + `
 - หรือ (รูปแบบสั้น): ` + "`<amount> <description> @user1 @user2...`" + `
 - หรือ แนบรูปภาพบิลพร้อมคำสั่ง ` + "`!bill`" + ` เพื่อให้ระบบวิเคราะห์รายการด้วย OCR
+- บิลจาก OCR สามารถให้แต่ละคนเลือกรายการของตัวเองใน Discord ได้ (เลือกจำนวนชิ้น เช่น 1 จาก 3 หรือแบ่งกันจ่าย) แล้วเจ้าของบิลกด "สร้างบิล"
+- ระบุวันครบกำหนดชำระในบรรทัดแรกได้ เช่น ` + "`due:14`" + ` (14 วัน) หรือ ` + "`due:2026-12-31`" + ` ถ้าไม่ระบุจะใช้ค่าเริ่มต้นของเซิร์ฟเวอร์
+- ระบบจะแสดงตัวอย่างบิลพร้อมยอดต่อคนก่อน กด "ยืนยัน" เพื่อบันทึกทุกรายการพร้อมกัน (หากมีรายการผิดพลาดจะไม่บันทึกรายการใดเลย)
+- แก้ไขข้อความ ` + "`!bill`" + ` เพื่อปรับยอดรายการที่ยังไม่ชำระ หรือลบข้อความเพื่อยกเลิกบิล (รายการที่ชำระแล้วจะไม่ถูกเปลี่ยนแปลง)
 
 **ตัวอย่าง:**
 ` + "```" + `
@@ -51,6 +80,8 @@ func HandleHelpCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []
 
 **การตรวจสอบการชำระเงิน:**
 คุณสามารถส่งสลิปโดยตอบกลับข้อความ QR code ที่บอทส่งให้ เพื่อตรวจสอบและปรับปรุงยอดหนี้โดยอัตโนมัติ
+หากระบบตรวจสอบสลิปไม่ผ่าน (จำนวนเงิน บัญชีผู้รับ หรือวันที่ไม่ตรง) สลิปจะถูกส่งให้ผู้รับเงินตรวจสอบแทน
+หากโอนเกินยอดที่ค้างชำระ ส่วนที่เกินจะถูกเก็บเป็นเครดิตและหักจากบิลถัดไปของผู้รับเงินรายนั้นโดยอัตโนมัติ (ดูเครดิตได้ใน ` + "`!mydebts`" + ` และ ` + "`!mydues`" + `)
 `
 	s.ChannelMessageSend(m.ChannelID, helpMessage)
 }
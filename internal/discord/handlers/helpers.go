@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -177,3 +178,56 @@ func EnhanceDebtsWithUsernames(s *discordgo.Session, debts []db.DebtDetail) {
 		debts[i].OtherPartyName = GetDiscordUsername(s, discordID)
 	}
 }
+
+// formatTxIDList formats transaction IDs as "[1,2,3]" for use in component custom IDs
+func formatTxIDList(txIDs []int) string {
+	idStrs := make([]string, 0, len(txIDs))
+	for _, id := range txIDs {
+		idStrs = append(idStrs, fmt.Sprintf("%d", id))
+	}
+	return "[" + strings.Join(idStrs, ",") + "]"
+}
+
+// parseTxIDList parses a transaction ID list formatted like "[1,2,3]" or "1, 2, 3".
+// Entries that are not numbers (e.g. "ไม่พบรายการ") are skipped.
+func parseTxIDList(txIDsString string) []int {
+	var txIDs []int
+	for _, part := range strings.Split(strings.Trim(txIDsString, "[]"), ",") {
+		trimmed := strings.TrimSpace(part)
+		if trimmed == "" {
+			continue
+		}
+		id, err := strconv.Atoi(trimmed)
+		if err != nil {
+			log.Printf("Error parsing TxID '%s': %v", trimmed, err)
+			continue
+		}
+		txIDs = append(txIDs, id)
+	}
+	return txIDs
+}
+
+// containsInt reports whether the slice contains the value
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ClaimEvent records that an event is about to be processed and reports whether this is its first delivery.
+// Gateway replays after a reconnect, or a second bot instance, must not create the same records twice.
+// If the claim can't be stored the event is processed anyway rather than dropped.
+func ClaimEvent(kind, eventID string) bool {
+	claimed, err := db.ClaimEvent(kind, eventID)
+	if err != nil {
+		log.Printf("Error claiming %s event %s, processing it anyway: %v", kind, eventID, err)
+		return true
+	}
+	if !claimed {
+		log.Printf("Skipping %s event %s, it was already processed", kind, eventID)
+	}
+	return claimed
+}
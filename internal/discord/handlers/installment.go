@@ -0,0 +1,315 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/oatsaysai/billing-in-discord/internal/db"
+	"github.com/spf13/viper"
+)
+
+// Installment plan limits
+const (
+	minInstallments = 2
+	maxInstallments = 24 // Keeps the schedule within one Discord message
+)
+
+// installmentUsage is shown when !installment can't be parsed
+const installmentUsage = "รูปแบบไม่ถูกต้อง โปรดใช้ `!installment <TxID> <จำนวนงวด> [every:<วัน>]`, " +
+	"`!installment list`, `!installment status <id>` หรือ `!installment payoff <id>`"
+
+// HandleInstallment handles !installment.
+// It splits an unpaid debt into an installment plan and shows or pays off existing plans.
+func HandleInstallment(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+	if len(args) < 2 {
+		handleInstallmentList(s, m)
+		return
+	}
+
+	switch strings.ToLower(args[1]) {
+	case "list":
+		handleInstallmentList(s, m)
+	case "status":
+		planID, ok := parseInstallmentPlanID(s, m, args)
+		if ok {
+			handleInstallmentStatus(s, m, planID)
+		}
+	case "payoff":
+		planID, ok := parseInstallmentPlanID(s, m, args)
+		if ok {
+			handleInstallmentPayoff(s, m, planID)
+		}
+	default:
+		handleInstallmentCreate(s, m, args)
+	}
+}
+
+// parseInstallmentPlanID reads the plan ID argument of !installment status|payoff <id>
+func parseInstallmentPlanID(s *discordgo.Session, m *discordgo.MessageCreate, args []string) (int, bool) {
+	if len(args) < 3 {
+		SendErrorMessage(s, m.ChannelID, installmentUsage)
+		return 0, false
+	}
+	planID, err := strconv.Atoi(strings.TrimPrefix(args[2], "#"))
+	if err != nil {
+		SendErrorMessage(s, m.ChannelID, fmt.Sprintf("รหัสแผนผ่อน '%s' ไม่ถูกต้อง", args[2]))
+		return 0, false
+	}
+	return planID, true
+}
+
+// handleInstallmentCreate handles !installment <TxID> <count> [every:<days>].
+// The creditor splits what is left of an unpaid transaction into count installments, the first due
+// today and the rest monthly (or every N days). The installments replace the transaction, so the
+// debtor owes nothing more than the debt they already had.
+func handleInstallmentCreate(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+	if len(args) < 3 || len(args) > 4 {
+		SendErrorMessage(s, m.ChannelID, installmentUsage)
+		return
+	}
+
+	txID, err := strconv.Atoi(strings.TrimPrefix(args[1], "#"))
+	if err != nil {
+		SendErrorMessage(s, m.ChannelID, fmt.Sprintf("TxID '%s' ไม่ถูกต้อง", args[1]))
+		return
+	}
+	count, err := strconv.Atoi(args[2])
+	if err != nil || count < minInstallments || count > maxInstallments {
+		SendErrorMessage(s, m.ChannelID, fmt.Sprintf("จำนวนงวดต้องอยู่ระหว่าง %d ถึง %d งวด", minInstallments, maxInstallments))
+		return
+	}
+
+	intervalDays := 0
+	if len(args) == 4 {
+		lower := strings.ToLower(args[3])
+		if !strings.HasPrefix(lower, "every:") {
+			SendErrorMessage(s, m.ChannelID, installmentUsage)
+			return
+		}
+		days, err := strconv.Atoi(strings.TrimSuffix(lower[len("every:"):], "d"))
+		if err != nil || days <= 0 {
+			SendErrorMessage(s, m.ChannelID, fmt.Sprintf("ระยะห่างระหว่างงวด '%s' ไม่ถูกต้อง", args[3]))
+			return
+		}
+		intervalDays = days
+	}
+
+	creditorDbID, err := db.GetOrCreateUser(m.Author.ID)
+	if err != nil {
+		SendErrorMessage(s, m.ChannelID, fmt.Sprintf("เกิดข้อผิดพลาดกับฐานข้อมูลสำหรับคุณ (<@%s>)", m.Author.ID))
+		return
+	}
+
+	plan, installments, err := db.ConvertToInstallmentPlan(txID, creditorDbID, count, intervalDays, endOfDay(time.Now()), m.ChannelID)
+	if err != nil {
+		log.Printf("Failed to convert TxID %d into an installment plan: %v", txID, err)
+		SendErrorMessage(s, m.ChannelID, fmt.Sprintf("ไม่สามารถสร้างแผนผ่อนได้: %v", err))
+		return
+	}
+	plan, err = db.GetInstallmentPlan(plan.ID)
+	if err != nil {
+		log.Printf("Failed to load installment plan created from TxID %d: %v", txID, err)
+		SendErrorMessage(s, m.ChannelID, "สร้างแผนผ่อนแล้ว แต่ไม่สามารถดึงข้อมูลแผนผ่อนได้")
+		return
+	}
+
+	s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("TxID %d ถูกแบ่งเป็นแผนผ่อนชำระแล้ว\n%s", txID, formatInstallmentSchedule(plan, installments)))
+
+	promptPayID, err := db.GetUserPromptPayID(creditorDbID)
+	if err != nil || promptPayID == "" {
+		s.ChannelMessageSend(m.ChannelID, "⚠️ ไม่พบ PromptPay ID ที่บันทึกไว้ จึงไม่ได้สร้าง QR Code สำหรับงวดแรก\nคุณสามารถตั้งค่า PromptPay ID ได้ด้วยคำสั่ง `!setpromptpay <PromptPayID>`")
+		return
+	}
+	first := installments[0]
+	GenerateAndSendQrCode(s, m.ChannelID, promptPayID, first.Amount, plan.DebtorDiscordID,
+		fmt.Sprintf("งวดที่ 1/%d ของแผนผ่อน #%d (%s) ให้ <@%s>", count, plan.ID, plan.Description, m.Author.ID), []int{first.TxID})
+}
+
+// handleInstallmentList lists the author's unfinished plans, as debtor and as creditor
+func handleInstallmentList(s *discordgo.Session, m *discordgo.MessageCreate) {
+	userDbID, err := db.GetOrCreateUser(m.Author.ID)
+	if err != nil {
+		SendErrorMessage(s, m.ChannelID, "ไม่สามารถดึงข้อมูลผู้ใช้ได้")
+		return
+	}
+	plans, err := db.GetUserInstallmentPlans(userDbID)
+	if err != nil {
+		log.Printf("Error listing installment plans for %s: %v", m.Author.ID, err)
+		SendErrorMessage(s, m.ChannelID, "ไม่สามารถดึงข้อมูลแผนผ่อนชำระได้")
+		return
+	}
+	if len(plans) == 0 {
+		s.ChannelMessageSend(m.ChannelID, "คุณไม่มีแผนผ่อนชำระที่ยังไม่เสร็จสิ้น")
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("**แผนผ่อนชำระของ <@%s>:**\n", m.Author.ID))
+	for _, plan := range plans {
+		b.WriteString("- " + formatInstallmentProgress(&plan) + "\n")
+	}
+	b.WriteString("ดูรายละเอียดด้วย `!installment status <id>`")
+	s.ChannelMessageSend(m.ChannelID, b.String())
+}
+
+// handleInstallmentStatus shows a plan's progress and each installment
+func handleInstallmentStatus(s *discordgo.Session, m *discordgo.MessageCreate, planID int) {
+	plan, ok := getInstallmentPlanForParty(s, m, planID)
+	if !ok {
+		return
+	}
+	installments, err := db.GetInstallments(planID)
+	if err != nil {
+		log.Printf("Error getting installments of plan %d: %v", planID, err)
+		SendErrorMessage(s, m.ChannelID, "ไม่สามารถดึงข้อมูลงวดผ่อนชำระได้")
+		return
+	}
+	s.ChannelMessageSend(m.ChannelID, formatInstallmentSchedule(plan, installments))
+}
+
+// handleInstallmentPayoff pays off a plan early: the remaining schedule is cancelled and
+// every unpaid installment is due today, with one QR code for all of them
+func handleInstallmentPayoff(s *discordgo.Session, m *discordgo.MessageCreate, planID int) {
+	plan, ok := getInstallmentPlanForParty(s, m, planID)
+	if !ok {
+		return
+	}
+	if plan.DebtorDiscordID != m.Author.ID {
+		SendErrorMessage(s, m.ChannelID, "เฉพาะผู้ผ่อนชำระเท่านั้นที่ปิดยอดก่อนกำหนดได้")
+		return
+	}
+	if plan.Completed() {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("แผนผ่อน #%d ชำระครบทุกงวดแล้ว 🎉", planID))
+		return
+	}
+
+	remaining, err := db.PayOffInstallmentPlan(planID, endOfDay(time.Now()))
+	if err != nil {
+		log.Printf("Error paying off installment plan %d: %v", planID, err)
+		SendErrorMessage(s, m.ChannelID, fmt.Sprintf("ไม่สามารถปิดยอดแผนผ่อนได้: %v", err))
+		return
+	}
+
+	var total float64
+	var txIDs []int
+	for _, installment := range remaining {
+		total += installment.Outstanding()
+		txIDs = append(txIDs, installment.TxID)
+	}
+	s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("✅ ยกเลิกตารางผ่อนที่เหลือของแผน #%d แล้ว งวดที่ค้าง %d งวด รวม **%.2f บาท** ครบกำหนดชำระวันนี้",
+		planID, len(remaining), total))
+
+	promptPayID, err := db.GetUserPromptPayID(plan.CreditorID)
+	if err != nil || total < 0.01 {
+		return
+	}
+	GenerateAndSendQrCode(s, m.ChannelID, promptPayID, total, plan.DebtorDiscordID,
+		fmt.Sprintf("ปิดยอดแผนผ่อน #%d (%s) ให้ <@%s>", planID, plan.Description, plan.CreditorDiscordID), txIDs)
+}
+
+// getInstallmentPlanForParty loads a plan and checks the author is its debtor or creditor
+func getInstallmentPlanForParty(s *discordgo.Session, m *discordgo.MessageCreate, planID int) (*db.InstallmentPlan, bool) {
+	plan, err := db.GetInstallmentPlan(planID)
+	if err != nil {
+		SendErrorMessage(s, m.ChannelID, err.Error())
+		return nil, false
+	}
+	if plan.DebtorDiscordID != m.Author.ID && plan.CreditorDiscordID != m.Author.ID {
+		SendErrorMessage(s, m.ChannelID, "คุณไม่ได้เป็นผู้เกี่ยวข้องกับแผนผ่อนนี้")
+		return nil, false
+	}
+	return plan, true
+}
+
+// formatInstallmentProgress describes a plan's progress in one line
+func formatInstallmentProgress(plan *db.InstallmentPlan) string {
+	line := fmt.Sprintf("#%d %s: <@%s> ผ่อนให้ <@%s> ชำระแล้ว %d/%d งวด (%.2f/%.2f บาท)",
+		plan.ID, plan.Description, plan.DebtorDiscordID, plan.CreditorDiscordID,
+		plan.PaidCount, plan.InstallmentCount, plan.PaidAmount, plan.TotalAmount)
+	if plan.Status == db.InstallmentPlanPaidOff {
+		line += " - ปิดยอดก่อนกำหนด"
+	}
+	if plan.NextDueDate != nil {
+		line += fmt.Sprintf(", งวดถัดไปครบกำหนด %s", plan.NextDueDate.Format(dueDateLayout))
+	}
+	return line
+}
+
+// formatInstallmentSchedule shows a plan's progress followed by each installment
+func formatInstallmentSchedule(plan *db.InstallmentPlan, installments []db.Installment) string {
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("📆 **แผนผ่อนชำระ #%d:** %s\n", plan.ID, plan.Description))
+	b.WriteString(formatInstallmentProgress(plan) + "\n")
+	for _, installment := range installments {
+		status := "ค้างชำระ"
+		switch {
+		case installment.Paid:
+			status = "✅ ชำระแล้ว"
+		case installment.PaidAmount > 0:
+			status = fmt.Sprintf("🟡 ชำระแล้วบางส่วน %.2f บาท", installment.PaidAmount)
+		case time.Now().After(installment.DueDate):
+			status = "⏰ เกินกำหนด"
+		}
+		b.WriteString(fmt.Sprintf("- งวดที่ %d: %.2f บาท ครบกำหนด %s (TxID %d) %s\n",
+			installment.Number, installment.Amount, installment.DueDate.Format(dueDateLayout), installment.TxID, status))
+	}
+	if len(installments) > 0 && !plan.Completed() && plan.Status == db.InstallmentPlanActive {
+		b.WriteString(fmt.Sprintf("ปิดยอดก่อนกำหนดได้ด้วย `!installment payoff %d`", plan.ID))
+	}
+	return b.String()
+}
+
+// RunInstallmentReminders posts a reminder with a QR code for every installment coming due
+func RunInstallmentReminders() {
+	// Claiming marks the installments reminded, so only claim them when they can be sent
+	if session == nil {
+		return
+	}
+	lead := time.Duration(viper.GetInt("Installment.ReminderHoursBefore")) * time.Hour
+	reminders, err := db.ClaimDueInstallmentReminders(lead)
+	if err != nil {
+		log.Printf("Installment reminders: error claiming due installments: %v", err)
+		return
+	}
+
+	for _, reminder := range reminders {
+		message := fmt.Sprintf("📆 <@%s> งวดที่ %d/%d ของแผนผ่อน #%d (%s) จำนวน %.2f บาท ครบกำหนด %s",
+			reminder.DebtorDiscordID, reminder.Number, reminder.InstallmentCount, reminder.PlanID,
+			reminder.Description, reminder.Outstanding(), reminder.DueDate.Format(dueDateLayout))
+
+		channelID := reminder.ChannelID
+		if channelID == "" {
+			channel, err := session.UserChannelCreate(reminder.DebtorDiscordID)
+			if err != nil {
+				log.Printf("Installment reminders: failed to open DM with %s: %v", reminder.DebtorDiscordID, err)
+				releaseInstallmentReminder(reminder.TxID)
+				continue
+			}
+			channelID = channel.ID
+		}
+		if _, err := session.ChannelMessageSend(channelID, message); err != nil {
+			log.Printf("Installment reminders: failed to remind %s of TxID %d: %v", reminder.DebtorDiscordID, reminder.TxID, err)
+			releaseInstallmentReminder(reminder.TxID)
+			continue
+		}
+
+		promptPayID, err := db.GetUserPromptPayID(reminder.CreditorID)
+		if err != nil {
+			continue
+		}
+		GenerateAndSendQrCode(session, channelID, promptPayID, reminder.Outstanding(), reminder.DebtorDiscordID,
+			fmt.Sprintf("งวดที่ %d/%d ของแผนผ่อน #%d ให้ <@%s>", reminder.Number, reminder.InstallmentCount, reminder.PlanID, reminder.CreditorDiscordID),
+			[]int{reminder.TxID})
+	}
+}
+
+// releaseInstallmentReminder lets the next run retry a reminder that could not be sent
+func releaseInstallmentReminder(txID int) {
+	if err := db.ReleaseInstallmentReminder(txID); err != nil {
+		log.Printf("Installment reminders: %v", err)
+	}
+}
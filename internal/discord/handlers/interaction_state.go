@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/oatsaysai/billing-in-discord/internal/db"
+)
+
+// Interaction state lifetimes
+const (
+	interactionStateTTL     = 24 * time.Hour      // Buttons and menus posted in channels
+	longInteractionStateTTL = 30 * 24 * time.Hour // Confirmations sent by DM that may be answered much later
+)
+
+// Interaction state payloads, one per kind of component
+
+// debtPairPayload identifies a debtor/creditor pair and optionally the transactions involved
+type debtPairPayload struct {
+	DebtorDiscordID   string `json:"debtor_discord_id"`
+	CreditorDiscordID string `json:"creditor_discord_id"`
+	TxIDs             []int  `json:"tx_ids,omitempty"`
+}
+
+// viewDetailPayload selects what a "view detail" button shows: a single transaction or a debt pair
+type viewDetailPayload struct {
+	TxID              int    `json:"tx_id,omitempty"`
+	DebtorDiscordID   string `json:"debtor_discord_id,omitempty"`
+	CreditorDiscordID string `json:"creditor_discord_id,omitempty"`
+}
+
+// txPayload identifies a single transaction
+type txPayload struct {
+	TxID int `json:"tx_id"`
+}
+
+// txListPayload holds the transactions a select menu may offer
+type txListPayload struct {
+	TxIDs []int `json:"tx_ids"`
+}
+
+// slipReviewPayload identifies a slip review
+type slipReviewPayload struct {
+	ReviewID int `json:"review_id"`
+}
+
+// billPayload identifies the bill message and, for per-item buttons, the item
+type billPayload struct {
+	MessageID string `json:"message_id"`
+	ItemIndex int    `json:"item_index,omitempty"`
+	Page      int    `json:"page,omitempty"` // Page of items shown in the OCR correction menus
+}
+
+// payerBillPayload identifies a bill waiting for its payers' confirmation
+type payerBillPayload struct {
+	BillID int `json:"bill_id"`
+}
+
+// iouPayload identifies a debtor-recorded IOU and where it was recorded
+type iouPayload struct {
+	TxID      int    `json:"tx_id"`
+	ChannelID string `json:"channel_id"`
+	GuildID   string `json:"guild_id,omitempty"`
+}
+
+// billConsentPayload holds a bill's pending transactions per participant, waiting for them to accept
+type billConsentPayload struct {
+	CreditorDiscordID string           `json:"creditor_discord_id"`
+	PromptPayID       string           `json:"promptpay_id,omitempty"`
+	ChannelID         string           `json:"channel_id"`
+	GuildID           string           `json:"guild_id,omitempty"`
+	TxIDs             map[string][]int `json:"tx_ids"` // Debtor Discord ID -> pending TxIDs
+}
+
+// billPreviewPayload holds a parsed !bill waiting for its author to confirm it
+type billPreviewPayload struct {
+	MessageID   string     `json:"message_id"` // The !bill message, later edits and deletion of it update the bill
+	Content     string     `json:"content"`    // The message as previewed, the bill isn't booked if it was edited since
+	ChannelID   string     `json:"channel_id"`
+	GuildID     string     `json:"guild_id,omitempty"`
+	PromptPayID string     `json:"promptpay_id,omitempty"`
+	DueDate     time.Time  `json:"due_date"`
+	Items       []billLine `json:"items"`
+}
+
+// claimSessionPayload identifies a claim board
+type claimSessionPayload struct {
+	SessionID int `json:"session_id"`
+}
+
+// claimItemPayload identifies an item on a claim board
+type claimItemPayload struct {
+	SessionID int `json:"session_id"`
+	ItemIndex int `json:"item_index"`
+}
+
+// newComponentState stores an interaction state shared by the given prefixes and returns its ID.
+// On failure the error is logged and an empty ID is returned, so the component is still rendered
+// but reports itself as expired when clicked instead of breaking the whole message.
+func newComponentState(prefixes []string, ownerID string, allowedActors []string, payload interface{}, singleUse bool, ttl time.Duration) string {
+	stateID, err := db.CreateInteractionState(prefixes, ownerID, allowedActors, payload, singleUse, ttl)
+	if err != nil {
+		log.Printf("Failed to create interaction state for %v: %v", prefixes, err)
+		return ""
+	}
+	return stateID
+}
+
+// newComponentID stores an interaction state for a single prefix and returns the component custom ID
+func newComponentID(prefix, ownerID string, allowedActors []string, payload interface{}, singleUse bool, ttl time.Duration) string {
+	return prefix + newComponentState([]string{prefix}, ownerID, allowedActors, payload, singleUse, ttl)
+}
+
+// claimedStates holds the single-use states consumed by interactions whose handler is still running,
+// keyed by interaction ID, so a handler that answers with an error gives its state back
+var claimedStates sync.Map
+
+// loadComponentState resolves a component custom ID to its prefix and interaction state.
+// It responds with an error and returns a nil state if the state is missing, expired,
+// already used, or the user isn't allowed to act on it.
+// A single-use state is consumed here so concurrent clicks are only handled once; it is released
+// again if the handler responds with an error, and stays consumed once the handler finished without one.
+func loadComponentState(s *discordgo.Session, i *discordgo.InteractionCreate, customID string) (string, *db.InteractionState) {
+	if len(customID) <= db.InteractionStateIDLength {
+		log.Printf("Component custom ID without interaction state: %s", customID)
+		respondWithError(s, i, "ปุ่มนี้หมดอายุแล้ว โปรดเรียกคำสั่งใหม่อีกครั้ง")
+		return "", nil
+	}
+	prefix := customID[:len(customID)-db.InteractionStateIDLength]
+	stateID := customID[len(customID)-db.InteractionStateIDLength:]
+
+	state, err := db.GetInteractionState(stateID)
+	if err != nil || !state.HasPrefix(prefix) {
+		if err != nil {
+			log.Printf("Failed to load interaction state for %s: %v", customID, err)
+		}
+		respondWithError(s, i, "ปุ่มนี้หมดอายุแล้ว โปรดเรียกคำสั่งใหม่อีกครั้ง")
+		return "", nil
+	}
+
+	if time.Now().After(state.ExpiresAt) {
+		respondWithError(s, i, "ปุ่มนี้หมดอายุแล้ว โปรดเรียกคำสั่งใหม่อีกครั้ง")
+		return "", nil
+	}
+	if state.ConsumedAt != nil {
+		respondWithError(s, i, "ปุ่มนี้ถูกใช้งานไปแล้ว")
+		return "", nil
+	}
+	if !state.CanAct(interactionUserID(i)) {
+		respondWithError(s, i, "คุณไม่มีสิทธิ์ใช้ปุ่มนี้")
+		return "", nil
+	}
+
+	if state.SingleUse {
+		if err := db.ConsumeInteractionState(state.ID); err != nil {
+			log.Printf("Failed to consume interaction state %s: %v", state.ID, err)
+			respondWithError(s, i, "ปุ่มนี้ถูกใช้งานไปแล้ว")
+			return "", nil
+		}
+		claimedStates.Store(i.ID, state.ID)
+	}
+
+	return prefix, state
+}
+
+// releaseClaimedState releases the single-use state consumed by the interaction, if any,
+// so the component can be used again after its handler failed
+func releaseClaimedState(i *discordgo.InteractionCreate) {
+	stateID, ok := claimedStates.LoadAndDelete(i.ID)
+	if !ok {
+		return
+	}
+	if err := db.ReleaseInteractionState(stateID.(string)); err != nil {
+		log.Printf("Failed to release interaction state %s: %v", stateID, err)
+	}
+}
+
+// finishClaimedState keeps the single-use state consumed by the interaction once its handler returned
+func finishClaimedState(i *discordgo.InteractionCreate) {
+	claimedStates.Delete(i.ID)
+}
+
+// decodeComponentPayload decodes the state payload, responding with an error on failure
+func decodeComponentPayload(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState, v interface{}) bool {
+	if err := state.DecodePayload(v); err != nil {
+		log.Printf("%v", err)
+		respondWithError(s, i, "ข้อมูลของปุ่มนี้ไม่ถูกต้อง โปรดเรียกคำสั่งใหม่อีกครั้ง")
+		return false
+	}
+	return true
+}
+
+// Custom ID builders for components that are created from several places
+
+// payDebtComponentID returns the custom ID of a button that lets the debtor pay their whole debt to the creditor
+func payDebtComponentID(debtorDiscordID, creditorDiscordID string) string {
+	return newComponentID(payDebtButtonPrefix, debtorDiscordID, []string{debtorDiscordID},
+		debtPairPayload{DebtorDiscordID: debtorDiscordID, CreditorDiscordID: creditorDiscordID}, false, interactionStateTTL)
+}
+
+// requestPaymentComponentID returns the custom ID of a button that lets the creditor request payment from the debtor
+func requestPaymentComponentID(debtorDiscordID, creditorDiscordID string) string {
+	return newComponentID(requestPaymentButtonPrefix, creditorDiscordID, []string{creditorDiscordID},
+		debtPairPayload{DebtorDiscordID: debtorDiscordID, CreditorDiscordID: creditorDiscordID}, false, interactionStateTTL)
+}
+
+// payTxComponentID returns the custom ID of a button that lets the payer pay a single transaction
+func payTxComponentID(payerDiscordID string, txID int) string {
+	return newComponentID(payTxButtonPrefix, payerDiscordID, []string{payerDiscordID}, txPayload{TxID: txID}, false, interactionStateTTL)
+}
+
+// markPaidComponentID returns the custom ID of a button that lets the payee mark a transaction as paid
+func markPaidComponentID(payeeDiscordID string, txID int) string {
+	return newComponentID(markPaidButtonPrefix, payeeDiscordID, []string{payeeDiscordID}, txPayload{TxID: txID}, true, interactionStateTTL)
+}
+
+// viewDebtDetailComponentID returns the custom ID of a button that shows a debt between two users to the viewer
+func viewDebtDetailComponentID(viewerDiscordID, debtorDiscordID, creditorDiscordID string) string {
+	return newComponentID(viewDetailButtonPrefix, viewerDiscordID, []string{viewerDiscordID},
+		viewDetailPayload{DebtorDiscordID: debtorDiscordID, CreditorDiscordID: creditorDiscordID}, false, interactionStateTTL)
+}
@@ -41,7 +41,7 @@ func HandleInteractiveMyDebts(s *discordgo.Session, m *discordgo.MessageCreate,
 	var totalAmount float64
 	for _, debt := range debts {
 		totalAmount += debt.Amount
-		content += fmt.Sprintf("- **%.2f บาท** ให้ <@%s>\n", debt.Amount, debt.OtherPartyDiscordID)
+		content += fmt.Sprintf("- **%.2f บาท** ให้ <@%s>%s%s\n", debt.Amount, debt.OtherPartyDiscordID, overdueFlag(debt.OverdueAmount), disputeFlag(debt.HasOpenDispute))
 	}
 	content += fmt.Sprintf("\n**ยอดรวมทั้งหมด: %.2f บาท**\n", totalAmount)
 	content += "คลิกปุ่มด้านล่างเพื่อดูรายละเอียดหรือชำระเงิน"
@@ -62,12 +62,12 @@ func HandleInteractiveMyDebts(s *discordgo.Session, m *discordgo.MessageCreate,
 				discordgo.Button{
 					Label:    fmt.Sprintf("ดูรายละเอียดหนี้ให้ %s", displayName),
 					Style:    discordgo.SecondaryButton,
-					CustomID: fmt.Sprintf("%sc%s", viewDetailButtonPrefix, debt.OtherPartyDiscordID),
+					CustomID: viewDebtDetailComponentID(userID, userID, debt.OtherPartyDiscordID),
 				},
 				discordgo.Button{
 					Label:    fmt.Sprintf("ชำระเงินให้ %s", displayName),
 					Style:    discordgo.PrimaryButton,
-					CustomID: fmt.Sprintf("%s%s", payDebtButtonPrefix, debt.OtherPartyDiscordID),
+					CustomID: payDebtComponentID(userID, debt.OtherPartyDiscordID),
 				},
 			},
 		})
@@ -115,7 +115,7 @@ func HandleInteractiveOwedToMe(s *discordgo.Session, m *discordgo.MessageCreate,
 	var totalAmount float64
 	for _, debt := range debts {
 		totalAmount += debt.Amount
-		content += fmt.Sprintf("- <@%s> เป็นหนี้ **%.2f บาท**\n", debt.OtherPartyDiscordID, debt.Amount)
+		content += fmt.Sprintf("- <@%s> เป็นหนี้ **%.2f บาท**%s%s\n", debt.OtherPartyDiscordID, debt.Amount, overdueFlag(debt.OverdueAmount), disputeFlag(debt.HasOpenDispute))
 	}
 	content += fmt.Sprintf("\n**ยอดรวมทั้งหมด: %.2f บาท**\n", totalAmount)
 	content += "คลิกปุ่มด้านล่างเพื่อดูรายละเอียด"
@@ -135,12 +135,12 @@ func HandleInteractiveOwedToMe(s *discordgo.Session, m *discordgo.MessageCreate,
 				discordgo.Button{
 					Label:    fmt.Sprintf("ดูรายละเอียดที่ %s ค้างชำระ", displayName),
 					Style:    discordgo.SecondaryButton,
-					CustomID: fmt.Sprintf("view_detail_d%s", debt.OtherPartyDiscordID),
+					CustomID: viewDebtDetailComponentID(userID, debt.OtherPartyDiscordID, userID),
 				},
 				discordgo.Button{
 					Label:    fmt.Sprintf("ส่งคำขอชำระเงินไปยัง %s", displayName),
 					Style:    discordgo.PrimaryButton,
-					CustomID: fmt.Sprintf("request_payment_%s", debt.OtherPartyDiscordID),
+					CustomID: requestPaymentComponentID(debt.OtherPartyDiscordID, userID),
 				},
 			},
 		})
@@ -215,12 +215,16 @@ func HandleSelectTransaction(s *discordgo.Session, m *discordgo.MessageCreate, a
 
 	// Create a selection menu
 	var options []discordgo.SelectMenuOption
+	var optionTxIDs []int
 	for _, tx := range txs {
 		txID := tx["id"].(int)
+		optionTxIDs = append(optionTxIDs, txID)
 		description := tx["description"].(string)
 		amount := tx["amount"].(float64)
 		isPaid := tx["already_paid"].(bool)
 		otherPartyDiscordID := tx["other_party_discord_id"].(string)
+		isDisputed, _ := tx["disputed"].(bool)
+		isOverdue, _ := tx["overdue"].(bool)
 
 		// ดึงชื่อจริงจาก Discord
 		otherPartyName := GetDiscordUsername(s, otherPartyDiscordID)
@@ -247,6 +251,12 @@ func HandleSelectTransaction(s *discordgo.Session, m *discordgo.MessageCreate, a
 				label = fmt.Sprintf("#%d: %.2f บาท", txID, amount)
 			}
 		}
+		if isOverdue {
+			label += " - เกินกำหนด"
+		}
+		if isDisputed {
+			label += " - มีข้อพิพาท"
+		}
 
 		// Create option
 		options = append(options, discordgo.SelectMenuOption{
@@ -255,6 +265,12 @@ func HandleSelectTransaction(s *discordgo.Session, m *discordgo.MessageCreate, a
 			Value:       fmt.Sprintf("tx_%d", txID),
 			Emoji: &discordgo.ComponentEmoji{
 				Name: func() string {
+					if isDisputed {
+						return "⚖️"
+					}
+					if isOverdue {
+						return "⏰"
+					}
 					if isPaid {
 						return "✅"
 					}
@@ -266,7 +282,7 @@ func HandleSelectTransaction(s *discordgo.Session, m *discordgo.MessageCreate, a
 
 	// Create the dropdown component
 	dropdown := discordgo.SelectMenu{
-		CustomID:    debtDropdownID,
+		CustomID:    newComponentID(debtDropdownPrefix, m.Author.ID, []string{m.Author.ID}, txListPayload{TxIDs: optionTxIDs}, false, interactionStateTTL),
 		Placeholder: "เลือกรายการที่ต้องการดู",
 		Options:     options,
 	}
@@ -382,12 +398,12 @@ func HandleInteractiveRequestPayment(s *discordgo.Session, m *discordgo.MessageC
 			discordgo.Button{
 				Label:    "ส่งคำขอชำระเงิน",
 				Style:    discordgo.PrimaryButton,
-				CustomID: fmt.Sprintf("%s%s", requestPaymentButtonPrefix, debtorDiscordID),
+				CustomID: requestPaymentComponentID(debtorDiscordID, creditorDiscordID),
 			},
 			discordgo.Button{
 				Label:    "ดูรายละเอียดเพิ่มเติม",
 				Style:    discordgo.SecondaryButton,
-				CustomID: fmt.Sprintf("%sd%s", viewDetailButtonPrefix, debtorDiscordID),
+				CustomID: viewDebtDetailComponentID(creditorDiscordID, debtorDiscordID, creditorDiscordID),
 			},
 		},
 	})
@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/oatsaysai/billing-in-discord/internal/db"
+)
+
+// iouUsage is shown when !iowe can't be parsed
+const iouUsage = "รูปแบบไม่ถูกต้อง โปรดใช้ `!iowe @user <จำนวนเงิน> [for <รายละเอียด>]`"
+
+// HandleIOwe handles !iowe @user <amount> [for <description>].
+// The debtor records a debt themselves, it only counts once the creditor accepts it.
+func HandleIOwe(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+	if len(args) < 3 || !userMentionRegex.MatchString(args[1]) {
+		SendErrorMessage(s, m.ChannelID, iouUsage)
+		return
+	}
+	creditorDiscordID := userMentionRegex.FindStringSubmatch(args[1])[1]
+	if creditorDiscordID == m.Author.ID {
+		SendErrorMessage(s, m.ChannelID, "ไม่สามารถบันทึกหนี้กับตัวเองได้")
+		return
+	}
+
+	amount, err := strconv.ParseFloat(args[2], 64)
+	if err != nil || amount <= 0 || math.IsNaN(amount) || math.IsInf(amount, 0) {
+		SendErrorMessage(s, m.ChannelID, fmt.Sprintf("จำนวนเงิน '%s' ไม่ถูกต้อง", args[2]))
+		return
+	}
+
+	description := "ยืมเงิน"
+	if len(args) > 3 {
+		if strings.ToLower(args[3]) != "for" || len(args) < 5 {
+			SendErrorMessage(s, m.ChannelID, iouUsage)
+			return
+		}
+		description = strings.Join(args[4:], " ")
+	}
+
+	debtorDbID, err := db.GetOrCreateUser(m.Author.ID)
+	if err != nil {
+		SendErrorMessage(s, m.ChannelID, fmt.Sprintf("เกิดข้อผิดพลาดกับฐานข้อมูลสำหรับคุณ (<@%s>)", m.Author.ID))
+		return
+	}
+	creditorDbID, err := db.GetOrCreateUser(creditorDiscordID)
+	if err != nil {
+		SendErrorMessage(s, m.ChannelID, fmt.Sprintf("เกิดข้อผิดพลาดกับฐานข้อมูลสำหรับ <@%s>", creditorDiscordID))
+		return
+	}
+
+	txID, err := db.CreatePendingTransaction(debtorDbID, creditorDbID, amount, description)
+	if err != nil {
+		log.Printf("Failed to save IOU from %s to %s: %v", m.Author.ID, creditorDiscordID, err)
+		SendErrorMessage(s, m.ChannelID, "เกิดข้อผิดพลาดในการบันทึก Transaction")
+		return
+	}
+
+	content := fmt.Sprintf("📝 <@%s> (**%s**) แจ้งว่าเป็นหนี้คุณ **%.2f บาท** ค่า %s (TxID: %d)\nหนี้นี้จะถูกบันทึกเมื่อคุณยอมรับเท่านั้น",
+		m.Author.ID, GetDiscordUsername(s, m.Author.ID), amount, description, txID)
+	stateID := newComponentState([]string{iouAcceptPrefix, iouRejectPrefix}, m.Author.ID, []string{creditorDiscordID},
+		iouPayload{TxID: txID, ChannelID: m.ChannelID, GuildID: m.GuildID}, false, longInteractionStateTTL)
+	components := []discordgo.MessageComponent{
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.Button{
+					Label:    "ยอมรับ",
+					Style:    discordgo.SuccessButton,
+					CustomID: iouAcceptPrefix + stateID,
+				},
+				discordgo.Button{
+					Label:    "ปฏิเสธ",
+					Style:    discordgo.DangerButton,
+					CustomID: iouRejectPrefix + stateID,
+				},
+			},
+		},
+	}
+
+	dmChannel, err := s.UserChannelCreate(creditorDiscordID)
+	if err == nil {
+		_, err = s.ChannelMessageSendComplex(dmChannel.ID, &discordgo.MessageSend{Content: content, Components: components})
+	}
+	if err != nil {
+		log.Printf("Could not DM creditor %s for IOU %d: %v", creditorDiscordID, txID, err)
+		s.ChannelMessageSendComplex(m.ChannelID, &discordgo.MessageSend{
+			Content:    fmt.Sprintf("<@%s>\n%s", creditorDiscordID, content),
+			Components: components,
+		})
+		return
+	}
+
+	s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("⏳ บันทึกว่า <@%s> เป็นหนี้ <@%s> %.2f บาท ค่า %s (TxID: %d) แล้ว รอ <@%s> ยอมรับทาง DM",
+		m.Author.ID, creditorDiscordID, amount, description, txID, creditorDiscordID))
+}
+
+// handleIOUAcceptButton activates an IOU the creditor accepted
+func handleIOUAcceptButton(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	var payload iouPayload
+	if !decodeComponentPayload(s, i, state, &payload) {
+		return
+	}
+
+	activated, err := db.ActivatePendingTransactions([]int{payload.TxID})
+	if err != nil {
+		log.Printf("Error accepting IOU %d: %v", payload.TxID, err)
+		respondWithError(s, i, "เกิดข้อผิดพลาดในการบันทึกหนี้")
+		return
+	}
+	if len(activated) == 0 {
+		respondWithError(s, i, fmt.Sprintf("รายการ TxID %d ถูกดำเนินการไปแล้ว", payload.TxID))
+		return
+	}
+
+	txInfo, err := db.GetTransactionInfo(payload.TxID)
+	if err != nil {
+		log.Printf("Error loading accepted IOU %d: %v", payload.TxID, err)
+		return
+	}
+	debtorDiscordID := state.OwnerDiscordID
+	amount := txInfo["amount"].(float64)
+	description := txInfo["description"].(string)
+
+	responseContent := fmt.Sprintf("✅ คุณยอมรับแล้วว่า <@%s> เป็นหนี้คุณ %.2f บาท ค่า %s (TxID: %d)", debtorDiscordID, amount, description, payload.TxID)
+	if dueDateLine := setBillDueDate(activated, defaultDueDate(payload.GuildID)); dueDateLine != "" {
+		responseContent += "\n" + dueDateLine
+	}
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Content:    responseContent,
+			Components: []discordgo.MessageComponent{}, // Remove buttons
+		},
+	})
+	if err != nil {
+		log.Printf("Error responding to IOU accept button: %v", err)
+	}
+
+	if payload.ChannelID != "" {
+		s.ChannelMessageSend(payload.ChannelID, fmt.Sprintf("✅ <@%s> ยอมรับหนี้ %.2f บาท ค่า %s จาก <@%s> แล้ว (TxID: %d)",
+			interactionUserID(i), amount, description, debtorDiscordID, payload.TxID))
+	}
+}
+
+// handleIOURejectButton rejects an IOU so it never becomes a debt
+func handleIOURejectButton(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	var payload iouPayload
+	if !decodeComponentPayload(s, i, state, &payload) {
+		return
+	}
+
+	rejected, err := db.RejectPendingTransactions([]int{payload.TxID})
+	if err != nil {
+		log.Printf("Error rejecting IOU %d: %v", payload.TxID, err)
+		respondWithError(s, i, "เกิดข้อผิดพลาดในการปฏิเสธรายการ")
+		return
+	}
+	if len(rejected) == 0 {
+		respondWithError(s, i, fmt.Sprintf("รายการ TxID %d ถูกดำเนินการไปแล้ว", payload.TxID))
+		return
+	}
+
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Content:    fmt.Sprintf("❌ คุณได้ปฏิเสธรายการ TxID %d จาก <@%s> ไม่มีการบันทึกหนี้", payload.TxID, state.OwnerDiscordID),
+			Components: []discordgo.MessageComponent{}, // Remove buttons
+		},
+	})
+	if err != nil {
+		log.Printf("Error responding to IOU reject button: %v", err)
+	}
+
+	if payload.ChannelID != "" {
+		s.ChannelMessageSend(payload.ChannelID, fmt.Sprintf("❌ <@%s> ปฏิเสธรายการหนี้ TxID %d ที่ <@%s> แจ้งไว้",
+			interactionUserID(i), payload.TxID, state.OwnerDiscordID))
+	}
+}
@@ -4,24 +4,25 @@ import (
 	"fmt"
 	"log"
 	"strconv"
-	"strings"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/oatsaysai/billing-in-discord/internal/db"
 )
 
 // handlePayDebtModalSubmit handles the pay debt modal submission
-func handlePayDebtModalSubmit(s *discordgo.Session, i *discordgo.InteractionCreate) {
-	// Extract the creditor's Discord ID from the custom ID
-	customID := i.ModalSubmitData().CustomID
-	creditorDiscordID := strings.TrimPrefix(customID, "modal_pay_debt_")
+func handlePayDebtModalSubmit(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	var payload debtPairPayload
+	if !decodeComponentPayload(s, i, state, &payload) {
+		return
+	}
+	creditorDiscordID := payload.CreditorDiscordID
 
 	if creditorDiscordID == "" {
 		respondWithError(s, i, "ไม่พบข้อมูลผู้รับเงินที่ถูกต้อง")
 		return
 	}
 
-	debtorDiscordID := i.Member.User.ID
+	debtorDiscordID := interactionUserID(i)
 
 	// Get DB IDs
 	debtorDbID, err := db.GetOrCreateUser(debtorDiscordID)
@@ -78,41 +79,16 @@ func handlePayDebtModalSubmit(s *discordgo.Session, i *discordgo.InteractionCrea
 		paymentNote = "การชำระเงินผ่านระบบบอท"
 	}
 
-	// Get unpaid transaction IDs to mark as paid
-	unpaidTxIDs, _, unpaidTotal, err := db.GetUnpaidTransactionIDsAndDetails(debtorDbID, creditorDbID, 10)
+	// Allocate the payment to the outstanding transactions
+	allocation, err := allocatePayment(s, i.ChannelID, debtorDiscordID, creditorDiscordID, paymentAmount)
 	if err != nil {
-		log.Printf("Error fetching unpaid transactions for modal payment: %v", err)
-		// Continue with general debt reduction
-		err = db.ReduceDebtFromPayment(debtorDiscordID, creditorDiscordID, paymentAmount)
-		if err != nil {
-			respondWithError(s, i, fmt.Sprintf("เกิดข้อผิดพลาดในการประมวลผลการชำระเงิน: %v", err))
-			return
-		}
-	} else {
-		// If payment amount closely matches unpaid total, mark those transactions as paid
-		if paymentAmount >= unpaidTotal*0.99 && paymentAmount <= unpaidTotal*1.01 {
-			for _, txID := range unpaidTxIDs {
-				err = db.MarkTransactionPaidAndUpdateDebt(txID)
-				if err != nil {
-					log.Printf("Error marking transaction %d as paid: %v", txID, err)
-				}
-			}
-		} else {
-			// Otherwise do a general debt reduction
-			err = db.ReduceDebtFromPayment(debtorDiscordID, creditorDiscordID, paymentAmount)
-			if err != nil {
-				respondWithError(s, i, fmt.Sprintf("เกิดข้อผิดพลาดในการประมวลผลการชำระเงิน: %v", err))
-				return
-			}
-		}
+		respondWithError(s, i, fmt.Sprintf("เกิดข้อผิดพลาดในการประมวลผลการชำระเงิน: %v", err))
+		return
 	}
 
 	// Respond with a success message
 	content := fmt.Sprintf("✅ บันทึกการชำระเงิน %.2f บาท ให้กับ <@%s> เรียบร้อยแล้ว\n", paymentAmount, creditorDiscordID)
-
-	if len(unpaidTxIDs) > 0 {
-		content += fmt.Sprintf("รายการเกี่ยวข้อง: %v\n", unpaidTxIDs)
-	}
+	content += formatPaymentAllocation(allocation) + "\n"
 
 	if paymentNote != "" {
 		content += fmt.Sprintf("หมายเหตุ: %s", paymentNote)
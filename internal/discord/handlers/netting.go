@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/oatsaysai/billing-in-discord/internal/db"
+	"github.com/spf13/viper"
+)
+
+// automaticNettingActor is recorded as the trigger of nettings done when a bill is created
+const automaticNettingActor = "automatic"
+
+// HandleNet handles !net @user.
+// It offsets the debts between the author and the mentioned user so only the difference stays payable.
+func HandleNet(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+	if len(args) < 2 || !userMentionRegex.MatchString(args[1]) {
+		SendErrorMessage(s, m.ChannelID, "รูปแบบไม่ถูกต้อง โปรดใช้ `!net @user`")
+		return
+	}
+	otherDiscordID := userMentionRegex.FindStringSubmatch(args[1])[1]
+	if otherDiscordID == m.Author.ID {
+		SendErrorMessage(s, m.ChannelID, "ไม่สามารถหักกลบหนี้กับตัวเองได้")
+		return
+	}
+
+	authorDbID, err := db.GetOrCreateUser(m.Author.ID)
+	if err != nil {
+		SendErrorMessage(s, m.ChannelID, "ไม่สามารถยืนยันบัญชีผู้ใช้ของคุณสำหรับการดำเนินการนี้")
+		return
+	}
+	otherDbID, err := db.GetOrCreateUser(otherDiscordID)
+	if err != nil {
+		SendErrorMessage(s, m.ChannelID, fmt.Sprintf("ไม่พบ <@%s> ในฐานข้อมูล", otherDiscordID))
+		return
+	}
+
+	netting, err := db.NetMutualDebts(authorDbID, otherDbID, m.Author.ID)
+	if err != nil {
+		log.Printf("Error netting debts between %s and %s: %v", m.Author.ID, otherDiscordID, err)
+		SendErrorMessage(s, m.ChannelID, fmt.Sprintf("ไม่สามารถหักกลบหนี้ได้: %v", err))
+		return
+	}
+	if netting == nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("ไม่มีหนี้ที่หักกลบได้ระหว่าง <@%s> และ <@%s> (ต้องเป็นหนี้กันทั้งสองฝ่าย)", m.Author.ID, otherDiscordID))
+		return
+	}
+
+	s.ChannelMessageSend(m.ChannelID, formatDebtNetting(netting, m.Author.ID, otherDiscordID))
+}
+
+// netNewBill offsets a bill's debtor and creditor if the creditor also owes the debtor.
+// It returns the amount and transactions of the bill still to be paid, which the caller uses for the QR code.
+func netNewBill(s *discordgo.Session, channelID, debtorDiscordID, creditorDiscordID string, amount float64, txIDs []int) (float64, []int) {
+	if !viper.GetBool("Payment.AutoNetting") || len(txIDs) == 0 || debtorDiscordID == creditorDiscordID {
+		return amount, txIDs
+	}
+
+	debtorDbID, err := db.GetOrCreateUser(debtorDiscordID)
+	if err != nil {
+		log.Printf("Error DB user %s while netting debts: %v", debtorDiscordID, err)
+		return amount, txIDs
+	}
+	creditorDbID, err := db.GetOrCreateUser(creditorDiscordID)
+	if err != nil {
+		log.Printf("Error DB user %s while netting debts: %v", creditorDiscordID, err)
+		return amount, txIDs
+	}
+
+	netting, err := db.NetMutualDebts(debtorDbID, creditorDbID, automaticNettingActor)
+	if err != nil {
+		log.Printf("Failed to net debts between %s and %s: %v", debtorDiscordID, creditorDiscordID, err)
+		return amount, txIDs
+	}
+	if netting == nil {
+		return amount, txIDs
+	}
+	s.ChannelMessageSend(channelID, formatDebtNetting(netting, debtorDiscordID, creditorDiscordID))
+
+	// Only the part of the netting that landed on this bill's transactions lowers its QR amount
+	var remainingTxIDs []int
+	for _, txID := range txIDs {
+		settled := false
+		for _, alloc := range netting.UserADebt.Allocations {
+			if alloc.TxID != txID {
+				continue
+			}
+			amount -= alloc.Applied
+			settled = alloc.Remaining <= 0.009
+		}
+		if !settled {
+			remainingTxIDs = append(remainingTxIDs, txID)
+		}
+	}
+	return math.Max(math.Round(amount*100)/100, 0), remainingTxIDs
+}
+
+// prepareBillPayment settles what it can of a new bill from credit and mutual debts before a QR code is sent.
+// It returns the amount and transactions still to be paid.
+func prepareBillPayment(s *discordgo.Session, channelID, debtorDiscordID, creditorDiscordID string, amount float64, txIDs []int) (float64, []int) {
+	amount, txIDs = applyCreditToNewBill(s, channelID, debtorDiscordID, creditorDiscordID, amount, txIDs)
+	return netNewBill(s, channelID, debtorDiscordID, creditorDiscordID, amount, txIDs)
+}
+
+// formatDebtNetting describes a netting between user A and user B
+func formatDebtNetting(netting *db.DebtNetting, userADiscordID, userBDiscordID string) string {
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("🔄 **หักกลบหนี้ระหว่าง <@%s> และ <@%s> จำนวน %.2f บาท** (รายการหักกลบ #%d)\n",
+		userADiscordID, userBDiscordID, netting.Amount, netting.ID))
+	b.WriteString(fmt.Sprintf("<@%s> → <@%s>:\n%s\n", userADiscordID, userBDiscordID, formatPaymentAllocation(netting.UserADebt)))
+	b.WriteString(fmt.Sprintf("<@%s> → <@%s>:\n%s\n", userBDiscordID, userADiscordID, formatPaymentAllocation(netting.UserBDebt)))
+	b.WriteString("ยอดที่เหลือหลังหักกลบเท่านั้นที่ต้องชำระ ดูได้ด้วย `!mydebts`")
+	return b.String()
+}
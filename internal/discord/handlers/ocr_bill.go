@@ -4,13 +4,13 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
@@ -42,95 +42,83 @@ func SetDiscordSession(s *discordgo.Session) {
 	session = s
 }
 
-// HandleOCRBillAttachment processes the bill image using OCR
-func HandleOCRBillAttachment(s *discordgo.Session, m *discordgo.MessageCreate, attachment *discordgo.MessageAttachment) {
+// HandleOCRBillAttachments processes the attached bill images using OCR. The images are read in parallel
+// and merged into one bill: photos of the same long receipt are joined, separate receipts become sections.
+func HandleOCRBillAttachments(s *discordgo.Session, m *discordgo.MessageCreate, attachments []*discordgo.MessageAttachment) {
 	// Check if OCR client is configured
 	if ocrClient == nil {
 		SendErrorMessage(s, m.ChannelID, "OCR service is not configured. OCR bill processing is not available.")
 		return
 	}
 
-	// Check if it's an image file
-	if !strings.HasPrefix(strings.ToLower(attachment.ContentType), "image/") {
-		SendErrorMessage(s, m.ChannelID, fmt.Sprintf("ไฟล์ที่แนบมาไม่ใช่รูปภาพ (%s)", attachment.ContentType))
-		return
+	// Only image files are receipts
+	var images []*discordgo.MessageAttachment
+	for _, attachment := range attachments {
+		if !strings.HasPrefix(strings.ToLower(attachment.ContentType), "image/") {
+			SendErrorMessage(s, m.ChannelID, fmt.Sprintf("ข้ามไฟล์ %s เพราะไม่ใช่รูปภาพ (%s)", attachment.Filename, attachment.ContentType))
+			continue
+		}
+		images = append(images, attachment)
 	}
-
-	// Download the image
-	tmpFile := fmt.Sprintf("bill_%s_%d.png", m.ID, time.Now().UnixNano())
-	err := downloadFile(tmpFile, attachment.URL)
-	if err != nil {
-		SendErrorMessage(s, m.ChannelID, "ไม่สามารถดาวน์โหลดไฟล์รูปภาพบิลได้")
-		log.Printf("OCRBill: Failed to download bill image %s: %v", attachment.URL, err)
+	if len(images) == 0 {
 		return
 	}
-	defer os.Remove(tmpFile) // Clean up temporary file when done
 
 	// Send a message to indicate processing
-	processingMsg, err := s.ChannelMessageSend(m.ChannelID, "⏳ กำลังประมวลผลรูปภาพบิลผ่าน OCR...")
+	processingText := "⏳ กำลังประมวลผลรูปภาพบิลผ่าน OCR..."
+	if len(images) > 1 {
+		processingText = fmt.Sprintf("⏳ กำลังประมวลผลรูปภาพบิล %d รูปผ่าน OCR...", len(images))
+	}
+	processingMsg, err := s.ChannelMessageSend(m.ChannelID, processingText)
 	if err != nil {
 		log.Printf("OCRBill: Failed to send processing message: %v", err)
 		// Continue processing even if we couldn't send the message
 	}
 
-	// Process the image with OCR
-	billData, err := ocrClient.ExtractBillText(tmpFile)
-	if err != nil {
-		SendErrorMessage(s, m.ChannelID, fmt.Sprintf("การประมวลผล OCR ล้มเหลว: %v", err))
-		log.Printf("OCRBill: OCR processing failed for %s: %v", attachment.URL, err)
+	// Process the images with OCR
+	var bills []*ocr.ExtractBillTextResponse
+	var failures, imageHashes []string
+	for idx, result := range extractBillImages(m, images) {
+		if result.Hash != "" {
+			imageHashes = append(imageHashes, result.Hash)
+		}
+		if result.Err != nil {
+			failures = append(failures, fmt.Sprintf("รูปที่ %d (%s): %v", idx+1, result.Attachment.Filename, result.Err))
+			continue
+		}
+		bills = append(bills, result.Bill)
+	}
+	if len(bills) == 0 {
+		SendErrorMessage(s, m.ChannelID, strings.Join(failures, "\n"))
 		// Clean up the processing message
 		if processingMsg != nil {
 			s.ChannelMessageDelete(m.ChannelID, processingMsg.ID)
 		}
 		return
 	}
+	if len(failures) > 0 {
+		SendErrorMessage(s, m.ChannelID, "บางรูปประมวลผลไม่สำเร็จ บิลนี้จึงไม่มีรายการจากรูปเหล่านี้:\n"+strings.Join(failures, "\n"))
+	}
 
 	// Update the processing message to indicate success
 	if processingMsg != nil {
 		s.ChannelMessageEdit(m.ChannelID, processingMsg.ID, "✅ ประมวลผลรูปภาพบิลสำเร็จ! กำลังแสดงผลลัพธ์...")
 	}
 
-	// Generate a summary of the bill
-	var summary strings.Builder
-	summary.WriteString(fmt.Sprintf("**ผลการวิเคราะห์บิลด้วย OCR**\n"))
-	summary.WriteString(fmt.Sprintf("📇 **ร้าน**: %s\n", billData.MerchantName))
-	summary.WriteString(fmt.Sprintf("📅 **วันที่เวลา**: %s\n", billData.Datetime))
-	summary.WriteString(fmt.Sprintf("💰 **ยอดรวม**: %.2f บาท\n\n", billData.Total))
-
-	summary.WriteString("**รายการ**:\n")
-	for i, item := range billData.Items {
-		summary.WriteString(fmt.Sprintf("%d. %s (จำนวน %d): %.2f บาท\n", i+1, item.Name, item.Quantity, item.Price))
-	}
-
-	if billData.SubTotal > 0 {
-		summary.WriteString(fmt.Sprintf("\nSubtotal: %.2f บาท\n", billData.SubTotal))
-	}
-	if billData.VAT > 0 {
-		summary.WriteString(fmt.Sprintf("VAT: %.2f บาท\n", billData.VAT))
-	}
-	if billData.ServiceCharge > 0 {
-		summary.WriteString(fmt.Sprintf("Service Charge: %.2f บาท\n", billData.ServiceCharge))
-	}
-
-	summary.WriteString("\nคลิกปุ่มด้านล่างเพื่อระบุรายการที่แต่ละคนต้องจ่าย")
+	// Store the bill data in memory for later use when allocating and correcting
+	billData, receipts, duplicates := mergeOCRBills(bills)
+	record := &ocrBillRecord{Raw: billData, Receipts: receipts, DuplicatesRemoved: duplicates, ImageHashes: imageHashes}
+	storeBillOCRData(m.ID, record)
 
-	// Create button for opening the bill allocation modal
-	components := []discordgo.MessageComponent{
-		discordgo.ActionsRow{
-			Components: []discordgo.MessageComponent{
-				discordgo.Button{
-					Label:    "ระบุรายการของแต่ละคน",
-					Style:    discordgo.PrimaryButton,
-					CustomID: fmt.Sprintf("bill_allocate_%s", m.ID),
-				},
-			},
-		},
+	// Re-posting a receipt that was already billed is usually a mistake
+	if warning := billedReceiptWarning(m.GuildID, imageHashes); warning != "" {
+		s.ChannelMessageSend(m.ChannelID, warning)
 	}
 
-	// Send the summary with button
+	// Send the summary, with its discrepancies highlighted, and the allocation and correction buttons
 	_, err = s.ChannelMessageSendComplex(m.ChannelID, &discordgo.MessageSend{
-		Content:    summary.String(),
-		Components: components,
+		Content:    ocrBillSummary(billData, record),
+		Components: ocrBillComponents(m.Author.ID, m.ID, billData, 0),
 	})
 	if err != nil {
 		log.Printf("OCRBill: Failed to send bill OCR results: %v", err)
@@ -141,53 +129,100 @@ func HandleOCRBillAttachment(s *discordgo.Session, m *discordgo.MessageCreate, a
 	if processingMsg != nil {
 		s.ChannelMessageDelete(m.ChannelID, processingMsg.ID)
 	}
+}
 
-	// Store the bill data in memory for later use when allocating
-	storeBillOCRData(m.ID, billData)
+// ocrBillRecord keeps a bill's OCR output next to the corrections its owner made
+type ocrBillRecord struct {
+	Raw               *ocr.ExtractBillTextResponse // As returned by the OCR service and merged, never changed
+	Corrected         *ocr.ExtractBillTextResponse // Used for allocation, starts as a copy of Raw
+	Receipts          []ocrReceipt                 // The receipts the bill was merged from
+	DuplicatesRemoved int                          // Lines repeated on overlapping photos of a receipt
+	ImageHashes       []string                     // Content hashes of the receipt images
 }
 
 // Global map to store OCR bill data temporarily
-var billOCRDataStore = make(map[string]*ocr.ExtractBillTextResponse)
+var (
+	billOCRDataStore = make(map[string]*ocrBillRecord)
+	billOCRDataMu    sync.Mutex
+)
 
 // Global map to store selected users temporarily
 var tempSelectedUsers = make(map[string][]string) // map[messageID][]userID
 
-// Global map to store tokens for web sessions
-var webSessionTokens = make(map[string]WebSessionData)
+// storeBillOCRData stores the bill data in memory
+func storeBillOCRData(messageID string, record *ocrBillRecord) {
+	billOCRDataMu.Lock()
+	defer billOCRDataMu.Unlock()
+	record.Corrected = copyOCRBill(record.Raw)
+	billOCRDataStore[messageID] = record
+}
 
-// WebSessionData stores data for a web session
-type WebSessionData struct {
-	BillData      *ocr.ExtractBillTextResponse
-	SelectedUsers []string
-	OwnerID       string
-	ChannelID     string
-	CreatedAt     time.Time
+// getBillOCRData retrieves the corrected bill data from memory
+func getBillOCRData(messageID string) *ocr.ExtractBillTextResponse {
+	billOCRDataMu.Lock()
+	defer billOCRDataMu.Unlock()
+	record, exists := billOCRDataStore[messageID]
+	if !exists {
+		return nil
+	}
+	return copyOCRBill(record.Corrected)
 }
 
-// storeBillOCRData stores the bill data in memory
-func storeBillOCRData(messageID string, data *ocr.ExtractBillTextResponse) {
-	billOCRDataStore[messageID] = data
+// getBillOCRRecord retrieves how the bill was read: the raw OCR output and the receipts it was merged from
+func getBillOCRRecord(messageID string) *ocrBillRecord {
+	billOCRDataMu.Lock()
+	defer billOCRDataMu.Unlock()
+	record, exists := billOCRDataStore[messageID]
+	if !exists {
+		return nil
+	}
+	copied := *record
+	return &copied
 }
 
-// getBillOCRData retrieves the bill data from memory
-func getBillOCRData(messageID string) *ocr.ExtractBillTextResponse {
-	data, exists := billOCRDataStore[messageID]
+// updateBillOCRData applies a correction to the stored bill data and returns the corrected bill
+func updateBillOCRData(messageID string, update func(bill *ocr.ExtractBillTextResponse) error) (*ocr.ExtractBillTextResponse, error) {
+	billOCRDataMu.Lock()
+	defer billOCRDataMu.Unlock()
+	record, exists := billOCRDataStore[messageID]
 	if !exists {
+		return nil, fmt.Errorf("ไม่พบข้อมูลบิล หรือข้อมูลหมดอายุแล้ว")
+	}
+	corrected := copyOCRBill(record.Corrected)
+	if err := update(corrected); err != nil {
+		return nil, err
+	}
+	record.Corrected = corrected
+	return copyOCRBill(corrected), nil
+}
+
+// deleteBillOCRData forgets the bill data of a message
+func deleteBillOCRData(messageID string) {
+	billOCRDataMu.Lock()
+	defer billOCRDataMu.Unlock()
+	delete(billOCRDataStore, messageID)
+}
+
+// copyOCRBill copies bill data so corrections never touch the raw OCR output
+func copyOCRBill(data *ocr.ExtractBillTextResponse) *ocr.ExtractBillTextResponse {
+	if data == nil {
 		return nil
 	}
-	return data
+	copied := *data
+	copied.Items = append([]ocr.BillItem(nil), data.Items...)
+	return &copied
 }
 
 // handleBillAllocateButton handles the button click to allocate bill items
-func handleBillAllocateButton(s *discordgo.Session, i *discordgo.InteractionCreate) {
-	parts := strings.Split(i.MessageComponentData().CustomID, "_")
-	if len(parts) < 3 {
-		respondWithError(s, i, "รูปแบบ custom ID ไม่ถูกต้อง")
+// Only the user who uploaded the bill is an allowed actor of the button's interaction state.
+func handleBillAllocateButton(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	var payload billPayload
+	if !decodeComponentPayload(s, i, state, &payload) {
 		return
 	}
 
 	// Extract the message ID that contains the bill data
-	messageID := parts[2]
+	messageID := payload.MessageID
 
 	// Get the bill data from memory
 	billData := getBillOCRData(messageID)
@@ -196,19 +231,6 @@ func handleBillAllocateButton(s *discordgo.Session, i *discordgo.InteractionCrea
 		return
 	}
 
-	// ตรวจสอบว่าผู้ใช้ที่กดปุ่มเป็นคนเริ่มคำสั่งเปิดบิลหรือไม่
-	originalMsg, err := s.ChannelMessage(i.ChannelID, messageID)
-	if err != nil {
-		respondWithError(s, i, "ไม่สามารถตรวจสอบข้อมูลผู้เริ่มคำสั่งได้")
-		return
-	}
-
-	// ตรวจสอบว่าผู้กดปุ่มเป็นคนเดียวกับคนที่อัปโหลดบิลหรือไม่
-	if originalMsg.Author.ID != i.Member.User.ID {
-		respondWithError(s, i, "ขออภัย คุณไม่มีสิทธิ์ในการดำเนินการนี้ เฉพาะผู้เริ่มคำสั่งเปิดบิลเท่านั้นที่สามารถระบุรายการได้")
-		return
-	}
-
 	// Send a message with user select component to select all users who will share this bill
 	respondWithUserSelect(s, i, messageID)
 }
@@ -218,9 +240,11 @@ func respondWithUserSelect(s *discordgo.Session, i *discordgo.InteractionCreate,
 	// Define min value (needs to be a pointer)
 	minV := 1
 
+	userID := interactionUserID(i)
+
 	// Create user select component
 	userSelect := discordgo.SelectMenu{
-		CustomID:    fmt.Sprintf("bill_users_select_%s", messageID),
+		CustomID:    newComponentID(billUsersSelectPrefix, userID, []string{userID}, billPayload{MessageID: messageID}, false, interactionStateTTL),
 		Placeholder: "เลือกผู้ใช้ทั้งหมดที่ร่วมจ่ายบิลนี้",
 		MinValues:   &minV,                    // MinValues is *int
 		MaxValues:   25,                       // MaxValues is int in this version
@@ -250,16 +274,15 @@ func respondWithUserSelect(s *discordgo.Session, i *discordgo.InteractionCreate,
 }
 
 // handleUserSelectSubmit handles the user selection submission
-func handleUserSelectSubmit(s *discordgo.Session, i *discordgo.InteractionCreate) {
-	data := i.MessageComponentData()
-	parts := strings.Split(data.CustomID, "_")
-	if len(parts) < 4 {
-		respondWithError(s, i, "รูปแบบ custom ID ไม่ถูกต้อง")
+func handleUserSelectSubmit(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	var payload billPayload
+	if !decodeComponentPayload(s, i, state, &payload) {
 		return
 	}
+	data := i.MessageComponentData()
 
 	// Extract the message ID that contains the bill data
-	messageID := parts[3]
+	messageID := payload.MessageID
 
 	// Get the bill data from memory
 	billData := getBillOCRData(messageID)
@@ -335,16 +358,45 @@ func createBillWebsite(s *discordgo.Session, i *discordgo.InteractionCreate, mes
 		})
 	}
 
-	// Generate a token for the web session
+	// Generate a token for the web session, shared with every participant, a separate key that
+	// only the owner's link carries, and a key per participant that identifies them when claiming
 	token := generateToken()
-
-	// Store the session data
-	webSessionTokens[token] = WebSessionData{
-		BillData:      billData,
-		SelectedUsers: selectedUsers,
-		OwnerID:       i.Member.User.ID,
-		ChannelID:     i.ChannelID,
-		CreatedAt:     time.Now(),
+	ownerKey := generateToken()
+	participantKeys := make(map[string]string)
+	for _, webUser := range webUsers {
+		participantKeys[webUser["id"].(string)] = generateToken()
+	}
+
+	// The claims of all participants are kept in the database, the web page only shows them
+	claimSession := &db.ClaimSession{
+		ChannelID:       i.ChannelID,
+		GuildID:         i.GuildID,
+		OwnerDiscordID:  interactionUserID(i),
+		SourceMessageID: messageID,
+		MerchantName:    billData.MerchantName,
+		BillDatetime:    billData.Datetime,
+		Status:          db.ClaimSessionOpen,
+		WebToken:        token,
+		OwnerKey:        ownerKey,
+		ParticipantKeys: participantKeys,
+	}
+	for _, item := range billData.Items {
+		quantity := item.Quantity
+		if quantity < 1 {
+			quantity = 1 // OCR sometimes misses the quantity of single items
+		}
+		claimSession.Items = append(claimSession.Items, db.ClaimItem{Name: item.Name, Price: item.Price, Quantity: quantity})
+	}
+	for _, webUser := range webUsers {
+		claimSession.Participants = append(claimSession.Participants, db.ClaimParticipant{
+			DiscordID: webUser["id"].(string),
+			Name:      webUser["name"].(string),
+		})
+	}
+	if _, err := db.CreateClaimSession(claimSession); err != nil {
+		log.Printf("Error creating web claim session for message %s: %v", messageID, err)
+		sendFollowupError(s, i, "เกิดข้อผิดพลาดในการสร้างรายการแบ่งบิล")
+		return
 	}
 
 	// Check if Firebase client is available
@@ -359,8 +411,14 @@ func createBillWebsite(s *discordgo.Session, i *discordgo.InteractionCreate, mes
 		webhookURL = "/api/bill-webhook" // Fallback default
 	}
 
+	// The page polls the claims from the same server that receives the webhook
+	claimsURL := config.GetString("Firebase.ClaimsURL")
+	if claimsURL == "" {
+		claimsURL = strings.TrimSuffix(webhookURL, "/api/bill-webhook") + "/api/bill-claims"
+	}
+
 	// Deploy the website using the Firebase client
-	websiteURL, siteName, err := firebase.DeployBillWebsite(firebaseClient, token, billData.MerchantName, webhookURL, webItems, webUsers)
+	websiteURL, siteName, err := firebase.DeployBillWebsite(firebaseClient, token, billData.MerchantName, webhookURL, claimsURL, webItems, webUsers)
 	if err != nil {
 		log.Printf("Error deploying bill website: %v", err)
 		sendFollowupError(s, i, fmt.Sprintf("เกิดข้อผิดพลาดในการสร้างเว็บไซต์: %v", err))
@@ -368,7 +426,7 @@ func createBillWebsite(s *discordgo.Session, i *discordgo.InteractionCreate, mes
 	}
 
 	// Store the site information in the database
-	userDbID, err := db.GetOrCreateUser(i.Member.User.ID)
+	userDbID, err := db.GetOrCreateUser(interactionUserID(i))
 	if err == nil {
 		// Save site information for cleanup later
 		err = db.SaveFirebaseSite(userDbID, firebaseClient.ProjectID, siteName, websiteURL, token)
@@ -378,10 +436,43 @@ func createBillWebsite(s *discordgo.Session, i *discordgo.InteractionCreate, mes
 		}
 	}
 
-	// Send the website URL to the user
+	// Every participant gets their own link by DM, it is what identifies them on the page.
+	// Links that can't be delivered are given to the owner to pass on.
+	ownerID := interactionUserID(i)
+	var undelivered strings.Builder
+	for _, webUser := range webUsers {
+		userID := webUser["id"].(string)
+		if userID == ownerID {
+			continue
+		}
+		link := fmt.Sprintf("%s#key=%s", websiteURL, participantKeys[userID])
+		err := SendDirectMessage(s, userID, fmt.Sprintf("🧾 <@%s> ชวนคุณแบ่งบิล %s เลือกรายการที่คุณสั่งได้ที่ลิงก์ส่วนตัวของคุณ (ห้ามแชร์):\n%s\n\n⚠️ ลิงก์นี้จะหมดอายุใน 30 นาที",
+			ownerID, billData.MerchantName, link))
+		if err != nil {
+			undelivered.WriteString(fmt.Sprintf("\n<@%s>: %s", userID, link))
+		}
+	}
+
+	// Only the owner gets the link that can lock and submit the allocation
+	ownerLink := fmt.Sprintf("%s#owner=%s", websiteURL, ownerKey)
+	if key, ok := participantKeys[ownerID]; ok {
+		ownerLink += "&key=" + key
+	}
+	ownerMessage := fmt.Sprintf("✅ สร้างเว็บไซต์สำหรับแบ่งรายการเรียบร้อยแล้ว\n\nลิงก์สำหรับเจ้าของบิล (ห้ามแชร์) ใช้ล็อกและส่งข้อมูลเมื่อทุกรายการมีคนรับครบ:\n%s", ownerLink)
+	if undelivered.Len() > 0 {
+		ownerMessage += "\n\nส่ง DM ไม่ถึงผู้ร่วมจ่ายต่อไปนี้ โปรดส่งลิงก์ส่วนตัวให้แต่ละคนเอง:" + undelivered.String()
+	}
+	ownerMessage += "\n\n⚠️ ลิงก์นี้จะหมดอายุใน 30 นาที"
 	s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
-		Content: stringPtr(fmt.Sprintf("✅ สร้างเว็บไซต์สำหรับแบ่งรายการเรียบร้อยแล้ว\n\nโปรดเข้าไปที่ลิงก์นี้เพื่อระบุรายการที่แต่ละคนต้องจ่าย:\n%s\n\n⚠️ ลิงก์นี้จะหมดอายุใน 30 นาที", websiteURL)),
+		Content: stringPtr(ownerMessage),
 	})
+
+	var mentions []string
+	for _, userID := range selectedUsers {
+		mentions = append(mentions, fmt.Sprintf("<@%s>", userID))
+	}
+	s.ChannelMessageSend(i.ChannelID, fmt.Sprintf("🧾 %s บอทส่งลิงก์ส่วนตัวสำหรับเลือกรายการของตัวเองในบิล %s ให้ทาง DM แล้ว\n\nติ๊กรายการที่สั่ง รายการจะอัปเดตให้ทุกคนเห็นทันที ⚠️ ลิงก์จะหมดอายุใน 30 นาที",
+		strings.Join(mentions, " "), billData.MerchantName))
 }
 
 // generateToken generates a random token for web sessions
@@ -395,16 +486,18 @@ func generateToken() string {
 	return base64.URLEncoding.EncodeToString(b)
 }
 
-// CleanupSessionDataByToken cleans up session data in memory maps when a token expires
+// CleanupSessionDataByToken cleans up session data when a token expires
 func CleanupSessionDataByToken(token string) {
-	delete(webSessionTokens, token)
+	if err := db.CancelClaimSessionByWebToken(token); err != nil {
+		log.Printf("Error cancelling claim session of expired token: %v", err)
+	}
 
 	// Try to clean up related data if possible
 	// We can only do this if we can derive messageID from token
 	parts := strings.Split(token, "_")
 	if len(parts) > 0 {
 		possibleMessageID := parts[0]
-		delete(billOCRDataStore, possibleMessageID)
+		deleteBillOCRData(possibleMessageID)
 		delete(tempSelectedUsers, possibleMessageID)
 	}
 }
@@ -427,6 +520,11 @@ func sendFollowupError(s *discordgo.Session, i *discordgo.InteractionCreate, err
 	}
 }
 
+// writeBillAlreadyProcessed answers a repeated submission of a bill allocation that was already accepted
+func writeBillAlreadyProcessed(w http.ResponseWriter) {
+	writeWebClaimsJSON(w, http.StatusOK, map[string]string{"status": "ok", "message": "Bill allocation was already processed"})
+}
+
 // HandleBillWebhookCallback processes callbacks from the bill allocation website
 func HandleBillWebhookCallback(w http.ResponseWriter, r *http.Request) {
 	// Set CORS headers
@@ -453,17 +551,10 @@ func HandleBillWebhookCallback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Parse the JSON payload
+	// Parse the JSON payload. The allocation itself is the claims the participants made on the page.
 	var payload struct {
-		Token     string `json:"token"`
-		BillItems []struct {
-			OriginalId   string   `json:"originalId"`
-			ClientSideId string   `json:"clientSideId"`
-			Name         string   `json:"name"`
-			TotalAmount  float64  `json:"totalAmount"`
-			Users        []string `json:"users"`
-			IsNew        bool     `json:"isNew"`
-		} `json:"billItems"`
+		Token             string `json:"token"`
+		OwnerKey          string `json:"ownerKey"`
 		PromptPayID       string `json:"promptPayID"`
 		AdditionalCharges struct {
 			AddVat           bool `json:"addVat"`
@@ -479,23 +570,46 @@ func HandleBillWebhookCallback(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Verify the token and retrieve session data
-	sessionData, exists := webSessionTokens[payload.Token]
-	if !exists {
-		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
-		log.Printf("Invalid or expired token in webhook: %s", payload.Token)
+	claimSession := loadWebClaimSession(w, payload.Token)
+	if claimSession == nil {
+		return
+	}
+	if !isWebClaimOwner(claimSession, payload.OwnerKey) {
+		writeWebClaimsError(w, http.StatusForbidden, "เฉพาะเจ้าของบิลเท่านั้นที่ส่งข้อมูลได้")
 		return
 	}
 
-	// Convert string indices to integers in itemAllocations
-	itemAllocations := make(map[int][]string)
-	for _, item := range payload.BillItems {
-		itemIdx, err := strconv.Atoi(item.ClientSideId)
-		if err != nil {
-			// Skip invalid indices
-			log.Printf("Invalid item index in webhook payload: %d", itemIdx)
-			continue
+	// The page may submit more than once, only the first submission creates the bill
+	if claimSession.Status == db.ClaimSessionFinalized {
+		writeBillAlreadyProcessed(w)
+		return
+	}
+	if claimSession.Status != db.ClaimSessionOpen {
+		writeWebClaimsError(w, http.StatusGone, "รายการแบ่งบิลนี้ถูกยกเลิกหรือหมดอายุแล้ว")
+		return
+	}
+	if unclaimed := unclaimedWebItems(claimSession); len(unclaimed) > 0 {
+		writeWebClaimsError(w, http.StatusConflict, "ยังมีรายการที่ไม่มีคนรับ: "+strings.Join(unclaimed, ", "))
+		return
+	}
+
+	// Lock the claims, nobody can change them once the bill is being created.
+	// Only one submission can move the session out of open, the others are duplicates.
+	if err := db.CloseClaimSession(claimSession.ID, db.ClaimSessionFinalized); err != nil {
+		if errors.Is(err, db.ErrClaimSessionClosed) {
+			writeBillAlreadyProcessed(w)
+			return
 		}
-		itemAllocations[itemIdx-1] = item.Users
+		log.Printf("Error finalizing claim session %d from webhook: %v", claimSession.ID, err)
+		writeWebClaimsError(w, http.StatusInternalServerError, "ไม่สามารถปิดรายการแบ่งบิลได้")
+		return
+	}
+
+	billData := &ocr.ExtractBillTextResponse{MerchantName: claimSession.MerchantName, Datetime: claimSession.BillDatetime}
+	itemAllocations := make(map[int][]db.ItemClaim)
+	for idx, item := range claimSession.Items {
+		billData.Items = append(billData.Items, ocr.BillItem{Name: item.Name, Price: item.Price, Quantity: item.Quantity})
+		itemAllocations[idx] = claimsOfItem(claimSession.Claims, idx)
 	}
 
 	// Get Discord session from global variable
@@ -505,6 +619,9 @@ func HandleBillWebhookCallback(w http.ResponseWriter, r *http.Request) {
 	} else {
 		http.Error(w, "Discord session not available", http.StatusInternalServerError)
 		log.Printf("Discord session not available for webhook processing")
+		if err := db.ReopenClaimSession(claimSession.ID); err != nil {
+			log.Printf("Error reopening claim session %d: %v", claimSession.ID, err)
+		}
 		return
 	}
 
@@ -515,29 +632,37 @@ func HandleBillWebhookCallback(w http.ResponseWriter, r *http.Request) {
 			Interaction: &discordgo.Interaction{
 				Member: &discordgo.Member{
 					User: &discordgo.User{
-						ID: sessionData.OwnerID,
+						ID: claimSession.OwnerDiscordID,
 					},
 				},
-				ChannelID: sessionData.ChannelID,
+				ChannelID: claimSession.ChannelID,
+				GuildID:   claimSession.GuildID,
 			},
 		}
 
 		// Process the bill allocation
-		successMsg, err := processBillAllocation(discordSession, dummyInteraction, sessionData.BillData, itemAllocations, payload.PromptPayID, payload.AdditionalCharges.AddVat, payload.AdditionalCharges.AddServiceCharge)
+		source := db.BillSource{MessageID: claimSession.SourceMessageID, ChannelID: claimSession.ChannelID, GuildID: claimSession.GuildID}
+		successMsg, err := processBillAllocation(discordSession, dummyInteraction, source, billData, itemAllocations, payload.PromptPayID, payload.AdditionalCharges.AddVat, payload.AdditionalCharges.AddServiceCharge)
 		if err != nil {
 			log.Printf("Error processing bill allocation from webhook: %v", err)
+			// Nothing was saved, let the owner submit again unless the bill already exists
+			if bill, _ := db.GetBillByMessageID(claimSession.SourceMessageID); bill == nil {
+				if err := db.ReopenClaimSession(claimSession.ID); err != nil {
+					log.Printf("Error reopening claim session %d: %v", claimSession.ID, err)
+				}
+			}
 			// Send error message to Discord channel
-			discordSession.ChannelMessageSend(sessionData.ChannelID, fmt.Sprintf("⚠️ เกิดข้อผิดพลาดในการสร้างบิลจากเว็บไซต์: %v", err))
+			discordSession.ChannelMessageSend(claimSession.ChannelID, fmt.Sprintf("⚠️ เกิดข้อผิดพลาดในการสร้างบิลจากเว็บไซต์: %v", err))
 			return
 		}
 
 		// Send success message to Discord channel
-		discordSession.ChannelMessageSend(sessionData.ChannelID, successMsg)
+		discordSession.ChannelMessageSend(claimSession.ChannelID, successMsg)
+		recordBilledReceipt(claimSession.GuildID, claimSession.ChannelID, claimSession.SourceMessageID)
 
 		// Clean up the data
-		delete(billOCRDataStore, strings.Split(payload.Token, "_")[0])
-		delete(tempSelectedUsers, strings.Split(payload.Token, "_")[0])
-		delete(webSessionTokens, payload.Token)
+		deleteBillOCRData(claimSession.SourceMessageID)
+		delete(tempSelectedUsers, claimSession.SourceMessageID)
 
 		// Delete the Firebase site after successful processing
 		go func() {
@@ -591,11 +716,12 @@ func getDiscordSession() *discordgo.Session {
 	return session
 }
 
-// processBillAllocation creates transactions based on the bill allocation
-func processBillAllocation(s *discordgo.Session, i *discordgo.InteractionCreate, billData *ocr.ExtractBillTextResponse,
-	itemAllocations map[int][]string, promptPayID string, addVat bool, addServiceCharge bool) (string, error) {
+// processBillAllocation creates the bill of an allocation, linked to the message the receipt was posted in.
+// Each item's claims take units at the per-unit price, sharers split the units nobody took individually.
+func processBillAllocation(s *discordgo.Session, i *discordgo.InteractionCreate, source db.BillSource, billData *ocr.ExtractBillTextResponse,
+	itemAllocations map[int][]db.ItemClaim, promptPayID string, addVat bool, addServiceCharge bool) (string, error) {
 
-	payeeDiscordID := i.Member.User.ID
+	payeeDiscordID := interactionUserID(i)
 	payeeDbID, err := db.GetOrCreateUser(payeeDiscordID)
 	if err != nil {
 		return "", fmt.Errorf("ไม่สามารถดึงข้อมูลผู้ใช้ได้: %v", err)
@@ -616,13 +742,9 @@ func processBillAllocation(s *discordgo.Session, i *discordgo.InteractionCreate,
 
 	// Find all unique users in the allocations
 	allUsers := make(map[string]bool)
-	for _, users := range itemAllocations {
-		if len(users) == 1 && users[0] == "all" {
-			// Handle "all" special case later
-			continue
-		}
-		for _, userID := range users {
-			allUsers[userID] = true
+	for _, claims := range itemAllocations {
+		for _, claim := range claims {
+			allUsers[claim.DiscordID] = true
 		}
 	}
 
@@ -631,12 +753,6 @@ func processBillAllocation(s *discordgo.Session, i *discordgo.InteractionCreate,
 		return "", fmt.Errorf("ไม่มีผู้ใช้ถูกระบุในรายการใดๆ")
 	}
 
-	// Convert map of users to slice
-	var allUsersList []string
-	for userID := range allUsers {
-		allUsersList = append(allUsersList, userID)
-	}
-
 	// Process each bill item and create transactions
 	userTotalDebts := make(map[string]float64) // payerDiscordID -> totalOwed
 	userTxIDs := make(map[string][]int)        // payerDiscordID -> list of TxIDs for this bill
@@ -650,44 +766,50 @@ func processBillAllocation(s *discordgo.Session, i *discordgo.InteractionCreate,
 	// Process bill items - รวบรวมยอดเงินที่แต่ละคนต้องจ่ายโดยไม่บันทึกเป็นรายการย่อย
 	for idx, item := range billData.Items {
 		// Skip items that are not allocated to anyone
-		users, allocated := itemAllocations[idx]
-		if !allocated || len(users) == 0 {
+		claims := itemAllocations[idx]
+		if len(claims) == 0 {
 			continue
 		}
 
+		claimItem := db.ClaimItem{Name: item.Name, Price: item.Price, Quantity: max(item.Quantity, 1)}
+		if err := validateItemClaims(claimItem, claims); err != nil {
+			return "", err
+		}
+
 		itemTotal := item.Price // ใช้ราคาโดยตรงจาก OCR โดยไม่ต้องคูณจำนวน เพราะเป็นยอดรวมแล้ว
 		totalBillAmount += itemTotal
+		amounts, rest := splitClaimedItem(claimItem, claims)
 
-		// Handle "all" special case
-		if len(users) == 1 && users[0] == "all" {
-			users = allUsersList
+		// Format the item summary
+		description := fmt.Sprintf("%s (x%d) จาก %s", item.Name, claimItem.Quantity, billData.MerchantName)
+		billItemsSummary.WriteString(fmt.Sprintf("- `%.2f` สำหรับ **%s**", itemTotal, description))
+		if claimItem.Quantity > 1 {
+			billItemsSummary.WriteString(fmt.Sprintf(" (ชิ้นละ %.2f)", itemTotal/float64(claimItem.Quantity)))
 		}
-
-		// Calculate amount per person
-		amountPerPerson := itemTotal / float64(len(users))
-		if amountPerPerson < 0.01 {
-			// Skip very small amounts to avoid dust
-			continue
+		billItemsSummary.WriteString(": ")
+		var parts []string
+		for _, claim := range claims {
+			if claim.Units == 0 {
+				parts = append(parts, fmt.Sprintf("<@%s> แบ่ง `%.2f`", claim.DiscordID, amounts[claim.DiscordID]))
+			} else {
+				parts = append(parts, fmt.Sprintf("<@%s> x%d `%.2f`", claim.DiscordID, claim.Units, float64(claim.Units)*itemTotal/float64(claimItem.Quantity)))
+			}
 		}
-
-		// Format the item summary
-		description := fmt.Sprintf("%s (x%d) จาก %s", item.Name, item.Quantity, billData.MerchantName)
-		billItemsSummary.WriteString(fmt.Sprintf("- `%.2f` สำหรับ **%s**, หารกับ: ", itemTotal, description))
-		for _, uid := range users {
-			billItemsSummary.WriteString(fmt.Sprintf("<@%s> ", uid))
+		billItemsSummary.WriteString(strings.Join(parts, ", "))
+		if rest > 0.009 {
+			billItemsSummary.WriteString(fmt.Sprintf(" · ส่วนที่ไม่มีคนรับ `%.2f` เป็นของ <@%s>", rest, payeeDiscordID))
 		}
 		billItemsSummary.WriteString("\n")
 
 		// บันทึกจำนวนเงินที่แต่ละคนต้องจ่ายลงในแผนที่ (map) แทนที่จะบันทึกลงฐานข้อมูลเลย
-		for _, payerDiscordID := range users {
+		for payerDiscordID, amount := range amounts {
 			// ข้ามการบันทึกรายการถ้าเจ้าของบิล (ผู้ออกเงินไปก่อน) เป็นคนเดียวกับผู้จ่าย
-			if payerDiscordID == payeeDiscordID {
-				//log.Printf("Skipping transaction for bill owner (self-payment) for item '%s'", description)
+			if payerDiscordID == payeeDiscordID || amount < 0.01 {
 				continue
 			}
 
 			// เพิ่มจำนวนเงินที่ต้องจ่ายเข้าไปในยอดรวม
-			userTotalDebts[payerDiscordID] += amountPerPerson
+			userTotalDebts[payerDiscordID] += amount
 		}
 	}
 
@@ -741,7 +863,14 @@ func processBillAllocation(s *discordgo.Session, i *discordgo.InteractionCreate,
 		}
 	}
 
+	// Under the guild's consent policy the participants accept their debts before they count
+	consentTimeout := billConsentTimeout(i.GuildID)
+	dueDate := defaultDueDate(i.GuildID)
+	pendingTxIDs := make(map[string][]int) // payerDiscordID -> TxIDs waiting for their consent
+
 	// บันทึกธุรกรรมเพียงครั้งเดียวต่อผู้ใช้ โดยรวมเป็นยอดรวมของบิล
+	var entries []db.BillEntry
+	var entryPayers []string // payerDiscordID of each entry
 	for payerDiscordID, totalAmount := range userTotalDebts {
 		// ข้ามถ้าจำนวนเงินน้อยเกินไป
 		if totalAmount < 0.01 {
@@ -766,20 +895,61 @@ func processBillAllocation(s *discordgo.Session, i *discordgo.InteractionCreate,
 			}
 		}
 
-		txID, txErr := db.CreateTransaction(payerDbID, payeeDbID, totalAmount, description)
-		if txErr != nil {
-			log.Printf("Failed to save transaction for user %s: %v", payerDiscordID, txErr)
-			continue
+		entries = append(entries, db.BillEntry{
+			DebtorID:    payerDbID,
+			Amount:      totalAmount,
+			Description: description,
+			Pending:     consentTimeout > 0 && payerDiscordID != payeeDiscordID, // user_debts is updated once the payer accepts
+			DueDate:     entryDueDate(dueDate),
+		})
+		entryPayers = append(entryPayers, payerDiscordID)
+	}
+
+	// Every share is written at once and linked to the receipt message, whose images !receipt retrieves
+	txIDs, err := db.CreateBill(source, payeeDbID, entries)
+	if errors.Is(err, db.ErrDuplicateSource) {
+		return "", fmt.Errorf("บิลจากใบเสร็จนี้ถูกบันทึกไปแล้ว")
+	}
+	if err != nil {
+		return "", fmt.Errorf("ไม่สามารถบันทึกบิลได้ ไม่มีรายการใดถูกบันทึก: %v", err)
+	}
+	for idx, payerDiscordID := range entryPayers {
+		if entries[idx].Pending {
+			pendingTxIDs[payerDiscordID] = []int{txIDs[idx]}
+		} else {
+			userTxIDs[payerDiscordID] = []int{txIDs[idx]}
 		}
+	}
+	receiptHint := billReceiptHint(source.MessageID)
 
-		userTxIDs[payerDiscordID] = []int{txID}
+	var billTxIDs []int
+	for _, txIDs := range userTxIDs {
+		billTxIDs = append(billTxIDs, txIDs...)
+	}
 
-		// อัปเดตตาราง user_debts
-		debtErr := db.UpdateUserDebt(payerDbID, payeeDbID, totalAmount)
-		if debtErr != nil {
-			log.Printf("Failed to update debt for user %s: %v", payerDiscordID, debtErr)
-			// Continue anyway as transaction was saved
+	// Pending debts get their trip and QR code once accepted
+	if len(pendingTxIDs) > 0 {
+		if hasAdditionalCharges {
+			billItemsSummary.WriteString("\n" + additionalChargesSummary.String())
 		}
+		billItemsSummary.WriteString(fmt.Sprintf("\n**ยอดรวมทั้งสิ้น: %.2f บาท**\n", finalTotalAmount))
+		requestBillConsent(s, i.ChannelID, i.GuildID, payeeDiscordID, promptPayID, pendingTxIDs, billItemsSummary.String(), consentTimeout)
+		return "✅ บิลถูกสร้างเรียบร้อยแล้ว! รอผู้ที่ถูกระบุกดยอมรับรายการของตน" + receiptHint, nil
+	}
+
+	// Expenses of an open trip are settled when the trip closes instead
+	if tripLine, inTrip := addBillToTrip(i.ChannelID, billTxIDs); inTrip {
+		billItemsSummary.WriteString(fmt.Sprintf("\n**ยอดรวมทั้งสิ้น: %.2f บาท**\n%s", finalTotalAmount, tripLine))
+		s.ChannelMessageSend(i.ChannelID, billItemsSummary.String())
+		if hasAdditionalCharges {
+			s.ChannelMessageSend(i.ChannelID, additionalChargesSummary.String())
+		}
+		return "✅ บิลถูกบันทึกเข้าทริปเรียบร้อยแล้ว! รายละเอียดได้ถูกส่งไปในช่องสนทนา" + receiptHint, nil
+	}
+
+	// All of the bill's transactions share the server's default due date
+	if line := dueDateLine(dueDate); line != "" {
+		billItemsSummary.WriteString(line + "\n")
 	}
 
 	// Send bill summary to channel
@@ -802,15 +972,16 @@ func processBillAllocation(s *discordgo.Session, i *discordgo.InteractionCreate,
 		s.ChannelMessageSend(i.ChannelID, qrSummary.String())
 
 		for payerDiscordID, totalOwed := range userTotalDebts {
+			// Settle what we can from credit and mutual debts before asking for money
+			totalOwed, relevantTxIDs := prepareBillPayment(s, i.ChannelID, payerDiscordID, payeeDiscordID, totalOwed, userTxIDs[payerDiscordID])
 			if promptPayID != "" && totalOwed > 0.009 { // Only send QR if ID provided and amount is significant
-				relevantTxIDs := userTxIDs[payerDiscordID]
 				GenerateAndSendQrCode(s, i.ChannelID, promptPayID, totalOwed, payerDiscordID,
 					fmt.Sprintf("ยอดรวมจากบิล %s โดย <@%s>", billData.MerchantName, payeeDiscordID), relevantTxIDs)
 			}
 		}
 	}
 
-	return "✅ บิลถูกสร้างเรียบร้อยแล้ว! รายละเอียดและ QR Code ได้ถูกส่งไปในช่องสนทนา", nil
+	return "✅ บิลถูกสร้างเรียบร้อยแล้ว! รายละเอียดและ QR Code ได้ถูกส่งไปในช่องสนทนา" + receiptHint, nil
 }
 
 // downloadFile is a helper function to download files from URLs
@@ -0,0 +1,554 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/oatsaysai/billing-in-discord/internal/db"
+	"github.com/oatsaysai/billing-in-discord/pkg/ocr"
+)
+
+// ocrAmountTolerance absorbs rounding on receipts when comparing their amounts
+const ocrAmountTolerance = 0.05
+
+// ocrBillIssues checks a receipt's arithmetic. It returns the discrepancies of the whole bill
+// and, per item index, what looks wrong with that item.
+func ocrBillIssues(bill *ocr.ExtractBillTextResponse) ([]string, map[int]string) {
+	var issues []string
+	itemIssues := make(map[int]string)
+
+	if len(bill.Items) == 0 {
+		issues = append(issues, "ไม่พบรายการในบิล")
+	}
+	itemsTotal := 0.0
+	for idx, item := range bill.Items {
+		itemsTotal += item.Price
+		switch {
+		case item.Price <= 0:
+			itemIssues[idx] = "ราคาเป็น 0 หรือติดลบ"
+		case item.Quantity < 1:
+			itemIssues[idx] = "ไม่พบจำนวน"
+		}
+	}
+
+	if bill.SubTotal > 0 && math.Abs(itemsTotal-bill.SubTotal) > ocrAmountTolerance {
+		issues = append(issues, fmt.Sprintf("ผลรวมรายการ %.2f บาท ไม่ตรงกับ Subtotal %.2f บาท (ต่างกัน %.2f บาท)",
+			itemsTotal, bill.SubTotal, itemsTotal-bill.SubTotal))
+	}
+
+	if bill.Total > 0 {
+		base := itemsTotal
+		if bill.SubTotal > 0 {
+			base = bill.SubTotal
+		}
+		withCharges := base + bill.VAT + bill.ServiceCharge
+		vatIncluded := base + bill.ServiceCharge // Prices on many Thai receipts already include VAT
+		if math.Abs(withCharges-bill.Total) > ocrAmountTolerance && math.Abs(vatIncluded-bill.Total) > ocrAmountTolerance {
+			issues = append(issues, fmt.Sprintf("Subtotal + VAT + Service Charge = %.2f บาท ไม่ตรงกับยอดรวม %.2f บาท (ต่างกัน %.2f บาท)",
+				withCharges, bill.Total, withCharges-bill.Total))
+		}
+	}
+	return issues, itemIssues
+}
+
+// ocrBillSummary renders the bill for its owner to check, highlighting discrepancies and corrections.
+// A bill merged from several receipts lists the items of each receipt under its own header.
+func ocrBillSummary(bill *ocr.ExtractBillTextResponse, record *ocrBillRecord) string {
+	issues, itemIssues := ocrBillIssues(bill)
+	var raw *ocr.ExtractBillTextResponse
+	var receipts []ocrReceipt
+	if record != nil {
+		raw, receipts = record.Raw, record.Receipts
+	}
+
+	var summary strings.Builder
+	summary.WriteString("**ผลการวิเคราะห์บิลด้วย OCR**\n")
+	summary.WriteString(fmt.Sprintf("📇 **ร้าน**: %s\n", bill.MerchantName))
+	summary.WriteString(fmt.Sprintf("📅 **วันที่เวลา**: %s\n", bill.Datetime))
+	summary.WriteString(fmt.Sprintf("💰 **ยอดรวม**: %.2f บาท\n", bill.Total))
+	if len(receipts) == 1 && receipts[0].Images > 1 {
+		summary.WriteString(fmt.Sprintf("📷 รวมจากรูปถ่าย %d รูปของใบเสร็จเดียวกัน\n", receipts[0].Images))
+	}
+	if record != nil && record.DuplicatesRemoved > 0 {
+		summary.WriteString(fmt.Sprintf("🔁 ตัดรายการที่ซ้ำกันในรูปที่ถ่ายซ้อนกันออก %d รายการ\n", record.DuplicatesRemoved))
+	}
+	summary.WriteString("\n")
+
+	writeItem := func(i int, item ocr.BillItem) {
+		summary.WriteString(fmt.Sprintf("%d. %s (จำนวน %d): %.2f บาท", i+1, item.Name, item.Quantity, item.Price))
+		if issue, ok := itemIssues[i]; ok {
+			summary.WriteString(fmt.Sprintf(" ⚠️ **%s**", issue))
+		}
+		summary.WriteString("\n")
+	}
+
+	summary.WriteString("**รายการ**:\n")
+	if len(receipts) > 1 {
+		// Items keep their bill-wide numbers, the correction menus refer to them
+		for r, receipt := range receipts {
+			header := fmt.Sprintf("🧾 **ใบที่ %d: %s**", r+1, receipt.MerchantName)
+			if receipt.Datetime != "" {
+				header += fmt.Sprintf(" (%s)", receipt.Datetime)
+			}
+			if receipt.Total > 0 {
+				header += fmt.Sprintf(" ยอด %.2f บาท", receipt.Total)
+			}
+			if receipt.Images > 1 {
+				header += fmt.Sprintf(" · รวมจาก %d รูป", receipt.Images)
+			}
+			summary.WriteString(header + "\n")
+			for i, item := range bill.Items {
+				// Items added by hand belong to no photo and are listed with the first receipt
+				if item.Receipt == r || (r == 0 && (item.Receipt < 0 || item.Receipt >= len(receipts))) {
+					writeItem(i, item)
+				}
+			}
+		}
+	} else {
+		for i, item := range bill.Items {
+			writeItem(i, item)
+		}
+	}
+
+	if bill.SubTotal > 0 {
+		summary.WriteString(fmt.Sprintf("\nSubtotal: %.2f บาท\n", bill.SubTotal))
+	}
+	if bill.VAT > 0 {
+		summary.WriteString(fmt.Sprintf("VAT: %.2f บาท\n", bill.VAT))
+	}
+	if bill.ServiceCharge > 0 {
+		summary.WriteString(fmt.Sprintf("Service Charge: %.2f บาท\n", bill.ServiceCharge))
+	}
+
+	if len(issues) > 0 || len(itemIssues) > 0 {
+		summary.WriteString("\n⚠️ **ตรวจพบยอดที่ไม่ตรงกัน** OCR อาจอ่านบางบรรทัดผิด:\n")
+		for _, issue := range issues {
+			summary.WriteString(fmt.Sprintf("- %s\n", issue))
+		}
+		if len(itemIssues) > 0 {
+			summary.WriteString(fmt.Sprintf("- มี %d รายการที่ข้อมูลไม่ครบหรือไม่ถูกต้อง\n", len(itemIssues)))
+		}
+		summary.WriteString("โปรดแก้ไขรายการด้วยเมนูด้านล่างก่อนแบ่งบิล\n")
+	} else {
+		summary.WriteString("\n✅ ยอดรายการตรงกับยอดรวมในบิล\n")
+	}
+
+	if raw != nil && !reflect.DeepEqual(bill, raw) {
+		rawTotal, total := 0.0, 0.0
+		for _, item := range raw.Items {
+			rawTotal += item.Price
+		}
+		for _, item := range bill.Items {
+			total += item.Price
+		}
+		summary.WriteString(fmt.Sprintf("✏️ แก้ไขจากผล OCR แล้ว (ผล OCR เดิม: %d รายการ รวม %.2f บาท → %d รายการ รวม %.2f บาท)\n",
+			len(raw.Items), rawTotal, len(bill.Items), total))
+	}
+
+	summary.WriteString("\nคลิกปุ่มด้านล่างเพื่อระบุรายการที่แต่ละคนต้องจ่าย หรือให้แต่ละคนเลือกรายการของตัวเองใน Discord")
+	return summary.String()
+}
+
+// ocrBillComponents builds the allocation buttons and the correction menus of an OCR result.
+// The menus show one page of items, receipts with more items than a menu holds are paged through.
+// Only the uploader can use them.
+func ocrBillComponents(ownerID, messageID string, bill *ocr.ExtractBillTextResponse, page int) []discordgo.MessageComponent {
+	owner := []string{ownerID}
+	payload := billPayload{MessageID: messageID}
+	components := []discordgo.MessageComponent{
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.Button{
+					Label:    "ระบุรายการของแต่ละคน",
+					Style:    discordgo.PrimaryButton,
+					CustomID: newComponentID(billAllocateButtonPrefix, ownerID, owner, payload, false, interactionStateTTL),
+				},
+				discordgo.Button{
+					Label:    "ให้แต่ละคนเลือกเองใน Discord",
+					Style:    discordgo.SecondaryButton,
+					CustomID: newComponentID(billClaimStartPrefix, ownerID, owner, payload, false, interactionStateTTL),
+				},
+			},
+		},
+	}
+
+	// Select menus hold at most 25 options, so the items are corrected a page at a time
+	pages := (len(bill.Items) + claimItemsPerSelect - 1) / claimItemsPerSelect
+	page = max(min(page, pages-1), 0)
+	start := page * claimItemsPerSelect
+	end := min(start+claimItemsPerSelect, len(bill.Items))
+	pageLabel := ""
+	if pages > 1 {
+		pageLabel = fmt.Sprintf(" (รายการที่ %d-%d จาก %d)", start+1, end, len(bill.Items))
+	}
+	pagePayload := billPayload{MessageID: messageID, Page: page}
+
+	var options []discordgo.SelectMenuOption
+	for idx := start; idx < end; idx++ {
+		item := bill.Items[idx]
+		options = append(options, discordgo.SelectMenuOption{
+			Label:       truncateText(fmt.Sprintf("%d. %s (x%d)", idx+1, item.Name, item.Quantity), 100),
+			Value:       strconv.Itoa(idx),
+			Description: fmt.Sprintf("%.2f บาท", item.Price),
+		})
+	}
+	if len(options) > 0 {
+		components = append(components,
+			discordgo.ActionsRow{
+				Components: []discordgo.MessageComponent{
+					discordgo.SelectMenu{
+						CustomID:    newComponentID(ocrItemEditSelectPrefix, ownerID, owner, pagePayload, false, interactionStateTTL),
+						Placeholder: "✏️ แก้ไขรายการที่ OCR อ่านผิด" + pageLabel,
+						Options:     options,
+					},
+				},
+			},
+			discordgo.ActionsRow{
+				Components: []discordgo.MessageComponent{
+					discordgo.SelectMenu{
+						CustomID:    newComponentID(ocrItemRemoveSelectPrefix, ownerID, owner, pagePayload, false, interactionStateTTL),
+						Placeholder: "🗑️ ลบรายการที่ไม่ใช่สินค้า" + pageLabel,
+						MaxValues:   len(options),
+						Options:     options,
+					},
+				},
+			},
+		)
+	}
+
+	stateID := newComponentState([]string{ocrItemAddButtonPrefix, ocrTotalsEditButtonPrefix}, ownerID, owner, pagePayload, false, interactionStateTTL)
+	buttons := []discordgo.MessageComponent{
+		discordgo.Button{
+			Label:    "เพิ่มรายการ",
+			Style:    discordgo.SecondaryButton,
+			CustomID: ocrItemAddButtonPrefix + stateID,
+		},
+		discordgo.Button{
+			Label:    "แก้ไขยอดรวม",
+			Style:    discordgo.SecondaryButton,
+			CustomID: ocrTotalsEditButtonPrefix + stateID,
+		},
+	}
+	if page > 0 {
+		buttons = append(buttons, discordgo.Button{
+			Label:    "◀ รายการก่อนหน้า",
+			Style:    discordgo.SecondaryButton,
+			CustomID: newComponentID(ocrItemsPageButtonPrefix, ownerID, owner, billPayload{MessageID: messageID, Page: page - 1}, false, interactionStateTTL),
+		})
+	}
+	if page < pages-1 {
+		buttons = append(buttons, discordgo.Button{
+			Label:    "รายการถัดไป ▶",
+			Style:    discordgo.SecondaryButton,
+			CustomID: newComponentID(ocrItemsPageButtonPrefix, ownerID, owner, billPayload{MessageID: messageID, Page: page + 1}, false, interactionStateTTL),
+		})
+	}
+	components = append(components, discordgo.ActionsRow{Components: buttons})
+	return components
+}
+
+// refreshOCRBillMessage re-renders the OCR result the interaction came from after a correction,
+// showing the given page of items in the correction menus
+func refreshOCRBillMessage(s *discordgo.Session, i *discordgo.InteractionCreate, messageID string, bill *ocr.ExtractBillTextResponse, page int) {
+	components := ocrBillComponents(interactionUserID(i), messageID, bill, page)
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Content:    ocrBillSummary(bill, getBillOCRRecord(messageID)),
+			Components: components,
+		},
+	})
+	if err != nil {
+		log.Printf("Error updating OCR result of message %s: %v", messageID, err)
+	}
+}
+
+// modalTextValues returns the text inputs of a submitted modal by custom ID
+func modalTextValues(i *discordgo.InteractionCreate) map[string]string {
+	values := make(map[string]string)
+	for _, component := range i.ModalSubmitData().Components {
+		row, ok := component.(*discordgo.ActionsRow)
+		if !ok {
+			continue
+		}
+		for _, c := range row.Components {
+			if input, ok := c.(*discordgo.TextInput); ok {
+				values[input.CustomID] = strings.TrimSpace(input.Value)
+			}
+		}
+	}
+	return values
+}
+
+// parseModalAmount parses an amount typed into a modal, empty means zero
+func parseModalAmount(value string) (float64, error) {
+	value = strings.TrimSpace(strings.ReplaceAll(value, ",", ""))
+	if value == "" {
+		return 0, nil
+	}
+	amount, err := strconv.ParseFloat(value, 64)
+	if err != nil || amount < 0 || math.IsNaN(amount) || math.IsInf(amount, 0) {
+		return 0, fmt.Errorf("จำนวนเงิน %q ไม่ถูกต้อง", value)
+	}
+	return math.Round(amount*100) / 100, nil
+}
+
+// ocrItemModal builds the modal for editing or adding a receipt item
+func ocrItemModal(customID, title string, item ocr.BillItem) *discordgo.InteractionResponse {
+	quantity, price := "1", ""
+	if item.Quantity > 0 {
+		quantity = strconv.Itoa(item.Quantity)
+	}
+	if item.Price > 0 {
+		price = fmt.Sprintf("%.2f", item.Price)
+	}
+	return &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseModal,
+		Data: &discordgo.InteractionResponseData{
+			CustomID: customID,
+			Title:    title,
+			Components: []discordgo.MessageComponent{
+				discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+					discordgo.TextInput{CustomID: "item_name", Label: "ชื่อรายการ", Style: discordgo.TextInputShort, Value: item.Name, Required: true, MaxLength: 100},
+				}},
+				discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+					discordgo.TextInput{CustomID: "item_quantity", Label: "จำนวน", Style: discordgo.TextInputShort, Value: quantity, Required: true, MaxLength: 4},
+				}},
+				discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+					discordgo.TextInput{CustomID: "item_price", Label: "ราคารวมของบรรทัดนี้ (บาท)", Style: discordgo.TextInputShort, Value: price, Placeholder: "เช่น 135.00", Required: true, MaxLength: 12},
+				}},
+			},
+		},
+	}
+}
+
+// parseOCRItemModal reads the item entered in the item modal
+func parseOCRItemModal(i *discordgo.InteractionCreate) (ocr.BillItem, error) {
+	values := modalTextValues(i)
+	if values["item_name"] == "" {
+		return ocr.BillItem{}, fmt.Errorf("กรุณาระบุชื่อรายการ")
+	}
+	quantity, err := strconv.Atoi(values["item_quantity"])
+	if err != nil || quantity < 1 {
+		return ocr.BillItem{}, fmt.Errorf("จำนวนต้องเป็นจำนวนเต็มตั้งแต่ 1 ขึ้นไป")
+	}
+	price, err := parseModalAmount(values["item_price"])
+	if err != nil {
+		return ocr.BillItem{}, err
+	}
+	if price <= 0 {
+		return ocr.BillItem{}, fmt.Errorf("ราคาต้องมากกว่า 0")
+	}
+	return ocr.BillItem{Name: values["item_name"], Quantity: quantity, Price: price}, nil
+}
+
+// handleOCRItemEditSelect opens the edit modal for the selected item
+func handleOCRItemEditSelect(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	var payload billPayload
+	if !decodeComponentPayload(s, i, state, &payload) {
+		return
+	}
+	values := i.MessageComponentData().Values
+	if len(values) == 0 {
+		return
+	}
+	itemIndex, err := strconv.Atoi(values[0])
+	bill := getBillOCRData(payload.MessageID)
+	if bill == nil {
+		respondWithError(s, i, "ไม่พบข้อมูลบิล หรือข้อมูลหมดอายุแล้ว")
+		return
+	}
+	if err != nil || itemIndex < 0 || itemIndex >= len(bill.Items) {
+		respondWithError(s, i, "ไม่พบรายการที่เลือก")
+		return
+	}
+
+	userID := interactionUserID(i)
+	customID := newComponentID(ocrItemEditModalPrefix, userID, []string{userID},
+		billPayload{MessageID: payload.MessageID, ItemIndex: itemIndex, Page: payload.Page}, false, interactionStateTTL)
+	if err := s.InteractionRespond(i.Interaction, ocrItemModal(customID, fmt.Sprintf("แก้ไขรายการที่ %d", itemIndex+1), bill.Items[itemIndex])); err != nil {
+		log.Printf("Error opening OCR item edit modal: %v", err)
+	}
+}
+
+// handleOCRItemEditModalSubmit replaces an item with the owner's correction
+func handleOCRItemEditModalSubmit(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	var payload billPayload
+	if !decodeComponentPayload(s, i, state, &payload) {
+		return
+	}
+	item, err := parseOCRItemModal(i)
+	if err != nil {
+		respondWithError(s, i, err.Error())
+		return
+	}
+
+	bill, err := updateBillOCRData(payload.MessageID, func(bill *ocr.ExtractBillTextResponse) error {
+		if payload.ItemIndex < 0 || payload.ItemIndex >= len(bill.Items) {
+			return fmt.Errorf("ไม่พบรายการที่เลือก")
+		}
+		bill.Items[payload.ItemIndex] = item
+		return nil
+	})
+	if err != nil {
+		respondWithError(s, i, err.Error())
+		return
+	}
+	refreshOCRBillMessage(s, i, payload.MessageID, bill, payload.Page)
+}
+
+// handleOCRItemRemoveSelect removes the selected items, e.g. discount or payment lines the OCR read as items
+func handleOCRItemRemoveSelect(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	var payload billPayload
+	if !decodeComponentPayload(s, i, state, &payload) {
+		return
+	}
+	remove := make(map[int]bool)
+	for _, value := range i.MessageComponentData().Values {
+		if idx, err := strconv.Atoi(value); err == nil {
+			remove[idx] = true
+		}
+	}
+	if len(remove) == 0 {
+		return
+	}
+
+	bill, err := updateBillOCRData(payload.MessageID, func(bill *ocr.ExtractBillTextResponse) error {
+		var kept []ocr.BillItem
+		for idx, item := range bill.Items {
+			if !remove[idx] {
+				kept = append(kept, item)
+			}
+		}
+		bill.Items = kept
+		return nil
+	})
+	if err != nil {
+		respondWithError(s, i, err.Error())
+		return
+	}
+	refreshOCRBillMessage(s, i, payload.MessageID, bill, payload.Page)
+}
+
+// handleOCRItemAddButton opens the modal for an item the OCR missed
+func handleOCRItemAddButton(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	var payload billPayload
+	if !decodeComponentPayload(s, i, state, &payload) {
+		return
+	}
+	userID := interactionUserID(i)
+	customID := newComponentID(ocrItemAddModalPrefix, userID, []string{userID}, billPayload{MessageID: payload.MessageID, Page: payload.Page}, false, interactionStateTTL)
+	if err := s.InteractionRespond(i.Interaction, ocrItemModal(customID, "เพิ่มรายการ", ocr.BillItem{})); err != nil {
+		log.Printf("Error opening OCR item add modal: %v", err)
+	}
+}
+
+// handleOCRItemAddModalSubmit appends the item entered by the owner
+func handleOCRItemAddModalSubmit(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	var payload billPayload
+	if !decodeComponentPayload(s, i, state, &payload) {
+		return
+	}
+	item, err := parseOCRItemModal(i)
+	if err != nil {
+		respondWithError(s, i, err.Error())
+		return
+	}
+
+	bill, err := updateBillOCRData(payload.MessageID, func(bill *ocr.ExtractBillTextResponse) error {
+		bill.Items = append(bill.Items, item)
+		return nil
+	})
+	if err != nil {
+		respondWithError(s, i, err.Error())
+		return
+	}
+	refreshOCRBillMessage(s, i, payload.MessageID, bill, (len(bill.Items)-1)/claimItemsPerSelect) // Show the page with the new item
+}
+
+// handleOCRItemsPageButton shows another page of items in the correction menus
+func handleOCRItemsPageButton(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	var payload billPayload
+	if !decodeComponentPayload(s, i, state, &payload) {
+		return
+	}
+	bill := getBillOCRData(payload.MessageID)
+	if bill == nil {
+		respondWithError(s, i, "ไม่พบข้อมูลบิล หรือข้อมูลหมดอายุแล้ว")
+		return
+	}
+	refreshOCRBillMessage(s, i, payload.MessageID, bill, payload.Page)
+}
+
+// handleOCRTotalsEditButton opens the modal for correcting the receipt's totals
+func handleOCRTotalsEditButton(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	var payload billPayload
+	if !decodeComponentPayload(s, i, state, &payload) {
+		return
+	}
+	bill := getBillOCRData(payload.MessageID)
+	if bill == nil {
+		respondWithError(s, i, "ไม่พบข้อมูลบิล หรือข้อมูลหมดอายุแล้ว")
+		return
+	}
+
+	userID := interactionUserID(i)
+	amountInput := func(customID, label string, value float64) discordgo.ActionsRow {
+		return discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+			discordgo.TextInput{CustomID: customID, Label: label, Style: discordgo.TextInputShort,
+				Value: fmt.Sprintf("%.2f", value), Required: false, MaxLength: 12},
+		}}
+	}
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseModal,
+		Data: &discordgo.InteractionResponseData{
+			CustomID: newComponentID(ocrTotalsEditModalPrefix, userID, []string{userID}, billPayload{MessageID: payload.MessageID, Page: payload.Page}, false, interactionStateTTL),
+			Title:    "แก้ไขยอดรวมของบิล",
+			Components: []discordgo.MessageComponent{
+				amountInput("sub_total", "Subtotal (บาท)", bill.SubTotal),
+				amountInput("vat", "VAT (บาท)", bill.VAT),
+				amountInput("service_charge", "Service Charge (บาท)", bill.ServiceCharge),
+				amountInput("total", "ยอดรวม (บาท)", bill.Total),
+			},
+		},
+	})
+	if err != nil {
+		log.Printf("Error opening OCR totals modal: %v", err)
+	}
+}
+
+// handleOCRTotalsEditModalSubmit applies the owner's corrected totals
+func handleOCRTotalsEditModalSubmit(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	var payload billPayload
+	if !decodeComponentPayload(s, i, state, &payload) {
+		return
+	}
+	values := modalTextValues(i)
+	amounts := make(map[string]float64)
+	for _, field := range []string{"sub_total", "vat", "service_charge", "total"} {
+		amount, err := parseModalAmount(values[field])
+		if err != nil {
+			respondWithError(s, i, err.Error())
+			return
+		}
+		amounts[field] = amount
+	}
+
+	bill, err := updateBillOCRData(payload.MessageID, func(bill *ocr.ExtractBillTextResponse) error {
+		bill.SubTotal = amounts["sub_total"]
+		bill.VAT = amounts["vat"]
+		bill.ServiceCharge = amounts["service_charge"]
+		bill.Total = amounts["total"]
+		return nil
+	})
+	if err != nil {
+		respondWithError(s, i, err.Error())
+		return
+	}
+	refreshOCRBillMessage(s, i, payload.MessageID, bill, payload.Page)
+}
@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/oatsaysai/billing-in-discord/internal/db"
+	"github.com/oatsaysai/billing-in-discord/pkg/ocr"
+)
+
+// ocrReceipt is the header of one receipt of a bill, a bill can merge several receipts
+type ocrReceipt struct {
+	MerchantName string
+	Datetime     string
+	Total        float64
+	Images       int // How many photos of the receipt were merged
+}
+
+// ocrImageResult is the OCR output of one attached image
+type ocrImageResult struct {
+	Attachment *discordgo.MessageAttachment
+	Bill       *ocr.ExtractBillTextResponse
+	Cached     bool   // The result of an identical image was reused
+	Hash       string // Content hash of the image, empty if it couldn't be hashed
+	Err        error
+}
+
+// extractBillImages downloads and OCRs every attached image in parallel, keeping the attachment order.
+// Images read before are answered from the OCR cache.
+func extractBillImages(m *discordgo.MessageCreate, attachments []*discordgo.MessageAttachment) []ocrImageResult {
+	results := make([]ocrImageResult, len(attachments))
+	var wg sync.WaitGroup
+	for idx, attachment := range attachments {
+		wg.Add(1)
+		go func(idx int, attachment *discordgo.MessageAttachment) {
+			defer wg.Done()
+			results[idx] = ocrImageResult{Attachment: attachment}
+
+			tmpFile := fmt.Sprintf("bill_%s_%d_%d.png", m.ID, idx, time.Now().UnixNano())
+			if err := downloadFile(tmpFile, attachment.URL); err != nil {
+				log.Printf("OCRBill: Failed to download bill image %s: %v", attachment.URL, err)
+				results[idx].Err = fmt.Errorf("ไม่สามารถดาวน์โหลดไฟล์รูปภาพบิลได้")
+				return
+			}
+			defer os.Remove(tmpFile) // Clean up temporary file when done
+
+			bill, cached, imageHash, err := extractBillTextCached(tmpFile)
+			results[idx].Cached, results[idx].Hash = cached, imageHash
+			archiveImageFile(db.ArchiveReceipt, tmpFile, imageHash, attachment, m)
+			if err != nil {
+				log.Printf("OCRBill: OCR processing failed for %s: %v", attachment.URL, err)
+				results[idx].Err = fmt.Errorf("การประมวลผล OCR ล้มเหลว: %v", err)
+				return
+			}
+			results[idx].Bill = bill
+		}(idx, attachment)
+	}
+	wg.Wait()
+	return results
+}
+
+// normalizeReceiptText makes OCR'd names comparable across photos
+func normalizeReceiptText(text string) string {
+	return strings.Join(strings.Fields(strings.ToLower(text)), " ")
+}
+
+// sameReceiptItem reports whether two OCR'd lines are the same line of a receipt
+func sameReceiptItem(a, b ocr.BillItem) bool {
+	return normalizeReceiptText(a.Name) == normalizeReceiptText(b.Name) &&
+		math.Abs(a.Price-b.Price) < 0.005 && a.Quantity == b.Quantity
+}
+
+// receiptOverlap returns how many lines at the start of next repeat the lines at the end of prev,
+// as when a long receipt is photographed in overlapping parts
+func receiptOverlap(prev, next []ocr.BillItem) int {
+	longest := len(prev)
+	if len(next) < longest {
+		longest = len(next)
+	}
+	for k := longest; k > 0; k-- {
+		overlaps := true
+		for j := 0; j < k; j++ {
+			if !sameReceiptItem(prev[len(prev)-k+j], next[j]) {
+				overlaps = false
+				break
+			}
+		}
+		if overlaps {
+			return k
+		}
+	}
+	return 0
+}
+
+// continuesReceipt reports whether a photo looks like the next part of the receipt before it.
+// Separate receipts have their own merchant or time; a later part often shows neither.
+func continuesReceipt(prev, next *ocr.ExtractBillTextResponse) bool {
+	prevMerchant, nextMerchant := normalizeReceiptText(prev.MerchantName), normalizeReceiptText(next.MerchantName)
+	if prevMerchant != "" && nextMerchant != "" && prevMerchant != nextMerchant {
+		return false
+	}
+	prevTime, nextTime := strings.TrimSpace(prev.Datetime), strings.TrimSpace(next.Datetime)
+	if prevTime != "" && nextTime != "" && prevTime != nextTime {
+		return false
+	}
+	// Two complete receipts of the same shop at the same time are the same receipt photographed twice
+	return true
+}
+
+// mergeOCRBills merges the OCR output of several photos into one bill. Consecutive photos of the same
+// receipt are joined with their overlapping lines removed, other receipts become sections of the bill.
+// It returns the merged bill, its receipts and how many duplicated lines were removed.
+func mergeOCRBills(bills []*ocr.ExtractBillTextResponse) (*ocr.ExtractBillTextResponse, []ocrReceipt, int) {
+	var receipts []*ocr.ExtractBillTextResponse
+	var images []int
+	duplicates := 0
+	for _, bill := range bills {
+		if len(receipts) > 0 && continuesReceipt(receipts[len(receipts)-1], bill) {
+			current := receipts[len(receipts)-1]
+			overlap := receiptOverlap(current.Items, bill.Items)
+			duplicates += overlap
+			current.Items = append(current.Items, bill.Items[overlap:]...)
+			if current.MerchantName == "" {
+				current.MerchantName = bill.MerchantName
+			}
+			if current.Datetime == "" {
+				current.Datetime = bill.Datetime
+			}
+			// The totals are printed at the bottom, so the later photo has them
+			if bill.SubTotal > 0 {
+				current.SubTotal = bill.SubTotal
+			}
+			if bill.VAT > 0 {
+				current.VAT = bill.VAT
+			}
+			if bill.ServiceCharge > 0 {
+				current.ServiceCharge = bill.ServiceCharge
+			}
+			if bill.Total > 0 {
+				current.Total = bill.Total
+			}
+			images[len(images)-1]++
+			continue
+		}
+		receipts = append(receipts, copyOCRBill(bill))
+		images = append(images, 1)
+	}
+
+	merged := &ocr.ExtractBillTextResponse{}
+	var headers []ocrReceipt
+	var merchants []string
+	subTotalKnown, totalKnown := true, true
+	for idx, receipt := range receipts {
+		headers = append(headers, ocrReceipt{
+			MerchantName: receipt.MerchantName,
+			Datetime:     receipt.Datetime,
+			Total:        receipt.Total,
+			Images:       images[idx],
+		})
+		if receipt.MerchantName != "" {
+			merchants = append(merchants, receipt.MerchantName)
+		}
+		if merged.Datetime == "" {
+			merged.Datetime = receipt.Datetime
+		}
+		for _, item := range receipt.Items {
+			item.Receipt = idx
+			merged.Items = append(merged.Items, item)
+		}
+		merged.SubTotal += receipt.SubTotal
+		merged.VAT += receipt.VAT
+		merged.ServiceCharge += receipt.ServiceCharge
+		merged.Total += receipt.Total
+		subTotalKnown = subTotalKnown && receipt.SubTotal > 0
+		totalKnown = totalKnown && receipt.Total > 0
+	}
+	merged.MerchantName = strings.Join(merchants, " + ")
+
+	// A partial sum would be reported as a discrepancy, leave totals unknown when a receipt lacks them
+	if !subTotalKnown {
+		merged.SubTotal = 0
+	}
+	if !totalKnown {
+		merged.Total = 0
+	}
+	return merged, headers, duplicates
+}
@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/oatsaysai/billing-in-discord/internal/db"
+	"github.com/oatsaysai/billing-in-discord/pkg/ocr"
+	"github.com/spf13/viper"
+)
+
+// imageContentHash returns the SHA-256 of a downloaded image, identical images have the same hash
+func imageContentHash(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// extractBillTextCached OCRs a bill image, reusing the result of an identical image while it is cached.
+// It returns the result, whether it came from the cache and the image hash.
+func extractBillTextCached(path string) (*ocr.ExtractBillTextResponse, bool, string, error) {
+	ttl := time.Duration(viper.GetInt("OCR.CacheTTLHours")) * time.Hour
+	imageHash, err := imageContentHash(path)
+	if err != nil {
+		// The image can still be read, it just can't be cached or recognized as billed
+		log.Printf("OCRBill: Failed to hash bill image %s: %v", path, err)
+	}
+
+	if imageHash != "" && ttl > 0 {
+		cached, err := db.GetCachedOCRResult(imageHash)
+		if err != nil {
+			log.Printf("OCRBill: %v", err)
+		}
+		if cached != nil {
+			var bill ocr.ExtractBillTextResponse
+			if err := json.Unmarshal(cached, &bill); err == nil {
+				log.Printf("OCRBill: Using cached OCR result of image %s", imageHash)
+				return &bill, true, imageHash, nil
+			}
+			log.Printf("OCRBill: Ignoring unreadable cached OCR result of image %s: %v", imageHash, err)
+		}
+	}
+
+	bill, err := ocrClient.ExtractBillText(path)
+	if err != nil {
+		return nil, false, imageHash, err
+	}
+
+	if imageHash != "" && ttl > 0 {
+		if result, err := json.Marshal(bill); err != nil {
+			log.Printf("OCRBill: Failed to encode OCR result of image %s: %v", imageHash, err)
+		} else if err := db.StoreOCRResult(imageHash, result, ttl); err != nil {
+			log.Printf("OCRBill: %v", err)
+		}
+	}
+	return bill, false, imageHash, nil
+}
+
+// billedReceiptWarning warns when receipt images were already billed in the guild, empty if none were
+func billedReceiptWarning(guildID string, imageHashes []string) string {
+	if len(imageHashes) == 0 {
+		return ""
+	}
+	billed, err := db.GetBilledReceiptImages(guildID, imageHashes)
+	if err != nil {
+		log.Printf("OCRBill: %v", err)
+		return ""
+	}
+	if len(billed) == 0 {
+		return ""
+	}
+
+	var warning strings.Builder
+	warning.WriteString("⚠️ **รูปใบเสร็จนี้เคยถูกใช้สร้างบิลในเซิร์ฟเวอร์นี้แล้ว** โปรดตรวจสอบว่าไม่ได้เรียกเก็บซ้ำ:\n")
+	seen := make(map[string]bool)
+	for _, image := range billed {
+		if seen[image.MessageID] {
+			continue
+		}
+		seen[image.MessageID] = true
+		warning.WriteString(fmt.Sprintf("- บิลเมื่อ %s: https://discord.com/channels/%s/%s/%s\n",
+			image.BilledAt.Format("02/01/2006 15:04"), guildIDOrMe(guildID), image.ChannelID, image.MessageID))
+	}
+	return warning.String()
+}
+
+// guildIDOrMe returns the guild part of a message link, direct messages link under @me
+func guildIDOrMe(guildID string) string {
+	if guildID == "" {
+		return "@me"
+	}
+	return guildID
+}
+
+// recordBilledReceipt remembers the receipt images of a bill message once a bill was created from it.
+// messageID is the receipt message the OCR result was stored under. Once that result is gone from memory,
+// e.g. after a restart, the hashes of the archived receipts of the message are used instead.
+func recordBilledReceipt(guildID, channelID, messageID string) {
+	var imageHashes []string
+	if record := getBillOCRRecord(messageID); record != nil {
+		imageHashes = record.ImageHashes
+	} else {
+		images, err := db.GetMessageArchivedImages(db.ArchiveReceipt, messageID)
+		if err != nil {
+			log.Printf("OCRBill: %v", err)
+		}
+		for _, image := range images {
+			imageHashes = append(imageHashes, image.ImageHash)
+		}
+	}
+	if len(imageHashes) == 0 {
+		return
+	}
+	if err := db.RecordBilledReceiptImages(guildID, channelID, messageID, imageHashes); err != nil {
+		log.Printf("OCRBill: %v", err)
+	}
+}
@@ -3,7 +3,6 @@ package handlers
 import (
 	"fmt"
 	"log"
-	"strconv"
 	"strings"
 	"time"
 
@@ -16,16 +15,12 @@ import (
 )
 
 // handlePayTxButton handles the pay specific transaction button interaction
-func handlePayTxButton(s *discordgo.Session, i *discordgo.InteractionCreate) {
-	// Extract the transaction ID from the custom ID
-	customID := i.MessageComponentData().CustomID
-	txIDStr := strings.TrimPrefix(customID, payTxButtonPrefix)
-
-	txID, err := strconv.Atoi(txIDStr)
-	if err != nil {
-		respondWithError(s, i, "รหัสรายการไม่ถูกต้อง")
+func handlePayTxButton(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	var payload txPayload
+	if !decodeComponentPayload(s, i, state, &payload) {
 		return
 	}
+	txID := payload.TxID
 
 	// Get transaction info
 	txInfo, err := db.GetTransactionInfo(txID)
@@ -44,7 +39,7 @@ func handlePayTxButton(s *discordgo.Session, i *discordgo.InteractionCreate) {
 	// Get user IDs
 	payerDbID := txInfo["payer_id"].(int)
 	payeeDbID := txInfo["payee_id"].(int)
-	amount := txInfo["amount"].(float64)
+	amount := txInfo["amount"].(float64) - txInfo["paid_amount"].(float64) // Outstanding after partial payments
 
 	payerDiscordID, err := db.GetDiscordIDFromDbID(payerDbID)
 	if err != nil {
@@ -59,7 +54,7 @@ func handlePayTxButton(s *discordgo.Session, i *discordgo.InteractionCreate) {
 	}
 
 	// Verify user is the payer
-	if i.Member.User.ID != payerDiscordID {
+	if interactionUserID(i) != payerDiscordID {
 		respondWithError(s, i, "คุณไม่ใช่ผู้จ่ายเงินของรายการนี้")
 		return
 	}
@@ -78,9 +73,6 @@ func handlePayTxButton(s *discordgo.Session, i *discordgo.InteractionCreate) {
 	content.WriteString(fmt.Sprintf("**ผู้รับเงิน:** <@%s>\n", payeeDiscordID))
 	content.WriteString(fmt.Sprintf("**PromptPay ID ของผู้รับเงิน:** `%s`\n\n", promptPayID))
 
-	// Create txIDsString for passing to the confirmation buttons
-	txIDsString := fmt.Sprintf("[%d]", txID)
-
 	// Generate QR code if PromptPay ID is available
 	if promptPayID != "ไม่พบข้อมูล" {
 		// Create a file name for the QR code
@@ -138,24 +130,9 @@ func handlePayTxButton(s *discordgo.Session, i *discordgo.InteractionCreate) {
 	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseChannelMessageWithSource,
 		Data: &discordgo.InteractionResponseData{
-			Content: content.String(),
-			Flags:   discordgo.MessageFlagsEphemeral, // Show only to the user
-			Components: []discordgo.MessageComponent{
-				discordgo.ActionsRow{
-					Components: []discordgo.MessageComponent{
-						discordgo.Button{
-							Label:    "ยืนยันการชำระเงินด้วยสลิป",
-							Style:    discordgo.SuccessButton,
-							CustomID: fmt.Sprintf("confirm_payment_%s_%s", payeeDiscordID, txIDsString),
-						},
-						discordgo.Button{
-							Label:    "ยืนยันการชำระเงินโดยไม่มีสลิป",
-							Style:    discordgo.PrimaryButton,
-							CustomID: fmt.Sprintf("confirm_payment_no_slip_%s_%s", payeeDiscordID, txIDsString),
-						},
-					},
-				},
-			},
+			Content:    content.String(),
+			Flags:      discordgo.MessageFlagsEphemeral, // Show only to the user
+			Components: confirmPaymentButtons(payerDiscordID, payeeDiscordID, []int{txID}),
 		},
 	})
 
@@ -0,0 +1,454 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/oatsaysai/billing-in-discord/internal/db"
+)
+
+// paidByKeyword introduces the people who actually paid for a bill
+const paidByKeyword = "paidby"
+
+// billPayerArg is one payer named after paidby, Amount is 0 when not given
+type billPayerArg struct {
+	DiscordID string
+	Amount    float64
+}
+
+// extractPaidByArg removes a "paidby @user [amount] [@user amount...]" clause from args.
+// A bill paid only by its author needs no confirmation, so that case returns no payers.
+func extractPaidByArg(args []string, authorDiscordID string) ([]string, []billPayerArg, error) {
+	keywordIdx := -1
+	for idx, arg := range args {
+		if strings.ToLower(arg) == paidByKeyword {
+			keywordIdx = idx
+			break
+		}
+	}
+	if keywordIdx == -1 {
+		return args, nil, nil
+	}
+
+	rest := append([]string{}, args[:keywordIdx]...)
+	var payers []billPayerArg
+	seen := make(map[string]bool)
+	idx := keywordIdx + 1
+	for idx < len(args) {
+		// Accept both "@user 600" and "@user:600"
+		token, amountText, _ := strings.Cut(args[idx], ":")
+		match := userMentionRegex.FindStringSubmatch(token)
+		if match == nil || match[0] != token {
+			break
+		}
+		idx++
+		if amountText == "" && idx < len(args) {
+			if _, err := strconv.ParseFloat(args[idx], 64); err == nil {
+				amountText = args[idx]
+				idx++
+			}
+		}
+
+		payer := billPayerArg{DiscordID: match[1]}
+		if amountText != "" {
+			amount, err := strconv.ParseFloat(amountText, 64)
+			if err != nil || amount <= 0 || math.IsNaN(amount) || math.IsInf(amount, 0) {
+				return nil, nil, fmt.Errorf("ยอดที่ <@%s> จ่ายไม่ถูกต้อง: '%s'", payer.DiscordID, amountText)
+			}
+			payer.Amount = amount
+		}
+		if seen[payer.DiscordID] {
+			return nil, nil, fmt.Errorf("ระบุ <@%s> หลัง `paidby` ซ้ำ", payer.DiscordID)
+		}
+		seen[payer.DiscordID] = true
+		payers = append(payers, payer)
+	}
+	rest = append(rest, args[idx:]...)
+
+	if len(payers) == 0 {
+		return nil, nil, fmt.Errorf("โปรดระบุผู้จ่ายหลัง `paidby` เช่น `paidby @user` หรือ `paidby @user1 600 @user2 400`")
+	}
+	if len(payers) > 1 {
+		for _, payer := range payers {
+			if payer.Amount == 0 {
+				return nil, nil, fmt.Errorf("เมื่อมีผู้จ่ายหลายคน โปรดระบุยอดที่แต่ละคนจ่าย เช่น `paidby @user1 600 @user2 400`")
+			}
+		}
+	}
+	if len(payers) == 1 && payers[0].DiscordID == authorDiscordID {
+		return rest, nil, nil
+	}
+	return rest, payers, nil
+}
+
+// handlePaidByBill records a text bill fronted by other people. The debts are split across the
+// payers in proportion to what each paid and are only booked once every payer confirms.
+func handlePaidByBill(s *discordgo.Session, m *discordgo.MessageCreate, items []billLine, paidBy []billPayerArg, totalAmount float64, dueDate time.Time, summary *strings.Builder) {
+	if len(items) == 0 {
+		s.ChannelMessageSend(m.ChannelID, "ไม่พบรายการที่ถูกต้องในบิล")
+		return
+	}
+
+	// A single payer without an amount paid the whole bill, otherwise the amounts must add up to it
+	if len(paidBy) == 1 && paidBy[0].Amount == 0 {
+		paidBy[0].Amount = totalAmount
+	}
+	var contributed float64
+	for _, payer := range paidBy {
+		contributed += payer.Amount
+	}
+	if math.Abs(contributed-totalAmount) > 0.01 {
+		SendErrorMessage(s, m.ChannelID, fmt.Sprintf("ยอดที่ผู้จ่ายจ่ายรวม %.2f บาท ไม่ตรงกับยอดรวมของบิล %.2f บาท", contributed, totalAmount))
+		return
+	}
+
+	recorderDbID, err := db.GetOrCreateUser(m.Author.ID)
+	if err != nil {
+		SendErrorMessage(s, m.ChannelID, fmt.Sprintf("เกิดข้อผิดพลาดกับฐานข้อมูลสำหรับคุณ (<@%s>)", m.Author.ID))
+		return
+	}
+
+	bill := &db.PayerBill{
+		MessageID:   m.ID,
+		ChannelID:   m.ChannelID,
+		GuildID:     m.GuildID,
+		RecordedBy:  recorderDbID,
+		TotalAmount: totalAmount,
+	}
+	if !dueDate.IsZero() {
+		bill.DueDate = &dueDate
+	}
+
+	userDbIDs := make(map[string]int)
+	lookupUser := func(discordID string) (int, bool) {
+		if dbID, ok := userDbIDs[discordID]; ok {
+			return dbID, true
+		}
+		dbID, err := db.GetOrCreateUser(discordID)
+		if err != nil {
+			log.Printf("Error DB user %s for paidby bill: %v", discordID, err)
+			SendErrorMessage(s, m.ChannelID, fmt.Sprintf("เกิดข้อผิดพลาด DB สำหรับ <@%s>", discordID))
+			return 0, false
+		}
+		userDbIDs[discordID] = dbID
+		return dbID, true
+	}
+
+	for _, payer := range paidBy {
+		payerDbID, ok := lookupUser(payer.DiscordID)
+		if !ok {
+			return
+		}
+		bill.Payers = append(bill.Payers, db.BillPayer{UserID: payerDbID, DiscordID: payer.DiscordID, Contributed: payer.Amount})
+	}
+
+	// Each participant owes every payer the payer's proportion of the participant's share
+	for _, item := range items {
+		share := item.Amount / float64(len(item.Mentions))
+		for _, debtorDiscordID := range item.Mentions {
+			debtorDbID, ok := lookupUser(debtorDiscordID)
+			if !ok {
+				return
+			}
+			for _, payer := range bill.Payers {
+				if payer.DiscordID == debtorDiscordID {
+					continue
+				}
+				amount := math.Round(share*payer.Contributed/totalAmount*100) / 100
+				if amount < 0.01 {
+					continue
+				}
+				bill.Debts = append(bill.Debts, db.BillDebt{
+					DebtorID:          debtorDbID,
+					CreditorID:        payer.UserID,
+					DebtorDiscordID:   debtorDiscordID,
+					CreditorDiscordID: payer.DiscordID,
+					Amount:            amount,
+					Description:       item.Description,
+				})
+			}
+		}
+	}
+
+	billID, err := db.CreatePayerBill(bill)
+	if err != nil {
+		log.Printf("Failed to store paidby bill from %s: %v", m.Author.ID, err)
+		SendErrorMessage(s, m.ChannelID, "เกิดข้อผิดพลาดในการบันทึกบิล")
+		return
+	}
+	bill, err = db.GetPayerBill(billID)
+	if err != nil {
+		log.Printf("Failed to load paidby bill %d: %v", billID, err)
+		SendErrorMessage(s, m.ChannelID, "เกิดข้อผิดพลาดในการบันทึกบิล")
+		return
+	}
+
+	summary.WriteString(fmt.Sprintf("\n**ยอดรวมทั้งสิ้น: %.2f บาท**\n", totalAmount))
+	writePayerBillPayers(summary, bill)
+	summary.WriteString(fmt.Sprintf("\n⏳ บิล #%d จะบันทึกหนี้เมื่อผู้จ่ายทุกคนยืนยันว่าได้จ่ายเงินจริง", bill.ID))
+	s.ChannelMessageSend(m.ChannelID, summary.String())
+
+	for _, payer := range bill.Payers {
+		if payer.ConfirmedAt == nil {
+			sendPayerBillConfirmation(s, bill, payer)
+		}
+	}
+}
+
+// writePayerBillPayers lists what each payer fronted and whether they confirmed
+func writePayerBillPayers(sb *strings.Builder, bill *db.PayerBill) {
+	sb.WriteString("**ผู้จ่าย:**\n")
+	for _, payer := range bill.Payers {
+		status := "⏳ รอยืนยัน"
+		if payer.ConfirmedAt != nil {
+			status = "✅ ยืนยันแล้ว"
+		}
+		sb.WriteString(fmt.Sprintf("- <@%s> จ่ายไป %.2f บาท (%s)\n", payer.DiscordID, payer.Contributed, status))
+	}
+}
+
+// sendPayerBillConfirmation asks a payer by DM to confirm they fronted the money,
+// falling back to the bill's channel if the DM can't be sent
+func sendPayerBillConfirmation(s *discordgo.Session, bill *db.PayerBill, payer db.BillPayer) {
+	var content strings.Builder
+	content.WriteString(fmt.Sprintf("🧾 **บิล #%d** ที่ <@%s> บันทึกไว้ระบุว่าคุณเป็นผู้จ่าย **%.2f บาท** จากยอดรวม %.2f บาท\n",
+		bill.ID, bill.RecordedByDiscordID, payer.Contributed, bill.TotalAmount))
+	content.WriteString("เมื่อยืนยัน ระบบจะบันทึกหนี้ต่อไปนี้ให้คุณ:\n")
+	var owedToPayer float64
+	for _, debt := range bill.Debts {
+		if debt.CreditorID != payer.UserID {
+			continue
+		}
+		owedToPayer += debt.Amount
+		content.WriteString(fmt.Sprintf("- <@%s> ค้าง %.2f บาท ค่า %s\n", debt.DebtorDiscordID, debt.Amount, debt.Description))
+	}
+	if owedToPayer < 0.01 {
+		content.WriteString("- (ไม่มีผู้ใดต้องจ่ายให้คุณ)\n")
+	}
+	content.WriteString("\nหากคุณไม่ได้จ่ายเงินตามนี้ โปรดกดปฏิเสธ")
+
+	stateID := newComponentState([]string{payerBillConfirmPrefix, payerBillRejectPrefix},
+		bill.RecordedByDiscordID, []string{payer.DiscordID}, payerBillPayload{BillID: bill.ID}, false, longInteractionStateTTL)
+	components := []discordgo.MessageComponent{
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.Button{
+					Label:    "ยืนยันว่าฉันจ่าย",
+					Style:    discordgo.SuccessButton,
+					CustomID: payerBillConfirmPrefix + stateID,
+				},
+				discordgo.Button{
+					Label:    "ฉันไม่ได้จ่าย",
+					Style:    discordgo.DangerButton,
+					CustomID: payerBillRejectPrefix + stateID,
+				},
+			},
+		},
+	}
+
+	dmChannel, err := s.UserChannelCreate(payer.DiscordID)
+	if err == nil {
+		_, err = s.ChannelMessageSendComplex(dmChannel.ID, &discordgo.MessageSend{Content: content.String(), Components: components})
+	}
+	if err != nil {
+		log.Printf("Could not DM payer %s for bill %d: %v", payer.DiscordID, bill.ID, err)
+		s.ChannelMessageSendComplex(bill.ChannelID, &discordgo.MessageSend{
+			Content:    fmt.Sprintf("<@%s>\n%s", payer.DiscordID, content.String()),
+			Components: components,
+		})
+	}
+}
+
+// getPayerBillForPayer loads the bill behind an interaction state and the clicking payer's DB ID
+func getPayerBillForPayer(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) (*db.PayerBill, int) {
+	var payload payerBillPayload
+	if !decodeComponentPayload(s, i, state, &payload) {
+		return nil, 0
+	}
+
+	payerDbID, err := db.GetOrCreateUser(interactionUserID(i))
+	if err != nil {
+		respondWithError(s, i, "ไม่สามารถยืนยันบัญชีผู้ใช้ของคุณสำหรับการดำเนินการนี้")
+		return nil, 0
+	}
+
+	bill, err := db.GetPayerBill(payload.BillID)
+	if err != nil {
+		respondWithError(s, i, err.Error())
+		return nil, 0
+	}
+	if bill.Status != db.PayerBillPending {
+		respondWithError(s, i, fmt.Sprintf("บิล #%d ถูกดำเนินการไปแล้ว (สถานะ: %s)", bill.ID, bill.Status))
+		return nil, 0
+	}
+	return bill, payerDbID
+}
+
+// handlePayerBillConfirmButton records a payer's confirmation and books the bill once everyone confirmed
+func handlePayerBillConfirmButton(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	bill, payerDbID := getPayerBillForPayer(s, i, state)
+	if bill == nil {
+		return
+	}
+
+	consentTimeout := billConsentTimeout(bill.GuildID)
+	bill, err := db.ConfirmPayerBill(bill.ID, payerDbID, consentTimeout > 0)
+	if err != nil {
+		log.Printf("Error confirming payer bill: %v", err)
+		respondWithError(s, i, err.Error())
+		return
+	}
+
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Content:    fmt.Sprintf("✅ คุณยืนยันแล้วว่าได้จ่ายเงินสำหรับบิล #%d", bill.ID),
+			Components: []discordgo.MessageComponent{}, // Remove buttons
+		},
+	})
+	if err != nil {
+		log.Printf("Error responding to payer bill confirm button: %v", err)
+	}
+
+	if bill.Status != db.PayerBillBooked {
+		var sb strings.Builder
+		sb.WriteString(fmt.Sprintf("✅ <@%s> ยืนยันการจ่ายเงินสำหรับบิล #%d แล้ว\n", interactionUserID(i), bill.ID))
+		writePayerBillPayers(&sb, bill)
+		s.ChannelMessageSend(bill.ChannelID, sb.String())
+		return
+	}
+	announceBookedPayerBill(s, bill, consentTimeout)
+}
+
+// handlePayerBillRejectButton cancels a bill whose payer says they didn't pay
+func handlePayerBillRejectButton(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	bill, payerDbID := getPayerBillForPayer(s, i, state)
+	if bill == nil {
+		return
+	}
+
+	if err := db.RejectPayerBill(bill.ID, payerDbID); err != nil {
+		respondWithError(s, i, err.Error())
+		return
+	}
+
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Content:    fmt.Sprintf("❌ คุณได้ปฏิเสธบิล #%d ไม่มีการบันทึกหนี้ใดๆ", bill.ID),
+			Components: []discordgo.MessageComponent{}, // Remove buttons
+		},
+	})
+	if err != nil {
+		log.Printf("Error responding to payer bill reject button: %v", err)
+	}
+
+	s.ChannelMessageSend(bill.ChannelID, fmt.Sprintf("❌ <@%s> แจ้งว่าไม่ได้จ่ายเงินตามบิล #%d ที่ <@%s> บันทึกไว้ บิลนี้ถูกยกเลิกและไม่มีการบันทึกหนี้",
+		interactionUserID(i), bill.ID, bill.RecordedByDiscordID))
+}
+
+// announceBookedPayerBill posts the debts of a bill every payer confirmed and sends each creditor's QR codes.
+// Pending debts are sent to their debtors for consent instead, one request per creditor.
+func announceBookedPayerBill(s *discordgo.Session, bill *db.PayerBill, consentTimeout time.Duration) {
+	var billTxIDs, pendingTxIDs []int
+	var creditors []string
+	creditorPendingTxIDs := make(map[string]map[string][]int) // creditor -> debtor -> pending TxIDs
+	for _, debt := range bill.Debts {
+		if !debt.Pending {
+			billTxIDs = append(billTxIDs, debt.TxID)
+			continue
+		}
+		pendingTxIDs = append(pendingTxIDs, debt.TxID)
+		if _, ok := creditorPendingTxIDs[debt.CreditorDiscordID]; !ok {
+			creditors = append(creditors, debt.CreditorDiscordID)
+			creditorPendingTxIDs[debt.CreditorDiscordID] = make(map[string][]int)
+		}
+		creditorPendingTxIDs[debt.CreditorDiscordID][debt.DebtorDiscordID] = append(creditorPendingTxIDs[debt.CreditorDiscordID][debt.DebtorDiscordID], debt.TxID)
+	}
+
+	if len(pendingTxIDs) > 0 {
+		// Pending debts keep the bill's due date and get their trip and QR code once accepted
+		var dueDateLine string
+		if bill.DueDate != nil {
+			dueDateLine = setBillDueDate(pendingTxIDs, *bill.DueDate)
+		}
+		for _, creditor := range creditors {
+			var sb strings.Builder
+			sb.WriteString(fmt.Sprintf("✅ **ผู้จ่ายยืนยันบิล #%d ครบแล้ว** รายการที่ต้องจ่ายให้ <@%s>:\n", bill.ID, creditor))
+			for _, debt := range bill.Debts {
+				if debt.Pending && debt.CreditorDiscordID == creditor {
+					sb.WriteString(fmt.Sprintf("- <@%s> ค้าง <@%s> %.2f บาท ค่า %s (TxID: %d)\n",
+						debt.DebtorDiscordID, debt.CreditorDiscordID, debt.Amount, debt.Description, debt.TxID))
+				}
+			}
+			if dueDateLine != "" {
+				sb.WriteString(dueDateLine + "\n")
+			}
+			requestBillConsent(s, bill.ChannelID, bill.GuildID, creditor, "", creditorPendingTxIDs[creditor], sb.String(), consentTimeout)
+		}
+		if len(billTxIDs) == 0 {
+			return
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("✅ **ผู้จ่ายยืนยันบิล #%d ครบแล้ว** บันทึกหนี้ดังนี้:\n", bill.ID))
+	for _, debt := range bill.Debts {
+		if debt.Pending {
+			continue
+		}
+		sb.WriteString(fmt.Sprintf("- <@%s> ค้าง <@%s> %.2f บาท ค่า %s (TxID: %d)\n",
+			debt.DebtorDiscordID, debt.CreditorDiscordID, debt.Amount, debt.Description, debt.TxID))
+	}
+
+	// Expenses of an open trip are settled when the trip closes instead
+	if tripLine, inTrip := addBillToTrip(bill.ChannelID, billTxIDs); inTrip {
+		sb.WriteString(tripLine)
+		s.ChannelMessageSend(bill.ChannelID, sb.String())
+		return
+	}
+	if bill.DueDate != nil {
+		if dueDateLine := setBillDueDate(billTxIDs, *bill.DueDate); dueDateLine != "" {
+			sb.WriteString(dueDateLine + "\n")
+		}
+	}
+	s.ChannelMessageSend(bill.ChannelID, sb.String())
+
+	// One QR code per debtor and creditor pair, in the order the debts were recorded
+	type debtPair struct{ debtor, creditor string }
+	var pairs []debtPair
+	pairTotals := make(map[debtPair]float64)
+	pairTxIDs := make(map[debtPair][]int)
+	creditorDbIDs := make(map[string]int)
+	for _, debt := range bill.Debts {
+		if debt.Pending {
+			continue
+		}
+		pair := debtPair{debt.DebtorDiscordID, debt.CreditorDiscordID}
+		if _, ok := pairTotals[pair]; !ok {
+			pairs = append(pairs, pair)
+		}
+		pairTotals[pair] += debt.Amount
+		pairTxIDs[pair] = append(pairTxIDs[pair], debt.TxID)
+		creditorDbIDs[debt.CreditorDiscordID] = debt.CreditorID
+	}
+
+	for _, pair := range pairs {
+		// Settle what we can from credit and mutual debts before asking for money
+		amount, txIDs := prepareBillPayment(s, bill.ChannelID, pair.debtor, pair.creditor, pairTotals[pair], pairTxIDs[pair])
+		if amount <= 0.009 {
+			continue
+		}
+		promptPayID, err := db.GetUserPromptPayID(creditorDbIDs[pair.creditor])
+		if err != nil || promptPayID == "" {
+			continue
+		}
+		GenerateAndSendQrCode(s, bill.ChannelID, promptPayID, amount, pair.debtor,
+			fmt.Sprintf("ยอดจากบิล #%d ที่ <@%s> จ่ายไป", bill.ID, pair.creditor), txIDs)
+	}
+}
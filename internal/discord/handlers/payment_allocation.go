@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/oatsaysai/billing-in-discord/internal/db"
+	"github.com/spf13/viper"
+)
+
+// allocatePayment applies a payment that doesn't name its transactions to the debtor's outstanding
+// transactions using the configured strategy, and checks praise for every transaction it settles
+func allocatePayment(s *discordgo.Session, channelID, debtorDiscordID, payeeDiscordID string, amount float64) (*db.PaymentAllocation, error) {
+	allocation, err := db.AllocatePayment(debtorDiscordID, payeeDiscordID, amount, viper.GetString("Payment.AllocationStrategy"))
+	if err != nil {
+		return nil, err
+	}
+	praiseSettledTransactions(s, channelID, debtorDiscordID, allocation)
+	return allocation, nil
+}
+
+// allocatePaymentToTransactions applies a payment made for specific transactions to them only,
+// keeping any overpayment as credit, and praises the debtor for each settled transaction
+func allocatePaymentToTransactions(s *discordgo.Session, channelID, debtorDiscordID, payeeDiscordID string, txIDs []int, amount float64) (*db.PaymentAllocation, error) {
+	allocation, err := db.AllocatePaymentToTransactions(debtorDiscordID, payeeDiscordID, txIDs, amount, viper.GetString("Payment.AllocationStrategy"))
+	if err != nil {
+		return nil, err
+	}
+	praiseSettledTransactions(s, channelID, debtorDiscordID, allocation)
+	return allocation, nil
+}
+
+// praiseSettledTransactions sends the automatic praise for each transaction an allocation settled
+func praiseSettledTransactions(s *discordgo.Session, channelID, debtorDiscordID string, allocation *db.PaymentAllocation) {
+	if channelID == "" {
+		return
+	}
+	for _, txID := range allocation.SettledTxIDs() {
+		CheckAndSendAutomaticPraise(s, channelID, txID, debtorDiscordID)
+	}
+}
+
+// formatPaymentAllocation describes which transactions a payment covered
+func formatPaymentAllocation(allocation *db.PaymentAllocation) string {
+	if len(allocation.Allocations) == 0 {
+		if allocation.Credited > 0 {
+			return fmt.Sprintf("ไม่พบรายการที่ค้างชำระ บันทึก %.2f บาท เป็นเครดิตสำหรับบิลถัดไปแล้ว", allocation.Credited)
+		}
+		return fmt.Sprintf("ไม่พบรายการที่ค้างชำระ ยอดหนี้สินลดลง %.2f บาท", allocation.Amount)
+	}
+
+	var lines []string
+	if settled := allocation.SettledTxIDs(); len(settled) > 0 {
+		lines = append(lines, fmt.Sprintf("ชำระครบ %d รายการ (TxIDs: %s)", len(settled), formatTxIDList(settled)))
+	}
+	for _, partial := range allocation.PartialAllocations() {
+		lines = append(lines, fmt.Sprintf("ชำระบางส่วน TxID %d: %.2f บาท (คงเหลือ %.2f บาท)", partial.TxID, partial.Applied, partial.Remaining))
+	}
+	if allocation.Credited > 0 {
+		lines = append(lines, fmt.Sprintf("ยอดที่เกินจากรายการค้างชำระ %.2f บาท บันทึกเป็นเครดิตสำหรับบิลถัดไปแล้ว", allocation.Credited))
+	} else if allocation.Unallocated > 0 {
+		lines = append(lines, fmt.Sprintf("ยอดที่เกินจากรายการค้างชำระ: %.2f บาท", allocation.Unallocated))
+	}
+	return strings.Join(lines, "\n")
+}
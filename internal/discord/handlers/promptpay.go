@@ -10,8 +10,8 @@ import (
 
 // HandleSetPromptPay handles the !setpromptpay command
 func HandleSetPromptPay(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
-	if len(args) != 2 {
-		SendErrorMessage(s, m.ChannelID, "รูปแบบไม่ถูกต้อง โปรดใช้: `!setpromptpay <PromptPayID>`")
+	if len(args) < 2 {
+		SendErrorMessage(s, m.ChannelID, "รูปแบบไม่ถูกต้อง โปรดใช้: `!setpromptpay <PromptPayID> [ชื่อบัญชี]`")
 		return
 	}
 
@@ -33,6 +33,17 @@ func HandleSetPromptPay(s *discordgo.Session, m *discordgo.MessageCreate, args [
 		return
 	}
 
+	// Optional account name, used to match the receiver name on payment slips
+	accountName := strings.TrimSpace(strings.Join(args[2:], " "))
+	if accountName != "" {
+		if err := db.SetUserAccountName(userDbID, accountName); err != nil {
+			SendErrorMessage(s, m.ChannelID, err.Error())
+			return
+		}
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("✅ บันทึก PromptPay ID `%s` (ชื่อบัญชี: %s) สำหรับ <@%s> เรียบร้อยแล้ว", promptPayID, accountName, m.Author.ID))
+		return
+	}
+
 	s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("✅ บันทึก PromptPay ID `%s` สำหรับ <@%s> เรียบร้อยแล้ว", promptPayID, m.Author.ID))
 }
 
@@ -44,7 +55,7 @@ func HandleGetMyPromptPay(s *discordgo.Session, m *discordgo.MessageCreate, args
 		return
 	}
 
-	promptPayID, err := db.GetUserPromptPayID(userDbID)
+	promptPayID, accountName, err := db.GetUserPromptPayAccount(userDbID)
 	if err != nil {
 		if strings.Contains(err.Error(), "ยังไม่พบ PromptPay ID") {
 			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("คุณยังไม่ได้ตั้งค่า PromptPay ID กรุณาใช้คำสั่ง `!setpromptpay <PromptPayID>` เพื่อตั้งค่า"))
@@ -54,5 +65,9 @@ func HandleGetMyPromptPay(s *discordgo.Session, m *discordgo.MessageCreate, args
 		return
 	}
 
+	if accountName != "" {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("PromptPay ID ของคุณคือ: `%s` (ชื่อบัญชี: %s)", promptPayID, accountName))
+		return
+	}
 	s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("PromptPay ID ของคุณคือ: `%s`", promptPayID))
 }
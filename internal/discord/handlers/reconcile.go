@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/oatsaysai/billing-in-discord/internal/db"
+	"github.com/spf13/viper"
+)
+
+// adminPermissions are the guild permissions required for guild maintenance commands such as !duedays
+const adminPermissions = discordgo.PermissionAdministrator | discordgo.PermissionManageServer
+
+// reconcileSchedulerActor is recorded as the trigger of corrections made by the scheduled job
+const reconcileSchedulerActor = "scheduler"
+
+// HandleReconcile handles !reconcile [fix].
+// It reports every debtor/creditor pair whose balance doesn't match the unpaid transactions,
+// and with "fix" rebuilds those balances from the ledger. Balances aren't tied to a guild, so the
+// command is limited to the bot owners in Reconciliation.OwnerDiscordIDs and the report is sent by DM.
+func HandleReconcile(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+	if !slices.Contains(viper.GetStringSlice("Reconciliation.OwnerDiscordIDs"), m.Author.ID) {
+		SendErrorMessage(s, m.ChannelID, "คำสั่งนี้ใช้ได้เฉพาะผู้ดูแลบอทเท่านั้น")
+		return
+	}
+	dmChannel, err := s.UserChannelCreate(m.Author.ID)
+	if err != nil {
+		log.Printf("Could not create DM channel with %s: %v", m.Author.ID, err)
+		SendErrorMessage(s, m.ChannelID, "ไม่สามารถส่งข้อความส่วนตัวถึงคุณได้ โปรดเปิดรับข้อความส่วนตัวแล้วลองอีกครั้ง")
+		return
+	}
+
+	fix := len(args) > 1 && strings.ToLower(args[1]) == "fix"
+	if len(args) > 1 && !fix {
+		SendErrorMessage(s, m.ChannelID, "รูปแบบไม่ถูกต้อง โปรดใช้ `!reconcile` หรือ `!reconcile fix`")
+		return
+	}
+
+	if !fix {
+		drifts, err := db.FindDebtDrift()
+		if err != nil {
+			log.Printf("Error finding debt drift: %v", err)
+			SendErrorMessage(s, m.ChannelID, "ไม่สามารถตรวจสอบยอดหนี้ได้")
+			return
+		}
+		sendReconcileReport(s, dmChannel.ID, formatDebtDriftReport(drifts, false))
+		notifyReconcileReportSent(s, m)
+		return
+	}
+
+	corrections, err := db.RebuildUserDebts(m.Author.ID)
+	if err != nil {
+		log.Printf("Error rebuilding user debts: %v", err)
+		SendErrorMessage(s, m.ChannelID, fmt.Sprintf("ไม่สามารถปรับยอดหนี้ได้: %v", err))
+		return
+	}
+	drifts := make([]db.DebtDrift, len(corrections))
+	for idx, correction := range corrections {
+		drifts[idx] = correction.DebtDrift
+	}
+	sendReconcileReport(s, dmChannel.ID, formatDebtDriftReport(drifts, true))
+	notifyReconcileReportSent(s, m)
+}
+
+// notifyReconcileReportSent points to the DM when !reconcile was used in a server channel
+func notifyReconcileReportSent(s *discordgo.Session, m *discordgo.MessageCreate) {
+	if m.GuildID != "" {
+		s.ChannelMessageSend(m.ChannelID, "📬 ส่งรายงานการตรวจสอบยอดหนี้ทางข้อความส่วนตัวแล้ว")
+	}
+}
+
+// RunScheduledReconciliation checks user_debts against the ledger and logs the result.
+// With autoFix the drifting balances are rebuilt; the report is posted to reportChannelID if set.
+func RunScheduledReconciliation(autoFix bool, reportChannelID string) {
+	var drifts []db.DebtDrift
+	if autoFix {
+		corrections, err := db.RebuildUserDebts(reconcileSchedulerActor)
+		if err != nil {
+			log.Printf("Scheduled reconciliation: error rebuilding user debts: %v", err)
+			return
+		}
+		for _, correction := range corrections {
+			drifts = append(drifts, correction.DebtDrift)
+		}
+	} else {
+		var err error
+		drifts, err = db.FindDebtDrift()
+		if err != nil {
+			log.Printf("Scheduled reconciliation: error finding debt drift: %v", err)
+			return
+		}
+	}
+
+	if len(drifts) == 0 {
+		return
+	}
+
+	for _, drift := range drifts {
+		log.Printf("Scheduled reconciliation: debtor %d -> creditor %d recorded %.2f, ledger %.2f (fixed: %t)",
+			drift.DebtorID, drift.CreditorID, drift.RecordedAmount, drift.LedgerAmount, autoFix)
+	}
+
+	if reportChannelID != "" && session != nil {
+		sendReconcileReport(session, reportChannelID, formatDebtDriftReport(drifts, autoFix))
+	}
+}
+
+// formatDebtDriftReport renders the drifting pairs, one line per pair
+func formatDebtDriftReport(drifts []db.DebtDrift, fixed bool) []string {
+	if len(drifts) == 0 {
+		return []string{"✅ ยอดหนี้ทั้งหมดตรงกับรายการที่ยังไม่ได้ชำระ"}
+	}
+
+	header := fmt.Sprintf("⚠️ **พบยอดหนี้ไม่ตรงกับรายการที่ยังไม่ได้ชำระ %d คู่**", len(drifts))
+	if fixed {
+		header = fmt.Sprintf("🛠️ **ปรับยอดหนี้ตามรายการที่ยังไม่ได้ชำระแล้ว %d คู่**", len(drifts))
+	}
+
+	lines := []string{header}
+	for _, drift := range drifts {
+		lines = append(lines, fmt.Sprintf("- <@%s> → <@%s>: ยอดในระบบ %.2f บาท, ตามรายการ %.2f บาท (ต่าง %+.2f)",
+			drift.DebtorDiscordID, drift.CreditorDiscordID, drift.RecordedAmount, drift.LedgerAmount, drift.Difference()))
+	}
+	if !fixed {
+		lines = append(lines, "ใช้ `!reconcile fix` เพื่อปรับยอดหนี้ให้ตรงกับรายการ")
+	}
+	return lines
+}
+
+// sendReconcileReport sends the report lines, split into messages that fit Discord's length limit
+func sendReconcileReport(s *discordgo.Session, channelID string, lines []string) {
+	var message strings.Builder
+	for _, line := range lines {
+		if message.Len()+len(line)+1 > 1900 {
+			s.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+				Content:         message.String(),
+				AllowedMentions: &discordgo.MessageAllowedMentions{},
+			})
+			message.Reset()
+		}
+		message.WriteString(line)
+		message.WriteString("\n")
+	}
+	if message.Len() > 0 {
+		s.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+			Content:         message.String(),
+			AllowedMentions: &discordgo.MessageAllowedMentions{},
+		})
+	}
+}
@@ -0,0 +1,418 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/oatsaysai/billing-in-discord/internal/db"
+	"github.com/oatsaysai/billing-in-discord/pkg/verifier"
+)
+
+// queueSlipForReview stores a slip that could not be verified automatically and asks the creditor to review it.
+// verifyResp may be nil when the verifier API itself failed, slipImageID is 0 when the slip wasn't archived.
+func queueSlipForReview(s *discordgo.Session, channelID string, verifyResp *verifier.VerifySlipResponse, slipURL string, slipImageID int, debtorDiscordID, creditorDiscordID string, expectedAmount float64, txIDs []int, reasons []string) {
+	debtorDbID, err := db.GetOrCreateUser(debtorDiscordID)
+	if err != nil {
+		SendErrorMessage(s, channelID, fmt.Sprintf("สลิปไม่ผ่านการตรวจสอบ: %s", strings.Join(reasons, "; ")))
+		return
+	}
+	creditorDbID, err := db.GetOrCreateUser(creditorDiscordID)
+	if err != nil {
+		SendErrorMessage(s, channelID, fmt.Sprintf("สลิปไม่ผ่านการตรวจสอบ: %s", strings.Join(reasons, "; ")))
+		return
+	}
+
+	var slipAmount float64
+	var slipData string
+	if verifyResp != nil {
+		slipAmount = verifyResp.Data.Amount
+		if data, marshalErr := json.Marshal(verifyResp.Data); marshalErr == nil {
+			slipData = string(data)
+		}
+	}
+
+	reason := strings.Join(reasons, "\n")
+	reviewID, err := db.CreateSlipReview(debtorDbID, creditorDbID, expectedAmount, slipAmount, slipURL, slipImageID, slipData, txIDs, reason, channelID)
+	if err != nil {
+		log.Printf("SlipReview: Failed to store review for debtor %s creditor %s: %v", debtorDiscordID, creditorDiscordID, err)
+		SendErrorMessage(s, channelID, fmt.Sprintf("สลิปไม่ผ่านการตรวจสอบและไม่สามารถบันทึกเพื่อรอตรวจสอบได้: %s", strings.Join(reasons, "; ")))
+		return
+	}
+
+	review, err := db.GetSlipReview(reviewID)
+	if err != nil {
+		log.Printf("SlipReview: Failed to load review %d: %v", reviewID, err)
+		return
+	}
+
+	if err := sendSlipReviewToCreditor(s, review, verifyResp); err != nil {
+		log.Printf("SlipReview: Could not DM creditor %s for review %d: %v", creditorDiscordID, reviewID, err)
+		s.ChannelMessageSend(channelID, fmt.Sprintf("⏳ สลิปจาก <@%s> ไม่สามารถยืนยันอัตโนมัติได้ และถูกบันทึกไว้เพื่อรอ <@%s> ตรวจสอบ (Review ID: %d)\nผู้รับเงินสามารถดูรายการที่รอตรวจสอบได้ด้วย `!reviews`",
+			debtorDiscordID, creditorDiscordID, reviewID))
+		return
+	}
+
+	s.ChannelMessageSend(channelID, fmt.Sprintf("⏳ สลิปจาก <@%s> ไม่สามารถยืนยันอัตโนมัติได้ ได้ส่งให้ <@%s> ตรวจสอบแล้ว (Review ID: %d) ยอดหนี้จะอัปเดตเมื่อผู้รับเงินยืนยัน",
+		debtorDiscordID, creditorDiscordID, reviewID))
+}
+
+// sendSlipReviewToCreditor sends the slip and review buttons to the creditor via DM
+func sendSlipReviewToCreditor(s *discordgo.Session, review *db.SlipReview, verifyResp *verifier.VerifySlipResponse) error {
+	creditorChannel, err := s.UserChannelCreate(review.CreditorDiscordID)
+	if err != nil {
+		return err
+	}
+
+	var content strings.Builder
+	content.WriteString(fmt.Sprintf("🔎 **รอตรวจสอบสลิป (Review ID: %d)**\n<@%s> (**%s**) ส่งสลิปชำระเงินให้คุณ แต่ระบบไม่สามารถยืนยันอัตโนมัติได้:\n",
+		review.ID, review.DebtorDiscordID, GetDiscordUsername(s, review.DebtorDiscordID)))
+	for _, reason := range strings.Split(review.Reason, "\n") {
+		content.WriteString(fmt.Sprintf("- %s\n", reason))
+	}
+
+	content.WriteString(fmt.Sprintf("\n- จำนวนที่ต้องชำระ: %.2f บาท\n", review.ExpectedAmount))
+	if verifyResp != nil {
+		content.WriteString(fmt.Sprintf("- จำนวนในสลิป: %.2f บาท\n- ผู้ส่ง (สลิป): %s (%s)\n- ผู้รับ (สลิป): %s (%s)\n- วันที่ (สลิป): %s\n- เลขอ้างอิง (สลิป): %s\n",
+			verifyResp.Data.Amount,
+			verifyResp.Data.SenderName, verifyResp.Data.SenderID,
+			verifyResp.Data.ReceiverName, verifyResp.Data.ReceiverID,
+			verifyResp.Data.Date, verifyResp.Data.Ref,
+		))
+	}
+	if len(review.TxIDs) > 0 {
+		content.WriteString(fmt.Sprintf("(เกี่ยวข้องกับรายการ TxIDs: %s)\n", formatTxIDList(review.TxIDs)))
+	}
+	content.WriteString(fmt.Sprintf("สลิป: %s\n\nกด **อนุมัติ** หากได้รับเงินครบ, **ปฏิเสธ** หากยังไม่ได้รับเงิน หรือ **แก้ไขจำนวน** หากได้รับเงินไม่ตรงกับที่แจ้ง", review.SlipURL))
+
+	_, err = s.ChannelMessageSendComplex(creditorChannel.ID, &discordgo.MessageSend{
+		Content:    content.String(),
+		Components: slipReviewButtons(review),
+	})
+	return err
+}
+
+// slipReviewButtons builds the approve/reject/adjust buttons for a slip review.
+// The buttons and the adjust modal share one interaction state, the review status guards against double resolution.
+func slipReviewButtons(review *db.SlipReview) []discordgo.MessageComponent {
+	stateID := newComponentState([]string{slipReviewApprovePrefix, slipReviewRejectPrefix, slipReviewAdjustPrefix, slipReviewAdjustModalPrefix},
+		review.CreditorDiscordID, []string{review.CreditorDiscordID}, slipReviewPayload{ReviewID: review.ID}, false, longInteractionStateTTL)
+
+	return []discordgo.MessageComponent{
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.Button{
+					Label:    "อนุมัติ",
+					Style:    discordgo.SuccessButton,
+					CustomID: slipReviewApprovePrefix + stateID,
+				},
+				discordgo.Button{
+					Label:    "ปฏิเสธ",
+					Style:    discordgo.DangerButton,
+					CustomID: slipReviewRejectPrefix + stateID,
+				},
+				discordgo.Button{
+					Label:    "แก้ไขจำนวน",
+					Style:    discordgo.SecondaryButton,
+					CustomID: slipReviewAdjustPrefix + stateID,
+				},
+			},
+		},
+	}
+}
+
+// getSlipReviewForCreditor loads the pending slip review behind an interaction state and checks the clicking user is its creditor
+func getSlipReviewForCreditor(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) *db.SlipReview {
+	var payload slipReviewPayload
+	if !decodeComponentPayload(s, i, state, &payload) {
+		return nil
+	}
+
+	review, err := db.GetSlipReview(payload.ReviewID)
+	if err != nil {
+		respondWithError(s, i, err.Error())
+		return nil
+	}
+
+	if interactionUserID(i) != review.CreditorDiscordID {
+		respondWithError(s, i, "คุณไม่มีสิทธิ์ตรวจสอบสลิปนี้")
+		return nil
+	}
+
+	if review.Status != db.SlipReviewPending {
+		respondWithError(s, i, fmt.Sprintf("รายการตรวจสอบสลิป ID %d ถูกดำเนินการไปแล้ว (สถานะ: %s)", review.ID, review.Status))
+		return nil
+	}
+
+	return review
+}
+
+// applySlipReviewPayment settles the debt covered by a reviewed slip.
+// The accepted amount goes to the linked TxIDs first and any overpayment is kept as credit;
+// slips without TxIDs are allocated to the oldest outstanding transactions.
+func applySlipReviewPayment(s *discordgo.Session, review *db.SlipReview, amount float64) (string, error) {
+	var allocation *db.PaymentAllocation
+	var err error
+	if len(review.TxIDs) > 0 {
+		allocation, err = allocatePaymentToTransactions(s, review.ChannelID, review.DebtorDiscordID, review.CreditorDiscordID, review.TxIDs, amount)
+	} else {
+		allocation, err = allocatePayment(s, review.ChannelID, review.DebtorDiscordID, review.CreditorDiscordID, amount)
+	}
+	if err != nil {
+		return "", err
+	}
+	var allocatedTxIDs []int
+	for _, alloc := range allocation.Allocations {
+		allocatedTxIDs = append(allocatedTxIDs, alloc.TxID)
+	}
+	if review.SlipImageID > 0 {
+		linkArchivedSlip(review.SlipImageID, allocatedTxIDs)
+	} else {
+		linkArchivedSlipURL(review.SlipURL, allocatedTxIDs) // Reviews queued before slips were kept with them
+	}
+	return formatPaymentAllocation(allocation), nil
+}
+
+// handleSlipReviewApproveButton approves a slip review using the slip amount (or the expected amount if unknown)
+func handleSlipReviewApproveButton(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	review := getSlipReviewForCreditor(s, i, state)
+	if review == nil {
+		return
+	}
+
+	amount := review.ExpectedAmount
+	if review.SlipAmount > 0 {
+		amount = review.SlipAmount
+	}
+
+	resolveSlipReview(s, i, review, db.SlipReviewApproved, amount)
+}
+
+// handleSlipReviewRejectButton rejects a slip review without changing any debt
+func handleSlipReviewRejectButton(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	review := getSlipReviewForCreditor(s, i, state)
+	if review == nil {
+		return
+	}
+
+	if err := db.ResolveSlipReview(review.ID, db.SlipReviewRejected, 0); err != nil {
+		respondWithError(s, i, err.Error())
+		return
+	}
+
+	// Open a dispute with the slip as the debtor's first piece of evidence
+	disputedAmount := review.ExpectedAmount
+	if review.SlipAmount > 0 {
+		disputedAmount = review.SlipAmount
+	}
+	disputeText := ""
+	dispute, err := openPaymentDispute(s, review.DebtorDiscordID, review.CreditorDiscordID, review.CreditorDiscordID, disputedAmount, review.TxIDs, i.GuildID, review.ChannelID,
+		fmt.Sprintf("เจ้าหนี้ปฏิเสธสลิป (Review ID: %d): %s", review.ID, strings.ReplaceAll(review.Reason, "\n", "; ")), []string{review.SlipURL})
+	if err != nil {
+		log.Printf("Error opening dispute for slip review %d: %v", review.ID, err)
+	} else {
+		disputeText = fmt.Sprintf(" และได้เปิดข้อพิพาท #%d แล้ว", dispute.ID)
+	}
+
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Content: fmt.Sprintf("❌ คุณได้ปฏิเสธสลิปจาก <@%s> (Review ID: %d) ไม่มีการเปลี่ยนแปลงข้อมูลหนี้สิน%s",
+				review.DebtorDiscordID, review.ID, disputeText),
+			Components: []discordgo.MessageComponent{}, // Remove buttons
+		},
+	})
+	if err != nil {
+		log.Printf("Error responding to slip review reject button: %v", err)
+	}
+
+	if review.ChannelID != "" {
+		s.ChannelMessageSend(review.ChannelID, fmt.Sprintf("❌ <@%s> ได้ปฏิเสธสลิปชำระเงินของ <@%s> (Review ID: %d)%s",
+			review.CreditorDiscordID, review.DebtorDiscordID, review.ID, disputeText))
+	}
+}
+
+// handleSlipReviewAdjustButton opens a modal for the creditor to enter the amount actually received
+func handleSlipReviewAdjustButton(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	review := getSlipReviewForCreditor(s, i, state)
+	if review == nil {
+		return
+	}
+
+	defaultAmount := review.SlipAmount
+	if defaultAmount <= 0 {
+		defaultAmount = review.ExpectedAmount
+	}
+
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseModal,
+		Data: &discordgo.InteractionResponseData{
+			CustomID: slipReviewAdjustModalPrefix + state.ID,
+			Title:    fmt.Sprintf("แก้ไขจำนวนเงิน (Review ID: %d)", review.ID),
+			Components: []discordgo.MessageComponent{
+				discordgo.ActionsRow{
+					Components: []discordgo.MessageComponent{
+						discordgo.TextInput{
+							CustomID:    "received_amount",
+							Label:       "จำนวนเงินที่ได้รับจริง (บาท)",
+							Style:       discordgo.TextInputShort,
+							Value:       fmt.Sprintf("%.2f", defaultAmount),
+							Placeholder: "เช่น 150.00",
+							Required:    true,
+						},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		log.Printf("Error opening slip review adjust modal: %v", err)
+	}
+}
+
+// handleSlipReviewAdjustModalSubmit applies the amount entered by the creditor
+func handleSlipReviewAdjustModalSubmit(s *discordgo.Session, i *discordgo.InteractionCreate, state *db.InteractionState) {
+	data := i.ModalSubmitData()
+	review := getSlipReviewForCreditor(s, i, state)
+	if review == nil {
+		return
+	}
+
+	var amount float64
+	for _, component := range data.Components {
+		for _, c := range component.(*discordgo.ActionsRow).Components {
+			input := c.(*discordgo.TextInput)
+			if input.CustomID == "received_amount" {
+				parsed, err := strconv.ParseFloat(strings.TrimSpace(strings.ReplaceAll(input.Value, ",", "")), 64)
+				if err != nil || parsed <= 0 {
+					respondWithError(s, i, "จำนวนเงินไม่ถูกต้อง")
+					return
+				}
+				amount = parsed
+			}
+		}
+	}
+
+	if amount <= 0 {
+		respondWithError(s, i, "จำนวนเงินไม่ถูกต้อง")
+		return
+	}
+
+	resolveSlipReview(s, i, review, db.SlipReviewAdjusted, amount)
+}
+
+// resolveSlipReview marks a review as approved/adjusted, settles the debt and notifies both parties
+func resolveSlipReview(s *discordgo.Session, i *discordgo.InteractionCreate, review *db.SlipReview, status string, amount float64) {
+	// Claim the review first so a double click can't apply the payment twice
+	if err := db.ResolveSlipReview(review.ID, status, amount); err != nil {
+		respondWithError(s, i, err.Error())
+		return
+	}
+
+	summary, err := applySlipReviewPayment(s, review, amount)
+	if err != nil {
+		// Nothing was paid, put the review back so the creditor can try again
+		log.Printf("SlipReview: Failed to apply payment for review %d: %v", review.ID, err)
+		if reopenErr := db.ReopenSlipReview(review.ID, status); reopenErr != nil {
+			log.Printf("SlipReview: %v", reopenErr)
+		}
+		respondWithError(s, i, fmt.Sprintf("ไม่สามารถอัปเดตข้อมูลหนี้สินได้ รายการตรวจสอบยังรออยู่ โปรดลองอีกครั้ง: %v", err))
+		return
+	}
+
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Content: fmt.Sprintf("✅ คุณได้ยืนยันการรับชำระ %.2f บาท จาก <@%s> (Review ID: %d)\n%s",
+				amount, review.DebtorDiscordID, review.ID, summary),
+			Components: []discordgo.MessageComponent{}, // Remove buttons
+		},
+	})
+	if err != nil {
+		log.Printf("Error responding to slip review resolution: %v", err)
+	}
+
+	notifySlipReviewResult(s, review, fmt.Sprintf("✅ <@%s> ได้ตรวจสอบและยืนยันการรับชำระ %.2f บาท จาก <@%s> แล้ว (Review ID: %d)\n%s",
+		review.CreditorDiscordID, amount, review.DebtorDiscordID, review.ID, summary))
+}
+
+// notifySlipReviewResult posts the review result in the channel where the slip was uploaded and DMs the debtor
+func notifySlipReviewResult(s *discordgo.Session, review *db.SlipReview, message string) {
+	if review.ChannelID != "" {
+		if _, err := s.ChannelMessageSend(review.ChannelID, message); err != nil {
+			log.Printf("SlipReview: Failed to post result for review %d in channel %s: %v", review.ID, review.ChannelID, err)
+		}
+	}
+	SendDirectMessage(s, review.DebtorDiscordID, message)
+}
+
+// HandleListReviews handles the !reviews command
+func HandleListReviews(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+	creditorDbID, err := db.GetOrCreateUser(m.Author.ID)
+	if err != nil {
+		SendErrorMessage(s, m.ChannelID, "ไม่สามารถดึงข้อมูลผู้ใช้ได้")
+		return
+	}
+
+	reviews, err := db.GetPendingSlipReviews(creditorDbID)
+	if err != nil {
+		SendErrorMessage(s, m.ChannelID, "ไม่สามารถดึงรายการสลิปที่รอตรวจสอบได้")
+		log.Printf("Error fetching pending slip reviews for %s: %v", m.Author.ID, err)
+		return
+	}
+
+	if len(reviews) == 0 {
+		s.ChannelMessageSend(m.ChannelID, "ไม่มีสลิปที่รอการตรวจสอบจากคุณ 👍")
+		return
+	}
+
+	// Send the review list with buttons via DM so only the creditor can act on them
+	dmChannel, err := s.UserChannelCreate(m.Author.ID)
+	if err != nil {
+		SendErrorMessage(s, m.ChannelID, "ไม่สามารถส่งข้อความส่วนตัวถึงคุณได้")
+		return
+	}
+
+	for idx := range reviews {
+		review := reviews[idx]
+		var content strings.Builder
+		content.WriteString(fmt.Sprintf("🔎 **Review ID: %d** — <@%s> (%s)\n", review.ID, review.DebtorDiscordID, review.CreatedAt.Local().Format("02/01/2006 15:04")))
+		content.WriteString(fmt.Sprintf("- จำนวนที่ต้องชำระ: %.2f บาท", review.ExpectedAmount))
+		if review.SlipAmount > 0 {
+			content.WriteString(fmt.Sprintf(" | จำนวนในสลิป: %.2f บาท", review.SlipAmount))
+		}
+		content.WriteString("\n")
+		for _, reason := range strings.Split(review.Reason, "\n") {
+			content.WriteString(fmt.Sprintf("- %s\n", reason))
+		}
+		if len(review.TxIDs) > 0 {
+			content.WriteString(fmt.Sprintf("(เกี่ยวข้องกับรายการ TxIDs: %s)\n", formatTxIDList(review.TxIDs)))
+		}
+		// The attachment URL expires, send the archived slip when there is one
+		message := &discordgo.MessageSend{Components: slipReviewButtons(&review)}
+		file := openArchivedImageFile(review.SlipImageID)
+		if file != nil {
+			content.WriteString("สลิป: ตามรูปที่แนบ")
+			message.Files = []*discordgo.File{file}
+		} else {
+			content.WriteString(fmt.Sprintf("สลิป: %s", review.SlipURL))
+		}
+		message.Content = content.String()
+
+		_, err := s.ChannelMessageSendComplex(dmChannel.ID, message)
+		if file != nil {
+			file.Reader.(io.Closer).Close()
+		}
+		if err != nil {
+			log.Printf("Error sending slip review %d to %s: %v", review.ID, m.Author.ID, err)
+		}
+	}
+
+	if m.GuildID != "" {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("📬 มีสลิปรอการตรวจสอบ %d รายการ ได้ส่งรายละเอียดไปยังข้อความส่วนตัวของ <@%s> แล้ว", len(reviews), m.Author.ID))
+	}
+}
@@ -5,11 +5,13 @@ import (
 	"log"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/oatsaysai/billing-in-discord/internal/db"
 	"github.com/oatsaysai/billing-in-discord/pkg/ocr"
 	"github.com/oatsaysai/billing-in-discord/pkg/verifier"
+	"github.com/spf13/viper"
 )
 
 var (
@@ -53,10 +55,12 @@ func HandleSlipVerification(s *discordgo.Session, m *discordgo.MessageCreate) {
 	log.Printf("SlipVerify: Received slip verification for debtor %s, amount %.2f, TxIDs %v", debtorDiscordID, amount, txIDs)
 	slipUploaderID := m.Author.ID
 	var slipURL string
+	var slipAttachment *discordgo.MessageAttachment
 
 	for _, att := range m.Attachments {
 		if strings.HasPrefix(strings.ToLower(att.ContentType), "image/") {
 			slipURL = att.URL
+			slipAttachment = att
 			break
 		}
 	}
@@ -71,28 +75,6 @@ func HandleSlipVerification(s *discordgo.Session, m *discordgo.MessageCreate) {
 		return
 	}
 
-	tmpFile := fmt.Sprintf("slip_%s_%s.png", m.ID, debtorDiscordID) // Unique temp file name
-	err = ocr.DownloadFile(tmpFile, slipURL)
-	if err != nil {
-		SendErrorMessage(s, m.ChannelID, "ไม่สามารถดาวน์โหลดรูปภาพสลิปเพื่อยืนยันได้")
-		log.Printf("SlipVerify: Failed to download slip %s: %v", slipURL, err)
-		return
-	}
-	defer os.Remove(tmpFile)
-
-	verifyResp, err := verifierClient.VerifySlip(amount, tmpFile)
-	if err != nil {
-		SendErrorMessage(s, m.ChannelID, fmt.Sprintf("การเรียก API ยืนยันสลิปล้มเหลว: %v", err))
-		log.Printf("SlipVerify: API call failed for debtor %s, amount %.2f: %v", debtorDiscordID, amount, err)
-		return
-	}
-
-	// Check if amount from slip matches expected amount (with tolerance)
-	if !(verifyResp.Data.Amount > amount-0.01 && verifyResp.Data.Amount < amount+0.01) {
-		SendErrorMessage(s, m.ChannelID, fmt.Sprintf("จำนวนเงินในสลิป (%.2f) ไม่ตรงกับจำนวนที่คาดไว้ (%.2f)", verifyResp.Data.Amount, amount))
-		return
-	}
-
 	intendedPayeeDiscordID := "???" // Placeholder
 	// Try to determine intended payee
 	if len(txIDs) > 0 {
@@ -119,6 +101,42 @@ func HandleSlipVerification(s *discordgo.Session, m *discordgo.MessageCreate) {
 		return
 	}
 
+	tmpFile := fmt.Sprintf("slip_%s_%s.png", m.ID, debtorDiscordID) // Unique temp file name
+	err = ocr.DownloadFile(tmpFile, slipURL)
+	if err != nil {
+		SendErrorMessage(s, m.ChannelID, "ไม่สามารถดาวน์โหลดรูปภาพสลิปเพื่อยืนยันได้")
+		log.Printf("SlipVerify: Failed to download slip %s: %v", slipURL, err)
+		return
+	}
+	defer os.Remove(tmpFile)
+
+	// Keep the slip as evidence of the payment, whatever the verification decides
+	slipImageID := archiveImageFile(db.ArchiveSlip, tmpFile, "", slipAttachment, m)
+	linkArchivedSlip(slipImageID, txIDs)
+
+	verifyResp, err := verifierClient.VerifySlip(amount, tmpFile)
+	if err != nil {
+		log.Printf("SlipVerify: API call failed for debtor %s, amount %.2f: %v", debtorDiscordID, amount, err)
+		// Keep the slip for the creditor instead of making the debtor start over
+		queueSlipForReview(s, m.ChannelID, nil, slipURL, slipImageID, debtorDiscordID, intendedPayeeDiscordID, amount, txIDs,
+			[]string{fmt.Sprintf("การเรียก API ยืนยันสลิปล้มเหลว: %v", err)})
+		return
+	}
+
+	// Check if amount from slip matches expected amount (with tolerance)
+	if !(verifyResp.Data.Amount > amount-0.01 && verifyResp.Data.Amount < amount+0.01) {
+		queueSlipForReview(s, m.ChannelID, verifyResp, slipURL, slipImageID, debtorDiscordID, intendedPayeeDiscordID, amount, txIDs,
+			[]string{fmt.Sprintf("จำนวนเงินในสลิป (%.2f) ไม่ตรงกับจำนวนที่คาดไว้ (%.2f)", verifyResp.Data.Amount, amount)})
+		return
+	}
+
+	// Make sure the slip was paid to the payee's registered account and not before the debt existed
+	if mismatches := checkSlipAgainstPayee(verifyResp, debtorDiscordID, intendedPayeeDiscordID, txIDs); len(mismatches) > 0 {
+		log.Printf("SlipVerify: Slip for debtor %s to payee %s needs manual review: %v", debtorDiscordID, intendedPayeeDiscordID, mismatches)
+		queueSlipForReview(s, m.ChannelID, verifyResp, slipURL, slipImageID, debtorDiscordID, intendedPayeeDiscordID, amount, txIDs, mismatches)
+		return
+	}
+
 	// Process payment based on TxIDs if available
 	if len(txIDs) > 0 {
 		log.Printf("SlipVerify: Attempting batch update using TxIDs: %v", txIDs)
@@ -155,21 +173,87 @@ func HandleSlipVerification(s *discordgo.Session, m *discordgo.MessageCreate) {
 		s.ChannelMessageSend(m.ChannelID, report.String())
 		return
 
-	} else { // No TxIDs, general debt reduction
-		log.Printf("SlipVerify: No TxIDs found in message. Attempting general debt reduction for %s paying %s amount %.2f.", debtorDiscordID, intendedPayeeDiscordID, amount)
+	} else { // No TxIDs, allocate to outstanding transactions
+		log.Printf("SlipVerify: No TxIDs found in message. Allocating payment to outstanding transactions for %s paying %s amount %.2f.", debtorDiscordID, intendedPayeeDiscordID, amount)
 
-		errReduce := db.ReduceDebtFromPayment(debtorDiscordID, intendedPayeeDiscordID, amount)
-		if errReduce != nil {
-			SendErrorMessage(s, m.ChannelID, fmt.Sprintf("เกิดข้อผิดพลาดในการลดหนี้สินทั่วไปสำหรับ <@%s> ถึง <@%s>: %v", debtorDiscordID, intendedPayeeDiscordID, errReduce))
-			log.Printf("SlipVerify: Failed general debt reduction for %s to %s (%.2f): %v", debtorDiscordID, intendedPayeeDiscordID, amount, errReduce)
+		allocation, errAlloc := allocatePayment(s, m.ChannelID, debtorDiscordID, intendedPayeeDiscordID, amount)
+		if errAlloc != nil {
+			SendErrorMessage(s, m.ChannelID, fmt.Sprintf("เกิดข้อผิดพลาดในการลดหนี้สินทั่วไปสำหรับ <@%s> ถึง <@%s>: %v", debtorDiscordID, intendedPayeeDiscordID, errAlloc))
+			log.Printf("SlipVerify: Failed payment allocation for %s to %s (%.2f): %v", debtorDiscordID, intendedPayeeDiscordID, amount, errAlloc)
 			return
 		}
+		var allocatedTxIDs []int
+		for _, alloc := range allocation.Allocations {
+			allocatedTxIDs = append(allocatedTxIDs, alloc.TxID)
+		}
+		linkArchivedSlip(slipImageID, allocatedTxIDs)
 		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf(
-			"✅ สลิปได้รับการยืนยัน & ยอดหนี้สินจาก <@%s> ถึง <@%s> ลดลง %.2f บาท!\n- ผู้ส่ง (สลิป): %s (%s)\n- ผู้รับ (สลิป): %s (%s)\n- วันที่ (สลิป): %s\n- เลขอ้างอิง (สลิป): %s",
+			"✅ สลิปได้รับการยืนยัน & ยอดหนี้สินจาก <@%s> ถึง <@%s> ลดลง %.2f บาท!\n- ผู้ส่ง (สลิป): %s (%s)\n- ผู้รับ (สลิป): %s (%s)\n- วันที่ (สลิป): %s\n- เลขอ้างอิง (สลิป): %s\n%s",
 			debtorDiscordID, intendedPayeeDiscordID, amount,
 			verifyResp.Data.SenderName, verifyResp.Data.SenderID,
 			verifyResp.Data.ReceiverName, verifyResp.Data.ReceiverID,
 			verifyResp.Data.Date, verifyResp.Data.Ref,
+			formatPaymentAllocation(allocation),
 		))
 	}
 }
+
+// checkSlipAgainstPayee compares the slip receiver and transfer date with the payee's registered account
+// and the debt being paid. It returns a list of reasons why the slip could not be auto-accepted.
+func checkSlipAgainstPayee(verifyResp *verifier.VerifySlipResponse, debtorDiscordID, payeeDiscordID string, txIDs []int) []string {
+	var mismatches []string
+
+	payeeDbID, err := db.GetOrCreateUser(payeeDiscordID)
+	if err != nil {
+		log.Printf("SlipVerify: Could not get DB ID for payee %s: %v", payeeDiscordID, err)
+		return []string{"ไม่สามารถดึงข้อมูลผู้รับเงินเพื่อตรวจสอบบัญชีปลายทางได้"}
+	}
+
+	promptPayID, accountName, err := db.GetUserPromptPayAccount(payeeDbID)
+	if err != nil {
+		mismatches = append(mismatches, fmt.Sprintf("ผู้รับเงินยังไม่ได้ตั้งค่า PromptPay ID จึงตรวจสอบบัญชีปลายทางไม่ได้ (%v)", err))
+	} else {
+		switch verifier.MatchReceiverID(verifyResp.Data.ReceiverID, promptPayID) {
+		case verifier.ReceiverMismatched:
+			mismatches = append(mismatches, fmt.Sprintf("บัญชีผู้รับในสลิป (%s) ไม่ตรงกับ PromptPay ID ของผู้รับเงิน", verifyResp.Data.ReceiverID))
+		case verifier.ReceiverUnknown:
+			// Slips often show the bank account instead of the PromptPay ID, fall back to the account name
+			if accountName == "" {
+				mismatches = append(mismatches, fmt.Sprintf("ไม่สามารถยืนยันบัญชีผู้รับในสลิป (%s) ได้ และผู้รับเงินยังไม่ได้ตั้งชื่อบัญชี", verifyResp.Data.ReceiverID))
+			} else if !verifier.MatchReceiverName(verifyResp.Data.ReceiverName, accountName) {
+				mismatches = append(mismatches, fmt.Sprintf("ชื่อผู้รับในสลิป (%s) ไม่ตรงกับชื่อบัญชีที่ลงทะเบียนไว้ (%s)", verifyResp.Data.ReceiverName, accountName))
+			}
+		}
+	}
+
+	slipTime, err := verifier.ParseSlipDate(verifyResp.Data.Date)
+	if err != nil {
+		// Unknown date formats should not block payments, only log them
+		log.Printf("SlipVerify: Could not parse slip date '%s': %v", verifyResp.Data.Date, err)
+		return mismatches
+	}
+
+	var debtTime time.Time
+	if len(txIDs) > 0 {
+		debtTime, err = db.GetEarliestTransactionTime(txIDs)
+	} else {
+		debtorDbID, userErr := db.GetOrCreateUser(debtorDiscordID)
+		if userErr != nil {
+			log.Printf("SlipVerify: Could not get DB ID for debtor %s: %v", debtorDiscordID, userErr)
+			return mismatches
+		}
+		debtTime, err = db.GetOldestUnpaidTransactionTime(debtorDbID, payeeDbID)
+	}
+	if err != nil {
+		log.Printf("SlipVerify: Could not determine debt creation time for debtor %s: %v", debtorDiscordID, err)
+		return mismatches
+	}
+
+	tolerance := time.Duration(viper.GetInt("SlipVerifier.DateToleranceMinutes")) * time.Minute
+	if slipTime.Before(debtTime.Add(-tolerance)) {
+		mismatches = append(mismatches, fmt.Sprintf("วันที่ในสลิป (%s) เกิดขึ้นก่อนที่จะมีรายการหนี้ (%s)",
+			slipTime.Format("02/01/2006 15:04"), debtTime.Local().Format("02/01/2006 15:04")))
+	}
+
+	return mismatches
+}
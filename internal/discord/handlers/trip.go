@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/oatsaysai/billing-in-discord/internal/db"
+)
+
+// tripUsage is shown when !trip can't be parsed
+const tripUsage = "รูปแบบไม่ถูกต้อง โปรดใช้ `!trip start <ชื่อทริป>`, `!trip summary` หรือ `!trip close`"
+
+// HandleTrip handles !trip.
+// While a trip is open, bills in the channel are collected without QR codes and settled together when it closes.
+func HandleTrip(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+	if len(args) < 2 {
+		handleTripSummary(s, m)
+		return
+	}
+
+	switch strings.ToLower(args[1]) {
+	case "start":
+		handleTripStart(s, m, strings.TrimSpace(strings.Join(args[2:], " ")))
+	case "summary":
+		handleTripSummary(s, m)
+	case "close":
+		handleTripClose(s, m)
+	default:
+		SendErrorMessage(s, m.ChannelID, tripUsage)
+	}
+}
+
+// handleTripStart opens a trip in the channel
+func handleTripStart(s *discordgo.Session, m *discordgo.MessageCreate, name string) {
+	if name == "" {
+		SendErrorMessage(s, m.ChannelID, "โปรดระบุชื่อทริป เช่น `!trip start เชียงใหม่ 2024`")
+		return
+	}
+
+	creatorDbID, err := db.GetOrCreateUser(m.Author.ID)
+	if err != nil {
+		SendErrorMessage(s, m.ChannelID, "ไม่สามารถยืนยันบัญชีผู้ใช้ของคุณสำหรับการดำเนินการนี้")
+		return
+	}
+
+	trip, err := db.CreateTrip(m.ChannelID, m.GuildID, name, creatorDbID)
+	if err != nil {
+		log.Printf("Error creating trip in channel %s: %v", m.ChannelID, err)
+		SendErrorMessage(s, m.ChannelID, fmt.Sprintf("ไม่สามารถเริ่มทริปได้: %v", err))
+		return
+	}
+
+	s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("🧳 เริ่มทริป **%s** (#%d) แล้ว\n"+
+		"บิลจาก `!bill`, `!qr` และรูปบิลในช่องนี้จะถูกบันทึกเข้าทริปโดยยังไม่สร้าง QR Code\n"+
+		"ดูยอดระหว่างทริปด้วย `!trip summary` และสรุปยอดโอนเมื่อจบทริปด้วย `!trip close`", trip.Name, trip.ID))
+}
+
+// handleTripSummary shows each participant's running totals for the channel's open trip
+func handleTripSummary(s *discordgo.Session, m *discordgo.MessageCreate) {
+	trip, ok := getOpenTripForChannel(s, m.ChannelID)
+	if !ok {
+		return
+	}
+
+	balances, err := db.GetTripBalances(trip.ID)
+	if err != nil {
+		log.Printf("Error fetching balances of trip %d: %v", trip.ID, err)
+		SendErrorMessage(s, m.ChannelID, "เกิดข้อผิดพลาดในการดึงยอดของทริป")
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("🧳 **ทริป %s (#%d)** เริ่มโดย <@%s>\n", trip.Name, trip.ID, trip.CreatorDiscordID))
+	if len(balances) == 0 {
+		sb.WriteString("ยังไม่มีค่าใช้จ่ายในทริปนี้")
+		s.ChannelMessageSend(m.ChannelID, sb.String())
+		return
+	}
+	writeTripBalances(&sb, balances)
+	sb.WriteString("\nปิดทริปและสร้างยอดโอนด้วย `!trip close`")
+	s.ChannelMessageSend(m.ChannelID, sb.String())
+}
+
+// handleTripClose settles the channel's open trip into the fewest transfers and sends a QR code for each
+func handleTripClose(s *discordgo.Session, m *discordgo.MessageCreate) {
+	trip, ok := getOpenTripForChannel(s, m.ChannelID)
+	if !ok {
+		return
+	}
+
+	// The trip's creator or a server admin decides when the trip is over
+	if trip.CreatorDiscordID != m.Author.ID {
+		permissions, err := s.UserChannelPermissions(m.Author.ID, m.ChannelID)
+		if m.GuildID == "" || err != nil || permissions&adminPermissions == 0 {
+			SendErrorMessage(s, m.ChannelID, fmt.Sprintf("เฉพาะผู้เริ่มทริป (<@%s>) หรือผู้ดูแลเซิร์ฟเวอร์เท่านั้นที่ปิดทริปได้", trip.CreatorDiscordID))
+			return
+		}
+	}
+
+	transfers, balances, err := db.CloseTrip(trip.ID)
+	if err != nil {
+		log.Printf("Error closing trip %d: %v", trip.ID, err)
+		SendErrorMessage(s, m.ChannelID, fmt.Sprintf("ไม่สามารถปิดทริปได้: %v", err))
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("🏁 **ปิดทริป %s (#%d) แล้ว**\n", trip.Name, trip.ID))
+	if len(balances) == 0 {
+		sb.WriteString("ไม่มีค่าใช้จ่ายที่ต้องสรุปยอด")
+		s.ChannelMessageSend(m.ChannelID, sb.String())
+		return
+	}
+	writeTripBalances(&sb, balances)
+
+	if len(transfers) == 0 {
+		sb.WriteString("\nทุกคนจ่ายเท่ากันพอดี ไม่ต้องโอนเงินเพิ่ม 🎉")
+		s.ChannelMessageSend(m.ChannelID, sb.String())
+		return
+	}
+	sb.WriteString(fmt.Sprintf("\n**ยอดโอนเพื่อปิดทริป (%d รายการ):**\n", len(transfers)))
+	for _, transfer := range transfers {
+		sb.WriteString(fmt.Sprintf("- <@%s> โอนให้ <@%s> **%.2f บาท** (TxID: %d)\n",
+			transfer.FromDiscordID, transfer.ToDiscordID, transfer.Amount, transfer.TxID))
+	}
+	s.ChannelMessageSend(m.ChannelID, sb.String())
+
+	for _, transfer := range transfers {
+		promptPayID, err := db.GetUserPromptPayID(transfer.ToID)
+		if err != nil || promptPayID == "" {
+			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("ℹ️ <@%s> ยังไม่ได้ตั้งค่า PromptPay ID จึงไม่สามารถสร้าง QR Code สำหรับ TxID %d ได้ (ตั้งค่าด้วย `!setpromptpay`)",
+				transfer.ToDiscordID, transfer.TxID))
+			continue
+		}
+		GenerateAndSendQrCode(s, m.ChannelID, promptPayID, transfer.Amount, transfer.FromDiscordID,
+			fmt.Sprintf("สรุปยอดทริป %s ให้ <@%s>", trip.Name, transfer.ToDiscordID), []int{transfer.TxID})
+	}
+}
+
+// getOpenTripForChannel loads the channel's open trip, telling the user if there is none
+func getOpenTripForChannel(s *discordgo.Session, channelID string) (*db.Trip, bool) {
+	trip, err := db.GetOpenTrip(channelID)
+	if err != nil {
+		log.Printf("Error fetching open trip for channel %s: %v", channelID, err)
+		SendErrorMessage(s, channelID, "เกิดข้อผิดพลาดในการดึงข้อมูลทริป")
+		return nil, false
+	}
+	if trip == nil {
+		SendErrorMessage(s, channelID, "ช่องนี้ไม่มีทริปที่เปิดอยู่ เริ่มทริปด้วย `!trip start <ชื่อทริป>`")
+		return nil, false
+	}
+	return trip, true
+}
+
+// writeTripBalances lists what each participant paid for others, owes, and their net position
+func writeTripBalances(sb *strings.Builder, balances []db.TripBalance) {
+	sorted := make([]db.TripBalance, len(balances))
+	copy(sorted, balances)
+	sort.Slice(sorted, func(a, b int) bool { return sorted[a].Net() > sorted[b].Net() })
+
+	sb.WriteString("**ยอดของแต่ละคน:**\n")
+	for _, balance := range sorted {
+		net := math.Round(balance.Net()*100) / 100
+		var position string
+		switch {
+		case net > 0.009:
+			position = fmt.Sprintf("ได้รับคืน **%.2f บาท**", net)
+		case net < -0.009:
+			position = fmt.Sprintf("ต้องจ่าย **%.2f บาท**", -net)
+		default:
+			position = "เท่ากันพอดี"
+		}
+		sb.WriteString(fmt.Sprintf("- <@%s>: ออกแทนผู้อื่น %.2f บาท, ส่วนที่ต้องจ่าย %.2f บาท → %s\n",
+			balance.DiscordID, balance.Paid, balance.Owed, position))
+	}
+}
+
+// addBillToTrip records a new bill's transactions as expenses of the channel's open trip.
+// It returns the line announcing it and whether a trip is open; trip expenses get no due date or QR code
+// because they are settled when the trip closes.
+func addBillToTrip(channelID string, txIDs []int) (string, bool) {
+	trip, err := db.GetOpenTrip(channelID)
+	if err != nil {
+		log.Printf("Error fetching open trip for channel %s: %v", channelID, err)
+		return "", false
+	}
+	if trip == nil || len(txIDs) == 0 {
+		return "", false
+	}
+
+	if err := db.AssignTransactionsToTrip(txIDs, trip.ID); err != nil {
+		log.Printf("Failed to add transactions %v to trip %d: %v", txIDs, trip.ID, err)
+		return "", false
+	}
+	return fmt.Sprintf("🧳 บันทึกเข้าทริป **%s** แล้ว จะสรุปยอดโอนและสร้าง QR Code เมื่อปิดทริปด้วย `!trip close`", trip.Name), true
+}
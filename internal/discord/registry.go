@@ -2,6 +2,7 @@ package discord
 
 import (
 	"github.com/bwmarrin/discordgo"
+	"github.com/oatsaysai/billing-in-discord/internal/db"
 	"github.com/oatsaysai/billing-in-discord/internal/discord/handlers"
 	"log"
 	"strings"
@@ -42,6 +43,9 @@ func ProcessCommand(s *discordgo.Session, m *discordgo.MessageCreate) {
 
 	// Handle slip verification replies
 	if m.MessageReference != nil && m.MessageReference.MessageID != "" && len(m.Attachments) > 0 {
+		if !handlers.ClaimEvent(db.EventMessage, m.ID) {
+			return
+		}
 		go handlers.HandleSlipVerification(s, m)
 		return
 	}
@@ -62,6 +66,9 @@ func ProcessCommand(s *discordgo.Session, m *discordgo.MessageCreate) {
 
 	// Route to the registered command handler
 	if cmd, exists := GetCommand(commandName); exists {
+		if !handlers.ClaimEvent(db.EventMessage, m.ID) {
+			return
+		}
 		go cmd.Handler(s, m, args)
 		return
 	}
@@ -13,7 +13,7 @@ import (
 )
 
 // DeployBillWebsite deploys a bill allocation website to Firebase Hosting
-func DeployBillWebsite(client *fbclient.Client, token, merchantName, webhookURL string, items []map[string]interface{}, users []map[string]interface{}) (string, string, error) {
+func DeployBillWebsite(client *fbclient.Client, token, merchantName, webhookURL, claimsURL string, items []map[string]interface{}, users []map[string]interface{}) (string, string, error) {
 	// แก้ไขเช็คเงื่อนไข
 	if client == nil {
 		return "", "", fmt.Errorf("Firebase client is not provided")
@@ -36,7 +36,7 @@ func DeployBillWebsite(client *fbclient.Client, token, merchantName, webhookURL
 	}
 
 	// Generate the website HTML
-	contentDir, err := generateWebsiteHTML(token, merchantName, webhookURL, items, users)
+	contentDir, err := generateWebsiteHTML(token, merchantName, webhookURL, claimsURL, items, users)
 	if err != nil {
 		log.Printf("Error generating website HTML: %v", err)
 		return "", "", fmt.Errorf("failed to generate website HTML: %w", err)
@@ -100,7 +100,7 @@ func DeployBillWebsite(client *fbclient.Client, token, merchantName, webhookURL
 }
 
 // generateWebsiteHTML generates the HTML for the bill allocation website
-func generateWebsiteHTML(token, merchantName, webhookURL string, items []map[string]interface{}, users []map[string]interface{}) (string, error) {
+func generateWebsiteHTML(token, merchantName, webhookURL, claimsURL string, items []map[string]interface{}, users []map[string]interface{}) (string, error) {
 	// Create a temporary directory for the website files
 	tempDir, err := os.MkdirTemp("", "bill-website-")
 	if err != nil {
@@ -115,6 +115,7 @@ func generateWebsiteHTML(token, merchantName, webhookURL string, items []map[str
 		Users        []map[string]interface{}
 		UsersJSON    string
 		WebhookURL   string
+		ClaimsURL    string
 	}{
 		Token:        token,
 		MerchantName: merchantName,
@@ -122,6 +123,7 @@ func generateWebsiteHTML(token, merchantName, webhookURL string, items []map[str
 		Users:        users,
 		UsersJSON:    toJSONString(users),
 		WebhookURL:   webhookURL,
+		ClaimsURL:    claimsURL,
 	}
 
 	// Get the path to the HTML template file
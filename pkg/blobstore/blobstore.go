@@ -0,0 +1,102 @@
+package blobstore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNotFound is returned when no blob is stored under a key
+var ErrNotFound = errors.New("blob not found")
+
+// Store keeps archived files by key. Keys are slash separated paths such as "receipts/ab/abcdef.png".
+// Backends other than the local filesystem, e.g. object storage, implement it to keep the archive elsewhere.
+type Store interface {
+	// Put stores the content under key, replacing what was stored before
+	Put(key string, content io.Reader) error
+	// Open returns the content stored under key, or ErrNotFound
+	Open(key string) (io.ReadCloser, error)
+}
+
+// New creates the store of a configured backend
+func New(backend, localPath string) (Store, error) {
+	switch strings.ToLower(backend) {
+	case "", "local":
+		return NewLocalStore(localPath)
+	default:
+		return nil, fmt.Errorf("unknown blob store backend: %s", backend)
+	}
+}
+
+// LocalStore keeps blobs as files under a directory
+type LocalStore struct {
+	Root string
+}
+
+// NewLocalStore creates a store under root, creating the directory if needed
+func NewLocalStore(root string) (*LocalStore, error) {
+	if root == "" {
+		return nil, errors.New("local blob store path is not configured")
+	}
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create blob store directory %s: %w", root, err)
+	}
+	return &LocalStore{Root: root}, nil
+}
+
+// path maps a key to a file under the root, rejecting keys that would escape it
+func (l *LocalStore) path(key string) (string, error) {
+	cleaned := filepath.Clean(filepath.FromSlash(key))
+	if key == "" || filepath.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid blob key: %s", key)
+	}
+	return filepath.Join(l.Root, cleaned), nil
+}
+
+// Put writes the blob to a temporary file first so readers never see a partial file
+func (l *LocalStore) Put(key string, content io.Reader) error {
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create directory for blob %s: %w", key, err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("failed to create blob %s: %w", key, err)
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+
+	if _, err := io.Copy(tmp, content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write blob %s: %w", key, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write blob %s: %w", key, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to store blob %s: %w", key, err)
+	}
+	return nil
+}
+
+// Open opens the file of a blob
+func (l *LocalStore) Open(key string) (io.ReadCloser, error) {
+	path, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open blob %s: %w", key, err)
+	}
+	return file, nil
+}
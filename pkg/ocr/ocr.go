@@ -36,6 +36,7 @@ type BillItem struct {
 	Name     string  `json:"name"`
 	Price    float64 `json:"price"`
 	Quantity int     `json:"quantity"`
+	Receipt  int     `json:"-"` // Index of the receipt the item is on when several receipts are merged into one bill
 }
 
 // NewClient creates a new OCR client
@@ -0,0 +1,190 @@
+package verifier
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ReceiverMatch describes how a slip receiver compares with an expected PromptPay ID
+type ReceiverMatch int
+
+const (
+	// ReceiverUnknown means the slip does not reveal enough digits to decide
+	ReceiverUnknown ReceiverMatch = iota
+	// ReceiverMatched means every visible digit on the slip agrees with the expected ID
+	ReceiverMatched
+	// ReceiverMismatched means at least one visible digit contradicts the expected ID
+	ReceiverMismatched
+)
+
+// minVisibleDigits is the number of unmasked digits required before a masked ID is trusted
+const minVisibleDigits = 3
+
+var nameTitleRegex = regexp.MustCompile(`^(นางสาว|นาง|นาย|น\.ส\.|ด\.ช\.|ด\.ญ\.|mr\.?|mrs\.?|ms\.?|miss)\s*`)
+
+// MatchReceiverID compares the (possibly masked) receiver ID printed on a slip with a PromptPay ID.
+// Bank slips mask digits with x, X, * or • and use separators such as "xxx-x-x1234-x" or "081-xxx-5678".
+func MatchReceiverID(slipReceiverID, promptPayID string) ReceiverMatch {
+	slipID := normalizeMaskedID(slipReceiverID)
+	expected := strings.TrimPrefix(strings.ToLower(promptPayID), "ewallet-")
+	expected = digitsOnly(expected)
+	if slipID == "" || expected == "" {
+		return ReceiverUnknown
+	}
+
+	// Phone numbers may be printed in international form (66xxxxxxxxx)
+	if len(expected) == 10 && strings.HasPrefix(expected, "0") && len(slipID) == 11 && strings.HasPrefix(slipID, "66") {
+		expected = "66" + expected[1:]
+	}
+
+	if len(slipID) != len(expected) {
+		// Different lengths usually mean the slip shows a bank account instead of the PromptPay ID
+		return ReceiverUnknown
+	}
+
+	visible := 0
+	for idx := 0; idx < len(slipID); idx++ {
+		if slipID[idx] == 'x' {
+			continue
+		}
+		visible++
+		if slipID[idx] != expected[idx] {
+			return ReceiverMismatched
+		}
+	}
+
+	if visible < minVisibleDigits {
+		return ReceiverUnknown
+	}
+	return ReceiverMatched
+}
+
+// MatchReceiverName compares the receiver name printed on a slip with a registered account name.
+// Slips often truncate the surname (e.g. "นาย สมชาย ใ"), so later words only need to be a prefix.
+func MatchReceiverName(slipReceiverName, accountName string) bool {
+	slipWords := nameWords(slipReceiverName)
+	accountWords := nameWords(accountName)
+	if len(slipWords) == 0 || len(accountWords) == 0 {
+		return false
+	}
+
+	if slipWords[0] != accountWords[0] {
+		return false
+	}
+
+	for idx := 1; idx < len(slipWords) && idx < len(accountWords); idx++ {
+		if !strings.HasPrefix(accountWords[idx], slipWords[idx]) {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeMaskedID lower-cases a slip ID, turns every mask character into 'x' and strips separators
+func normalizeMaskedID(id string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(id) {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == 'x' || r == '*' || r == '•' || r == '●':
+			b.WriteRune('x')
+		}
+	}
+	return b.String()
+}
+
+// digitsOnly removes every non-digit character from a string
+func digitsOnly(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// nameWords normalizes a person's name into lower-case words without titles or punctuation
+func nameWords(name string) []string {
+	normalized := strings.ToLower(strings.TrimSpace(name))
+	normalized = nameTitleRegex.ReplaceAllString(normalized, "")
+
+	var words []string
+	for _, word := range strings.Fields(normalized) {
+		word = strings.Trim(word, ".,")
+		if word != "" {
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+// Thai month abbreviations as printed on Thai bank slips
+var thaiMonths = map[string]time.Month{
+	"ม.ค.": time.January, "ก.พ.": time.February, "มี.ค.": time.March,
+	"เม.ย.": time.April, "พ.ค.": time.May, "มิ.ย.": time.June,
+	"ก.ค.": time.July, "ส.ค.": time.August, "ก.ย.": time.September,
+	"ต.ค.": time.October, "พ.ย.": time.November, "ธ.ค.": time.December,
+}
+
+var thaiSlipDateRegex = regexp.MustCompile(`^(\d{1,2})\s+(\S+)\s+(\d{2,4})(?:\s*-?\s*(\d{1,2}):(\d{2})(?::(\d{2}))?)?`)
+
+// slipDateLayouts are the Gregorian layouts returned by the slip verification API
+var slipDateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"02/01/2006 15:04:05",
+	"02/01/2006 15:04",
+	"2006-01-02",
+}
+
+// ParseSlipDate parses the transfer date from a slip, accepting ISO dates and Thai Buddhist-era dates
+// such as "1 พ.ค. 67 12:34". Dates without a zone are interpreted in the local time zone.
+func ParseSlipDate(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, fmt.Errorf("empty slip date")
+	}
+
+	for _, layout := range slipDateLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+
+	matches := thaiSlipDateRegex.FindStringSubmatch(value)
+	if matches == nil {
+		return time.Time{}, fmt.Errorf("unrecognized slip date format: %s", value)
+	}
+
+	month, ok := thaiMonths[matches[2]]
+	if !ok {
+		return time.Time{}, fmt.Errorf("unrecognized Thai month in slip date: %s", matches[2])
+	}
+
+	day, _ := strconv.Atoi(matches[1])
+	year, _ := strconv.Atoi(matches[3])
+	if year < 100 {
+		year += 2500 // Two-digit years on slips are Buddhist era (67 = 2567)
+	}
+	if year > 2400 {
+		year -= 543
+	}
+
+	hour, minute, second := 0, 0, 0
+	if matches[4] != "" {
+		hour, _ = strconv.Atoi(matches[4])
+		minute, _ = strconv.Atoi(matches[5])
+	}
+	if matches[6] != "" {
+		second, _ = strconv.Atoi(matches[6])
+	}
+
+	return time.Date(year, month, day, hour, minute, second, 0, time.Local), nil
+}